@@ -0,0 +1,3 @@
+#!/usr/bin/env bash
+
+exec java -jar /opt/google-java-format/google-java-format.jar "$@"
@@ -5,19 +5,34 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/alicebob/miniredis"
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis"
+	"github.com/pasiasty/cocoder/server/executor"
+	"github.com/pasiasty/cocoder/server/language_registry"
 	"github.com/pasiasty/cocoder/server/route_manager"
+	"github.com/pasiasty/cocoder/server/session_manager"
+	"github.com/pasiasty/cocoder/server/users_manager"
 )
 
-func main() {
-	ctx := context.Background()
+// newStore returns the store of the sessions together with the broadcaster.
+// Only the real Redis allows to run multiple server instances.
+func newStore() (session_manager.Store, users_manager.Broadcaster) {
+	if boltPath := os.Getenv("BOLT_PATH"); boltPath != "" {
+		s, err := session_manager.NewBoltStore(boltPath)
+		if err != nil {
+			log.Fatalf("Failed to open BoltDB (%s): %v", boltPath, err)
+		}
+		return s, users_manager.NewLocalBroadcaster()
+	}
 
 	redisAddr := os.Getenv("REDIS_HOST")
-	if redisAddr == "" {
+	inMemory := redisAddr == ""
+	if inMemory {
 		mr, err := miniredis.Run()
 		if err != nil {
 			log.Fatalf("Failed to setup miniredis: %v", err)
@@ -36,9 +51,96 @@ func main() {
 		Password: redisPassw,
 		DB:       int(redisDB),
 	})
+	if inMemory {
+		// miniredis doesn't support pub/sub.
+		return session_manager.NewRedisStore(redisClient), users_manager.NewLocalBroadcaster()
+	}
+	return session_manager.NewRedisStore(redisClient), users_manager.NewRedisBroadcaster(redisClient)
+}
+
+// newSandbox returns the sandbox of the executed programs, selected with
+// SANDBOX: "docker" (the default), "namespaces" or "unsafe-local". The
+// namespaces sandbox runs the programs as the dedicated SANDBOX_UID.
+func newSandbox() executor.Sandbox {
+	sb, err := executor.NewSandbox(os.Getenv("SANDBOX"), os.Getenv("SANDBOX_IMAGE"), os.Getenv("SANDBOX_CGROUP"), intFromEnv("SANDBOX_UID", 0))
+	if err != nil {
+		log.Fatalf("Failed to setup sandbox: %v", err)
+	}
+	return sb
+}
+
+const (
+	defaultMaxExecutions       = 4
+	defaultMaxQueuedExecutions = 64
+	defaultBuildCacheSizeMB    = 512
+)
+
+func intFromEnv(name string, def int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return def
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("Failed to parse %s (%s) as int", name, s)
+	}
+	return v
+}
+
+// newBuildCache returns the cache of the compiled programs of up to
+// BUILD_CACHE_SIZE_MB, kept in BUILD_CACHE_DIR. The size of 0 disables it.
+func newBuildCache() *executor.BuildCache {
+	size := intFromEnv("BUILD_CACHE_SIZE_MB", defaultBuildCacheSizeMB)
+	if size == 0 {
+		return nil
+	}
+	dir := os.Getenv("BUILD_CACHE_DIR")
+	if dir == "" {
+		dir = filepath.Join(os.TempDir(), "cocoder-build-cache")
+	}
+	cache, err := executor.NewBuildCache(dir, int64(size)<<20)
+	if err != nil {
+		log.Fatalf("Failed to setup build cache: %v", err)
+	}
+	return cache
+}
+
+// newExecutor returns the executor running up to MAX_EXECUTIONS programs at
+// once, with up to MAX_QUEUED_EXECUTIONS waiting.
+func newExecutor(languages *language_registry.Registry) *executor.Executor {
+	queue := executor.NewQueue(
+		intFromEnv("MAX_EXECUTIONS", defaultMaxExecutions),
+		intFromEnv("MAX_QUEUED_EXECUTIONS", defaultMaxQueuedExecutions))
+	return executor.New(languages, newSandbox(), queue, newBuildCache())
+}
+
+// languagesReloadInterval is how often the languages file is checked for
+// changes.
+const languagesReloadInterval = 5 * time.Second
+
+// newLanguages loads the languages from LANGUAGES_PATH, languages.json by
+// default, and keeps reloading them.
+func newLanguages(ctx context.Context) *language_registry.Registry {
+	path := os.Getenv("LANGUAGES_PATH")
+	if path == "" {
+		path = "languages.json"
+	}
+	languages, err := language_registry.Load(path)
+	if err != nil {
+		log.Fatalf("Failed to load languages: %v", err)
+	}
+	go languages.Watch(ctx, languagesReloadInterval)
+	return languages
+}
+
+func main() {
+	ctx := context.Background()
 
-	m := route_manager.NewRouterManager(ctx, redisClient)
+	store, broadcaster := newStore()
+	languages := newLanguages(ctx)
+	m := route_manager.NewRouterManager(ctx, store, broadcaster, languages, newExecutor(languages))
 	defer m.Dispose()
+	m.StartLSPPool(ctx)
 
 	r := m.Router()
 	r.LoadHTMLGlob("templates/*.tmpl.html")
@@ -10,6 +10,41 @@ type User struct {
 	SelectionStart int       `diff:"SelectionStart" json:"SelectionStart"`
 	SelectionEnd   int       `diff:"SelectionEnd" json:"SelectionEnd"`
 	LastEdit       time.Time `json:"LastEdit" diff:"LastEdit"`
+
+	// ActiveFile is the file the cursor and the selection refer to. Empty
+	// path denotes the main file of the session.
+	ActiveFile string `json:"ActiveFile" diff:"ActiveFile"`
+}
+
+// OperationComponent is a single step of an operational-transform operation.
+// Exactly one of the fields is set: Retain skips over characters, Insert adds
+// text at the current position and Delete removes characters. Lengths are
+// counted in runes.
+type OperationComponent struct {
+	Retain int    `json:"Retain,omitempty" diff:"Retain"`
+	Insert string `json:"Insert,omitempty" diff:"Insert"`
+	Delete int    `json:"Delete,omitempty" diff:"Delete"`
+}
+
+// Operation describes a complete edit of the document. It has to span the
+// whole document it is applied to.
+type Operation []OperationComponent
+
+// CharacterID uniquely identifies a character inserted into a CRDT document.
+// Clock is a Lamport timestamp of the insertion made by the given Site.
+type CharacterID struct {
+	Site  string `json:"Site" diff:"Site"`
+	Clock int    `json:"Clock" diff:"Clock"`
+}
+
+// CRDTOperation either inserts a single character (Value) right after the
+// Origin character or, when Delete is set, removes the character with the ID.
+// Empty Origin denotes the beginning of the document.
+type CRDTOperation struct {
+	ID     CharacterID `json:"ID" diff:"ID"`
+	Origin CharacterID `json:"Origin" diff:"Origin"`
+	Value  string      `json:"Value" diff:"Value"`
+	Delete bool        `json:"Delete" diff:"Delete"`
 }
 
 type UpdateSessionRequest struct {
@@ -24,15 +59,53 @@ type UpdateSessionRequest struct {
 	Language       string  `form:"Language" diff:"Language" json:"Language"`
 	Users          []*User `json:"Users" diff:"users"`
 
+	// File addresses the edited file, empty path denotes the main file.
+	File       string `form:"File" diff:"File" json:"File"`
+	DeleteFile bool   `form:"DeleteFile" diff:"DeleteFile" json:"DeleteFile"`
+
+	UseOperations bool      `form:"UseOperations" diff:"UseOperations" json:"UseOperations"`
+	Revision      int       `form:"Revision" diff:"Revision" json:"Revision"`
+	Operation     Operation `json:"Operation" diff:"Operation"`
+
+	CRDTOperations []CRDTOperation `json:"CRDTOperations" diff:"CRDTOperations"`
+
+	// UseDeltas switches the connection to receive deltas against the
+	// AckRevision, the newest revision of the main file known to the user.
+	UseDeltas   bool `form:"UseDeltas" diff:"UseDeltas" json:"UseDeltas"`
+	AckRevision int  `form:"AckRevision" diff:"AckRevision" json:"AckRevision"`
+
+	// StreamOutput enables receiving the output of the running programs as
+	// it is produced, and their positions in the execution queue.
+	StreamOutput bool `form:"StreamOutput" diff:"StreamOutput" json:"StreamOutput"`
+
+	// SendStdin requests carry nothing else but the line of the standard input
+	// for the interactively running program.
+	SendStdin bool   `form:"SendStdin" diff:"SendStdin" json:"SendStdin"`
+	Stdin     string `form:"Stdin" diff:"Stdin" json:"Stdin"`
+
+	// CancelExecution requests stop the program with the JobID, or all the
+	// programs of the session if it's empty.
+	CancelExecution bool   `form:"CancelExecution" diff:"CancelExecution" json:"CancelExecution"`
+	JobID           string `form:"JobID" diff:"JobID" json:"JobID"`
+
+	// Sequence numbers the edits of the user, so that the edits resent after
+	// reconnecting are applied only once.
+	Sequence int `form:"Sequence" diff:"Sequence" json:"Sequence"`
+
 	UpdateInputText bool   `form:"UpdateInputText" diff:"UpdateInputText" json:"UpdateInputText"`
 	InputText       string `form:"InputText" diff:"InputText" json:"InputText"`
 
 	UpdateOutputText bool   `form:"UpdateOutputText" diff:"UpdateOutputText" json:"UpdateOutputText"`
 	Stdout           string `form:"Stdout" diff:"Stdout" json:"Stdout"`
 	Stderr           string `form:"Stderr" diff:"Stderr" json:"Stderr"`
+	// ExecutionResult is updated along with the output.
+	ExecutionResult *ExecutionResult `diff:"ExecutionResult" json:"ExecutionResult"`
 
 	UpdateRunningState bool `form:"UpdateRunningState" diff:"UpdateRunningState" json:"UpdateRunningState"`
 	Running            bool `form:"Running" diff:"Running" json:"Running"`
+
+	UpdateLintResult bool        `diff:"UpdateLintResult" json:"UpdateLintResult"`
+	LintResult       *LintResult `diff:"LintResult" json:"LintResult"`
 }
 
 type UpdateSessionResponse struct {
@@ -41,15 +114,86 @@ type UpdateSessionResponse struct {
 	Language string  `json:"Language" diff:"language"`
 	Users    []*User `json:"Users" diff:"users"`
 
+	// File is the path of the file NewText and Language refer to. Files
+	// lists all the files of the session apart from the main one.
+	File  string   `json:"File" diff:"file"`
+	Files []string `json:"Files" diff:"files"`
+
+	Revision        int       `json:"Revision" diff:"revision"`
+	Operation       Operation `json:"Operation" diff:"operation"`
+	OperationAuthor string    `json:"OperationAuthor" diff:"operation_author"`
+	Resync          bool      `json:"Resync" diff:"resync"`
+
+	CRDTOperations []CRDTOperation `json:"CRDTOperations" diff:"crdt_operations"`
+
+	// IsDelta responses carry TextDelta transforming the text of the
+	// BaseRevision into the text of the Revision instead of the NewText. Users
+	// are omitted if they did not change since the previous response.
+	IsDelta      bool      `json:"IsDelta" diff:"is_delta"`
+	BaseRevision int       `json:"BaseRevision" diff:"base_revision"`
+	TextDelta    Operation `json:"TextDelta" diff:"text_delta"`
+
+	// ResumeToken is sent in the first response on the connection and allows
+	// to resume it after reconnecting. Resumed connections receive deltas
+	// against the revision they were at. AppliedSequence is the last edit of
+	// the user applied so far, the newer ones should be resent.
+	ResumeToken     string `json:"ResumeToken" diff:"resume_token"`
+	Resumed         bool   `json:"Resumed" diff:"resumed"`
+	AppliedSequence int    `json:"AppliedSequence" diff:"applied_sequence"`
+
+	// OutputChunk responses carry nothing else but the chunk.
+	OutputChunk *OutputChunk `json:"OutputChunk" diff:"output_chunk"`
+	// QueuePosition responses carry nothing else but the position.
+	QueuePosition *QueuePosition `json:"QueuePosition" diff:"queue_position"`
+	// StdinLine and ExecutionCancel are only exchanged between the server
+	// instances.
+	StdinLine       *StdinLine       `json:"StdinLine" diff:"stdin_line"`
+	ExecutionCancel *ExecutionCancel `json:"ExecutionCancel" diff:"execution_cancel"`
+
 	UpdateInputText bool   `form:"UpdateInputText" diff:"UpdateInputText" json:"UpdateInputText"`
 	InputText       string `form:"InputText" diff:"InputText" json:"InputText"`
 
 	UpdateOutputText bool   `form:"UpdateOutputText" diff:"UpdateOutputText" json:"UpdateOutputText"`
 	Stdout           string `form:"Stdout" diff:"Stdout" json:"Stdout"`
 	Stderr           string `form:"Stderr" diff:"Stderr" json:"Stderr"`
+	// ExecutionResult is updated along with the output.
+	ExecutionResult *ExecutionResult `diff:"ExecutionResult" json:"ExecutionResult"`
 
 	UpdateRunningState bool `form:"UpdateRunningState" diff:"UpdateRunningState" json:"UpdateRunningState"`
 	Running            bool `form:"Running" diff:"Running" json:"Running"`
+
+	UpdateLintResult bool        `diff:"UpdateLintResult" json:"UpdateLintResult"`
+	LintResult       *LintResult `diff:"LintResult" json:"LintResult"`
+}
+
+// StdinLine is the line of the standard input sent by the user to the
+// interactively running program.
+type StdinLine struct {
+	UserID string `json:"UserID"`
+	Text   string `json:"Text"`
+}
+
+// OutputChunk is a part of the output of the running program. Sequence orders
+// the chunks of a single execution.
+type OutputChunk struct {
+	Sequence int    `json:"Sequence"`
+	Stderr   bool   `json:"Stderr"`
+	Text     string `json:"Text"`
+}
+
+// ExecutionCancel stops the program with the JobID, or all the programs of
+// the session if it's empty.
+type ExecutionCancel struct {
+	UserID string `json:"UserID"`
+	JobID  string `json:"JobID"`
+}
+
+// QueuePosition is the position of the program run by the user in the
+// execution queue. Position 0 means the program has started.
+type QueuePosition struct {
+	JobID    string `json:"JobID"`
+	UserID   string `json:"UserID"`
+	Position int    `json:"Position"`
 }
 
 type UpdateLanguageRequest struct {
@@ -62,11 +206,133 @@ type GetSessionResponse struct {
 }
 
 type ExecutionResponse struct {
+	JobID        string           `json:"JobID"`
+	ErrorMessage string           `json:"ErrorMessage"`
+	Stdout       string           `json:"Stdout"`
+	Stderr       string           `json:"Stderr"`
+	Result       *ExecutionResult `json:"Result"`
+}
+
+// ExecutionResult describes how the program has run. Step is the one which
+// has failed, e.g. "compile", or the last one if all of them have succeeded.
+// The times and the memory are of that step only.
+type ExecutionResult struct {
+	Step         string `json:"Step"`
+	ExitCode     int    `json:"ExitCode"`
+	Signal       string `json:"Signal"`
+	WallTimeMs   int64  `json:"WallTimeMs"`
+	CPUTimeMs    int64  `json:"CPUTimeMs"`
+	PeakMemoryKB int64  `json:"PeakMemoryKB"`
+}
+
+// TestCase is the input of the program together with its expected output.
+// Hidden test cases reveal nothing but their verdicts to the users.
+type TestCase struct {
+	Name           string `json:"Name"`
+	Stdin          string `json:"Stdin"`
+	ExpectedStdout string `json:"ExpectedStdout"`
+	// TimeLimitMs bounds the CPU time of the program, it replaces the timeout
+	// of the language if set.
+	TimeLimitMs int  `json:"TimeLimitMs"`
+	Hidden      bool `json:"Hidden"`
+}
+
+type Verdict string
+
+const (
+	VerdictOK                Verdict = "OK"
+	VerdictWrongAnswer       Verdict = "WA"
+	VerdictTimeLimitExceeded Verdict = "TLE"
+	VerdictRuntimeError      Verdict = "RE"
+)
+
+// TestCaseResult is the outcome of a single test case. Diff shows how the
+// output differs from the expected one, line by line.
+type TestCaseResult struct {
+	Name    string           `json:"Name"`
+	Hidden  bool             `json:"Hidden"`
+	Verdict Verdict          `json:"Verdict"`
+	Stdout  string           `json:"Stdout"`
+	Stderr  string           `json:"Stderr"`
+	Diff    string           `json:"Diff"`
+	Result  *ExecutionResult `json:"Result"`
+}
+
+// JudgeResponse holds the results of all the test cases. If the compilation
+// has failed, it holds its output instead.
+type JudgeResponse struct {
+	JobID        string           `json:"JobID"`
+	ErrorMessage string           `json:"ErrorMessage"`
+	Stdout       string           `json:"Stdout"`
+	Stderr       string           `json:"Stderr"`
+	Result       *ExecutionResult `json:"Result"`
+	TestCases    []TestCaseResult `json:"TestCases"`
+}
+
+// Diagnostic is a single finding of the linter. Line and Column are 1-based,
+// Column is 0 if the linter doesn't report it.
+type Diagnostic struct {
+	File     string `json:"File"`
+	Line     int    `json:"Line"`
+	Column   int    `json:"Column"`
+	Severity string `json:"Severity"`
+	Message  string `json:"Message"`
+	Rule     string `json:"Rule"`
+}
+
+// LintResult holds the diagnostics of the session text of the Revision.
+type LintResult struct {
+	Revision    int          `json:"Revision"`
+	Language    string       `json:"Language"`
+	Diagnostics []Diagnostic `json:"Diagnostics"`
+}
+
+// LintResponse holds the result of the linter. If the linter has failed, the
+// Result is nil and the ErrorMessage together with the Stderr explain why.
+type LintResponse struct {
+	ErrorMessage string      `json:"ErrorMessage"`
+	Stderr       string      `json:"Stderr"`
+	Result       *LintResult `json:"Result"`
+}
+
+// FormatResponse holds the formatted code. If the formatter has failed, the
+// Code is empty and the ErrorMessage together with the Stderr explain why.
+type FormatResponse struct {
+	Code         string `json:"Code"`
 	ErrorMessage string `json:"ErrorMessage"`
-	Stdout       string `json:"Stdout"`
 	Stderr       string `json:"Stderr"`
 }
 
-type FormatResponse struct {
-	Code string `json:"Code"`
+// Revision describes a single change of the text or language of the session
+// or of one of its files, the main one for the empty File. Diff is a patch (in
+// the diff-match-patch text format) against the previous text of the file.
+type Revision struct {
+	Number    int       `json:"Number"`
+	UserID    string    `json:"UserID"`
+	Timestamp time.Time `json:"Timestamp"`
+	File      string    `json:"File"`
+	Language  string    `json:"Language"`
+	Diff      string    `json:"Diff"`
+}
+
+// RevisionResponse holds the text of the file changed by the revision.
+type RevisionResponse struct {
+	Number    int       `json:"Number"`
+	UserID    string    `json:"UserID"`
+	Timestamp time.Time `json:"Timestamp"`
+	File      string    `json:"File"`
+	Language  string    `json:"Language"`
+	Text      string    `json:"Text"`
+}
+
+// ReplayFrame is the state of the session after a single recorded edit.
+type ReplayFrame struct {
+	Timestamp time.Time `json:"Timestamp"`
+	UserID    string    `json:"UserID"`
+	NewText   string    `json:"NewText"`
+	Language  string    `json:"Language"`
+	// Files holds the text of the files apart from the main one.
+	Files    map[string]string `json:"Files"`
+	Users    []*User           `json:"Users"`
+	Finished bool              `json:"Finished"`
 }
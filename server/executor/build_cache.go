@@ -0,0 +1,215 @@
+package executor
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+type cacheEntry struct {
+	key  string
+	size int64
+	// readers counts the restores in progress, the entry can't be evicted
+	// until they finish.
+	readers int
+}
+
+// BuildCache keeps the directories of the compiled programs, so that
+// running the same code again skips the compilation. The entries are never
+// modified, every run gets its own copy. The least recently used entries are
+// evicted once the cache exceeds its size.
+type BuildCache struct {
+	mux     sync.Mutex
+	dir     string
+	maxSize int64
+	size    int64
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+// NewBuildCache creates the cache of up to maxSize bytes in the directory.
+// The previous contents of the directory are removed.
+func NewBuildCache(dir string, maxSize int64) (*BuildCache, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &BuildCache{
+		dir:     dir,
+		maxSize: maxSize,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}, nil
+}
+
+// buildKey identifies the outcome of the compilation of the code.
+func buildKey(ex *execution, code string, files map[string]string) string {
+	h := sha256.New()
+	write := func(s string) {
+		fmt.Fprintf(h, "%d:%s", len(s), s)
+	}
+
+	write(ex.mainFile)
+	write(ex.image)
+	for _, cd := range ex.commands[:ex.compileSteps()] {
+		write(cd.Name)
+		write(cd.Cmd)
+	}
+	write(code)
+
+	paths := []string{}
+	for p := range files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		write(p)
+		write(files[p])
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func copyFile(src, dst string, mode os.FileMode) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, mode)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return 0, err
+	}
+	return n, out.Close()
+}
+
+// copyTree copies the regular files, directories and symlinks of src into
+// dst, returning the size of the files.
+func copyTree(src, dst string) (int64, error) {
+	var size int64
+	err := filepath.Walk(src, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm()|0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case info.Mode().IsRegular():
+			n, err := copyFile(p, target, info.Mode().Perm())
+			size += n
+			return err
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Restore copies the cached directory into d. It returns false if the key is
+// not cached.
+func (c *BuildCache) Restore(key, d string) bool {
+	c.mux.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(el)
+		el.Value.(*cacheEntry).readers++
+	}
+	c.mux.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	_, err := copyTree(filepath.Join(c.dir, key), d)
+
+	c.mux.Lock()
+	el.Value.(*cacheEntry).readers--
+	c.mux.Unlock()
+
+	if err != nil {
+		log.Printf("Failed to restore build %s: %v", key, err)
+		return false
+	}
+	return true
+}
+
+// Store caches the contents of d under the key.
+func (c *BuildCache) Store(key, d string) error {
+	c.mux.Lock()
+	_, ok := c.entries[key]
+	c.mux.Unlock()
+	if ok {
+		return nil
+	}
+
+	tmp := filepath.Join(c.dir, fmt.Sprintf("tmp-%s", uuid.New().String()))
+	size, err := copyTree(d, tmp)
+	if err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	if size > c.maxSize {
+		return os.RemoveAll(tmp)
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+
+	if _, ok := c.entries[key]; ok {
+		// Stored concurrently by another run.
+		return os.RemoveAll(tmp)
+	}
+	if err := os.Rename(tmp, filepath.Join(c.dir, key)); err != nil {
+		os.RemoveAll(tmp)
+		return err
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, size: size})
+	c.size += size
+	c.evict()
+	return nil
+}
+
+// evict removes the least recently used entries until the cache fits its
+// size. The entries being restored are skipped.
+func (c *BuildCache) evict() {
+	for el := c.lru.Back(); el != nil && c.size > c.maxSize; {
+		prev := el.Prev()
+		e := el.Value.(*cacheEntry)
+		if e.readers == 0 {
+			c.lru.Remove(el)
+			delete(c.entries, e.key)
+			c.size -= e.size
+			if err := os.RemoveAll(filepath.Join(c.dir, e.key)); err != nil {
+				log.Printf("Failed to remove build %s: %v", e.key, err)
+			}
+		}
+		el = prev
+	}
+}
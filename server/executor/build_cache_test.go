@@ -0,0 +1,152 @@
+package executor
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pasiasty/cocoder/server/language_registry"
+)
+
+func cachedKeys(t *testing.T, c *BuildCache) []string {
+	infos, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		t.Fatalf("Failed to list the cache: %v", err)
+	}
+	res := []string{}
+	for _, info := range infos {
+		res = append(res, info.Name())
+	}
+	sort.Strings(res)
+	return res
+}
+
+// buildDir creates the directory with the file of the given size.
+func buildDir(t *testing.T, size int) string {
+	d := t.TempDir()
+	if err := writeFile(filepath.Join(d, "bin", "prog"), strings.Repeat("x", size)); err != nil {
+		t.Fatalf("Failed to write the build: %v", err)
+	}
+	return d
+}
+
+func TestBuildCache(t *testing.T) {
+	c, err := NewBuildCache(filepath.Join(t.TempDir(), "cache"), 100)
+	if err != nil {
+		t.Fatalf("Failed to create the cache: %v", err)
+	}
+
+	for _, key := range []string{"a", "b"} {
+		if err := c.Store(key, buildDir(t, 40)); err != nil {
+			t.Fatalf("Failed to store %s: %v", key, err)
+		}
+	}
+
+	d := t.TempDir()
+	if !c.Restore("a", d) {
+		t.Fatalf("Build a is not cached")
+	}
+	content, err := ioutil.ReadFile(filepath.Join(d, "bin", "prog"))
+	if err != nil || len(content) != 40 {
+		t.Errorf("Build was not restored (%d bytes): %v", len(content), err)
+	}
+
+	// Storing c evicts b, as a was restored more recently.
+	if err := c.Store("c", buildDir(t, 40)); err != nil {
+		t.Fatalf("Failed to store c: %v", err)
+	}
+	// The build larger than the cache is not stored.
+	if err := c.Store("d", buildDir(t, 101)); err != nil {
+		t.Fatalf("Failed to store d: %v", err)
+	}
+
+	if c.Restore("b", t.TempDir()) {
+		t.Errorf("Build b was not evicted")
+	}
+	if diff := cmp.Diff([]string{"a", "c"}, cachedKeys(t, c)); diff != "" {
+		t.Errorf("Wrong cached builds, -want +got:\n%v", diff)
+	}
+	if c.size != 80 {
+		t.Errorf("Cache size: %d, want: 80", c.size)
+	}
+}
+
+func TestBuildKey(t *testing.T) {
+	ex := &execution{
+		mainFile: "code.sh",
+		commands: []language_registry.Command{
+			{Name: "compile", Cmd: "cp code.sh prog"},
+			{Name: "run", Cmd: "./prog"},
+		},
+	}
+	runChanged := &execution{
+		mainFile: "code.sh",
+		commands: []language_registry.Command{
+			{Name: "compile", Cmd: "cp code.sh prog"},
+			{Name: "run", Cmd: "bash prog"},
+		},
+	}
+
+	base := buildKey(ex, "code", map[string]string{"a": "1"})
+	for _, tc := range []struct {
+		name string
+		key  string
+		same bool
+	}{
+		{name: "same", key: buildKey(ex, "code", map[string]string{"a": "1"}), same: true},
+		{name: "run_command", key: buildKey(runChanged, "code", map[string]string{"a": "1"}), same: true},
+		{name: "code", key: buildKey(ex, "code2", map[string]string{"a": "1"})},
+		{name: "file_content", key: buildKey(ex, "code", map[string]string{"a": "2"})},
+		{name: "file_path", key: buildKey(ex, "code", map[string]string{"b": "1"})},
+		{name: "moved_content", key: buildKey(ex, "code", map[string]string{"a": "", "1": ""})},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.key == base; got != tc.same {
+				t.Errorf("Keys equal: %v, want: %v", got, tc.same)
+			}
+		})
+	}
+}
+
+func TestExecuteCachedBuild(t *testing.T) {
+	e := prepareExecutor(t, "10s", `[
+  {"name": "compile", "cmd": "date +%s%N > /mnt/built"},
+  {"name": "run", "cmd": "cat /mnt/built", "usesStdin": true}
+]`)
+	cache, err := NewBuildCache(filepath.Join(t.TempDir(), "cache"), 1<<20)
+	if err != nil {
+		t.Fatalf("Failed to create the cache: %v", err)
+	}
+	e.cache = cache
+
+	execute := func(code, stdin string) string {
+		resp, err := e.Execute(context.Background(), &ExecutionRequest{
+			SessionID: "session",
+			UserID:    "user",
+			Language:  "bash",
+			Code:      code,
+			Stdin:     stdin,
+		})
+		if err != nil || resp.ErrorMessage != "" {
+			t.Fatalf("Failed to execute: %v %+v", err, resp)
+		}
+		return resp.Stdout
+	}
+
+	first := execute("code", "")
+	if got := execute("code", "other input"); got != first {
+		t.Errorf("Program was compiled again: %s, want: %s", got, first)
+	}
+	if got := execute("changed code", ""); got == first {
+		t.Errorf("Changed program was not compiled")
+	}
+
+	if got := cachedKeys(t, cache); len(got) != 2 {
+		t.Errorf("Cached builds: %v, want 2 of them", got)
+	}
+}
@@ -4,94 +4,189 @@ import (
 	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 
+	"github.com/google/uuid"
 	"github.com/pasiasty/cocoder/server/common"
+	"github.com/pasiasty/cocoder/server/language_registry"
+	"github.com/pasiasty/cocoder/server/session_manager"
 	"github.com/pasiasty/cocoder/server/users_manager"
 )
 
-type languageDefinition struct {
-	extension string
-	commands  []commandDefinition
-	timeout   time.Duration
-}
-
-type commandDefinition struct {
-	name      string
-	cmd       string
-	readonly  bool
-	usesSTDIN bool
-}
-
-var executeLanguageDefs = map[string]languageDefinition{
-	"python": {
-		timeout:   10 * time.Second,
-		extension: "py",
-		commands: []commandDefinition{
-			{
-				name:      "run",
-				cmd:       "python3 /mnt/code.py",
-				readonly:  true,
-				usesSTDIN: true,
-			},
-		},
-	},
-	"cpp": {
-		timeout:   15 * time.Second,
-		extension: "cpp",
-		commands: []commandDefinition{
-			{
-				name: "compile",
-				cmd:  "clang++ /mnt/code.cpp -o /mnt/code",
-			},
-			{
-				name:      "run",
-				cmd:       "/mnt/code",
-				readonly:  true,
-				usesSTDIN: true,
-			},
-		},
-	},
-	"go": {
-		timeout:   15 * time.Second,
-		extension: "go",
-		commands: []commandDefinition{
-			{
-				name: "compile",
-				cmd:  "cd /mnt && go build code.go",
-			},
-			{
-				name:      "run",
-				cmd:       "/mnt/code",
-				readonly:  true,
-				usesSTDIN: true,
-			},
-		},
-	},
-}
-
-var formatLanguageDefs = map[string]languageDefinition{
-	"python": {
-		extension: "py",
-		timeout:   10 * time.Second,
-		commands: []commandDefinition{
-			{name: "format",
-				cmd:       "black -q ./code.py && cat ./code.py",
-				readonly:  false,
-				usesSTDIN: false,
-			},
-		},
-	},
-}
-
-func runCommand(ctx context.Context, cd commandDefinition, d string, stdin string, inContainer bool) (*common.ExecutionResponse, error) {
-	rfc := fmt.Sprintf("#!/bin/bash\n\n%s", cd.cmd)
-
-	runFilename := fmt.Sprintf("run_%s.sh", cd.name)
+// OutputHandler receives the output of the program as it is produced.
+type OutputHandler func(chunk common.OutputChunk)
+
+var (
+	// outputFlushInterval is how long the output is gathered before it's
+	// streamed as a single chunk.
+	outputFlushInterval = 50 * time.Millisecond
+	// maxChunkSize makes the gathered output streamed earlier.
+	maxChunkSize = 16 * 1024
+	// maxStreamedOutput bounds the output streamed by a single execution, the
+	// rest is only in the response.
+	maxStreamedOutput = 1024 * 1024
+)
+
+const truncatedOutputNotice = "\n[output truncated]\n"
+
+// outputStream numbers the chunks written to stdout and stderr by all the
+// commands of a single execution. Consecutive writes to the same stream are
+// coalesced into a single chunk.
+type outputStream struct {
+	mux     sync.Mutex
+	seq     int
+	handler OutputHandler
+
+	pending       string
+	pendingStderr bool
+	timer         *time.Timer
+	// streamed is the size of the output already streamed.
+	streamed  int
+	truncated bool
+}
+
+func (s *outputStream) write(text string, stderr bool) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.truncated || text == "" {
+		return
+	}
+	if s.pending != "" && s.pendingStderr != stderr {
+		s.flushLocked()
+	}
+
+	if remaining := maxStreamedOutput - s.streamed - len(s.pending); len(text) > remaining {
+		for remaining > 0 && !utf8.RuneStart(text[remaining]) {
+			remaining--
+		}
+		s.pending += text[:remaining]
+		s.pendingStderr = stderr
+		s.flushLocked()
+		s.emit(truncatedOutputNotice, true)
+		s.truncated = true
+		return
+	}
+
+	s.pending += text
+	s.pendingStderr = stderr
+	if len(s.pending) >= maxChunkSize {
+		s.flushLocked()
+	} else if s.timer == nil {
+		s.timer = time.AfterFunc(outputFlushInterval, s.flush)
+	}
+}
+
+func (s *outputStream) emit(text string, stderr bool) {
+	s.seq++
+	s.handler(common.OutputChunk{
+		Sequence: s.seq,
+		Stderr:   stderr,
+		Text:     text,
+	})
+}
+
+// flush streams the gathered output, it's safe to call on nil.
+func (s *outputStream) flush() {
+	if s == nil || s.handler == nil {
+		return
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.flushLocked()
+}
+
+func (s *outputStream) flushLocked() {
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	if s.pending == "" {
+		return
+	}
+	s.streamed += len(s.pending)
+	s.emit(s.pending, s.pendingStderr)
+	s.pending = ""
+}
+
+type chunkWriter struct {
+	s      *outputStream
+	stderr bool
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	text := string(p)
+	if w.stderr {
+		text = strings.Replace(text, swapWarning, "", 1)
+	}
+	w.s.write(text, w.stderr)
+	return len(p), nil
+}
+
+func (s *outputStream) writers(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	if s == nil || s.handler == nil {
+		return stdout, stderr
+	}
+	return io.MultiWriter(stdout, &chunkWriter{s: s}), io.MultiWriter(stderr, &chunkWriter{s: s, stderr: true})
+}
+
+// lockedWriter allows the program and the echoed input to write the output
+// concurrently. Once closed, all the writes are dropped.
+type lockedWriter struct {
+	mux    sync.Mutex
+	w      io.Writer
+	closed bool
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	if w.closed {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
+
+func (w *lockedWriter) Close() error {
+	w.mux.Lock()
+	defer w.mux.Unlock()
+
+	w.closed = true
+	return nil
+}
+
+// commandIO describes the standard streams of the executed commands.
+type commandIO struct {
+	stdin string
+	// input, if set, replaces the stdin and stays attached to the program.
+	input  io.Reader
+	output *outputStream
+	// rawStdout keeps the stdout as written, e.g. the formatted code, instead
+	// of trimming it.
+	rawStdout bool
+}
+
+func (cio *commandIO) stdout(b *bytes.Buffer) string {
+	if cio.rawStdout {
+		return b.String()
+	}
+	return postprocessStdout(b.String())
+}
+
+func runCommand(ctx context.Context, sb Sandbox, cd language_registry.Command, ex *execution, d string, cio *commandIO) (*common.ExecutionResponse, error) {
+	rfc := fmt.Sprintf("#!/bin/bash\n\n%s", cd.Cmd)
+
+	runFilename := fmt.Sprintf("run_%s.sh", cd.Name)
 
 	runFile, err := os.Create(fmt.Sprintf("%s/%s", d, runFilename))
 	if err != nil {
@@ -100,87 +195,270 @@ func runCommand(ctx context.Context, cd commandDefinition, d string, stdin strin
 	if _, err := runFile.WriteString(rfc); err != nil {
 		return nil, err
 	}
-	os.Chmod(runFile.Name(), 0111)
+	os.Chmod(runFile.Name(), 0555)
 
 	if err := runFile.Close(); err != nil {
 		return nil, err
 	}
 
-	var cmd *exec.Cmd
-
-	if inContainer {
-		args := []string{
-			"run",
-			"-v",
-			fmt.Sprintf("%v:/mnt", d),
-			"--rm",
-			"-i",
-			"--memory",
-			"128MB",
-			"--memory-swap",
-			"0",
-			"--cpus",
-			"0.5",
-		}
-
-		if cd.readonly {
-			args = append(args, "--read-only")
-		}
-
-		args = append(args, "--network", "none", "mpasek/cocoder-executor", fmt.Sprintf("/mnt/%s", runFilename))
-		cmd = exec.CommandContext(ctx, "docker", args...)
-	} else {
-		cmd = exec.CommandContext(ctx, "bash", "-c", cd.cmd)
-		cmd.Dir = d
+	c := &Command{
+		ID:            uuid.New().String(),
+		Name:          cd.Name,
+		Cmd:           cd.Cmd,
+		Script:        runFilename,
+		ReadOnly:      cd.ReadOnly,
+		Image:         ex.image,
+		MemoryLimitMB: ex.memoryLimitMB,
 	}
-
-	if cd.usesSTDIN {
-		cmd.Stdin = strings.NewReader(stdin)
+	cmd, cleanup, err := sb.Command(d, c)
+	if err != nil {
+		return nil, err
 	}
+	defer cleanup()
 
 	stdoutBuf := &bytes.Buffer{}
 	stderrBuf := &bytes.Buffer{}
 
-	cmd.Stdout = stdoutBuf
-	cmd.Stderr = stderrBuf
+	cmd.Stdout, cmd.Stderr = cio.output.writers(stdoutBuf, stderrBuf)
+
+	var echo *lockedWriter
+	if cd.UsesStdin && cio.input != nil {
+		// The input is echoed into the output, as it happens in the terminal.
+		echo = &lockedWriter{w: cmd.Stdout}
+		cmd.Stdout = echo
+
+		// Not using cmd.Stdin, as cmd.Wait would wait for the input to be
+		// closed, even after the program has finished.
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			defer stdin.Close()
+			io.Copy(stdin, io.TeeReader(cio.input, echo))
+		}()
+	} else if cd.UsesStdin {
+		cmd.Stdin = strings.NewReader(cio.stdin)
+	}
+
+	var result *common.ExecutionResult
+	start := time.Now()
+	err = cmd.Start()
+	if err == nil {
+		var release func()
+		if release, err = sb.Attach(cmd, c); err != nil {
+			sb.Kill(cmd, c)
+			cmd.Wait()
+			return nil, err
+		}
 
-	if err := cmd.Run(); err != nil {
+		done := make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				if err := sb.Kill(cmd, c); err != nil {
+					log.Printf("Failed to kill %s: %v", cd.Name, err)
+				}
+			case <-done:
+			}
+		}()
+
+		err = cmd.Wait()
+		close(done)
+		release()
+		cio.output.flush()
+		result = sb.Usage(cmd, d, c).result(cd.Name, time.Since(start))
+	}
+	if echo != nil {
+		echo.Close()
+	}
+	if err != nil {
 		if ctx.Err() != nil {
-			return &common.ExecutionResponse{
-				ErrorMessage: "Execution timed out",
-			}, nil
+			resp := interrupted(ctx)
+			resp.Result = result
+			return resp, nil
 		}
 		return &common.ExecutionResponse{
-			ErrorMessage: fmt.Sprintf("%s has failed (%v)", cd.name, err),
-			Stdout:       postprocessStdout(stdoutBuf.String()),
+			ErrorMessage: fmt.Sprintf("%s has failed (%v)", cd.Name, err),
+			Stdout:       cio.stdout(stdoutBuf),
 			Stderr:       postprocessStderr(stderrBuf.String()),
+			Result:       result,
 		}, nil
 	}
 
 	return &common.ExecutionResponse{
-		Stdout: postprocessStdout(stdoutBuf.String()),
+		Stdout: cio.stdout(stdoutBuf),
 		Stderr: postprocessStderr(stderrBuf.String()),
+		Result: result,
 	}, nil
 }
 
+// interrupted describes the execution stopped before the program has
+// finished.
+func interrupted(ctx context.Context) *common.ExecutionResponse {
+	if ctx.Err() == context.Canceled {
+		return &common.ExecutionResponse{ErrorMessage: "Execution cancelled"}
+	}
+	return &common.ExecutionResponse{ErrorMessage: "Execution timed out"}
+}
+
 type Executor struct {
+	languages *language_registry.Registry
+	queue     *Queue
+	sandbox   Sandbox
+	// cache, if set, keeps the compiled programs.
+	cache *BuildCache
 }
 
-func New() *Executor {
-	return &Executor{}
+// New creates the executor running the programs in the sandbox, once the
+// queue lets them. The cache may be nil, then the programs are always
+// compiled.
+func New(languages *language_registry.Registry, sb Sandbox, queue *Queue, cache *BuildCache) *Executor {
+	return &Executor{
+		languages: languages,
+		queue:     queue,
+		sandbox:   sb,
+		cache:     cache,
+	}
 }
 
 func postprocessStdout(s string) string {
 	return strings.TrimSpace(s)
 }
 
+const swapWarning = "WARNING: Your kernel does not support swap limit capabilities or the cgroup is not mounted. Memory limited without swap."
+
 func postprocessStderr(s string) string {
-	s = strings.Replace(s, "WARNING: Your kernel does not support swap limit capabilities or the cgroup is not mounted. Memory limited without swap.", "", 1)
+	s = strings.Replace(s, swapWarning, "", 1)
 	return postprocessStdout(s)
 }
 
-func (e *Executor) executeCommands(ctx context.Context, userID users_manager.UserID, ld languageDefinition, code, stdin string, inContainer bool) (*common.ExecutionResponse, error) {
-	ctx, cancel := context.WithTimeout(ctx, ld.timeout)
+func writeFile(p, content string) error {
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	f, err := os.Create(p)
+	if err != nil {
+		return err
+	}
+	if _, err := f.WriteString(content); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeFileTree writes the main file and the rest of the files under their
+// paths.
+func writeFileTree(d, mainFile, code string, files map[string]string) error {
+	for p, content := range files {
+		if err := session_manager.ValidateFilePath(p); err != nil {
+			return err
+		}
+		if p == mainFile {
+			return fmt.Errorf("file %q collides with the main file", p)
+		}
+		if err := writeFile(filepath.Join(d, filepath.FromSlash(p)), content); err != nil {
+			return err
+		}
+	}
+
+	return writeFile(filepath.Join(d, mainFile), code)
+}
+
+// interactiveTimeout replaces the timeout of the language, as the program
+// waits for the users to type the input.
+const interactiveTimeout = 5 * time.Minute
+
+// ExecutionRequest describes the program to be executed.
+type ExecutionRequest struct {
+	// JobID identifies the execution, e.g. when it's cancelled.
+	JobID     string
+	SessionID string
+	UserID    users_manager.UserID
+	Language  string
+	// Code is the main file of the program. Files, keyed by their paths, are
+	// placed next to it.
+	Code  string
+	Files map[string]string
+	Stdin string
+	// Input, if set, replaces the Stdin and stays attached to the running
+	// program. It's echoed into the output.
+	Input io.Reader
+	// OnOutput, if set, receives the output as it is produced.
+	OnOutput OutputHandler
+	// OnQueued, if set, receives the position of the program in the queue.
+	OnQueued PositionHandler
+}
+
+// execution describes the commands of a single language.
+type execution struct {
+	mainFile      string
+	image         string
+	memoryLimitMB int
+	commands      []language_registry.Command
+	timeout       time.Duration
+}
+
+// newExecution describes running the commands of the language on the code,
+// with the placeholders of the main file expanded.
+func newExecution(l *language_registry.Language, code string, commands []language_registry.Command, timeout time.Duration) *execution {
+	mainFile := l.MainFile(code)
+	expanded := make([]language_registry.Command, len(commands))
+	for i, cd := range commands {
+		cd.Cmd = language_registry.ExpandCommand(cd.Cmd, mainFile)
+		expanded[i] = cd
+	}
+	return &execution{
+		mainFile:      mainFile,
+		image:         l.Image,
+		memoryLimitMB: l.MemoryLimitMB,
+		commands:      expanded,
+		timeout:       timeout,
+	}
+}
+
+// compileSteps is the number of the commands preparing the program, all of
+// them but the last one.
+func (ex *execution) compileSteps() int {
+	if len(ex.commands) == 0 {
+		return 0
+	}
+	return len(ex.commands) - 1
+}
+
+// compile runs the commands preparing the program in d, unless their outcome
+// is already in the build cache. It returns nil if nothing was run.
+func (e *Executor) compile(ctx context.Context, ex *execution, d, code string, files map[string]string, sb Sandbox, cio *commandIO) (*common.ExecutionResponse, error) {
+	n := ex.compileSteps()
+	if n == 0 {
+		return nil, nil
+	}
+	if e.cache == nil {
+		return runCommands(ctx, ex.commands[:n], ex, d, sb, cio)
+	}
+
+	key := buildKey(ex, code, files)
+	if e.cache.Restore(key, d) {
+		return nil, nil
+	}
+
+	resp, err := runCommands(ctx, ex.commands[:n], ex, d, sb, cio)
+	if err != nil || resp.ErrorMessage != "" {
+		return resp, err
+	}
+	if err := e.cache.Store(key, d); err != nil {
+		log.Printf("Failed to cache the build: %v", err)
+	}
+	return resp, nil
+}
+
+func (e *Executor) executeCommands(ctx context.Context, ex *execution, code string, files map[string]string, sb Sandbox, cio *commandIO) (*common.ExecutionResponse, error) {
+	timeout := ex.timeout
+	if cio.input != nil {
+		timeout = interactiveTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
 	d, err := ioutil.TempDir("", "")
@@ -189,21 +467,24 @@ func (e *Executor) executeCommands(ctx context.Context, userID users_manager.Use
 	}
 	defer os.RemoveAll(d)
 
-	codeFile, err := os.Create(fmt.Sprintf("%s/code.%s", d, ld.extension))
-	if err != nil {
-		return nil, err
-	}
-	if _, err := codeFile.WriteString(code); err != nil {
+	if err := writeFileTree(d, ex.mainFile, code, files); err != nil {
 		return nil, err
 	}
-	if err := codeFile.Close(); err != nil {
-		return nil, err
+
+	resp, err := e.compile(ctx, ex, d, code, files, sb, cio)
+	if err != nil || (resp != nil && resp.ErrorMessage != "") {
+		return resp, err
 	}
+	return runCommands(ctx, ex.commands[ex.compileSteps():], ex, d, sb, cio)
+}
 
+// runCommands runs the commands of the execution in the directory until one
+// of them fails.
+func runCommands(ctx context.Context, commands []language_registry.Command, ex *execution, d string, sb Sandbox, cio *commandIO) (*common.ExecutionResponse, error) {
 	var lastRes *common.ExecutionResponse = nil
 
-	for _, cd := range ld.commands {
-		resp, err := runCommand(ctx, cd, d, stdin, inContainer)
+	for _, cd := range commands {
+		resp, err := runCommand(ctx, sb, cd, ex, d, cio)
 		if err != nil {
 			return nil, err
 		}
@@ -216,25 +497,103 @@ func (e *Executor) executeCommands(ctx context.Context, userID users_manager.Use
 	return lastRes, nil
 }
 
-func (e *Executor) Format(ctx context.Context, userID users_manager.UserID, language, code string) (*common.FormatResponse, error) {
-	ld, ok := formatLanguageDefs[language]
-	if !ok {
-		return nil, fmt.Errorf("language: %s is not supported", language)
+// FormatRequest describes the code to be formatted.
+type FormatRequest struct {
+	SessionID string
+	UserID    users_manager.UserID
+	Language  string
+	Code      string
+	// HasSelection limits the formatting to the lines between the
+	// SelectionStart and the SelectionEnd, given in runes of the Code.
+	HasSelection   bool
+	SelectionStart int
+	SelectionEnd   int
+}
+
+// selectedLines returns the lines (1-based, inclusive) of the text between
+// the rune offsets.
+func selectedLines(text string, start, end int) (int, int) {
+	if start > end {
+		start, end = end, start
 	}
+	startLine, endLine := 1, 1
+	i := 0
+	for _, r := range text {
+		if i >= end {
+			break
+		}
+		if r == '\n' {
+			if i < start {
+				startLine++
+			}
+			endLine++
+		}
+		i++
+	}
+	return startLine, endLine
+}
 
-	resp, err := e.executeCommands(ctx, userID, ld, code, "", false)
+// Format formats the code in the sandbox. It's queued as the interactive job,
+// as the users wait for it while editing. If the formatter has failed, the
+// response holds its error instead of the code.
+func (e *Executor) Format(ctx context.Context, req *FormatRequest) (*common.FormatResponse, error) {
+	l, ok := e.languages.Get(req.Language)
+	if !ok || l.Formatter == nil {
+		return nil, fmt.Errorf("language: %s is not supported", req.Language)
+	}
+
+	release, err := e.queue.Acquire(ctx, Job{SessionID: req.SessionID, UserID: string(req.UserID), Interactive: true}, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	cmd := l.Formatter.Cmd
+	if req.HasSelection {
+		cmd = l.Formatter.Command(selectedLines(req.Code, req.SelectionStart, req.SelectionEnd))
+	}
+
+	ex := newExecution(l, req.Code, []language_registry.Command{{Name: "format", Cmd: cmd}}, time.Duration(l.Formatter.Timeout))
+	// Trimming the output would make every formatting change the code.
+	resp, err := e.executeCommands(ctx, ex, req.Code, nil, e.sandbox, &commandIO{rawStdout: true})
 	if err != nil {
 		return nil, err
 	}
+	if resp.ErrorMessage != "" {
+		return &common.FormatResponse{ErrorMessage: resp.ErrorMessage, Stderr: resp.Stderr}, nil
+	}
 
 	return &common.FormatResponse{Code: resp.Stdout}, nil
 }
 
-func (e *Executor) Execute(ctx context.Context, userID users_manager.UserID, language, code, stdin string) (*common.ExecutionResponse, error) {
-	ld, ok := executeLanguageDefs[language]
-	if !ok {
-		return nil, fmt.Errorf("language: %s is not supported", language)
+// Execute runs the program. The response holds the complete output, even if
+// it was streamed to OnOutput.
+func (e *Executor) Execute(ctx context.Context, req *ExecutionRequest) (*common.ExecutionResponse, error) {
+	l, ok := e.languages.Get(req.Language)
+	if !ok || len(l.Commands) == 0 {
+		return nil, fmt.Errorf("language: %s is not supported", req.Language)
 	}
 
-	return e.executeCommands(ctx, userID, ld, code, stdin, true)
+	release, err := e.queue.Acquire(ctx, Job{SessionID: req.SessionID, UserID: string(req.UserID)}, req.OnQueued)
+	if err == context.Canceled {
+		resp := interrupted(ctx)
+		resp.JobID = req.JobID
+		return resp, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ex := newExecution(l, req.Code, l.Commands, time.Duration(l.Timeout))
+	resp, err := e.executeCommands(ctx, ex, req.Code, req.Files, e.sandbox, &commandIO{
+		stdin:  req.Stdin,
+		input:  req.Input,
+		output: &outputStream{handler: req.OnOutput},
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.JobID = req.JobID
+	return resp, nil
 }
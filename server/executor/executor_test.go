@@ -0,0 +1,435 @@
+package executor
+
+import (
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/pasiasty/cocoder/server/common"
+	"github.com/pasiasty/cocoder/server/language_registry"
+)
+
+const sleepCommands = `[{"name": "run", "cmd": "sleep 30 & sleep 30"}]`
+
+func prepareExecutor(t *testing.T, timeout, commands string) *Executor {
+	languages, err := language_registry.Parse([]byte(`{
+  "bash": {
+    "extension": "sh",
+    "timeout": "` + timeout + `",
+    "commands": ` + commands + `
+  }
+}`))
+	if err != nil {
+		t.Fatalf("Failed to parse languages: %v", err)
+	}
+	return New(language_registry.New(languages), NewUnsafeLocalSandbox(), NewQueue(1, 1), nil)
+}
+
+func TestExecuteInterrupted(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		timeout string
+		cancel  bool
+		want    string
+	}{
+		{name: "cancelled", timeout: "1m", cancel: true, want: "Execution cancelled"},
+		{name: "timed out", timeout: "100ms", want: "Execution timed out"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := prepareExecutor(t, tc.timeout, sleepCommands)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tc.cancel {
+				time.AfterFunc(100*time.Millisecond, cancel)
+			}
+
+			start := time.Now()
+			resp, err := e.Execute(ctx, &ExecutionRequest{JobID: "job_1", Language: "bash"})
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if resp.ErrorMessage != tc.want || resp.JobID != "job_1" {
+				t.Errorf("Got response: %+v, want error: %q", resp, tc.want)
+			}
+			if resp.Result == nil || resp.Result.Signal != "killed" {
+				t.Errorf("Got result: %+v, want killed", resp.Result)
+			}
+			// Waiting for the background sleep would take the whole 30s.
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("Execution took %v", d)
+			}
+		})
+	}
+}
+
+func TestExecuteCancelledInQueue(t *testing.T) {
+	e := prepareExecutor(t, "1m", sleepCommands)
+
+	release, err := e.queue.Acquire(context.Background(), Job{SessionID: "s1", UserID: "u1"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to acquire: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+
+	resp, err := e.Execute(ctx, &ExecutionRequest{JobID: "job_1", SessionID: "s2", Language: "bash"})
+	if err != nil {
+		t.Fatalf("Execute failed: %v", err)
+	}
+	if resp.ErrorMessage != "Execution cancelled" {
+		t.Errorf("Got response: %+v", resp)
+	}
+}
+
+func TestExecutionResult(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		commands string
+		want     *common.ExecutionResult
+	}{
+		{
+			name:     "success",
+			commands: `[{"name": "compile", "cmd": "true"}, {"name": "run", "cmd": "echo ok"}]`,
+			want:     &common.ExecutionResult{Step: "run"},
+		},
+		{
+			name:     "failed compilation",
+			commands: `[{"name": "compile", "cmd": "exit 2"}, {"name": "run", "cmd": "echo ok"}]`,
+			want:     &common.ExecutionResult{Step: "compile", ExitCode: 2},
+		},
+		{
+			name:     "failed run",
+			commands: `[{"name": "compile", "cmd": "true"}, {"name": "run", "cmd": "exit 3"}]`,
+			want:     &common.ExecutionResult{Step: "run", ExitCode: 3},
+		},
+		{
+			name:     "signal",
+			commands: `[{"name": "run", "cmd": "kill -SEGV $$"}]`,
+			want:     &common.ExecutionResult{Step: "run", ExitCode: -1, Signal: "segmentation fault"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e := prepareExecutor(t, "10s", tc.commands)
+
+			resp, err := e.Execute(context.Background(), &ExecutionRequest{Language: "bash"})
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if resp.Result == nil || resp.Result.PeakMemoryKB <= 0 {
+				t.Fatalf("Peak memory is missing: %+v", resp.Result)
+			}
+			if diff := cmp.Diff(tc.want, resp.Result, cmpopts.IgnoreFields(common.ExecutionResult{}, "WallTimeMs", "CPUTimeMs", "PeakMemoryKB")); diff != "" {
+				t.Errorf("Wrong result, -want +got:\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestSelectedLines(t *testing.T) {
+	text := "ab\ncd\nef"
+	for _, tc := range []struct {
+		name      string
+		start     int
+		end       int
+		wantStart int
+		wantEnd   int
+	}{
+		{name: "first_line", start: 0, end: 2, wantStart: 1, wantEnd: 1},
+		{name: "middle", start: 4, end: 5, wantStart: 2, wantEnd: 2},
+		{name: "multiple_lines", start: 1, end: 7, wantStart: 1, wantEnd: 3},
+		{name: "reversed", start: 7, end: 4, wantStart: 2, wantEnd: 3},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			start, end := selectedLines(text, tc.start, tc.end)
+			if start != tc.wantStart || end != tc.wantEnd {
+				t.Errorf("selectedLines() = %d, %d, want: %d, %d", start, end, tc.wantStart, tc.wantEnd)
+			}
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	languages, err := language_registry.Parse([]byte(`{
+  "bash": {
+    "extension": "sh",
+    "formatter": {
+      "cmd": "tr a-z A-Z < /mnt/code.sh",
+      "rangeCmd": "awk 'NR >= {start_line} && NR <= {end_line} { $0 = toupper($0) } 1' /mnt/code.sh",
+      "timeout": "10s"
+    }
+  },
+  "broken": {
+    "extension": "sh",
+    "formatter": {"cmd": "echo 'syntax error' >&2 && exit 1", "timeout": "10s"}
+  }
+}`))
+	if err != nil {
+		t.Fatalf("Failed to parse languages: %v", err)
+	}
+	e := New(language_registry.New(languages), NewUnsafeLocalSandbox(), NewQueue(1, 1), nil)
+
+	for _, tc := range []struct {
+		name string
+		req  *FormatRequest
+		want *common.FormatResponse
+	}{
+		{
+			name: "whole",
+			req:  &FormatRequest{Language: "bash", Code: "ab\ncd\nef\n"},
+			want: &common.FormatResponse{Code: "AB\nCD\nEF\n"},
+		},
+		{
+			name: "selection",
+			req:  &FormatRequest{Language: "bash", Code: "ab\ncd\nef\n", HasSelection: true, SelectionStart: 4, SelectionEnd: 4},
+			want: &common.FormatResponse{Code: "ab\nCD\nef\n"},
+		},
+		{
+			name: "selection_in_multi_byte_text",
+			req:  &FormatRequest{Language: "bash", Code: "ąb\ncd\nef\n", HasSelection: true, SelectionStart: 3, SelectionEnd: 3},
+			want: &common.FormatResponse{Code: "ąb\nCD\nef\n"},
+		},
+		{
+			name: "failed",
+			req:  &FormatRequest{Language: "broken", Code: "ab"},
+			want: &common.FormatResponse{ErrorMessage: "format has failed (exit status 1)", Stderr: "syntax error"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := e.Format(context.Background(), tc.req)
+			if err != nil {
+				t.Fatalf("Format failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Wrong response, -want +got:\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestExecutePublicClassFile(t *testing.T) {
+	languages, err := language_registry.Parse([]byte(`{
+  "java": {
+    "extension": "java",
+    "publicClassFile": true,
+    "timeout": "10s",
+    "commands": [
+      {"name": "compile", "cmd": "test -f /mnt/{main_file}"},
+      {"name": "run", "cmd": "echo {main_name}"}
+    ]
+  }
+}`))
+	if err != nil {
+		t.Fatalf("Failed to parse languages: %v", err)
+	}
+	e := New(language_registry.New(languages), NewUnsafeLocalSandbox(), NewQueue(1, 1), nil)
+
+	for _, tc := range []struct {
+		name string
+		code string
+		want string
+	}{
+		{name: "public_class", code: "public class Solution {}", want: "Solution"},
+		{name: "non_public_class", code: "class Helper {}\n\nclass Main {\n  public static void main(String[] args) {}\n}", want: "Main"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			resp, err := e.Execute(context.Background(), &ExecutionRequest{
+				Language: "java",
+				Code:     tc.code,
+			})
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if resp.ErrorMessage != "" || resp.Stdout != tc.want {
+				t.Errorf("Wrong response: %+v", resp)
+			}
+		})
+	}
+}
+
+func TestOutputStream(t *testing.T) {
+	defer func(size, max int) { maxChunkSize, maxStreamedOutput = size, max }(maxChunkSize, maxStreamedOutput)
+	maxChunkSize, maxStreamedOutput = 8, 20
+
+	chunks := []common.OutputChunk{}
+	s := &outputStream{handler: func(c common.OutputChunk) { chunks = append(chunks, c) }}
+	stdout, stderr := s.writers(ioutil.Discard, ioutil.Discard)
+
+	for _, w := range []struct {
+		stderr bool
+		text   string
+	}{
+		{false, "a"},
+		{false, "b"},
+		{true, "c"},
+		{false, "defghijk"},
+		{false, "lm"},
+		{false, "nopqrstuvwxyz"},
+		{false, "ignored"},
+	} {
+		out := stdout
+		if w.stderr {
+			out = stderr
+		}
+		out.Write([]byte(w.text))
+	}
+	s.flush()
+
+	if diff := cmp.Diff([]common.OutputChunk{
+		{Sequence: 1, Text: "ab"},
+		{Sequence: 2, Stderr: true, Text: "c"},
+		{Sequence: 3, Text: "defghijk"},
+		{Sequence: 4, Text: "lmnopqrst"},
+		{Sequence: 5, Stderr: true, Text: truncatedOutputNotice},
+	}, chunks); diff != "" {
+		t.Errorf("Streamed wrong chunks, -want +got:\n%v", diff)
+	}
+}
+
+func TestOutputStreamFlushInterval(t *testing.T) {
+	got := make(chan common.OutputChunk, 1)
+	s := &outputStream{handler: func(c common.OutputChunk) { got <- c }}
+	s.write("a", false)
+	s.write("b", false)
+
+	select {
+	case c := <-got:
+		if c.Text != "ab" {
+			t.Errorf("Streamed %q, want %q", c.Text, "ab")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Output was not flushed")
+	}
+}
+
+func TestExecuteLanguages(t *testing.T) {
+	languages, err := language_registry.Load("../languages.json")
+	if err != nil {
+		t.Fatalf("Failed to load languages: %v", err)
+	}
+	e := New(languages, NewUnsafeLocalSandbox(), NewQueue(1, 1), nil)
+
+	for _, tc := range []struct {
+		language string
+		// binaries have to be installed to run the program.
+		binaries []string
+		code     string
+	}{
+		{
+			language: "kotlin",
+			binaries: []string{"kotlinc", "java"},
+			code:     `fun main() { println("hello " + readLine()!!) }`,
+		},
+		{
+			language: "rust",
+			binaries: []string{"rustc"},
+			code: `fn main() {
+    let mut name = String::new();
+    std::io::stdin().read_line(&mut name).unwrap();
+    println!("hello {}", name.trim());
+}`,
+		},
+		{
+			language: "javascript",
+			binaries: []string{"node"},
+			code:     `console.log("hello " + require("fs").readFileSync(0, "utf8").trim());`,
+		},
+		{
+			language: "typescript",
+			binaries: []string{"tsc", "node"},
+			code: `declare const require: any;
+const name: string = require("fs").readFileSync(0, "utf8").trim();
+console.log("hello " + name);`,
+		},
+	} {
+		t.Run(tc.language, func(t *testing.T) {
+			for _, b := range tc.binaries {
+				if _, err := exec.LookPath(b); err != nil {
+					t.Skipf("%s is not installed", b)
+				}
+			}
+
+			resp, err := e.Execute(context.Background(), &ExecutionRequest{Language: tc.language, Code: tc.code, Stdin: "world\n"})
+			if err != nil {
+				t.Fatalf("Execute failed: %v", err)
+			}
+			if resp.ErrorMessage != "" || resp.Stdout != "hello world" {
+				t.Errorf("Wrong response: %q, stdout: %q, stderr: %q", resp.ErrorMessage, resp.Stdout, resp.Stderr)
+			}
+		})
+	}
+}
+
+func TestDockerSandboxMemoryLimit(t *testing.T) {
+	sb := NewDockerSandbox("")
+	for _, tc := range []struct {
+		limit int
+		want  string
+	}{
+		{limit: 0, want: "128MB"},
+		{limit: 1024, want: "1024MB"},
+	} {
+		cmd, _, err := sb.Command("/tmp", &Command{ID: "id", Script: "run.sh", MemoryLimitMB: tc.limit})
+		if err != nil {
+			t.Fatalf("Command failed: %v", err)
+		}
+		if args := strings.Join(cmd.Args, " "); !strings.Contains(args, "--memory "+tc.want+" ") {
+			t.Errorf("Command(limit: %d) = %q, want memory: %s", tc.limit, args, tc.want)
+		}
+	}
+}
+
+func TestDockerStatsWrapper(t *testing.T) {
+	d := t.TempDir()
+	for _, tc := range []struct {
+		name   string
+		script string
+		want   Usage
+		busy   bool
+	}{
+		{name: "exit_code", script: "exit 3", want: Usage{ExitCode: 3}},
+		{name: "cpu_time", script: "for i in $(seq 100000); do :; done", busy: true},
+		{name: "signal", script: "kill -KILL $$", want: Usage{ExitCode: -1, Signal: "killed"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			script := filepath.Join(d, tc.name+".sh")
+			if err := ioutil.WriteFile(script, []byte("#!/bin/bash\n"+tc.script), 0755); err != nil {
+				t.Fatalf("Failed to write the script: %v", err)
+			}
+			stats := filepath.Join(d, tc.name+".json")
+			exec.Command("bash", "-c", dockerStatsWrapper, "stats", script, stats).Run()
+
+			b, err := ioutil.ReadFile(stats)
+			if err != nil {
+				t.Fatalf("Stats weren't written: %v", err)
+			}
+			got, err := parseDockerStats(b)
+			if err != nil {
+				t.Fatalf("parseDockerStats(%s) failed: %v", b, err)
+			}
+			if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreFields(Usage{}, "CPUTime", "PeakMemoryKB")); diff != "" {
+				t.Errorf("Wrong usage, -want +got:\n%v", diff)
+			}
+			if tc.busy && got.CPUTime == 0 {
+				t.Errorf("CPU time of the script wasn't measured: %s", b)
+			}
+		})
+	}
+
+	got, err := parseDockerStats([]byte(`{"ExitCode": 0, "UserTime": "0m1.250s", "SystemTime": "0m0.250s", "PeakMemoryBytes": 2097152}`))
+	if err != nil {
+		t.Fatalf("parseDockerStats failed: %v", err)
+	}
+	if want := (Usage{CPUTime: 1500 * time.Millisecond, PeakMemoryKB: 2048}); got != want {
+		t.Errorf("parseDockerStats() = %+v, want: %+v", got, want)
+	}
+}
@@ -0,0 +1,216 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/pasiasty/cocoder/server/common"
+	"github.com/pasiasty/cocoder/server/users_manager"
+)
+
+// JudgeRequest describes the program to be run against the test cases.
+type JudgeRequest struct {
+	JobID     string
+	SessionID string
+	UserID    users_manager.UserID
+	Language  string
+	Code      string
+	Files     map[string]string
+	TestCases []common.TestCase
+}
+
+// normalizeOutput drops the trailing whitespace, which is usually invisible
+// to the users.
+func normalizeOutput(s string) string {
+	lines := strings.Split(strings.TrimRight(s, " \t\r\n"), "\n")
+	for i, l := range lines {
+		lines[i] = strings.TrimRight(l, " \t\r")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// maxDiffLines bounds the lines of each output compared by the outputDiff.
+const maxDiffLines = 1000
+
+func truncateLines(lines []string) ([]string, bool) {
+	if len(lines) > maxDiffLines {
+		return lines[:maxDiffLines], true
+	}
+	return lines, false
+}
+
+// outputDiff shows the lines missing from the output with "-" and the
+// unexpected ones with "+".
+func outputDiff(expected, got string) string {
+	a, aTruncated := truncateLines(strings.Split(expected, "\n"))
+	b, bTruncated := truncateLines(strings.Split(got, "\n"))
+
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	res := &strings.Builder{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			fmt.Fprintf(res, " %s\n", a[i])
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			fmt.Fprintf(res, "-%s\n", a[i])
+			i++
+		default:
+			fmt.Fprintf(res, "+%s\n", b[j])
+			j++
+		}
+	}
+	if aTruncated || bTruncated {
+		res.WriteString("...\n")
+	}
+	return res.String()
+}
+
+// judgeStartupGrace is added to the time limit of the test case for the
+// deadline of the run, as the run also starts the sandbox. The program itself
+// is held to the limit by its CPU time.
+var judgeStartupGrace = 5 * time.Second
+
+// judge compares the outcome of the run with the test case.
+func judge(tc common.TestCase, resp *common.ExecutionResponse, timedOut bool) common.TestCaseResult {
+	res := common.TestCaseResult{
+		Name:   tc.Name,
+		Hidden: tc.Hidden,
+		Stdout: resp.Stdout,
+		Stderr: resp.Stderr,
+		Result: resp.Result,
+	}
+
+	switch {
+	case timedOut:
+		res.Verdict = common.VerdictTimeLimitExceeded
+	case resp.ErrorMessage != "":
+		res.Verdict = common.VerdictRuntimeError
+	case normalizeOutput(resp.Stdout) == normalizeOutput(tc.ExpectedStdout):
+		res.Verdict = common.VerdictOK
+	default:
+		res.Verdict = common.VerdictWrongAnswer
+		res.Diff = outputDiff(normalizeOutput(tc.ExpectedStdout), normalizeOutput(resp.Stdout))
+	}
+
+	if tc.Hidden {
+		res.Stdout, res.Stderr, res.Diff = "", "", ""
+	}
+	return res
+}
+
+// Judge compiles the program once and runs it against all the test cases.
+// Each of the steps waits in the queue on its own, so that judging many test
+// cases doesn't hold the slot of the others.
+func (e *Executor) Judge(ctx context.Context, req *JudgeRequest) (*common.JudgeResponse, error) {
+	l, ok := e.languages.Get(req.Language)
+	if !ok || len(l.Commands) == 0 {
+		return nil, fmt.Errorf("language: %s is not supported", req.Language)
+	}
+
+	job := Job{SessionID: req.SessionID, UserID: string(req.UserID)}
+	release, err := e.queue.Acquire(ctx, job, nil)
+	if err == context.Canceled {
+		resp := interrupted(ctx)
+		return &common.JudgeResponse{JobID: req.JobID, ErrorMessage: resp.ErrorMessage}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(d)
+
+	ex := newExecution(l, req.Code, l.Commands, time.Duration(l.Timeout))
+	if err := writeFileTree(d, ex.mainFile, req.Code, req.Files); err != nil {
+		return nil, err
+	}
+
+	run := ex.commands[ex.compileSteps()]
+	timeout := ex.timeout
+
+	compileCtx, cancel := context.WithTimeout(ctx, timeout)
+	resp, err := e.compile(compileCtx, ex, d, req.Code, req.Files, e.sandbox, &commandIO{})
+	cancel()
+	release()
+	if err != nil {
+		return nil, err
+	}
+	if resp != nil && resp.ErrorMessage != "" {
+		return &common.JudgeResponse{
+			JobID:        req.JobID,
+			ErrorMessage: resp.ErrorMessage,
+			Stdout:       resp.Stdout,
+			Stderr:       resp.Stderr,
+			Result:       resp.Result,
+		}, nil
+	}
+
+	res := &common.JudgeResponse{
+		JobID:     req.JobID,
+		TestCases: []common.TestCaseResult{},
+	}
+	for _, tc := range req.TestCases {
+		// The test case can only make the timeout of the language shorter.
+		limit := timeout
+		if l := time.Duration(tc.TimeLimitMs) * time.Millisecond; l > 0 && l < timeout {
+			limit = l
+		}
+
+		release, err := e.queue.Acquire(ctx, job, nil)
+		if ctx.Err() != nil {
+			res.ErrorMessage = interrupted(ctx).ErrorMessage
+			return res, nil
+		}
+		if err == ErrQueueFull {
+			res.ErrorMessage = err.Error()
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		caseCtx, cancel := context.WithTimeout(ctx, limit+judgeStartupGrace)
+		resp, err := runCommand(caseCtx, e.sandbox, run, ex, d, &commandIO{stdin: tc.Stdin})
+		deadlineExceeded := caseCtx.Err() == context.DeadlineExceeded
+		cancel()
+		release()
+		if err != nil {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			res.ErrorMessage = interrupted(ctx).ErrorMessage
+			return res, nil
+		}
+		timedOut := deadlineExceeded || (resp.Result != nil && time.Duration(resp.Result.CPUTimeMs)*time.Millisecond > limit)
+		res.TestCases = append(res.TestCases, judge(tc, resp, timedOut))
+	}
+	return res, nil
+}
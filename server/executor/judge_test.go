@@ -0,0 +1,176 @@
+package executor
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func TestOutputDiff(t *testing.T) {
+	for _, tc := range []struct {
+		expected string
+		got      string
+		want     string
+	}{
+		{expected: "a\nb", got: "a\nb", want: " a\n b\n"},
+		{expected: "a\nb\nc", got: "a\nx\nc", want: " a\n-b\n+x\n c\n"},
+		{expected: "a", got: "", want: "-a\n+\n"},
+	} {
+		if got := outputDiff(tc.expected, tc.got); got != tc.want {
+			t.Errorf("outputDiff(%q, %q) = %q, want %q", tc.expected, tc.got, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeOutput(t *testing.T) {
+	if got := normalizeOutput("a  \r\nb\t\n\n"); got != "a\nb" {
+		t.Errorf("normalizeOutput() = %q, want \"a\\nb\"", got)
+	}
+}
+
+const judgedProgram = `read x
+if [ "$x" = loop ]; then sleep 5; fi
+if [ "$x" = fail ]; then exit 1; fi
+echo $((x * 2))`
+
+func TestJudge(t *testing.T) {
+	defer func(grace time.Duration) { judgeStartupGrace = grace }(judgeStartupGrace)
+	judgeStartupGrace = 100 * time.Millisecond
+
+	e := prepareExecutor(t, "10s", `[
+  {"name": "compile", "cmd": "cp /mnt/code.sh /mnt/prog.sh"},
+  {"name": "run", "cmd": "bash /mnt/prog.sh", "usesStdin": true}
+]`)
+
+	resp, err := e.Judge(context.Background(), &JudgeRequest{
+		JobID:    "job_1",
+		Language: "bash",
+		Code:     judgedProgram,
+		TestCases: []common.TestCase{
+			{Name: "ok", Stdin: "2", ExpectedStdout: "4\n"},
+			{Name: "wrong", Stdin: "3", ExpectedStdout: "7"},
+			{Name: "slow", Stdin: "loop", ExpectedStdout: "0", TimeLimitMs: 200},
+			{Name: "crash", Stdin: "fail", ExpectedStdout: "0"},
+			{Name: "hidden", Stdin: "4", ExpectedStdout: "9", Hidden: true},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Judge failed: %v", err)
+	}
+
+	want := &common.JudgeResponse{
+		JobID: "job_1",
+		TestCases: []common.TestCaseResult{
+			{Name: "ok", Verdict: common.VerdictOK, Stdout: "4"},
+			{Name: "wrong", Verdict: common.VerdictWrongAnswer, Stdout: "6", Diff: "-7\n+6\n"},
+			{Name: "slow", Verdict: common.VerdictTimeLimitExceeded},
+			{Name: "crash", Verdict: common.VerdictRuntimeError},
+			{Name: "hidden", Verdict: common.VerdictWrongAnswer, Hidden: true},
+		},
+	}
+	if diff := cmp.Diff(want, resp, cmpopts.IgnoreFields(common.TestCaseResult{}, "Result")); diff != "" {
+		t.Errorf("Wrong verdicts, -want +got:\n%v", diff)
+	}
+}
+
+func TestJudgeCompilationError(t *testing.T) {
+	e := prepareExecutor(t, "10s", `[
+  {"name": "compile", "cmd": "echo broken >&2; exit 1"},
+  {"name": "run", "cmd": "true"}
+]`)
+
+	resp, err := e.Judge(context.Background(), &JudgeRequest{
+		Language:  "bash",
+		TestCases: []common.TestCase{{Name: "ok"}},
+	})
+	if err != nil {
+		t.Fatalf("Judge failed: %v", err)
+	}
+	if resp.ErrorMessage == "" || resp.Stderr != "broken" || resp.Result.Step != "compile" || len(resp.TestCases) != 0 {
+		t.Errorf("Compilation should've failed, got: %+v", resp)
+	}
+}
+
+func TestJudgeTimeLimitClamped(t *testing.T) {
+	defer func(grace time.Duration) { judgeStartupGrace = grace }(judgeStartupGrace)
+	judgeStartupGrace = 100 * time.Millisecond
+
+	e := prepareExecutor(t, "200ms", `[{"name": "run", "cmd": "bash /mnt/code.sh", "usesStdin": true}]`)
+
+	start := time.Now()
+	resp, err := e.Judge(context.Background(), &JudgeRequest{
+		Language:  "bash",
+		Code:      judgedProgram,
+		TestCases: []common.TestCase{{Name: "slow", Stdin: "loop", TimeLimitMs: 60000}},
+	})
+	if err != nil {
+		t.Fatalf("Judge failed: %v", err)
+	}
+	if len(resp.TestCases) != 1 || resp.TestCases[0].Verdict != common.VerdictTimeLimitExceeded {
+		t.Errorf("Wrong verdicts: %+v", resp.TestCases)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("Time limit of the test case exceeded the timeout of the language: %v", elapsed)
+	}
+}
+
+func TestJudgeTimesProgram(t *testing.T) {
+	// The sleep stands for the slow start of the sandbox, which doesn't count
+	// into the time limit, unlike the CPU time of the program.
+	e := prepareExecutor(t, "10s", `[{"name": "run", "cmd": "sleep 0.5; bash /mnt/code.sh", "usesStdin": true}]`)
+
+	resp, err := e.Judge(context.Background(), &JudgeRequest{
+		Language: "bash",
+		Code:     `read x; if [ "$x" = busy ]; then for i in $(seq 300000); do :; done; fi; echo $((x * 2))`,
+		TestCases: []common.TestCase{
+			{Name: "slow_start", Stdin: "2", ExpectedStdout: "4", TimeLimitMs: 200},
+			{Name: "busy", Stdin: "busy", ExpectedStdout: "0", TimeLimitMs: 200},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Judge failed: %v", err)
+	}
+
+	want := []common.TestCaseResult{
+		{Name: "slow_start", Verdict: common.VerdictOK, Stdout: "4"},
+		{Name: "busy", Verdict: common.VerdictTimeLimitExceeded, Stdout: "0"},
+	}
+	if diff := cmp.Diff(want, resp.TestCases, cmpopts.IgnoreFields(common.TestCaseResult{}, "Result")); diff != "" {
+		t.Errorf("Wrong verdicts, -want +got:\n%v", diff)
+	}
+}
+
+func TestJudgeReentersQueue(t *testing.T) {
+	e := prepareExecutor(t, "10s", `[{"name": "run", "cmd": "sleep 0.2", "usesStdin": true}]`)
+
+	judged := make(chan struct{})
+	go func() {
+		defer close(judged)
+		cases := make([]common.TestCase, 10)
+		if _, err := e.Judge(context.Background(), &JudgeRequest{SessionID: "s1", Language: "bash", TestCases: cases}); err != nil {
+			t.Errorf("Judge failed: %v", err)
+		}
+	}()
+
+	// The other session gets the slot in between the test cases.
+	time.Sleep(100 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	release, err := e.queue.Acquire(ctx, Job{SessionID: "s2"}, nil)
+	if err != nil {
+		t.Fatalf("Other session waited for all the test cases: %v", err)
+	}
+	release()
+
+	select {
+	case <-judged:
+		t.Errorf("Judging has finished before the other session has run")
+	default:
+	}
+	<-judged
+}
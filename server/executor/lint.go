@@ -0,0 +1,56 @@
+package executor
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pasiasty/cocoder/server/common"
+	"github.com/pasiasty/cocoder/server/language_registry"
+)
+
+// LintRequest describes the code to be linted.
+type LintRequest struct {
+	SessionID string
+	Language  string
+	Code      string
+	Files     map[string]string
+}
+
+// Lint runs the linter of the language in the sandbox. The linters exit with
+// an error whenever they find something, so the failure is only reported if
+// the linter has been killed or hasn't printed any diagnostics.
+func (e *Executor) Lint(ctx context.Context, req *LintRequest) (*common.LintResponse, error) {
+	l, ok := e.languages.Get(req.Language)
+	if !ok || l.Linter == nil {
+		return nil, fmt.Errorf("language: %s is not supported", req.Language)
+	}
+
+	release, err := e.queue.Acquire(ctx, Job{SessionID: req.SessionID}, nil)
+	if err == context.Canceled {
+		return &common.LintResponse{ErrorMessage: interrupted(ctx).ErrorMessage}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ex := newExecution(l, req.Code, []language_registry.Command{{Name: "lint", Cmd: l.Linter.Cmd}}, time.Duration(l.Linter.Timeout))
+	resp, err := e.executeCommands(ctx, ex, req.Code, req.Files, e.sandbox, &commandIO{})
+	if err != nil {
+		return nil, err
+	}
+
+	diagnostics := l.Linter.Diagnostics(resp.Stdout + "\n" + resp.Stderr)
+	killed := resp.Result == nil || resp.Result.Signal != ""
+	if resp.ErrorMessage != "" && (killed || len(diagnostics) == 0) {
+		return &common.LintResponse{ErrorMessage: resp.ErrorMessage, Stderr: resp.Stderr}, nil
+	}
+
+	return &common.LintResponse{
+		Result: &common.LintResult{
+			Language:    req.Language,
+			Diagnostics: diagnostics,
+		},
+	}, nil
+}
@@ -0,0 +1,79 @@
+package executor
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pasiasty/cocoder/server/common"
+	"github.com/pasiasty/cocoder/server/language_registry"
+)
+
+func TestLint(t *testing.T) {
+	languages, err := language_registry.Parse([]byte(`{
+  "found": {
+    "extension": "sh",
+    "linter": {
+      "cmd": "echo 'code.sh:1:5: unquoted variable [SC2086]'; echo './lib/a.sh:2:1: unused variable [SC2034]' >&2; exit 1",
+      "pattern": "^(?P<file>[^:]+):(?P<line>\\d+):(?P<column>\\d+): (?P<message>.+?) \\[(?P<rule>\\w+)\\]$",
+      "severity": "warning",
+      "timeout": "10s"
+    }
+  },
+  "clean": {
+    "extension": "sh",
+    "linter": {"cmd": "true", "pattern": "(?P<line>\\d+) (?P<message>.+)", "timeout": "10s"}
+  },
+  "missing": {
+    "extension": "sh",
+    "linter": {"cmd": "echo 'linter: command not found' >&2; exit 127", "pattern": "(?P<line>\\d+): (?P<message>.+)", "timeout": "10s"}
+  },
+  "hanging": {
+    "extension": "sh",
+    "linter": {"cmd": "echo '1: slow'; sleep 30", "pattern": "(?P<line>\\d+): (?P<message>.+)", "timeout": "100ms"}
+  }
+}`))
+	if err != nil {
+		t.Fatalf("Failed to parse languages: %v", err)
+	}
+	e := New(language_registry.New(languages), NewUnsafeLocalSandbox(), NewQueue(1, 1), nil)
+
+	for _, tc := range []struct {
+		language string
+		want     *common.LintResponse
+	}{
+		{
+			language: "found",
+			want: &common.LintResponse{Result: &common.LintResult{
+				Language: "found",
+				Diagnostics: []common.Diagnostic{
+					{File: "code.sh", Line: 1, Column: 5, Severity: "warning", Message: "unquoted variable", Rule: "SC2086"},
+					{File: "lib/a.sh", Line: 2, Column: 1, Severity: "warning", Message: "unused variable", Rule: "SC2034"},
+				},
+			}},
+		},
+		{
+			language: "clean",
+			want:     &common.LintResponse{Result: &common.LintResult{Language: "clean", Diagnostics: []common.Diagnostic{}}},
+		},
+		{
+			language: "missing",
+			want:     &common.LintResponse{ErrorMessage: "lint has failed (exit status 127)", Stderr: "linter: command not found"},
+		},
+		{
+			language: "hanging",
+			want:     &common.LintResponse{ErrorMessage: "Execution timed out"},
+		},
+	} {
+		t.Run(tc.language, func(t *testing.T) {
+			got, err := e.Lint(context.Background(), &LintRequest{SessionID: "session", Language: tc.language, Code: "echo $a"})
+			if err != nil {
+				t.Fatalf("Lint failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("Wrong response, -want +got:\n%v", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,236 @@
+package executor
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+)
+
+// ErrQueueFull is returned when there are too many executions waiting.
+var ErrQueueFull = errors.New("too many programs are waiting for execution, try again later")
+
+// Job identifies who requested the execution.
+type Job struct {
+	SessionID string
+	UserID    string
+	// Interactive jobs, which the users wait for while editing, are started
+	// before the others.
+	Interactive bool
+}
+
+// PositionHandler receives the position of the job in the queue whenever it
+// changes. Position 0 means the job has started.
+type PositionHandler func(position int)
+
+type ticket struct {
+	job        Job
+	seq        int
+	position   int
+	onPosition PositionHandler
+	ready      chan struct{}
+}
+
+// Queue bounds the number of concurrent executions. The waiting interactive
+// jobs are started first, then the jobs are started in order of the number of already running jobs of their session
+// and user, and then of how long ago their session and user were served, so
+// that no session or user can take all the slots.
+type Queue struct {
+	mux           sync.Mutex
+	maxConcurrent int
+	maxQueued     int
+
+	seq             int
+	running         int
+	runningSessions map[string]int
+	runningUsers    map[string]int
+	waiting         []*ticket
+
+	// starts counts the started jobs. lastSessionStart and lastUserStart keep
+	// its value from the newest job of the session or user.
+	starts           int
+	lastSessionStart map[string]int
+	lastUserStart    map[string]int
+}
+
+// NewQueue creates the queue running up to maxConcurrent jobs at once, with
+// up to maxQueued jobs waiting.
+func NewQueue(maxConcurrent, maxQueued int) *Queue {
+	if maxConcurrent < 1 {
+		maxConcurrent = 1
+	}
+	return &Queue{
+		maxConcurrent:    maxConcurrent,
+		maxQueued:        maxQueued,
+		runningSessions:  make(map[string]int),
+		runningUsers:     make(map[string]int),
+		lastSessionStart: make(map[string]int),
+		lastUserStart:    make(map[string]int),
+	}
+}
+
+// notification is delivered outside of the lock, as the handlers may block.
+type notification struct {
+	handler  PositionHandler
+	position int
+}
+
+func notify(ns []notification) {
+	for _, n := range ns {
+		n.handler(n.position)
+	}
+}
+
+func (q *Queue) less(a, b *ticket) bool {
+	if a.job.Interactive != b.job.Interactive {
+		return a.job.Interactive
+	}
+	if sa, sb := q.runningSessions[a.job.SessionID], q.runningSessions[b.job.SessionID]; sa != sb {
+		return sa < sb
+	}
+	if ua, ub := q.runningUsers[a.job.UserID], q.runningUsers[b.job.UserID]; ua != ub {
+		return ua < ub
+	}
+	if sa, sb := q.lastSessionStart[a.job.SessionID], q.lastSessionStart[b.job.SessionID]; sa != sb {
+		return sa < sb
+	}
+	if ua, ub := q.lastUserStart[a.job.UserID], q.lastUserStart[b.job.UserID]; ua != ub {
+		return ua < ub
+	}
+	return a.seq < b.seq
+}
+
+func (q *Queue) start(t *ticket) {
+	q.running++
+	q.runningSessions[t.job.SessionID]++
+	q.runningUsers[t.job.UserID]++
+	q.starts++
+	q.lastSessionStart[t.job.SessionID] = q.starts
+	q.lastUserStart[t.job.UserID] = q.starts
+	close(t.ready)
+}
+
+// schedule starts the jobs while there are free slots and reorders the rest.
+// It returns the position changes to be delivered.
+func (q *Queue) schedule() []notification {
+	var ns []notification
+
+	for len(q.waiting) > 0 {
+		sort.SliceStable(q.waiting, func(i, j int) bool {
+			return q.less(q.waiting[i], q.waiting[j])
+		})
+		if q.running >= q.maxConcurrent {
+			break
+		}
+
+		t := q.waiting[0]
+		q.waiting = q.waiting[1:]
+		q.start(t)
+		if t.onPosition != nil && t.position > 0 {
+			ns = append(ns, notification{t.onPosition, 0})
+		}
+	}
+
+	for i, t := range q.waiting {
+		if t.position != i+1 {
+			t.position = i + 1
+			if t.onPosition != nil {
+				ns = append(ns, notification{t.onPosition, t.position})
+			}
+		}
+	}
+	return ns
+}
+
+// finish frees the slot of the job and starts the next ones.
+func (q *Queue) finish(t *ticket) []notification {
+	q.running--
+	if q.runningSessions[t.job.SessionID]--; q.runningSessions[t.job.SessionID] == 0 {
+		delete(q.runningSessions, t.job.SessionID)
+	}
+	if q.runningUsers[t.job.UserID]--; q.runningUsers[t.job.UserID] == 0 {
+		delete(q.runningUsers, t.job.UserID)
+	}
+	q.forget(t.job)
+	return q.schedule()
+}
+
+// forget drops the history of the session and user without any jobs left.
+func (q *Queue) forget(job Job) {
+	sessionActive := q.runningSessions[job.SessionID] > 0
+	userActive := q.runningUsers[job.UserID] > 0
+	for _, w := range q.waiting {
+		sessionActive = sessionActive || w.job.SessionID == job.SessionID
+		userActive = userActive || w.job.UserID == job.UserID
+	}
+	if !sessionActive {
+		delete(q.lastSessionStart, job.SessionID)
+	}
+	if !userActive {
+		delete(q.lastUserStart, job.UserID)
+	}
+}
+
+func (q *Queue) remove(t *ticket) {
+	for i, w := range q.waiting {
+		if w == t {
+			q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// Acquire waits for the free slot for the job. The returned function must be
+// called once the execution has finished.
+func (q *Queue) Acquire(ctx context.Context, job Job, onPosition PositionHandler) (func(), error) {
+	q.mux.Lock()
+	if len(q.waiting) >= q.maxQueued && q.running >= q.maxConcurrent {
+		q.mux.Unlock()
+		return nil, ErrQueueFull
+	}
+
+	q.seq++
+	t := &ticket{
+		job:        job,
+		seq:        q.seq,
+		onPosition: onPosition,
+		ready:      make(chan struct{}),
+	}
+	q.waiting = append(q.waiting, t)
+	ns := q.schedule()
+	q.mux.Unlock()
+
+	notify(ns)
+
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			q.mux.Lock()
+			ns := q.finish(t)
+			q.mux.Unlock()
+
+			notify(ns)
+		})
+	}
+
+	select {
+	case <-t.ready:
+		return release, nil
+	case <-ctx.Done():
+	}
+
+	q.mux.Lock()
+	select {
+	case <-t.ready:
+		// Started concurrently with the cancellation.
+		ns = q.finish(t)
+	default:
+		q.remove(t)
+		q.forget(t.job)
+		ns = q.schedule()
+	}
+	q.mux.Unlock()
+
+	notify(ns)
+	return nil, ctx.Err()
+}
@@ -0,0 +1,165 @@
+package executor
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// positionRecorder collects the positions reported to the jobs.
+type positionRecorder struct {
+	mux       sync.Mutex
+	positions map[string][]int
+}
+
+func newPositionRecorder() *positionRecorder {
+	return &positionRecorder{positions: make(map[string][]int)}
+}
+
+func (r *positionRecorder) handler(name string) PositionHandler {
+	return func(position int) {
+		r.mux.Lock()
+		defer r.mux.Unlock()
+		r.positions[name] = append(r.positions[name], position)
+	}
+}
+
+func (r *positionRecorder) get() map[string][]int {
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	return r.positions
+}
+
+type acquired struct {
+	name    string
+	release func()
+}
+
+// enqueue acquires the slot in the background, reporting it to the channel.
+func enqueue(ctx context.Context, q *Queue, r *positionRecorder, name string, job Job, started chan<- acquired) {
+	go func() {
+		release, err := q.Acquire(ctx, job, r.handler(name))
+		if err != nil {
+			return
+		}
+		started <- acquired{name, release}
+	}()
+	// Keeping the order of the arrivals.
+	time.Sleep(10 * time.Millisecond)
+}
+
+func waitStarted(t *testing.T, started <-chan acquired) acquired {
+	select {
+	case a := <-started:
+		return a
+	case <-time.After(time.Second):
+		t.Fatalf("No job has started")
+	}
+	return acquired{}
+}
+
+func TestQueueFairness(t *testing.T) {
+	ctx := context.Background()
+	q := NewQueue(1, 10)
+	r := newPositionRecorder()
+	started := make(chan acquired, 10)
+
+	enqueue(ctx, q, r, "a1", Job{SessionID: "s1", UserID: "a"}, started)
+	first := waitStarted(t, started)
+
+	// The second job of the session "s1" waits for the job of the session
+	// "s2", even though it came first.
+	enqueue(ctx, q, r, "a2", Job{SessionID: "s1", UserID: "a"}, started)
+	enqueue(ctx, q, r, "b1", Job{SessionID: "s2", UserID: "b"}, started)
+
+	order := []string{first.name}
+	first.release()
+	for i := 0; i < 2; i++ {
+		a := waitStarted(t, started)
+		order = append(order, a.name)
+		a.release()
+	}
+
+	if diff := cmp.Diff([]string{"a1", "b1", "a2"}, order); diff != "" {
+		t.Errorf("Wrong order of the jobs, -want +got:\n%v", diff)
+	}
+
+	want := map[string][]int{
+		"a2": {1, 2, 1, 0},
+		"b1": {1, 0},
+	}
+	if diff := cmp.Diff(want, r.get()); diff != "" {
+		t.Errorf("Wrong positions, -want +got:\n%v", diff)
+	}
+}
+
+func TestQueueInteractive(t *testing.T) {
+	ctx := context.Background()
+	q := NewQueue(1, 10)
+	r := newPositionRecorder()
+	started := make(chan acquired, 10)
+
+	enqueue(ctx, q, r, "run1", Job{SessionID: "s1", UserID: "a"}, started)
+	first := waitStarted(t, started)
+
+	// The formatting waits for the free slot, but goes ahead of the programs.
+	enqueue(ctx, q, r, "run2", Job{SessionID: "s2", UserID: "b"}, started)
+	enqueue(ctx, q, r, "format", Job{SessionID: "s1", UserID: "a", Interactive: true}, started)
+
+	order := []string{first.name}
+	first.release()
+	for i := 0; i < 2; i++ {
+		a := waitStarted(t, started)
+		order = append(order, a.name)
+		a.release()
+	}
+
+	if diff := cmp.Diff([]string{"run1", "format", "run2"}, order); diff != "" {
+		t.Errorf("Wrong order of the jobs, -want +got:\n%v", diff)
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	ctx := context.Background()
+	q := NewQueue(1, 1)
+
+	release, err := q.Acquire(ctx, Job{SessionID: "s1", UserID: "a"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to acquire: %v", err)
+	}
+
+	waitCtx, cancel := context.WithCancel(ctx)
+	errs := make(chan error)
+	go func() {
+		_, err := q.Acquire(waitCtx, Job{SessionID: "s2", UserID: "b"}, nil)
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	if _, err := q.Acquire(ctx, Job{SessionID: "s3", UserID: "c"}, nil); err != ErrQueueFull {
+		t.Errorf("Acquire() returned: %v, want: %v", err, ErrQueueFull)
+	}
+
+	// Cancelled job leaves the queue.
+	cancel()
+	if err := <-errs; err != context.Canceled {
+		t.Errorf("Acquire() returned: %v, want: %v", err, context.Canceled)
+	}
+	release()
+
+	release, err = q.Acquire(ctx, Job{SessionID: "s3", UserID: "c"}, nil)
+	if err != nil {
+		t.Fatalf("Failed to acquire after the queue was freed: %v", err)
+	}
+	release()
+	// Releasing twice has no effect.
+	release()
+
+	if q.running != 0 || len(q.waiting) != 0 || len(q.runningSessions) != 0 || len(q.runningUsers) != 0 ||
+		len(q.lastSessionStart) != 0 || len(q.lastUserStart) != 0 {
+		t.Errorf("Queue was not emptied: %+v", q)
+	}
+}
@@ -0,0 +1,259 @@
+package executor
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+// Command is a single step of the execution.
+type Command struct {
+	// ID is unique for every run of the command.
+	ID   string
+	Name string
+	// Cmd is the shell command of the step. It refers to the program's
+	// directory as /mnt.
+	Cmd string
+	// Script is the path of the script running Cmd, relative to the program's
+	// directory.
+	Script   string
+	ReadOnly bool
+	// Image, if set, replaces the default image of the sandbox.
+	Image string
+	// MemoryLimitMB, if set, replaces the default memory limit of the
+	// sandbox.
+	MemoryLimitMB int
+}
+
+// defaultMemoryLimitMB is the memory limit of the commands of the languages
+// which don't set their own.
+const defaultMemoryLimitMB = 128
+
+func (c *Command) memoryLimitMB() int {
+	if c.MemoryLimitMB > 0 {
+		return c.MemoryLimitMB
+	}
+	return defaultMemoryLimitMB
+}
+
+// Sandbox isolates the executed programs from the host. Each sandbox makes
+// the program's directory visible to the commands as /mnt.
+type Sandbox interface {
+	// Command prepares the command running the step in the program's
+	// directory d. The cleanup closes what the command holds on the host,
+	// it's called once the command has exited or has failed to start.
+	Command(d string, c *Command) (cmd *exec.Cmd, cleanup func(), err error)
+	// Attach is called once the command has started. The returned function
+	// releases the resources of the command after it has exited.
+	Attach(cmd *exec.Cmd, c *Command) (release func(), err error)
+	// Kill stops the started command together with all the processes it has
+	// spawned.
+	Kill(cmd *exec.Cmd, c *Command) error
+	// Usage describes the resources used by the finished command.
+	Usage(cmd *exec.Cmd, d string, c *Command) Usage
+}
+
+// Usage describes how the command has exited and the resources it has used.
+type Usage struct {
+	ExitCode     int
+	Signal       string
+	CPUTime      time.Duration
+	PeakMemoryKB int64
+}
+
+// result describes the command which has run for the wallTime.
+func (u Usage) result(step string, wallTime time.Duration) *common.ExecutionResult {
+	return &common.ExecutionResult{
+		Step:         step,
+		ExitCode:     u.ExitCode,
+		Signal:       u.Signal,
+		WallTimeMs:   wallTime.Milliseconds(),
+		CPUTimeMs:    u.CPUTime.Milliseconds(),
+		PeakMemoryKB: u.PeakMemoryKB,
+	}
+}
+
+func noRelease() {}
+
+const defaultImage = "mpasek/cocoder-executor"
+
+type dockerSandbox struct {
+	image string
+}
+
+// NewDockerSandbox runs every command in a fresh container of the image. The
+// default executor image is used if the image is empty.
+func NewDockerSandbox(image string) Sandbox {
+	if image == "" {
+		image = defaultImage
+	}
+	return &dockerSandbox{image: image}
+}
+
+func (s *dockerSandbox) Command(d string, c *Command) (*exec.Cmd, func(), error) {
+	args := []string{
+		"run",
+		"--name",
+		containerName(c),
+		"-v",
+		fmt.Sprintf("%v:/mnt", d),
+		"--rm",
+		"-i",
+		"--memory",
+		fmt.Sprintf("%dMB", c.memoryLimitMB()),
+		"--memory-swap",
+		"0",
+		"--cpus",
+		"0.5",
+	}
+
+	if c.ReadOnly {
+		args = append(args, "--read-only")
+	}
+
+	image := s.image
+	if c.Image != "" {
+		image = c.Image
+	}
+
+	args = append(args, "--network", "none", image,
+		"bash", "-c", dockerStatsWrapper, "stats", fmt.Sprintf("/mnt/%s", c.Script), fmt.Sprintf("/mnt/%s", statsFile(c)))
+	return exec.Command("docker", args...), noRelease, nil
+}
+
+// dockerStatsWrapper runs the script inside of the container and stores its
+// usage, as the usage of the docker client tells nothing about the program.
+// It only uses the builtins of bash, which runs the scripts anyway: times for
+// the CPU time of the script (not in a subshell, which has no children) and
+// the peak memory of the container's cgroup (v2, or v1 otherwise), if the
+// kernel tracks it.
+const dockerStatsWrapper = `"$1"
+code=$?
+times > "$2"
+t=($(< "$2"))
+peak=0
+for f in /sys/fs/cgroup/memory.peak /sys/fs/cgroup/memory/memory.max_usage_in_bytes; do
+  if [ -r "$f" ]; then peak=$(< "$f"); break; fi
+done
+printf '{"ExitCode": %d, "UserTime": "%s", "SystemTime": "%s", "PeakMemoryBytes": %d}' "$code" "${t[2]}" "${t[3]}" "$peak" > "$2"
+exit $code
+`
+
+// dockerStats is written by the dockerStatsWrapper. The times are formatted
+// by bash, e.g. 0m1.250s.
+type dockerStats struct {
+	ExitCode        int
+	UserTime        string
+	SystemTime      string
+	PeakMemoryBytes int64
+}
+
+// parseDockerStats reads the usage from the stats. Like in the shell, the exit
+// codes above 128 are the signals which have killed the script.
+func parseDockerStats(b []byte) (Usage, error) {
+	stats := &dockerStats{}
+	if err := json.Unmarshal(b, stats); err != nil {
+		return Usage{}, err
+	}
+	user, err := time.ParseDuration(stats.UserTime)
+	if err != nil {
+		return Usage{}, err
+	}
+	system, err := time.ParseDuration(stats.SystemTime)
+	if err != nil {
+		return Usage{}, err
+	}
+
+	u := Usage{
+		ExitCode:     stats.ExitCode,
+		CPUTime:      user + system,
+		PeakMemoryKB: stats.PeakMemoryBytes / 1024,
+	}
+	if sig := stats.ExitCode - 128; sig > 0 && sig < 65 {
+		u.ExitCode = -1
+		u.Signal = syscall.Signal(sig).String()
+	}
+	return u, nil
+}
+
+func containerName(c *Command) string {
+	return fmt.Sprintf("cocoder-%s", c.ID)
+}
+
+func statsFile(c *Command) string {
+	return fmt.Sprintf(".stats_%s.json", c.ID)
+}
+
+func (s *dockerSandbox) Attach(cmd *exec.Cmd, c *Command) (func(), error) {
+	return noRelease, nil
+}
+
+// Usage is read from the stats file. If the container was killed before the
+// file was written, only the exit code of the client is known.
+func (s *dockerSandbox) Usage(cmd *exec.Cmd, d string, c *Command) Usage {
+	b, err := ioutil.ReadFile(filepath.Join(d, statsFile(c)))
+	if err != nil {
+		return Usage{ExitCode: cmd.ProcessState.ExitCode()}
+	}
+	u, err := parseDockerStats(b)
+	if err != nil {
+		return Usage{ExitCode: cmd.ProcessState.ExitCode()}
+	}
+	return u
+}
+
+// Kill stops the container, as killing the client leaves it running.
+func (s *dockerSandbox) Kill(cmd *exec.Cmd, c *Command) error {
+	err := exec.Command("docker", "kill", containerName(c)).Run()
+	cmd.Process.Kill()
+	return err
+}
+
+type unsafeLocalSandbox struct{}
+
+// NewUnsafeLocalSandbox runs the commands directly on the host, with the
+// privileges of the server. It's meant for the development only.
+func NewUnsafeLocalSandbox() Sandbox {
+	return &unsafeLocalSandbox{}
+}
+
+func (s *unsafeLocalSandbox) Command(d string, c *Command) (*exec.Cmd, func(), error) {
+	cmd := exec.Command("bash", "-c", strings.ReplaceAll(c.Cmd, "/mnt", d))
+	cmd.Dir = d
+	setProcessGroup(cmd)
+	return cmd, noRelease, nil
+}
+
+func (s *unsafeLocalSandbox) Attach(cmd *exec.Cmd, c *Command) (func(), error) {
+	return noRelease, nil
+}
+
+func (s *unsafeLocalSandbox) Kill(cmd *exec.Cmd, c *Command) error {
+	return killProcessGroup(cmd)
+}
+
+func (s *unsafeLocalSandbox) Usage(cmd *exec.Cmd, d string, c *Command) Usage {
+	return processUsage(cmd.ProcessState)
+}
+
+// NewSandbox creates the sandbox of the given kind: "docker" (the default),
+// "namespaces" or "unsafe-local". The cgroup and the uid are only used by the
+// namespaces sandbox.
+func NewSandbox(kind, image, cgroup string, uid int) (Sandbox, error) {
+	switch kind {
+	case "", "docker":
+		return NewDockerSandbox(image), nil
+	case "namespaces":
+		return NewNamespaceSandbox(cgroup, uid)
+	case "unsafe-local":
+		return NewUnsafeLocalSandbox(), nil
+	}
+	return nil, fmt.Errorf("unknown sandbox: %q", kind)
+}
@@ -0,0 +1,247 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// namespaceLimits are applied with ulimit inside of the sandbox: the CPU time,
+// the written file size, the open files, the address space (in KB, loose
+// enough for the JVM and V8, which reserve large ranges upfront) and the
+// processes. The processes are counted per user, so the limit is shared by
+// all the sandboxed commands.
+const namespaceLimits = "ulimit -t 60 -f 65536 -n 256 -v 4194304 -u 512"
+
+// cgroupLimits mirror the limits of the Docker sandbox, the memory.max is
+// set from the memory limit of the command.
+var cgroupLimits = map[string]string{
+	"memory.swap.max": "0",
+	"cpu.max":         "50000 100000",
+	"pids.max":        "64",
+}
+
+// sandboxDirs are the host directories visible read-only in the sandbox, they
+// hold the toolchains. Missing ones are skipped, symlinks are recreated.
+var sandboxDirs = []string{"/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/usr", "/etc", "/opt"}
+
+// sandboxDevices are bind-mounted from the host into /dev.
+var sandboxDevices = []string{"null", "zero", "full", "random", "urandom"}
+
+// NamespaceSandbox runs the commands in their own user, mount, PID, network,
+// IPC and UTS namespaces. The root of the sandbox is a read-only tmpfs with
+// the sandboxDirs, /dev, /proc, /tmp and the program's directory as /mnt.
+type NamespaceSandbox struct {
+	// cgroup, if set, is the cgroup v2 directory under which every command
+	// gets its own cgroup with the memory, CPU and process limits.
+	cgroup string
+	// uid is the dedicated host user and group running the commands.
+	uid int
+	// root is the mount point of the root of the sandbox, each command mounts
+	// its own tmpfs there.
+	root string
+}
+
+// NewNamespaceSandbox creates the sandbox running the commands as the uid,
+// which has to be a dedicated unprivileged user. The server needs root, or
+// CAP_SETUID and CAP_SETGID, to map it. The cgroup is optional, without it
+// only the rlimits apply.
+func NewNamespaceSandbox(cgroup string, uid int) (Sandbox, error) {
+	if uid <= 0 || uid == os.Getuid() {
+		return nil, fmt.Errorf("sandbox needs a dedicated unprivileged uid, got %d", uid)
+	}
+	if cgroup != "" {
+		if _, err := os.Stat(filepath.Join(cgroup, "cgroup.procs")); err != nil {
+			return nil, fmt.Errorf("%s is not a cgroup v2 directory: %v", cgroup, err)
+		}
+	}
+
+	root, err := ioutil.TempDir("", "cocoder-sandbox-")
+	if err != nil {
+		return nil, err
+	}
+	// The mount point is looked up by the user of the sandbox.
+	if err := os.Chmod(root, 0755); err != nil {
+		return nil, err
+	}
+
+	return &NamespaceSandbox{
+		cgroup: cgroup,
+		uid:    uid,
+		root:   root,
+	}, nil
+}
+
+// chownTree passes the program's directory to the user running the commands.
+func (s *NamespaceSandbox) chownTree(d string) error {
+	return filepath.Walk(d, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(p, s.uid, s.uid)
+	})
+}
+
+// setupScript builds the root of the sandbox, pivots into it and runs the
+// script of the command with all the capabilities dropped. It starts once the
+// gate (fd 3) is opened by Attach.
+func (s *NamespaceSandbox) setupScript(d string, c *Command) string {
+	tmpOptions := "size=512m"
+	if c.ReadOnly {
+		tmpOptions = "ro"
+	}
+
+	lines := []string{
+		"set -e",
+		"read -r -n 1 -u 3 gate",
+		"exec 3<&- 4>&-",
+		// The mounts are made private first, so that none of them propagates
+		// back to the host.
+		"mount --make-rprivate /",
+		fmt.Sprintf("mount -t tmpfs -o size=16m,mode=755 tmpfs %q", s.root),
+		fmt.Sprintf("cd %q", s.root),
+	}
+	for _, p := range sandboxDirs {
+		lines = append(lines, fmt.Sprintf(
+			`if [ -L %[1]q ]; then ln -s "$(readlink %[1]q)" .%[1]s; elif [ -d %[1]q ]; then mkdir .%[1]s && mount --rbind %[1]q .%[1]s && mount -o remount,bind,ro .%[1]s; fi`, p))
+	}
+	lines = append(lines, "mkdir dev proc tmp mnt")
+	for _, dev := range sandboxDevices {
+		lines = append(lines, fmt.Sprintf("touch dev/%[1]s && mount --bind /dev/%[1]s dev/%[1]s", dev))
+	}
+	lines = append(lines,
+		"ln -s /proc/self/fd dev/fd && ln -s /proc/self/fd/0 dev/stdin && ln -s /proc/self/fd/1 dev/stdout && ln -s /proc/self/fd/2 dev/stderr",
+		fmt.Sprintf("mount --bind %q mnt", d),
+		"mount -t proc proc proc",
+		fmt.Sprintf("mount -t tmpfs -o %s tmpfs tmp", tmpOptions),
+		"mkdir .old && pivot_root . .old && cd / && umount -l /.old && rmdir /.old",
+		"mount -o remount,bind,ro /",
+		"cd /mnt",
+		namespaceLimits,
+		fmt.Sprintf("exec setpriv --no-new-privs --inh-caps=-all --bounding-set=-all bash /mnt/%s", c.Script),
+	)
+	return strings.Join(lines, "\n")
+}
+
+func (s *NamespaceSandbox) Command(d string, c *Command) (*exec.Cmd, func(), error) {
+	if err := s.chownTree(d); err != nil {
+		return nil, nil, err
+	}
+
+	// The gate holds the command until it's moved to its cgroup.
+	gateR, gateW, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() {
+		gateR.Close()
+		gateW.Close()
+	}
+
+	cmd := exec.Command("bash", "-c", s.setupScript(d, c))
+	cmd.Env = []string{
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin:/usr/local/go/bin",
+		"HOME=/tmp",
+	}
+	cmd.ExtraFiles = []*os.File{gateR, gateW}
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Cloneflags: syscall.CLONE_NEWUSER | syscall.CLONE_NEWNS | syscall.CLONE_NEWPID |
+			syscall.CLONE_NEWNET | syscall.CLONE_NEWIPC | syscall.CLONE_NEWUTS,
+		UidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: s.uid, Size: 1}},
+		GidMappings: []syscall.SysProcIDMap{{ContainerID: 0, HostID: s.uid, Size: 1}},
+		// Becoming root of the namespace keeps the capabilities needed to
+		// build the root, they are dropped before running the command.
+		Credential: &syscall.Credential{Uid: 0, Gid: 0, NoSetGroups: true},
+		Pdeathsig:  syscall.SIGKILL,
+	}
+	return cmd, cleanup, nil
+}
+
+// Kill stops the init process of the PID namespace, which takes down all the
+// other processes in it.
+func (s *NamespaceSandbox) Kill(cmd *exec.Cmd, c *Command) error {
+	return cmd.Process.Kill()
+}
+
+// Usage of the init process includes all the processes it has waited for.
+func (s *NamespaceSandbox) Usage(cmd *exec.Cmd, d string, c *Command) Usage {
+	return processUsage(cmd.ProcessState)
+}
+
+// Attach moves the command to its cgroup and then lets it start.
+func (s *NamespaceSandbox) Attach(cmd *exec.Cmd, c *Command) (func(), error) {
+	gateW := cmd.ExtraFiles[1]
+
+	release := noRelease
+	if s.cgroup != "" {
+		var err error
+		if release, err = s.attachCgroup(cmd, c); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := gateW.Write([]byte{'\n'}); err != nil {
+		release()
+		return nil, fmt.Errorf("failed to start the command: %v", err)
+	}
+	return release, nil
+}
+
+func (s *NamespaceSandbox) attachCgroup(cmd *exec.Cmd, c *Command) (func(), error) {
+	d := filepath.Join(s.cgroup, fmt.Sprintf("cocoder-%d", cmd.Process.Pid))
+	if err := os.Mkdir(d, 0755); err != nil {
+		return nil, err
+	}
+	release := func() {
+		if err := os.Remove(d); err != nil {
+			log.Printf("Failed to remove cgroup %s: %v", d, err)
+		}
+	}
+
+	limits := map[string]string{"memory.max": fmt.Sprintf("%dM", c.memoryLimitMB())}
+	for f, v := range cgroupLimits {
+		limits[f] = v
+	}
+	for f, v := range limits {
+		if err := ioutil.WriteFile(filepath.Join(d, f), []byte(v), 0644); err != nil && f != "memory.swap.max" {
+			release()
+			return nil, fmt.Errorf("failed to set %s of cgroup %s: %v", f, d, err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(d, "cgroup.procs"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		release()
+		return nil, fmt.Errorf("failed to move process to cgroup %s: %v", d, err)
+	}
+	return release, nil
+}
+
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+func killProcessGroup(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+func processUsage(ps *os.ProcessState) Usage {
+	u := Usage{
+		ExitCode: ps.ExitCode(),
+		CPUTime:  ps.UserTime() + ps.SystemTime(),
+	}
+	if ws, ok := ps.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		u.Signal = ws.Signal().String()
+	}
+	if ru, ok := ps.SysUsage().(*syscall.Rusage); ok {
+		u.PeakMemoryKB = ru.Maxrss
+	}
+	return u
+}
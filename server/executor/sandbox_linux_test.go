@@ -0,0 +1,132 @@
+//go:build linux
+// +build linux
+
+package executor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pasiasty/cocoder/server/language_registry"
+)
+
+// sandboxTestUID is the user running the commands in the test.
+const sandboxTestUID = 64123
+
+func TestNamespaceSandbox(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Mapping the sandbox user requires root")
+	}
+	sb, err := NewNamespaceSandbox("", sandboxTestUID)
+	if err != nil {
+		t.Fatalf("NewNamespaceSandbox failed: %v", err)
+	}
+
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := ioutil.WriteFile(secret, []byte("secret"), 0644); err != nil {
+		t.Fatalf("Failed to write the secret: %v", err)
+	}
+
+	// As in the executor, the parent of the directory is not owned by root.
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(d)
+	resp, err := runCommand(context.Background(), sb, language_registry.Command{
+		Name: "run",
+		Cmd: strings.Join([]string{
+			"echo hello > /mnt/out",
+			"cat /mnt/out",
+			"test ! -e " + secret + " && echo no-secret",
+			"touch /usr/x 2> /dev/null || echo read-only",
+			"grep CapEff /proc/self/status",
+			"ulimit -v",
+			"ulimit -u",
+		}, "\n"),
+	}, &execution{}, d, &commandIO{})
+	if err != nil {
+		if strings.Contains(err.Error(), "operation not permitted") {
+			t.Skipf("Namespaces are not available: %v", err)
+		}
+		t.Fatalf("runCommand failed: %v", err)
+	}
+	if resp.ErrorMessage != "" {
+		t.Fatalf("Command failed: %s, stderr: %s", resp.ErrorMessage, resp.Stderr)
+	}
+
+	want := "hello\nno-secret\nread-only\nCapEff:\t0000000000000000\n4194304\n512"
+	if resp.Stdout != want {
+		t.Errorf("Wrong output of the sandboxed command, got:\n%s\nwant:\n%s", resp.Stdout, want)
+	}
+
+	info, err := os.Stat(filepath.Join(d, "out"))
+	if err != nil {
+		t.Fatalf("Output of the command is missing: %v", err)
+	}
+	if uid := info.Sys().(*syscall.Stat_t).Uid; uid != sandboxTestUID {
+		t.Errorf("Command ran as %d, want %d", uid, sandboxTestUID)
+	}
+}
+
+func TestNamespaceSandboxUID(t *testing.T) {
+	for _, uid := range []int{0, -1, os.Getuid()} {
+		if _, err := NewNamespaceSandbox("", uid); err == nil {
+			t.Errorf("NewNamespaceSandbox accepted uid %d", uid)
+		}
+	}
+}
+
+func TestNamespaceSandboxStartsAfterAttach(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("Mapping the sandbox user requires root")
+	}
+	sb, err := NewNamespaceSandbox("", sandboxTestUID)
+	if err != nil {
+		t.Fatalf("NewNamespaceSandbox failed: %v", err)
+	}
+	d, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("TempDir failed: %v", err)
+	}
+	defer os.RemoveAll(d)
+	if err := ioutil.WriteFile(filepath.Join(d, "run.sh"), []byte("touch /mnt/started"), 0755); err != nil {
+		t.Fatalf("Failed to write the script: %v", err)
+	}
+
+	c := &Command{ID: "gate", Name: "run", Script: "run.sh"}
+	cmd, cleanup, err := sb.Command(d, c)
+	if err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+	defer cleanup()
+	if err := cmd.Start(); err != nil {
+		t.Skipf("Namespaces are not available: %v", err)
+	}
+
+	// The command waits until it's attached, e.g. moved to its cgroup.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat(filepath.Join(d, "started")); !os.IsNotExist(err) {
+		t.Errorf("Command has started before being attached: %v", err)
+	}
+
+	release, err := sb.Attach(cmd, c)
+	if err != nil {
+		sb.Kill(cmd, c)
+		cmd.Wait()
+		t.Fatalf("Attach failed: %v", err)
+	}
+	defer release()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("Command failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(d, "started")); err != nil {
+		t.Errorf("Command has not run after being attached: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+// +build !linux
+
+package executor
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+// NewNamespaceSandbox is only available on Linux.
+func NewNamespaceSandbox(cgroup string, uid int) (Sandbox, error) {
+	return nil, errors.New("namespaces sandbox is only supported on Linux")
+}
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup only kills the command itself, leaving the processes it
+// has spawned running.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// processUsage doesn't know the peak memory nor the signal.
+func processUsage(ps *os.ProcessState) Usage {
+	return Usage{
+		ExitCode: ps.ExitCode(),
+		CPUTime:  ps.UserTime() + ps.SystemTime(),
+	}
+}
@@ -19,5 +19,6 @@ require (
 	github.com/r3labs/diff/v2 v2.15.1
 	github.com/sergi/go-diff v1.2.0
 	github.com/yuin/gopher-lua v0.0.0-20220504180219-658193537a64 // indirect
+	go.etcd.io/bbolt v1.3.6
 	golang.org/x/tools/gopls v0.8.4 // indirect
 )
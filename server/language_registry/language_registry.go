@@ -0,0 +1,408 @@
+package language_registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+// Duration is the time.Duration written as "10s" in the registry file.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// Command is a single step of the execution, e.g. the compilation.
+type Command struct {
+	Name      string `json:"name"`
+	Cmd       string `json:"cmd"`
+	ReadOnly  bool   `json:"readOnly"`
+	UsesStdin bool   `json:"usesStdin"`
+}
+
+// Formatter formats the main file, /mnt/{main_file}, and prints the result.
+// RangeCmd, if set, formats only the lines from {start_line} to {end_line}
+// (1-based, inclusive).
+type Formatter struct {
+	Cmd      string   `json:"cmd"`
+	RangeCmd string   `json:"rangeCmd"`
+	Timeout  Duration `json:"timeout"`
+}
+
+const (
+	startLinePlaceholder = "{start_line}"
+	endLinePlaceholder   = "{end_line}"
+)
+
+// Command returns the command formatting the lines, or the whole code if
+// the lines are not set or the range formatting is not supported.
+func (f *Formatter) Command(startLine, endLine int) string {
+	if f.RangeCmd == "" || startLine <= 0 || endLine < startLine {
+		return f.Cmd
+	}
+	return strings.NewReplacer(
+		startLinePlaceholder, strconv.Itoa(startLine),
+		endLinePlaceholder, strconv.Itoa(endLine),
+	).Replace(f.RangeCmd)
+}
+
+// Linter reports the diagnostics of the code, one per line of its output.
+// Pattern matches the lines of the diagnostics with the named groups: file,
+// line, column, severity, message and rule, of which line and message are
+// required. Severity is used for the diagnostics not reporting it.
+type Linter struct {
+	Cmd      string   `json:"cmd"`
+	Pattern  string   `json:"pattern"`
+	Severity string   `json:"severity"`
+	Timeout  Duration `json:"timeout"`
+
+	re *regexp.Regexp
+}
+
+func (l *Linter) compile() error {
+	re, err := regexp.Compile(l.Pattern)
+	if err != nil {
+		return err
+	}
+	groups := map[string]bool{}
+	for _, name := range re.SubexpNames() {
+		groups[name] = true
+	}
+	for _, required := range []string{"line", "message"} {
+		if !groups[required] {
+			return fmt.Errorf("pattern has no %q group", required)
+		}
+	}
+	l.re = re
+	return nil
+}
+
+// Diagnostics parses the output of the linter. The paths of the files are
+// relative to the directory of the code.
+func (l *Linter) Diagnostics(output string) []common.Diagnostic {
+	res := []common.Diagnostic{}
+	for _, line := range strings.Split(output, "\n") {
+		m := l.re.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil {
+			continue
+		}
+		groups := map[string]string{}
+		for i, name := range l.re.SubexpNames() {
+			if name != "" {
+				groups[name] = m[i]
+			}
+		}
+
+		d := common.Diagnostic{
+			File:     strings.TrimPrefix(strings.TrimPrefix(groups["file"], "/mnt/"), "./"),
+			Severity: strings.ToLower(groups["severity"]),
+			Message:  strings.TrimSpace(groups["message"]),
+			Rule:     groups["rule"],
+		}
+		d.Line, _ = strconv.Atoi(groups["line"])
+		d.Column, _ = strconv.Atoi(groups["column"])
+		if d.Severity == "" {
+			d.Severity = l.Severity
+		}
+		res = append(res, d)
+	}
+	return res
+}
+
+// LSPPool keeps the language servers started and initialized before they are
+// needed. The pooled servers are initialized with the capabilities of the
+// Monaco language client instead of the ones of the actual client, which
+// can't be changed later, and its initialization options are only passed
+// through workspace/didChangeConfiguration. The pool suits the servers that
+// take their settings from the configuration and don't depend on the client.
+type LSPPool struct {
+	// Size is the number of the idle servers kept.
+	Size int `json:"size"`
+	// IdleTimeout stops the idle servers once no server of the language was
+	// needed for that long, they are started again on the next demand. Zero
+	// keeps them forever.
+	IdleTimeout Duration `json:"idleTimeout"`
+}
+
+// userIDPlaceholder is replaced in the LSP command with the ID of the user.
+const userIDPlaceholder = "{user_id}"
+
+type Language struct {
+	Name        string `json:"-"`
+	DisplayName string `json:"displayName"`
+	Extension   string `json:"extension"`
+	// Image is the sandbox image running the commands and the language server.
+	Image string `json:"image"`
+	// PublicClassFile names the main file after the public class of the code,
+	// as Java requires, instead of code.<extension>. Without the public class
+	// the file is named after the class declaring the main method.
+	PublicClassFile bool `json:"publicClassFile"`
+	// MemoryLimitMB replaces the default memory limit of the sandbox, for
+	// the toolchains that don't fit in it.
+	MemoryLimitMB int        `json:"memoryLimitMB"`
+	Timeout       Duration   `json:"timeout"`
+	Commands      []Command  `json:"commands"`
+	Formatter     *Formatter `json:"formatter"`
+	Linter        *Linter    `json:"linter"`
+	LSP           []string   `json:"lsp"`
+	LSPPool       *LSPPool   `json:"lspPool"`
+}
+
+const (
+	mainFilePlaceholder = "{main_file}"
+	mainNamePlaceholder = "{main_name}"
+)
+
+// publicClassRe matches the top-level public class, which is not indented.
+var publicClassRe = regexp.MustCompile(`(?m)^public\s+(?:(?:abstract|final|sealed|non-sealed|strictfp|static)\s+)*(?:class|interface|enum|record)\s+([A-Za-z_$][\w$]*)`)
+
+// classRe matches the top-level classes, public or not.
+var classRe = regexp.MustCompile(`(?m)^(?:(?:public|abstract|final|sealed|non-sealed|strictfp|static)\s+)*(?:class|interface|enum|record)\s+([A-Za-z_$][\w$]*)`)
+
+// mainMethodRe matches the declaration of the main method.
+var mainMethodRe = regexp.MustCompile(`\bstatic\s+(?:final\s+)?void\s+main\s*\(`)
+
+// MainFile returns the name of the file, under which the code is run.
+func (l *Language) MainFile(code string) string {
+	name := "code"
+	if l.PublicClassFile {
+		if m := publicClassRe.FindStringSubmatch(code); m != nil {
+			name = m[1]
+		} else if c := mainClass(code); c != "" {
+			name = c
+		}
+	}
+	return fmt.Sprintf("%s.%s", name, l.Extension)
+}
+
+// mainClass returns the top-level class declaring the main method, which is
+// the last one starting before the method, or "" if there is none.
+func mainClass(code string) string {
+	m := mainMethodRe.FindStringIndex(code)
+	if m == nil {
+		return ""
+	}
+	name := ""
+	for _, c := range classRe.FindAllStringSubmatchIndex(code, -1) {
+		if c[0] > m[0] {
+			break
+		}
+		name = code[c[2]:c[3]]
+	}
+	return name
+}
+
+// ExpandCommand replaces {main_file} in the command with the name of the main
+// file and {main_name} with the name without the extension.
+func ExpandCommand(cmd, mainFile string) string {
+	return strings.NewReplacer(
+		mainFilePlaceholder, mainFile,
+		mainNamePlaceholder, strings.TrimSuffix(mainFile, path.Ext(mainFile)),
+	).Replace(cmd)
+}
+
+// LSPCommand returns the command starting the language server for the user.
+func (l *Language) LSPCommand(userID string) []string {
+	res := make([]string, len(l.LSP))
+	for i, arg := range l.LSP {
+		res[i] = strings.ReplaceAll(arg, userIDPlaceholder, userID)
+	}
+	return res
+}
+
+func (l *Language) validate() error {
+	if l.Extension == "" {
+		return fmt.Errorf("language %q has no extension", l.Name)
+	}
+	if len(l.Commands) > 0 && l.Timeout <= 0 {
+		return fmt.Errorf("language %q has no timeout", l.Name)
+	}
+	if l.MemoryLimitMB < 0 {
+		return fmt.Errorf("language %q has negative memory limit", l.Name)
+	}
+	for _, c := range l.Commands {
+		if c.Name == "" || c.Cmd == "" {
+			return fmt.Errorf("language %q has incomplete command: %+v", l.Name, c)
+		}
+	}
+	if l.Formatter != nil && (l.Formatter.Cmd == "" || l.Formatter.Timeout <= 0) {
+		return fmt.Errorf("language %q has incomplete formatter", l.Name)
+	}
+	if l.Linter != nil {
+		if l.Linter.Cmd == "" || l.Linter.Timeout <= 0 {
+			return fmt.Errorf("language %q has incomplete linter", l.Name)
+		}
+		if err := l.Linter.compile(); err != nil {
+			return fmt.Errorf("language %q has invalid linter: %v", l.Name, err)
+		}
+	}
+	if l.LSPPool != nil && (len(l.LSP) == 0 || l.LSPPool.Size < 0 || l.LSPPool.IdleTimeout < 0) {
+		return fmt.Errorf("language %q has invalid LSP pool", l.Name)
+	}
+	return nil
+}
+
+// Info is what the UI gets to know about the language.
+type Info struct {
+	Name        string
+	DisplayName string
+	Extension   string
+	Execute     bool
+	Format      bool
+	FormatRange bool
+	Lint        bool
+	LSP         bool
+}
+
+// Parse reads the registry file, which maps the names of the languages to
+// their definitions.
+func Parse(b []byte) (map[string]*Language, error) {
+	languages := make(map[string]*Language)
+	if err := json.Unmarshal(b, &languages); err != nil {
+		return nil, fmt.Errorf("failed to parse languages: %v", err)
+	}
+	for name, l := range languages {
+		if l == nil {
+			return nil, fmt.Errorf("language %q has no definition", name)
+		}
+		l.Name = name
+		if err := l.validate(); err != nil {
+			return nil, err
+		}
+	}
+	return languages, nil
+}
+
+// Registry holds the supported languages. It's safe to use concurrently with
+// the reloads.
+type Registry struct {
+	mux       sync.RWMutex
+	path      string
+	modTime   time.Time
+	languages map[string]*Language
+}
+
+// New creates the registry of the given languages, which is never reloaded.
+func New(languages map[string]*Language) *Registry {
+	return &Registry{languages: languages}
+}
+
+// Load reads the registry from the file.
+func Load(path string) (*Registry, error) {
+	r := &Registry{path: path}
+	if _, err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the file again if it was modified since the last read. On
+// failure the previous languages are kept.
+func (r *Registry) reload() (bool, error) {
+	st, err := os.Stat(r.path)
+	if err != nil {
+		return false, err
+	}
+
+	r.mux.RLock()
+	unchanged := st.ModTime().Equal(r.modTime)
+	r.mux.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	b, err := ioutil.ReadFile(r.path)
+	if err != nil {
+		return false, err
+	}
+	languages, err := Parse(b)
+	if err != nil {
+		return false, fmt.Errorf("%s: %v", r.path, err)
+	}
+
+	r.mux.Lock()
+	defer r.mux.Unlock()
+	r.languages = languages
+	r.modTime = st.ModTime()
+	return true, nil
+}
+
+// Watch reloads the registry file whenever it changes, until the ctx is done.
+func (r *Registry) Watch(ctx context.Context, interval time.Duration) {
+	if r.path == "" {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			reloaded, err := r.reload()
+			if err != nil {
+				log.Printf("Failed to reload languages: %v", err)
+			} else if reloaded {
+				log.Printf("Reloaded languages from %s", r.path)
+			}
+		}
+	}
+}
+
+// Get returns the language. The returned definition must not be modified.
+func (r *Registry) Get(name string) (*Language, bool) {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	l, ok := r.languages[name]
+	return l, ok
+}
+
+// List describes all the languages, ordered by their names.
+func (r *Registry) List() []Info {
+	r.mux.RLock()
+	defer r.mux.RUnlock()
+
+	res := []Info{}
+	for _, l := range r.languages {
+		res = append(res, Info{
+			Name:        l.Name,
+			DisplayName: l.DisplayName,
+			Extension:   l.Extension,
+			Execute:     len(l.Commands) > 0,
+			Format:      l.Formatter != nil,
+			FormatRange: l.Formatter != nil && l.Formatter.RangeCmd != "",
+			Lint:        l.Linter != nil,
+			LSP:         len(l.LSP) > 0,
+		})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Name < res[j].Name
+	})
+	return res
+}
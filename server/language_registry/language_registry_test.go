@@ -0,0 +1,206 @@
+package language_registry
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+const testLanguages = `{
+  "python": {
+    "extension": "py",
+    "timeout": "10s",
+    "commands": [{"name": "run", "cmd": "python3 /mnt/code.py", "usesStdin": true}],
+    "lsp": ["run_lsp", "{user_id}"]
+  }
+}`
+
+func TestParse(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{name: "valid", content: testLanguages},
+		{name: "invalid json", content: "{", wantErr: true},
+		{name: "no definition", content: `{"python": null}`, wantErr: true},
+		{name: "no extension", content: `{"python": {}}`, wantErr: true},
+		{name: "bad timeout", content: `{"python": {"extension": "py", "timeout": "ten"}}`, wantErr: true},
+		{name: "no timeout", content: `{"python": {"extension": "py", "commands": [{"name": "run", "cmd": "true"}]}}`, wantErr: true},
+		{name: "incomplete command", content: `{"python": {"extension": "py", "timeout": "1s", "commands": [{"name": "run"}]}}`, wantErr: true},
+		{name: "incomplete formatter", content: `{"python": {"extension": "py", "formatter": {"cmd": "black"}}}`, wantErr: true},
+		{name: "incomplete linter", content: `{"python": {"extension": "py", "linter": {"cmd": "ruff", "pattern": "(?P<line>\\d+) (?P<message>.*)"}}}`, wantErr: true},
+		{name: "invalid linter pattern", content: `{"python": {"extension": "py", "linter": {"cmd": "ruff", "timeout": "1s", "pattern": "("}}}`, wantErr: true},
+		{name: "linter pattern without message", content: `{"python": {"extension": "py", "linter": {"cmd": "ruff", "timeout": "1s", "pattern": "(?P<line>\\d+)"}}}`, wantErr: true},
+		{name: "LSP pool without LSP", content: `{"python": {"extension": "py", "lspPool": {"size": 1}}}`, wantErr: true},
+		{name: "negative LSP pool", content: `{"python": {"extension": "py", "lsp": ["pyright"], "lspPool": {"size": -1}}}`, wantErr: true},
+		{name: "negative memory limit", content: `{"kotlin": {"extension": "kt", "memoryLimitMB": -1}}`, wantErr: true},
+		{name: "LSP pool", content: `{"python": {"extension": "py", "lsp": ["pyright"], "lspPool": {"size": 2, "idleTimeout": "30m"}}}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := Parse([]byte(tc.content))
+			if (err != nil) != tc.wantErr {
+				t.Errorf("Parse() returned: %v, want error: %v", err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestLanguage(t *testing.T) {
+	languages, err := Parse([]byte(testLanguages))
+	if err != nil {
+		t.Fatalf("Failed to parse languages: %v", err)
+	}
+	r := New(languages)
+
+	l, ok := r.Get("python")
+	if !ok {
+		t.Fatalf("Python is missing")
+	}
+	if time.Duration(l.Timeout) != 10*time.Second {
+		t.Errorf("Wrong timeout: %v", l.Timeout)
+	}
+	if diff := cmp.Diff([]string{"run_lsp", "user_1"}, l.LSPCommand("user_1")); diff != "" {
+		t.Errorf("Wrong LSP command, -want +got:\n%v", diff)
+	}
+	if _, ok := r.Get("cobol"); ok {
+		t.Errorf("Cobol should not be supported")
+	}
+
+	want := []Info{{Name: "python", Extension: "py", Execute: true, LSP: true}}
+	if diff := cmp.Diff(want, r.List()); diff != "" {
+		t.Errorf("Wrong languages, -want +got:\n%v", diff)
+	}
+}
+
+func TestFormatterCommand(t *testing.T) {
+	f := &Formatter{
+		Cmd:      "fmt /mnt/code.go",
+		RangeCmd: "fmt --lines={start_line}:{end_line} /mnt/code.go",
+	}
+
+	for _, tc := range []struct {
+		name      string
+		formatter *Formatter
+		startLine int
+		endLine   int
+		want      string
+	}{
+		{name: "whole", formatter: f, want: "fmt /mnt/code.go"},
+		{name: "range", formatter: f, startLine: 2, endLine: 5, want: "fmt --lines=2:5 /mnt/code.go"},
+		{name: "invalid_range", formatter: f, startLine: 5, endLine: 2, want: "fmt /mnt/code.go"},
+		{name: "range_not_supported", formatter: &Formatter{Cmd: "fmt /mnt/code.go"}, startLine: 2, endLine: 5, want: "fmt /mnt/code.go"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.formatter.Command(tc.startLine, tc.endLine); got != tc.want {
+				t.Errorf("Command() = %q, want: %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMainFile(t *testing.T) {
+	java := &Language{Extension: "java", PublicClassFile: true}
+
+	for _, tc := range []struct {
+		name     string
+		language *Language
+		code     string
+		want     string
+	}{
+		{name: "default", language: &Language{Extension: "py"}, code: "public class Main {}", want: "code.py"},
+		{name: "public_class", language: java, code: "import java.util.*;\n\npublic class Solution {\n}", want: "Solution.java"},
+		{name: "modifiers", language: java, code: "class Helper {}\npublic final class App {}", want: "App.java"},
+		{name: "record", language: java, code: "public record Point(int x, int y) {}", want: "Point.java"},
+		{name: "no_public_class", language: java, code: "class Main {}", want: "code.java"},
+		{name: "main_class", language: java, code: "class Helper {}\n\nclass Main {\n  public static void main(String[] args) {}\n}\n\nclass Other {}", want: "Main.java"},
+		{name: "public_class_before_main_class", language: java, code: "class Main {\n  static void main(String... args) {}\n}\npublic class App {}", want: "App.java"},
+		{name: "nested_public_class", language: java, code: "class Main {\n  public static class Inner {}\n}", want: "code.java"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.language.MainFile(tc.code); got != tc.want {
+				t.Errorf("MainFile() = %q, want: %q", got, tc.want)
+			}
+		})
+	}
+
+	if got, want := ExpandCommand("javac /mnt/{main_file} && java {main_name}", "App.java"), "javac /mnt/App.java && java App"; got != want {
+		t.Errorf("ExpandCommand() = %q, want: %q", got, want)
+	}
+}
+
+func TestLinterDiagnostics(t *testing.T) {
+	l := &Linter{
+		Cmd:      "lint",
+		Pattern:  `^(?P<file>[^:\s]+):(?P<line>\d+):(?:(?P<column>\d+):)? (?:(?P<severity>(?i:warning|error)): )?(?P<message>.+?)(?: \[(?P<rule>[^\]]+)\])?$`,
+		Severity: "info",
+		Timeout:  Duration(time.Second),
+	}
+	if err := l.compile(); err != nil {
+		t.Fatalf("Failed to compile the pattern: %v", err)
+	}
+
+	output := strings.Join([]string{
+		"/mnt/code.cpp:3:7: warning: unused variable 'x' [clang-diagnostic-unused-variable]",
+		"1 warning generated.",
+		"./lib/util.cpp:10: ERROR: missing return",
+		"code.cpp:1:1: just a remark",
+	}, "\n")
+
+	want := []common.Diagnostic{
+		{File: "code.cpp", Line: 3, Column: 7, Severity: "warning", Message: "unused variable 'x'", Rule: "clang-diagnostic-unused-variable"},
+		{File: "lib/util.cpp", Line: 10, Severity: "error", Message: "missing return"},
+		{File: "code.cpp", Line: 1, Column: 1, Severity: "info", Message: "just a remark"},
+	}
+	if diff := cmp.Diff(want, l.Diagnostics(output)); diff != "" {
+		t.Errorf("Wrong diagnostics, -want +got:\n%v", diff)
+	}
+}
+
+func TestReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "languages.json")
+	if err := ioutil.WriteFile(path, []byte(testLanguages), 0644); err != nil {
+		t.Fatalf("Failed to write languages: %v", err)
+	}
+
+	r, err := Load(path)
+	if err != nil {
+		t.Fatalf("Failed to load languages: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go r.Watch(ctx, 10*time.Millisecond)
+
+	write := func(content string, modTime time.Time) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("Failed to write languages: %v", err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatalf("Failed to change modification time: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// Broken file keeps the previous languages.
+	write("{", time.Now().Add(time.Minute))
+	if _, ok := r.Get("python"); !ok {
+		t.Errorf("Python should be kept after failed reload")
+	}
+
+	write(`{"cpp": {"extension": "cpp"}}`, time.Now().Add(2*time.Minute))
+	if _, ok := r.Get("python"); ok {
+		t.Errorf("Python should be removed after reload")
+	}
+	if _, ok := r.Get("cpp"); !ok {
+		t.Errorf("C++ should be added after reload")
+	}
+}
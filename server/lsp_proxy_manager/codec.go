@@ -0,0 +1,270 @@
+package lsp_proxy_manager
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+const (
+	// maxMessageSize limits the content of a single message, in both
+	// directions.
+	maxMessageSize = 32 << 20
+	// maxHeaderLine and maxHeaders limit the header of a message.
+	maxHeaderLine = 1024
+	maxHeaders    = 16
+)
+
+var errMalformedHeader = errors.New("malformed LSP header")
+
+// invalidMessageError is returned for the message which was read whole, but
+// can't be passed on. The stream stays in sync, so the next message can be
+// read.
+type invalidMessageError struct {
+	reason string
+}
+
+func (e *invalidMessageError) Error() string {
+	return fmt.Sprintf("invalid LSP message: %s", e.reason)
+}
+
+func isInvalidMessage(err error) bool {
+	var e *invalidMessageError
+	return errors.As(err, &e)
+}
+
+// message is the JSON-RPC 2.0 envelope of the LSP message. The params, the
+// result and the error are kept raw.
+type message struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   json.RawMessage `json:"error,omitempty"`
+}
+
+func (m *message) isRequest() bool {
+	return m.Method != "" && len(m.ID) > 0
+}
+
+func (m *message) isNotification() bool {
+	return m.Method != "" && len(m.ID) == 0
+}
+
+func (m *message) isResponse() bool {
+	return m.Method == "" && len(m.ID) > 0
+}
+
+// String describes the message in the logs, without its contents.
+func (m *message) String() string {
+	switch {
+	case m.isRequest():
+		return fmt.Sprintf("request %s %s", m.Method, m.ID)
+	case m.isNotification():
+		return fmt.Sprintf("notification %s", m.Method)
+	}
+	return fmt.Sprintf("response %s", m.ID)
+}
+
+// parseMessage decodes the content of the message and checks that it's a
+// valid request, notification or response.
+func parseMessage(b []byte) (*message, error) {
+	if !utf8.Valid(b) {
+		return nil, &invalidMessageError{"content is not valid UTF-8"}
+	}
+	msg := &message{}
+	if err := json.Unmarshal(b, msg); err != nil {
+		return nil, &invalidMessageError{err.Error()}
+	}
+	if msg.JSONRPC != "2.0" {
+		return nil, &invalidMessageError{fmt.Sprintf("unsupported jsonrpc version %q", msg.JSONRPC)}
+	}
+	if len(msg.ID) > 0 {
+		var id interface{}
+		json.Unmarshal(msg.ID, &id)
+		switch id.(type) {
+		case string, float64, nil:
+		default:
+			return nil, &invalidMessageError{fmt.Sprintf("invalid id %s", msg.ID)}
+		}
+	}
+
+	hasResult, hasError := len(msg.Result) > 0, len(msg.Error) > 0
+	switch {
+	case msg.Method != "" && (hasResult || hasError):
+		return nil, &invalidMessageError{fmt.Sprintf("%s has a result or an error", msg.Method)}
+	case msg.Method == "" && len(msg.ID) == 0:
+		return nil, &invalidMessageError{"message has neither a method nor an id"}
+	case msg.Method == "" && hasResult == hasError:
+		return nil, &invalidMessageError{fmt.Sprintf("response %s must have either a result or an error", msg.ID)}
+	}
+	return msg, nil
+}
+
+// header holds the header fields of the message, under the canonical names,
+// so that they are matched case-insensitively.
+type header map[string]string
+
+func (h header) get(name string) string {
+	return h[textproto.CanonicalMIMEHeaderKey(name)]
+}
+
+// messageReader reads the messages framed with the LSP base protocol: the
+// header fields, an empty line and the content of Content-Length bytes.
+type messageReader struct {
+	r       *bufio.Reader
+	maxSize int64
+}
+
+func newMessageReader(r io.Reader) *messageReader {
+	return &messageReader{r: bufio.NewReader(r), maxSize: maxMessageSize}
+}
+
+func (r *messageReader) readLine() (string, error) {
+	var line []byte
+	for {
+		b, isPrefix, err := r.r.ReadLine()
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		line = append(line, b...)
+		if len(line) > maxHeaderLine {
+			return "", fmt.Errorf("%w: line longer than %d bytes", errMalformedHeader, maxHeaderLine)
+		}
+		if !isPrefix {
+			return string(line), nil
+		}
+	}
+}
+
+func (r *messageReader) readHeader() (header, error) {
+	h := header{}
+	for {
+		line, err := r.readLine()
+		if err != nil {
+			if err == io.EOF && len(h) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		if line == "" {
+			if len(h) == 0 {
+				// Tolerating the blank lines between the messages.
+				continue
+			}
+			return h, nil
+		}
+		if len(h) == maxHeaders {
+			return nil, fmt.Errorf("%w: more than %d fields", errMalformedHeader, maxHeaders)
+		}
+
+		i := strings.IndexByte(line, ':')
+		if i <= 0 {
+			return nil, fmt.Errorf("%w: %q", errMalformedHeader, line)
+		}
+		h[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(line[:i]))] = strings.TrimSpace(line[i+1:])
+	}
+}
+
+// checkContentType accepts the JSON-RPC content in UTF-8, the default.
+func checkContentType(value string) error {
+	if value == "" {
+		return nil
+	}
+	_, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return &invalidMessageError{fmt.Sprintf("invalid content type %q: %v", value, err)}
+	}
+	switch strings.ToLower(params["charset"]) {
+	// utf8 is still accepted for the backwards compatibility.
+	case "", "utf-8", "utf8":
+		return nil
+	}
+	return &invalidMessageError{fmt.Sprintf("unsupported charset %q", params["charset"])}
+}
+
+// read returns the next message. The malformed header fails the stream, as
+// it can't be resynced, while the invalid content is skipped and reported
+// with invalidMessageError.
+func (r *messageReader) read() (*message, error) {
+	h, err := r.readHeader()
+	if err != nil {
+		return nil, err
+	}
+
+	lengthValue := h.get("Content-Length")
+	if lengthValue == "" {
+		return nil, fmt.Errorf("%w: no Content-Length", errMalformedHeader)
+	}
+	length, err := strconv.ParseInt(lengthValue, 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("%w: invalid Content-Length %q", errMalformedHeader, lengthValue)
+	}
+
+	if length > r.maxSize {
+		if _, err := io.CopyN(ioutil.Discard, r.r, length); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		return nil, &invalidMessageError{fmt.Sprintf("content of %d bytes exceeds the limit of %d", length, r.maxSize)}
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if err := checkContentType(h.get("Content-Type")); err != nil {
+		return nil, err
+	}
+	return parseMessage(b)
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// messageWriter writes the framed messages, it's safe for the concurrent
+// use.
+type messageWriter struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+func newMessageWriter(w io.Writer) *messageWriter {
+	return &messageWriter{w: w}
+}
+
+func (w *messageWriter) write(msg *message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	if len(b) > maxMessageSize {
+		return &invalidMessageError{fmt.Sprintf("%s of %d bytes exceeds the limit of %d", msg, len(b), maxMessageSize)}
+	}
+
+	// A single write, so that the header and the content are not split.
+	frame := make([]byte, 0, len(b)+32)
+	frame = append(frame, fmt.Sprintf("Content-Length: %d\r\n\r\n", len(b))...)
+	frame = append(frame, b...)
+
+	w.mux.Lock()
+	defer w.mux.Unlock()
+	_, err = w.w.Write(frame)
+	return err
+}
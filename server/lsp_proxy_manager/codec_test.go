@@ -0,0 +1,172 @@
+package lsp_proxy_manager
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+)
+
+func frame(content string) string {
+	return "Content-Length: " + strconv.Itoa(len(content)) + "\r\n\r\n" + content
+}
+
+func TestMessageReader(t *testing.T) {
+	request := `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`
+	length := strconv.Itoa(len(request))
+
+	for _, tc := range []struct {
+		name  string
+		input string
+		// want lists the methods or the ids of the messages read before the
+		// error.
+		want        []string
+		wantInvalid int
+		wantErr     error
+	}{{
+		name:    "single",
+		input:   frame(request),
+		want:    []string{"initialize"},
+		wantErr: io.EOF,
+	}, {
+		name:    "case insensitive header",
+		input:   "content-length: " + length + "\r\nCONTENT-TYPE: application/vscode-jsonrpc; charset=utf-8\r\n\r\n" + request,
+		want:    []string{"initialize"},
+		wantErr: io.EOF,
+	}, {
+		name:    "legacy charset",
+		input:   "Content-Type: application/vscode-jsonrpc; charset=utf8\r\nContent-Length: " + length + "\r\n\r\n" + request,
+		want:    []string{"initialize"},
+		wantErr: io.EOF,
+	}, {
+		name:    "bare line feeds",
+		input:   "Content-Length: " + length + "\n\n" + request,
+		want:    []string{"initialize"},
+		wantErr: io.EOF,
+	}, {
+		name:    "multibyte content",
+		input:   frame(`{"jsonrpc":"2.0","method":"ząb","params":{}}`) + frame(`{"jsonrpc":"2.0","id":"a","result":null}`),
+		want:    []string{"ząb", `"a"`},
+		wantErr: io.EOF,
+	}, {
+		name:        "unsupported charset",
+		input:       "Content-Type: application/vscode-jsonrpc; charset=latin1\r\nContent-Length: " + length + "\r\n\r\n" + request + frame(request),
+		want:        []string{"initialize"},
+		wantInvalid: 1,
+		wantErr:     io.EOF,
+	}, {
+		name:        "invalid content",
+		input:       frame(`{bad}`) + frame(`{"id":1,"method":"x"}`) + frame(`{"jsonrpc":"2.0","id":1,"result":1,"error":{}}`) + frame(`{"jsonrpc":"2.0","id":{},"method":"x"}`) + frame(`{"jsonrpc":"2.0"}`) + frame("\"\xff\"") + frame(request),
+		want:        []string{"initialize"},
+		wantInvalid: 6,
+		wantErr:     io.EOF,
+	}, {
+		name:    "no content length",
+		input:   "Content-Type: application/vscode-jsonrpc\r\n\r\n" + request,
+		wantErr: errMalformedHeader,
+	}, {
+		name:    "negative content length",
+		input:   "Content-Length: -1\r\n\r\n" + request,
+		wantErr: errMalformedHeader,
+	}, {
+		name:    "overflowing content length",
+		input:   "Content-Length: 99999999999999999999\r\n\r\n" + request,
+		wantErr: errMalformedHeader,
+	}, {
+		name:    "header without colon",
+		input:   "Content-Length " + length + "\r\n\r\n" + request,
+		wantErr: errMalformedHeader,
+	}, {
+		name:    "long header line",
+		input:   "X-Padding: " + strings.Repeat("a", maxHeaderLine) + "\r\n" + frame(request),
+		wantErr: errMalformedHeader,
+	}, {
+		name:    "truncated content",
+		input:   "Content-Length: 100\r\n\r\n" + request,
+		wantErr: io.ErrUnexpectedEOF,
+	}, {
+		name:    "truncated header",
+		input:   "Content-Length: " + length + "\r\n",
+		wantErr: io.ErrUnexpectedEOF,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := newMessageReader(strings.NewReader(tc.input))
+			got := []string{}
+			invalid := 0
+			var err error
+			for {
+				var msg *message
+				msg, err = r.read()
+				if isInvalidMessage(err) {
+					invalid++
+					continue
+				}
+				if err != nil {
+					break
+				}
+				if msg.Method != "" {
+					got = append(got, msg.Method)
+				} else {
+					got = append(got, string(msg.ID))
+				}
+			}
+
+			if !errors.Is(err, tc.wantErr) {
+				t.Errorf("read() failed with %v, want %v", err, tc.wantErr)
+			}
+			if invalid != tc.wantInvalid {
+				t.Errorf("read() reported %d invalid messages, want %d", invalid, tc.wantInvalid)
+			}
+			if diff := cmp.Diff(tc.want, got, cmpopts.EquateEmpty()); diff != "" {
+				t.Errorf("read() returned wrong messages, -want +got:\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestMessageReaderMaxSize(t *testing.T) {
+	large := `{"jsonrpc":"2.0","method":"x","params":"` + strings.Repeat("a", 100) + `"}`
+	r := newMessageReader(strings.NewReader(frame(large) + frame(`{"jsonrpc":"2.0","method":"y"}`)))
+	r.maxSize = 100
+
+	if _, err := r.read(); !isInvalidMessage(err) {
+		t.Errorf("read() of the large message returned %v, want invalid message", err)
+	}
+	if msg, err := r.read(); err != nil || msg.Method != "y" {
+		t.Errorf("read() after the large message returned %v, %v, want y", msg, err)
+	}
+}
+
+func TestMessageWriter(t *testing.T) {
+	b := &bytes.Buffer{}
+	w := newMessageWriter(b)
+	for _, msg := range []*message{
+		{JSONRPC: "2.0", Method: "ząb", Params: []byte(`{"a": 1}`)},
+		{JSONRPC: "2.0", ID: []byte("7"), Result: []byte("null")},
+	} {
+		if err := w.write(msg); err != nil {
+			t.Fatalf("write(%s) failed: %v", msg, err)
+		}
+	}
+
+	want := frame(`{"jsonrpc":"2.0","method":"ząb","params":{"a":1}}`) + frame(`{"jsonrpc":"2.0","id":7,"result":null}`)
+	if diff := cmp.Diff(want, b.String()); diff != "" {
+		t.Errorf("write() wrote wrong frames, -want +got:\n%v", diff)
+	}
+
+	r := newMessageReader(b)
+	for _, want := range []string{"ząb", "7"} {
+		msg, err := r.read()
+		if err != nil {
+			t.Fatalf("read() failed: %v", err)
+		}
+		if got := msg.Method + string(msg.ID); got != want {
+			t.Errorf("read() returned %s, want %s", got, want)
+		}
+	}
+}
@@ -1,53 +1,61 @@
 package lsp_proxy_manager
 
 import (
-	"bufio"
 	"context"
+	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"os"
 	"os/exec"
-	"strconv"
-	"strings"
 	"sync"
-	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/pasiasty/cocoder/server/language_registry"
+	"github.com/pasiasty/cocoder/server/session_manager"
 	"github.com/pasiasty/cocoder/server/users_manager"
 )
 
 type LSPProxyManager struct {
+	languages   *language_registry.Registry
+	sm          *session_manager.SessionManager
 	connections map[users_manager.UserID]*Connection
+
+	sharedMux sync.Mutex
+	shared    map[sharedKey]*sharedServer
+
+	poolMux    sync.Mutex
+	pools      map[string]*languagePool
+	poolRefill chan struct{}
+
+	// newCommand starts the language server for the id, it's replaced in
+	// tests.
+	newCommand func(l *language_registry.Language, id string) *exec.Cmd
 }
 
-func New() *LSPProxyManager {
-	return &LSPProxyManager{
+func New(languages *language_registry.Registry, sm *session_manager.SessionManager) *LSPProxyManager {
+	m := &LSPProxyManager{
+		languages:   languages,
+		sm:          sm,
 		connections: make(map[users_manager.UserID]*Connection),
+		shared:      make(map[sharedKey]*sharedServer),
+		newCommand:  languageServerCommand,
+		pools:       make(map[string]*languagePool),
+		poolRefill:  make(chan struct{}, 1),
 	}
+	sm.AddUpdateListener(m.sessionUpdated)
+	return m
 }
 
-func execInContainer(entrypoint string, extraArgs ...string) *exec.Cmd {
+func execInContainer(image, entrypoint string, extraArgs ...string) *exec.Cmd {
 	args := []string{
-		"run", "--rm", "-i", "mpasek/cocoder-executor", entrypoint,
+		"run", "--rm", "-i", image, entrypoint,
 	}
 	args = append(args, extraArgs...)
 	return exec.Command("docker", args...)
 }
 
-func initialCommand(userID users_manager.UserID, language string) (*exec.Cmd, error) {
-
-	switch language {
-	case "python":
-		return execInContainer("/usr/local/bin/pyright-python-langserver", "--stdio"), nil
-	case "cpp":
-		return execInContainer("clangd"), nil
-	case "go":
-		return execInContainer("/usr/local/bin/run_gopls", string(userID)), nil
-	case "java":
-		return execInContainer("/usr/local/bin/run_jdtls", string(userID)), nil
-	}
-	return nil, fmt.Errorf("language: %s is not supported", language)
+func languageServerCommand(l *language_registry.Language, id string) *exec.Cmd {
+	args := l.LSPCommand(id)
+	return execInContainer(l.Image, args[0], args[1:]...)
 }
 
 type Connection struct {
@@ -57,42 +65,96 @@ type Connection struct {
 	userID   users_manager.UserID
 	language string
 
-	stdin  io.Writer
-	stdout *bufio.Reader
+	server *languageServer
+	// clientURIs and serverURIs are the workspaces of the user and of the
+	// pooled server, which is started for another id.
+	clientURIs uriMapping
+	serverURIs uriMapping
+}
 
-	process *os.Process
+func (c *Connection) pooled() bool {
+	return c.server.initResult != nil
 }
 
-func (c *Connection) passToServerLoop(ctx context.Context) {
-	defer c.close()
+func (c *Connection) send(msg *message) error {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(10 * time.Millisecond):
-			mt, msg, err := c.conn.ReadMessage()
-			if err != nil {
-				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
-					log.Printf("Unexpected websocket error: %v", err)
-				}
-				return
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	return c.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+// fromClient tells whether the message of the client is passed to the pooled
+// server, rewriting it. The server is already initialized, so the client gets
+// the result of the pool's initialize request, and its initialization options
+// are passed as the configuration. Once the client is initialized, it gets the
+// registrations the server has made while pooled.
+func (c *Connection) fromClient(msg *message) bool {
+	if isReplayedRegistration(msg) {
+		return false
+	}
+
+	switch msg.Method {
+	case "initialize":
+		if err := c.send(&message{JSONRPC: "2.0", ID: msg.ID, Result: c.serverURIs.rewriteRaw(c.server.initResult, c.clientURIs)}); err != nil {
+			log.Printf("Failed to send the initialize result: %v", err)
+		}
+		if config := configuration(msg); config != nil {
+			config.Params = c.clientURIs.rewriteRaw(config.Params, c.serverURIs)
+			if err := c.server.send(config); err != nil {
+				log.Printf("Failed to pass the initialization options to the language server: %v", err)
 			}
-			if mt == websocket.PingMessage {
-				c.mux.Lock()
-				if err := c.conn.WriteMessage(websocket.PongMessage, nil); err != nil {
-					log.Printf("Failed to write pong: %v", err)
-				}
-				c.mux.Unlock()
-				continue
+		}
+		return false
+	case "initialized":
+		for _, reg := range c.server.replayedRegistrations() {
+			c.fromServer(reg)
+			if err := c.send(reg); err != nil {
+				log.Printf("Failed to replay %s: %v", reg, err)
 			}
+		}
+		return false
+	}
+
+	msg.Params = c.clientURIs.rewriteRaw(msg.Params, c.serverURIs)
+	msg.Result = c.clientURIs.rewriteRaw(msg.Result, c.serverURIs)
+	return true
+}
+
+// fromServer rewrites the message of the pooled server for the client.
+func (c *Connection) fromServer(msg *message) {
+	msg.Params = c.serverURIs.rewriteRaw(msg.Params, c.clientURIs)
+	msg.Result = c.serverURIs.rewriteRaw(msg.Result, c.clientURIs)
+}
 
-			msgEnc := fmt.Sprintf("%v", string(msg))
+func (c *Connection) passToServerLoop(ctx context.Context) {
+	defer c.close()
 
-			reqStanza := "Content-Length: %v\r\n" + "Content-Type: application/vscode-jsonrpc; charset=utf8\r\n\r\n%v"
+	for ctx.Err() == nil {
+		_, b, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+				log.Printf("Unexpected websocket error: %v", err)
+			}
+			return
+		}
 
-			req := fmt.Sprintf(reqStanza, len(msgEnc), msgEnc)
-			c.stdin.Write([]byte(req))
+		msg, err := parseMessage(b)
+		if err != nil {
+			log.Printf("Dropping LSP message of user %q: %v", c.userID, err)
+			continue
+		}
+		if c.pooled() && !c.fromClient(msg) {
+			continue
+		}
+		if err := c.server.send(msg); err != nil {
+			log.Printf("Failed to pass %s to the language server: %v", msg, err)
+			if !isInvalidMessage(err) {
+				return
+			}
 		}
 	}
 }
@@ -104,56 +166,28 @@ func (c *Connection) readFromServerLoop(ctx context.Context) {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(10 * time.Millisecond):
-			line, err := c.stdout.ReadString('\n')
-			if err != nil {
-				log.Printf("Failed to read from stdout: %v\n", err)
-			}
-			prefix := "Content-Length: "
-			if !strings.HasPrefix(line, prefix) {
-				fmt.Printf("First line got unexpected format: %q\n", line)
-				continue
-			}
-			respLen, err := strconv.ParseInt(strings.TrimSpace(line[len(prefix):]), 10, 32)
-			if err != nil {
-				fmt.Printf("Failed to parse content length: %v\n", err)
-			}
-
-			for strings.TrimSpace(line) != "" {
-				line, err = c.stdout.ReadString('\n')
-				if err != nil {
-					break
-				}
+		case msg, ok := <-c.server.messages:
+			if !ok {
+				return
 			}
-			if err != nil {
-				log.Printf("Failed while skipping headers: %v\n", err)
-				continue
+			if c.pooled() {
+				c.fromServer(msg)
 			}
 
-			resp := make([]byte, respLen)
-
-			if _, err := io.ReadFull(c.stdout, resp); err != nil {
-				log.Printf("Failed to get the response: %v\n", err)
-				continue
-			}
-
-			c.mux.Lock()
-			if err := c.conn.WriteMessage(websocket.TextMessage, resp); err != nil {
-				log.Printf("Failed to send the response to the websocket: %v\n", err)
-				c.mux.Unlock()
+			if err := c.send(msg); err != nil {
+				log.Printf("Failed to pass %s to the websocket: %v", msg, err)
 				return
 			}
-			c.mux.Unlock()
 		}
 	}
 }
 
 func (c *Connection) close() {
 	log.Printf("closing LSP connection for user: %q language: %q\n", c.userID, c.language)
+	c.server.kill()
+
 	c.mux.Lock()
 	defer c.mux.Unlock()
-
-	c.process.Kill()
 	c.conn.Close()
 }
 
@@ -161,36 +195,43 @@ func (m *LSPProxyManager) Dispose() {
 	for _, c := range m.connections {
 		c.close()
 	}
+
+	m.sharedMux.Lock()
+	shared := []*sharedServer{}
+	for _, s := range m.shared {
+		shared = append(shared, s)
+	}
+	m.sharedMux.Unlock()
+	for _, s := range shared {
+		s.close()
+	}
+	m.drainPools()
 }
 
 func (m *LSPProxyManager) Connect(ctx context.Context, conn *websocket.Conn, language string, userID users_manager.UserID) error {
-	cmd, err := initialCommand(userID, language)
-	if err != nil {
-		return err
+	l, ok := m.languages.Get(language)
+	if !ok || len(l.LSP) == 0 {
+		return fmt.Errorf("language: %s is not supported", language)
 	}
 
-	c := &Connection{
-		userID:   userID,
-		language: language,
-		conn:     conn,
+	server := m.acquireServer(l)
+	if server == nil {
+		var err error
+		if server, err = m.startServer(l, string(userID)); err != nil {
+			return err
+		}
 	}
 
-	stdoutReader, stdoutWriter := io.Pipe()
-	cmd.Stdout = stdoutWriter
-	c.stdout = bufio.NewReader(stdoutReader)
-
-	stdinReader, stdinWriter := io.Pipe()
-	cmd.Stdin = stdinReader
-	c.stdin = stdinWriter
-
-	cmd.Stderr = os.Stdout
-
-	if err := cmd.Start(); err != nil {
-		return err
+	conn.SetReadLimit(maxMessageSize)
+	c := &Connection{
+		userID:     userID,
+		language:   language,
+		conn:       conn,
+		server:     server,
+		clientURIs: uriMapping{root: workspaceURI(language, string(userID))},
+		serverURIs: uriMapping{root: workspaceURI(language, server.id)},
 	}
 
-	c.process = cmd.Process
-
 	go c.passToServerLoop(ctx)
 	go c.readFromServerLoop(ctx)
 
@@ -199,3 +240,77 @@ func (m *LSPProxyManager) Connect(ctx context.Context, conn *websocket.Conn, lan
 	log.Printf("Opened LSP connection for user: %q language: %q\n", c.userID, c.language)
 	return nil
 }
+
+// ConnectShared connects the user to the language server shared by all the
+// participants of the session, starting it if needed.
+func (m *LSPProxyManager) ConnectShared(conn *websocket.Conn, sessionID session_manager.SessionID, language string, userID users_manager.UserID) error {
+	key := sharedKey{sessionID: sessionID, language: language}
+
+	// The server may be closed by its last client leaving in the meantime.
+	for {
+		s, err := m.sharedServer(key)
+		if err != nil {
+			return err
+		}
+		if s.connect(conn, userID) {
+			break
+		}
+	}
+
+	log.Printf("Opened shared LSP connection for user: %q session: %q language: %q\n", userID, sessionID, language)
+	return nil
+}
+
+// sharedServer returns the shared server of the key, starting it if needed.
+// The server is started without holding the lock, which would block the
+// session updates, so the one started concurrently may be used instead.
+func (m *LSPProxyManager) sharedServer(key sharedKey) (*sharedServer, error) {
+	m.sharedMux.Lock()
+	s, ok := m.shared[key]
+	m.sharedMux.Unlock()
+	if ok {
+		return s, nil
+	}
+
+	started, err := m.newSharedServer(key)
+	if err != nil {
+		return nil, err
+	}
+
+	m.sharedMux.Lock()
+	if s, ok = m.shared[key]; !ok {
+		s = started
+		m.shared[key] = s
+	}
+	m.sharedMux.Unlock()
+
+	if s != started {
+		started.close()
+	}
+	return s, nil
+}
+
+func (m *LSPProxyManager) forgetShared(key sharedKey, s *sharedServer) {
+	m.sharedMux.Lock()
+	defer m.sharedMux.Unlock()
+
+	if m.shared[key] == s {
+		delete(m.shared, key)
+	}
+}
+
+// sessionUpdated passes the new state of the session to its shared servers.
+func (m *LSPProxyManager) sessionUpdated(sessionID session_manager.SessionID, sess *session_manager.Session) {
+	m.sharedMux.Lock()
+	servers := []*sharedServer{}
+	for key, s := range m.shared {
+		if key.sessionID == sessionID {
+			servers = append(servers, s)
+		}
+	}
+	m.sharedMux.Unlock()
+
+	for _, s := range servers {
+		s.update(document{text: sess.Text, language: sess.Language, revision: sess.Revision})
+	}
+}
@@ -0,0 +1,274 @@
+package lsp_proxy_manager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/gorilla/websocket"
+
+	"github.com/pasiasty/cocoder/server/language_registry"
+	"github.com/pasiasty/cocoder/server/session_manager"
+	"github.com/pasiasty/cocoder/server/users_manager"
+)
+
+const fakeServerEnv = "COCODER_FAKE_LANGUAGE_SERVER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(fakeServerEnv) != "" {
+		runFakeLanguageServer()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+type fakeDocument struct {
+	URI  string `json:"uri"`
+	Text string `json:"text"`
+}
+
+type fakeState struct {
+	Root            string          `json:"root"`
+	Initializations int             `json:"initializations"`
+	Initialized     int             `json:"initialized"`
+	Documents       []fakeDocument  `json:"documents"`
+	Settings        json.RawMessage `json:"settings,omitempty"`
+	Registered      int             `json:"registered,omitempty"`
+}
+
+// runFakeLanguageServer serves the language server used in the tests. It
+// publishes the text of the document as its diagnostic, reports its state on
+// fake/state, asks the client on fake/ask and writes an invalid message
+// before the response on fake/garbage. The initialize request with the fail
+// option is slowly rejected. On fake/flood it stops reading for a while and
+// then writes more than the pipe holds. The clients supporting the dynamic
+// registration get the watched files registered, before the initialize
+// result, and the answers are counted.
+func runFakeLanguageServer() {
+	r := newMessageReader(os.Stdin)
+	w := newMessageWriter(os.Stdout)
+	state := fakeState{}
+	docs := map[string]string{}
+	var ask json.RawMessage
+
+	send := func(msg *message) {
+		msg.JSONRPC = "2.0"
+		w.write(msg)
+	}
+	publish := func(uri, text string) {
+		params, _ := json.Marshal(map[string]interface{}{
+			"uri":         uri,
+			"diagnostics": []map[string]string{{"message": text}},
+		})
+		send(&message{Method: "textDocument/publishDiagnostics", Params: params})
+	}
+
+	for {
+		msg, err := r.read()
+		if err != nil {
+			return
+		}
+
+		params := struct {
+			RootURI               string `json:"rootUri"`
+			InitializationOptions struct {
+				Fail bool `json:"fail"`
+			} `json:"initializationOptions"`
+			Capabilities struct {
+				Workspace struct {
+					DidChangeWatchedFiles struct {
+						DynamicRegistration bool `json:"dynamicRegistration"`
+					} `json:"didChangeWatchedFiles"`
+				} `json:"workspace"`
+			} `json:"capabilities"`
+			TextDocument   fakeDocument    `json:"textDocument"`
+			ContentChanges []fakeDocument  `json:"contentChanges"`
+			Settings       json.RawMessage `json:"settings"`
+		}{}
+		json.Unmarshal(msg.Params, &params)
+
+		switch msg.Method {
+		case "initialize":
+			if params.InitializationOptions.Fail {
+				time.Sleep(500 * time.Millisecond)
+				send(&message{ID: msg.ID, Error: json.RawMessage(`{"code":-32603,"message":"failed"}`)})
+				continue
+			}
+			state.Initializations++
+			state.Root = params.RootURI
+			if params.Capabilities.Workspace.DidChangeWatchedFiles.DynamicRegistration {
+				send(&message{ID: json.RawMessage(`"register"`), Method: "client/registerCapability", Params: json.RawMessage(
+					`{"registrations":[{"id":"watch","method":"workspace/didChangeWatchedFiles","registerOptions":{"watchers":[{"globPattern":"` + params.RootURI + `**/*.py"}]}}]}`)})
+			}
+			send(&message{ID: msg.ID, Result: json.RawMessage(`{"capabilities":{"textDocumentSync":1}}`)})
+		case "initialized":
+			state.Initialized++
+		case "textDocument/didOpen":
+			docs[params.TextDocument.URI] = params.TextDocument.Text
+			publish(params.TextDocument.URI, params.TextDocument.Text)
+		case "textDocument/didChange":
+			docs[params.TextDocument.URI] = params.ContentChanges[0].Text
+			publish(params.TextDocument.URI, params.ContentChanges[0].Text)
+		case "workspace/didChangeConfiguration":
+			state.Settings = params.Settings
+		case "textDocument/didClose":
+			delete(docs, params.TextDocument.URI)
+		case "fake/state":
+			state.Documents = nil
+			for uri, text := range docs {
+				state.Documents = append(state.Documents, fakeDocument{URI: uri, Text: text})
+			}
+			result, _ := json.Marshal(state)
+			send(&message{ID: msg.ID, Result: result})
+		case "fake/garbage":
+			os.Stdout.Write([]byte("Content-Length: 5\r\n\r\n{bad}"))
+			send(&message{ID: msg.ID, Result: json.RawMessage(`"ok"`)})
+		case "fake/flood":
+			time.Sleep(200 * time.Millisecond)
+			for i := 0; i < 100; i++ {
+				publish("file:///flood", strings.Repeat("x", 4096))
+			}
+			send(&message{ID: msg.ID, Result: json.RawMessage(`"ok"`)})
+		case "fake/ask":
+			ask = msg.ID
+			send(&message{ID: json.RawMessage(`"question"`), Method: "fake/question", Params: json.RawMessage(`{}`)})
+		case "":
+			if string(msg.ID) == `"question"` {
+				send(&message{ID: ask, Result: msg.Result})
+			}
+			if string(msg.ID) == `"register"` {
+				state.Registered++
+			}
+		}
+	}
+}
+
+// prepareManager returns the manager of the fake python language server,
+// served by srv to the clients dialed with dial.
+func prepareManager(t *testing.T, pool *language_registry.LSPPool) (*LSPProxyManager, *session_manager.SessionManager, *httptest.Server) {
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Failed to setup miniredis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+	sm := session_manager.NewSessionManager(session_manager.NewRedisStore(redis.NewClient(&redis.Options{
+		Addr: mr.Addr(),
+	})))
+
+	m := New(language_registry.New(map[string]*language_registry.Language{
+		"python": {Name: "python", Extension: "py", LSP: []string{"fake"}, LSPPool: pool},
+	}), sm)
+	m.newCommand = func(l *language_registry.Language, id string) *exec.Cmd {
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), fakeServerEnv+"=1")
+		return cmd
+	}
+
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		q := r.URL.Query()
+		userID := users_manager.UserID(q.Get("user_id"))
+		if sessionID := q.Get("session_id"); sessionID != "" {
+			err = m.ConnectShared(conn, session_manager.SessionID(sessionID), "python", userID)
+		} else {
+			err = m.Connect(context.Background(), conn, "python", userID)
+		}
+		if err != nil {
+			t.Errorf("Connect failed: %v", err)
+			conn.Close()
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	return m, sm, srv
+}
+
+func dial(t *testing.T, srv *httptest.Server, sessionID session_manager.SessionID, userID string) *websocket.Conn {
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/?session_id=" + string(sessionID) + "&user_id=" + userID
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	return conn
+}
+
+func sendMessage(t *testing.T, conn *websocket.Conn, msg string) {
+	if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+		t.Fatalf("Failed to send %s: %v", msg, err)
+	}
+}
+
+// waitForMessage skips the messages until the one matching the predicate.
+func waitForMessage(t *testing.T, conn *websocket.Conn, desc string, match func(*message) bool) *message {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatalf("Failed to receive %s: %v", desc, err)
+		}
+		msg := &message{}
+		if err := json.Unmarshal(b, msg); err != nil {
+			t.Fatalf("Received invalid message %s: %v", b, err)
+		}
+		if match(msg) {
+			return msg
+		}
+	}
+}
+
+func waitForResponse(t *testing.T, conn *websocket.Conn, id string) *message {
+	t.Helper()
+	return waitForMessage(t, conn, "response "+id, func(msg *message) bool {
+		return msg.isResponse() && string(msg.ID) == id
+	})
+}
+
+func waitForDiagnostic(t *testing.T, conn *websocket.Conn, uri, text string) {
+	t.Helper()
+	want := `{"diagnostics":[{"message":"` + text + `"}],"uri":"` + uri + `"}`
+	waitForMessage(t, conn, "diagnostic "+want, func(msg *message) bool {
+		return msg.Method == "textDocument/publishDiagnostics" && string(msg.Params) == want
+	})
+}
+
+func TestConnect(t *testing.T) {
+	_, _, srv := prepareManager(t, nil)
+
+	conn := dial(t, srv, "", "u")
+	defer conn.Close()
+
+	sendMessage(t, conn, `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"rootUri":"`+workspaceURI("python", "u")+`"}}`)
+	if got := waitForResponse(t, conn, "1"); string(got.Result) != `{"capabilities":{"textDocumentSync":1}}` {
+		t.Errorf("Got initialize result %s", got.Result)
+	}
+
+	// The invalid messages are skipped, both of the client and the server.
+	sendMessage(t, conn, `{"jsonrpc":"1.0","id":2,"method":"fake/state"}`)
+	sendMessage(t, conn, `{"jsonrpc":"2.0","id":3,"method":"fake/garbage"}`)
+	if got := waitForResponse(t, conn, "3"); string(got.Result) != `"ok"` {
+		t.Errorf("fake/garbage got result %s, want \"ok\"", got.Result)
+	}
+
+	sendMessage(t, conn, `{"jsonrpc":"2.0","id":4,"method":"fake/state","params":{}}`)
+	got := fakeState{}
+	if err := json.Unmarshal(waitForResponse(t, conn, "4").Result, &got); err != nil {
+		t.Fatalf("Invalid state: %v", err)
+	}
+	if want := (fakeState{Root: workspaceURI("python", "u"), Initializations: 1}); !reflect.DeepEqual(want, got) {
+		t.Errorf("Got state %+v, want %+v", got, want)
+	}
+}
@@ -0,0 +1,344 @@
+package lsp_proxy_manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pasiasty/cocoder/server/language_registry"
+)
+
+var (
+	// poolCheckInterval is how often the pools are refilled and reaped,
+	// besides refilling after every handout.
+	poolCheckInterval = 10 * time.Second
+	// poolInitTimeout limits the initialization of the pooled servers.
+	poolInitTimeout = 2 * time.Minute
+)
+
+// poolInitID is the id of the initialize request sent by the pool.
+const poolInitID = `"cocoder-pool-initialize"`
+
+// poolRegistrationID prefixes the ids of the registrations replayed to the
+// client taking the pooled server. The pool has already answered them, so the
+// responses of the client are dropped.
+const poolRegistrationID = "cocoder-pool-registration-"
+
+// poolClientCapabilities are announced to the pooled servers on behalf of the
+// clients they are handed to later, they match the capabilities of the
+// Monaco language client.
+const poolClientCapabilities = `{
+	"workspace": {
+		"applyEdit": true,
+		"workspaceEdit": {"documentChanges": true},
+		"didChangeConfiguration": {"dynamicRegistration": true},
+		"didChangeWatchedFiles": {"dynamicRegistration": true},
+		"symbol": {"dynamicRegistration": true},
+		"executeCommand": {"dynamicRegistration": true},
+		"configuration": true,
+		"workspaceFolders": true
+	},
+	"textDocument": {
+		"publishDiagnostics": {"relatedInformation": true},
+		"synchronization": {"dynamicRegistration": true, "willSave": true, "willSaveWaitUntil": true, "didSave": true},
+		"completion": {
+			"dynamicRegistration": true,
+			"contextSupport": true,
+			"completionItem": {"snippetSupport": true, "commitCharactersSupport": true, "documentationFormat": ["markdown", "plaintext"], "deprecatedSupport": true}
+		},
+		"hover": {"dynamicRegistration": true, "contentFormat": ["markdown", "plaintext"]},
+		"signatureHelp": {"dynamicRegistration": true, "signatureInformation": {"documentationFormat": ["markdown", "plaintext"]}},
+		"definition": {"dynamicRegistration": true},
+		"references": {"dynamicRegistration": true},
+		"documentHighlight": {"dynamicRegistration": true},
+		"documentSymbol": {"dynamicRegistration": true, "hierarchicalDocumentSymbolSupport": true},
+		"codeAction": {"dynamicRegistration": true},
+		"formatting": {"dynamicRegistration": true},
+		"rangeFormatting": {"dynamicRegistration": true},
+		"rename": {"dynamicRegistration": true}
+	}
+}`
+
+// configuration returns the workspace/didChangeConfiguration notification with
+// the initialization options of the client's initialize request, which the
+// pooled server was initialized without, or nil if there are none.
+func configuration(initialize *message) *message {
+	params := struct {
+		InitializationOptions json.RawMessage `json:"initializationOptions"`
+	}{}
+	if err := json.Unmarshal(initialize.Params, &params); err != nil || len(params.InitializationOptions) == 0 || string(params.InitializationOptions) == "null" {
+		return nil
+	}
+	b, err := json.Marshal(map[string]json.RawMessage{"settings": params.InitializationOptions})
+	if err != nil {
+		return nil
+	}
+	return &message{JSONRPC: "2.0", Method: "workspace/didChangeConfiguration", Params: b}
+}
+
+// isRegistration tells whether the request of the server changes the
+// capabilities registered with the client.
+func isRegistration(msg *message) bool {
+	return msg.Method == "client/registerCapability" || msg.Method == "client/unregisterCapability"
+}
+
+// replayedRegistrations returns the registrations made by the server while it
+// was pooled, as the requests to the client which has taken it.
+func (s *languageServer) replayedRegistrations() []*message {
+	res := make([]*message, len(s.registrations))
+	for i, r := range s.registrations {
+		reg := *r
+		reg.ID = json.RawMessage(strconv.Quote(poolRegistrationID + strconv.Itoa(i)))
+		res[i] = &reg
+	}
+	return res
+}
+
+// isReplayedRegistration tells whether the message of the client answers the
+// replayed registration.
+func isReplayedRegistration(msg *message) bool {
+	return msg.isResponse() && strings.HasPrefix(string(msg.ID), `"`+poolRegistrationID)
+}
+
+// pooledServer is the language server waiting in the pool, its messages are
+// handled by the pool until it's handed out.
+type pooledServer struct {
+	*languageServer
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// languagePool holds the servers of a single language.
+type languagePool struct {
+	ready []*pooledServer
+	// starting counts the servers being initialized.
+	starting int
+	// lastUsed is when a server of the language was last needed.
+	lastUsed time.Time
+}
+
+// StartPool keeps the idle language servers of the languages with the LSP
+// pool, until the context is done.
+func (m *LSPProxyManager) StartPool(ctx context.Context) {
+	interval := poolCheckInterval
+	go func() {
+		for {
+			m.maintainPools()
+
+			select {
+			case <-ctx.Done():
+				m.drainPools()
+				return
+			case <-m.poolRefill:
+			case <-time.After(interval):
+			}
+		}
+	}()
+}
+
+func (m *LSPProxyManager) languagePool(language string) *languagePool {
+	p, ok := m.pools[language]
+	if !ok {
+		p = &languagePool{lastUsed: time.Now()}
+		m.pools[language] = p
+	}
+	return p
+}
+
+// maintainPools starts the missing servers of the languages in demand and
+// stops the servers of the languages not used for their idle timeout.
+func (m *LSPProxyManager) maintainPools() {
+	m.poolMux.Lock()
+	defer m.poolMux.Unlock()
+
+	configs := make(map[string]*language_registry.Language)
+	for _, info := range m.languages.List() {
+		if l, ok := m.languages.Get(info.Name); ok && l.LSPPool != nil && len(l.LSP) > 0 {
+			configs[l.Name] = l
+		}
+	}
+
+	for language, p := range m.pools {
+		l := configs[language]
+		size := 0
+		if l != nil {
+			size = l.LSPPool.Size
+			if timeout := time.Duration(l.LSPPool.IdleTimeout); timeout > 0 && time.Since(p.lastUsed) > timeout {
+				size = 0
+			}
+		}
+		for len(p.ready) > size {
+			s := p.ready[0]
+			p.ready = p.ready[1:]
+			log.Printf("Stopping idle %s language server %q", language, s.id)
+			go s.release()
+		}
+	}
+
+	for language, l := range configs {
+		p := m.languagePool(language)
+		if timeout := time.Duration(l.LSPPool.IdleTimeout); timeout > 0 && time.Since(p.lastUsed) > timeout {
+			continue
+		}
+		for ; len(p.ready)+p.starting < l.LSPPool.Size; p.starting++ {
+			go m.warmUp(l)
+		}
+	}
+}
+
+// drainPools stops all the idle servers.
+func (m *LSPProxyManager) drainPools() {
+	m.poolMux.Lock()
+	defer m.poolMux.Unlock()
+
+	for _, p := range m.pools {
+		for _, s := range p.ready {
+			go s.release()
+		}
+		p.ready = nil
+	}
+}
+
+// release stops handling the messages of the idle server and kills it.
+func (s *pooledServer) release() {
+	close(s.stop)
+	<-s.stopped
+	s.kill()
+}
+
+// warmUp starts and initializes the server of the language, which is then
+// added to the pool.
+func (m *LSPProxyManager) warmUp(l *language_registry.Language) {
+	id := fmt.Sprintf("pool-%s", uuid.New().String())
+	server, err := m.startServer(l, id)
+	if err != nil {
+		log.Printf("Failed to start pooled %s language server: %v", l.Name, err)
+		m.poolMux.Lock()
+		m.languagePool(l.Name).starting--
+		m.poolMux.Unlock()
+		return
+	}
+
+	s := &pooledServer{languageServer: server, stop: make(chan struct{}), stopped: make(chan struct{})}
+	go m.serveIdle(s, workspaceURI(l.Name, id))
+}
+
+// serveIdle initializes the pooled server and then answers its requests, until
+// it's handed out or stopped.
+func (m *LSPProxyManager) serveIdle(s *pooledServer, root string) {
+	defer close(s.stopped)
+
+	ready := false
+	fail := func(format string, args ...interface{}) {
+		select {
+		case <-s.stop:
+			// Handed out meanwhile, the new owner sees the failure.
+			return
+		default:
+		}
+		log.Printf("Pooled %s language server %q failed: %s", s.language, s.id, fmt.Sprintf(format, args...))
+
+		m.poolMux.Lock()
+		p := m.languagePool(s.language)
+		if ready {
+			for i, o := range p.ready {
+				if o == s {
+					p.ready = append(p.ready[:i], p.ready[i+1:]...)
+					break
+				}
+			}
+		} else {
+			p.starting--
+		}
+		m.poolMux.Unlock()
+
+		go s.kill()
+	}
+
+	params := fmt.Sprintf(`{"processId":null,"rootUri":%q,"workspaceFolders":[{"uri":%q,"name":%q}],"capabilities":%s}`, root, root, s.id, poolClientCapabilities)
+	if err := s.send(&message{JSONRPC: "2.0", ID: json.RawMessage(poolInitID), Method: "initialize", Params: json.RawMessage(params)}); err != nil {
+		fail("sending initialize: %v", err)
+		return
+	}
+
+	initTimeout := time.After(poolInitTimeout)
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-initTimeout:
+			fail("initialization timed out")
+			return
+		case msg, ok := <-s.messages:
+			if !ok {
+				fail("exited")
+				return
+			}
+
+			switch {
+			case msg.isResponse() && string(msg.ID) == poolInitID:
+				if msg.Error != nil {
+					fail("initialize: %s", msg.Error)
+					return
+				}
+				s.initResult = msg.Result
+				if err := s.send(&message{JSONRPC: "2.0", Method: "initialized", Params: json.RawMessage("{}")}); err != nil {
+					fail("sending initialized: %v", err)
+					return
+				}
+
+				m.poolMux.Lock()
+				p := m.languagePool(s.language)
+				p.starting--
+				p.ready = append(p.ready, s)
+				m.poolMux.Unlock()
+
+				ready, initTimeout = true, nil
+				log.Printf("Pooled %s language server %q is ready", s.language, s.id)
+			case msg.isRequest():
+				// Nobody is there to answer, e.g. workspace/configuration.
+				// The registrations are replayed to the client taking the
+				// server, which would miss the capabilities otherwise.
+				if isRegistration(msg) {
+					s.registrations = append(s.registrations, msg)
+				}
+				s.send(&message{JSONRPC: "2.0", ID: msg.ID, Result: json.RawMessage("null")})
+			}
+		}
+	}
+}
+
+// acquireServer hands out the initialized server of the language, or returns
+// nil if there is none ready. The pool is refilled in the background.
+func (m *LSPProxyManager) acquireServer(l *language_registry.Language) *languageServer {
+	if l.LSPPool == nil {
+		return nil
+	}
+
+	m.poolMux.Lock()
+	p := m.languagePool(l.Name)
+	p.lastUsed = time.Now()
+	var s *pooledServer
+	if len(p.ready) > 0 {
+		s = p.ready[0]
+		p.ready = p.ready[1:]
+	}
+	m.poolMux.Unlock()
+
+	select {
+	case m.poolRefill <- struct{}{}:
+	default:
+	}
+
+	if s == nil {
+		return nil
+	}
+	close(s.stop)
+	<-s.stopped
+	return s.languageServer
+}
@@ -0,0 +1,166 @@
+package lsp_proxy_manager
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
+
+	"github.com/pasiasty/cocoder/server/common"
+	"github.com/pasiasty/cocoder/server/language_registry"
+)
+
+// readyServers returns the ids of the idle servers of the python pool.
+func readyServers(m *LSPProxyManager) []string {
+	m.poolMux.Lock()
+	defer m.poolMux.Unlock()
+
+	ids := []string{}
+	if p, ok := m.pools["python"]; ok {
+		for _, s := range p.ready {
+			ids = append(ids, s.id)
+		}
+	}
+	return ids
+}
+
+func waitForReadyServers(t *testing.T, m *LSPProxyManager, n int) []string {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		ids := readyServers(m)
+		if len(ids) == n {
+			return ids
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Pool has %d ready servers, want %d", len(ids), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// answerRegistration answers the registration of the watched files in the
+// workspace, which the client gets from the pooled server.
+func answerRegistration(t *testing.T, conn *websocket.Conn, root string) {
+	t.Helper()
+	reg := waitForMessage(t, conn, "registration", func(msg *message) bool {
+		return msg.Method == "client/registerCapability"
+	})
+	if !strings.HasPrefix(string(reg.ID), `"`+poolRegistrationID) {
+		t.Errorf("Registration has the id of the server: %s", reg.ID)
+	}
+	if !strings.Contains(string(reg.Params), `"globPattern":"`+root+`**/*.py"`) {
+		t.Errorf("Registration isn't in the workspace of the client: %s", reg.Params)
+	}
+	sendMessage(t, conn, `{"jsonrpc":"2.0","id":`+string(reg.ID)+`,"result":null}`)
+}
+
+func TestPool(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, sm, srv := prepareManager(t, &language_registry.LSPPool{Size: 1})
+	m.StartPool(ctx)
+	pooled := waitForReadyServers(t, m, 1)[0]
+
+	conn := dial(t, srv, "", "u")
+	defer conn.Close()
+
+	// The client gets the result of the initialization done by the pool, its
+	// options are passed as the configuration.
+	settings := `{"extraPaths":["` + workspaceURI("python", "u") + `lib"]}`
+	sendMessage(t, conn, `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"rootUri":"`+workspaceURI("python", "u")+`","initializationOptions":`+settings+`}}`)
+	if got := waitForResponse(t, conn, "1"); string(got.Result) != `{"capabilities":{"textDocumentSync":1}}` {
+		t.Errorf("Got initialize result %s", got.Result)
+	}
+	sendMessage(t, conn, `{"jsonrpc":"2.0","method":"initialized","params":{}}`)
+
+	// The registration answered by the pool is replayed to the client, whose
+	// answer doesn't reach the server.
+	answerRegistration(t, conn, workspaceURI("python", "u"))
+
+	uri := workspaceURI("python", "u") + "edit_code.py"
+	sendMessage(t, conn, `{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"`+uri+`","languageId":"python","version":1,"text":"x = 1"}}}`)
+	waitForDiagnostic(t, conn, uri, "x = 1")
+
+	sendMessage(t, conn, `{"jsonrpc":"2.0","id":2,"method":"fake/state","params":{}}`)
+	got := fakeState{}
+	if err := json.Unmarshal(waitForResponse(t, conn, "2").Result, &got); err != nil {
+		t.Fatalf("Invalid state: %v", err)
+	}
+	want := fakeState{
+		Root:            workspaceURI("python", "u"),
+		Initializations: 1,
+		Initialized:     1,
+		Documents:       []fakeDocument{{URI: uri, Text: "x = 1"}},
+		Settings:        json.RawMessage(settings),
+		Registered:      1,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Wrong state of the pooled server, -want +got:\n%v", diff)
+	}
+
+	// The pool is refilled with another server.
+	if refilled := waitForReadyServers(t, m, 1)[0]; refilled == pooled {
+		t.Errorf("Pool was refilled with the server handed out: %s", pooled)
+	}
+
+	// The shared servers are taken from the pool as well.
+	sessionID := sm.NewSession()
+	if _, err := sm.UpdateSession(ctx, sessionID, &common.UpdateSessionRequest{NewText: "y = 2", Language: "python"}); err != nil {
+		t.Fatalf("UpdateSession failed: %v", err)
+	}
+	shared := dial(t, srv, sessionID, "v")
+	defer shared.Close()
+	sharedSettings := `{"extraPaths":["` + workspaceURI("python", "v") + `lib"]}`
+	sendMessage(t, shared, `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"rootUri":"`+workspaceURI("python", "v")+`","initializationOptions":`+sharedSettings+`}}`)
+	waitForResponse(t, shared, "1")
+	sendMessage(t, shared, `{"jsonrpc":"2.0","method":"initialized","params":{}}`)
+	answerRegistration(t, shared, workspaceURI("python", "v"))
+	sharedURI := workspaceURI("python", "v") + "edit_code.py"
+	sendMessage(t, shared, `{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"`+sharedURI+`","languageId":"python","version":1,"text":"ignored"}}}`)
+	sendMessage(t, shared, `{"jsonrpc":"2.0","id":2,"method":"fake/state","params":{}}`)
+	got = fakeState{}
+	if err := json.Unmarshal(waitForResponse(t, shared, "2").Result, &got); err != nil {
+		t.Fatalf("Invalid state: %v", err)
+	}
+	want = fakeState{
+		Root:            workspaceURI("python", "v"),
+		Initializations: 1,
+		Initialized:     1,
+		Documents:       []fakeDocument{{URI: sharedURI, Text: "y = 2"}},
+		Settings:        json.RawMessage(sharedSettings),
+		Registered:      1,
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Wrong state of the pooled shared server, -want +got:\n%v", diff)
+	}
+}
+
+func TestPoolIdleTimeout(t *testing.T) {
+	defer func(d time.Duration) { poolCheckInterval = d }(poolCheckInterval)
+	poolCheckInterval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	m, _, _ := prepareManager(t, &language_registry.LSPPool{Size: 2, IdleTimeout: language_registry.Duration(200 * time.Millisecond)})
+	m.StartPool(ctx)
+	waitForReadyServers(t, m, 2)
+
+	// Nobody needed the language, so the servers are stopped.
+	waitForReadyServers(t, m, 0)
+
+	// The demand starts the pool again, the connection itself gets a new
+	// server.
+	l, _ := m.languages.Get("python")
+	if s := m.acquireServer(l); s != nil {
+		t.Errorf("Pool should be empty, but handed out %s", s.id)
+		s.kill()
+	}
+	waitForReadyServers(t, m, 2)
+}
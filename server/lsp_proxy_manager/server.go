@@ -0,0 +1,109 @@
+package lsp_proxy_manager
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+
+	"github.com/pasiasty/cocoder/server/language_registry"
+)
+
+// languageServer is the running process of the language server.
+type languageServer struct {
+	// id replaces {user_id} in the command of the server.
+	id       string
+	language string
+	cmd      *exec.Cmd
+
+	stdin  io.Closer
+	writer *messageWriter
+
+	// messages receives the messages of the server, it's closed once the
+	// server exits. There is a single reader at a time.
+	messages chan *message
+
+	// initResult is the result of the initialize request sent by the pool,
+	// nil if the server was started on demand.
+	initResult json.RawMessage
+	// registrations are the capability registrations the server has made
+	// while pooled, answered by the pool.
+	registrations []*message
+
+	killOnce sync.Once
+	done     chan struct{}
+}
+
+func (m *LSPProxyManager) startServer(l *language_registry.Language, id string) (*languageServer, error) {
+	cmd := m.newCommand(l, id)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = os.Stdout
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	s := &languageServer{
+		id:       id,
+		language: l.Name,
+		cmd:      cmd,
+		stdin:    stdin,
+		writer:   newMessageWriter(stdin),
+		messages: make(chan *message, 16),
+		done:     make(chan struct{}),
+	}
+	go s.readLoop(newMessageReader(stdout))
+	return s, nil
+}
+
+func (s *languageServer) readLoop(r *messageReader) {
+	defer close(s.messages)
+
+	for {
+		msg, err := r.read()
+		if isInvalidMessage(err) {
+			log.Printf("Dropping message of the %s language server %q: %v", s.language, s.id, err)
+			continue
+		}
+		if err != nil {
+			select {
+			case <-s.done:
+			default:
+				if err != io.EOF {
+					log.Printf("Failed to read from the %s language server %q: %v", s.language, s.id, err)
+				}
+			}
+			return
+		}
+
+		select {
+		case s.messages <- msg:
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *languageServer) send(msg *message) error {
+	return s.writer.write(msg)
+}
+
+// kill stops the server, it's safe to call it multiple times.
+func (s *languageServer) kill() {
+	s.killOnce.Do(func() {
+		close(s.done)
+		s.stdin.Close()
+		if s.cmd.Process != nil {
+			s.cmd.Process.Kill()
+		}
+		s.cmd.Wait()
+	})
+}
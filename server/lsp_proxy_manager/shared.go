@@ -0,0 +1,656 @@
+package lsp_proxy_manager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/pasiasty/cocoder/server/language_registry"
+	"github.com/pasiasty/cocoder/server/session_manager"
+	"github.com/pasiasty/cocoder/server/users_manager"
+)
+
+// sessionPollInterval is how often the shared servers reload the session, to
+// follow the edits merged by the other server instances.
+var sessionPollInterval = time.Second
+
+var (
+	// clientQueueSize is the number of messages queued for a client, which
+	// is disconnected once it falls that far behind.
+	clientQueueSize = 256
+	// clientWriteTimeout bounds writing a single message to a client.
+	clientWriteTimeout = 10 * time.Second
+	// serverQueueSize is the number of messages queued for the shared server,
+	// which is closed once it stops reading that many.
+	serverQueueSize = 1024
+)
+
+// uriMapping describes the document of the client, or of the shared server,
+// together with the directory of its workspace.
+type uriMapping struct {
+	doc  string
+	root string
+}
+
+func (from uriMapping) rewrite(v interface{}, to uriMapping) interface{} {
+	switch t := v.(type) {
+	case string:
+		if from.doc != "" && to.doc != "" && t == from.doc {
+			return to.doc
+		}
+		if from.root != "" && strings.HasPrefix(t, from.root) {
+			return to.root + t[len(from.root):]
+		}
+		if from.root != "" && t+"/" == from.root {
+			return strings.TrimSuffix(to.root, "/")
+		}
+	case map[string]interface{}:
+		for k, x := range t {
+			t[k] = from.rewrite(x, to)
+		}
+	case []interface{}:
+		for i, x := range t {
+			t[i] = from.rewrite(x, to)
+		}
+	}
+	return v
+}
+
+// rewriteRaw replaces the URIs of one side in the JSON value with the URIs of
+// the other.
+func (from uriMapping) rewriteRaw(raw json.RawMessage, to uriMapping) json.RawMessage {
+	if len(raw) == 0 {
+		return raw
+	}
+	d := json.NewDecoder(bytes.NewReader(raw))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return raw
+	}
+	b, err := json.Marshal(from.rewrite(v, to))
+	if err != nil {
+		return raw
+	}
+	return b
+}
+
+// workspaceURI is the directory of the documents of the language server
+// started for the id, e.g. the user.
+func workspaceURI(language, id string) string {
+	return fmt.Sprintf("file:///tmp/%s/%s/", language, id)
+}
+
+type sharedKey struct {
+	sessionID session_manager.SessionID
+	language  string
+}
+
+type sharedClient struct {
+	conn   *websocket.Conn
+	userID users_manager.UserID
+	// uris is the document opened by the client, which is replaced with the
+	// document of the session.
+	uris uriMapping
+
+	// out queues the messages written by writeLoop, so that a slow client
+	// holds up neither the server nor the other clients.
+	out       chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSharedClient(conn *websocket.Conn, userID users_manager.UserID) *sharedClient {
+	c := &sharedClient{
+		conn:   conn,
+		userID: userID,
+		out:    make(chan []byte, clientQueueSize),
+		done:   make(chan struct{}),
+	}
+	go c.writeLoop()
+	return c
+}
+
+// send queues the message without blocking, the client is disconnected when
+// its queue is full.
+func (c *sharedClient) send(msg *message) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to encode LSP message: %v", err)
+		return
+	}
+
+	select {
+	case <-c.done:
+	case c.out <- b:
+	default:
+		log.Printf("Disconnecting user %q, who doesn't keep up with the LSP messages", c.userID)
+		c.close()
+	}
+}
+
+func (c *sharedClient) writeLoop() {
+	for {
+		select {
+		case <-c.done:
+			return
+		case b := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(clientWriteTimeout))
+			if err := c.conn.WriteMessage(websocket.TextMessage, b); err != nil {
+				log.Printf("Failed to send the LSP message to user %q: %v", c.userID, err)
+				c.close()
+				return
+			}
+		}
+	}
+}
+
+// close closes the connection, which also stops reading from the client.
+func (c *sharedClient) close() {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.conn.Close()
+	})
+}
+
+type pendingRequest struct {
+	client *sharedClient
+	id     json.RawMessage
+}
+
+// document is the state of the session the shared server follows.
+type document struct {
+	text     string
+	language string
+	revision int
+}
+
+// sharedServer is the language server of a single session and language,
+// shared by all its participants. The document of the session is synced from
+// the server side, the documents of the clients are ignored. The requests of
+// the clients get new ids, so that they don't collide.
+type sharedServer struct {
+	m        *LSPProxyManager
+	key      sharedKey
+	language *language_registry.Language
+
+	server *languageServer
+	// out queues the messages written by writeLoop, so that the server isn't
+	// written to with the lock held, while its messages wait for the lock.
+	out chan *message
+
+	mux     sync.Mutex
+	clients []*sharedClient
+	nextID  int
+	pending map[int]*pendingRequest
+	// serverRequests holds the clients answering the requests of the server.
+	serverRequests map[string]*sharedClient
+	closed         bool
+
+	// initializing is set once the first initialize request is forwarded.
+	// Its result is then returned to all the clients.
+	initializing bool
+	initID       int
+	initResult   json.RawMessage
+	initWaiters  []*pendingRequest
+	// initialized is set once the initialized notification is forwarded,
+	// only then the document is opened.
+	initialized bool
+
+	latest     document
+	updates    chan struct{}
+	done       chan struct{}
+	uris       uriMapping
+	docVersion int
+	docText    string
+}
+
+func (m *LSPProxyManager) newSharedServer(key sharedKey) (*sharedServer, error) {
+	l, ok := m.languages.Get(key.language)
+	if !ok || len(l.LSP) == 0 {
+		return nil, fmt.Errorf("language: %s is not supported", key.language)
+	}
+	sess, err := m.sm.LoadSession(key.sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	server := m.acquireServer(l)
+	if server == nil {
+		if server, err = m.startServer(l, string(key.sessionID)); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &sharedServer{
+		m:              m,
+		key:            key,
+		language:       l,
+		server:         server,
+		out:            make(chan *message, serverQueueSize),
+		pending:        make(map[int]*pendingRequest),
+		serverRequests: make(map[string]*sharedClient),
+		latest:         document{text: sess.Text, language: sess.Language, revision: sess.Revision},
+		updates:        make(chan struct{}, 1),
+		done:           make(chan struct{}),
+		uris:           uriMapping{root: workspaceURI(key.language, server.id)},
+	}
+	if server.initResult != nil {
+		// Initialized by the pool, the document is opened right away.
+		s.initializing, s.initResult, s.initialized = true, server.initResult, true
+		s.updates <- struct{}{}
+	}
+
+	go s.readLoop()
+	go s.writeLoop()
+	go s.syncLoop()
+
+	log.Printf("Started shared LSP server for session: %q language: %q", key.sessionID, key.language)
+	return s, nil
+}
+
+// sendToServer queues the message without blocking, the server is closed
+// when its queue is full.
+func (s *sharedServer) sendToServer(msg *message) {
+	select {
+	case s.out <- msg:
+	default:
+		log.Printf("Closing the LSP server of session %q, which doesn't keep up with the messages", s.key.sessionID)
+		// The lock may be held by the caller.
+		go s.close()
+	}
+}
+
+func (s *sharedServer) writeLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case msg := <-s.out:
+			if err := s.server.send(msg); err != nil {
+				log.Printf("Failed to write to the LSP server of session %q: %v", s.key.sessionID, err)
+			}
+		}
+	}
+}
+
+func (s *sharedServer) notify(method string, params interface{}) {
+	b, err := json.Marshal(params)
+	if err != nil {
+		log.Printf("Failed to encode %s: %v", method, err)
+		return
+	}
+	s.sendToServer(&message{JSONRPC: "2.0", Method: method, Params: b})
+}
+
+// update records the new state of the session, which is synced in the
+// background.
+func (s *sharedServer) update(doc document) {
+	s.mux.Lock()
+	if doc.revision < s.latest.revision {
+		s.mux.Unlock()
+		return
+	}
+	s.latest = doc
+	s.mux.Unlock()
+
+	select {
+	case s.updates <- struct{}{}:
+	default:
+	}
+}
+
+func (s *sharedServer) syncLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-s.updates:
+		case <-time.After(sessionPollInterval):
+			if sess, err := s.m.sm.LoadSession(s.key.sessionID); err == nil {
+				s.update(document{text: sess.Text, language: sess.Language, revision: sess.Revision})
+			}
+		}
+		s.syncDocument()
+	}
+}
+
+type textDocumentItem struct {
+	URI        string `json:"uri"`
+	LanguageID string `json:"languageId,omitempty"`
+	Version    int    `json:"version"`
+	Text       string `json:"text,omitempty"`
+}
+
+type textDocumentIdentifier struct {
+	URI string `json:"uri"`
+}
+
+// syncDocument opens, changes or closes the document of the session in the
+// language server, so that it matches the latest state of the session.
+func (s *sharedServer) syncDocument() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.initialized || s.closed {
+		return
+	}
+
+	doc := s.latest
+	uri := ""
+	if doc.language == s.key.language {
+		uri = s.uris.root + s.language.MainFile(doc.text)
+	}
+
+	if s.uris.doc != "" && s.uris.doc != uri {
+		s.notify("textDocument/didClose", map[string]interface{}{
+			"textDocument": textDocumentIdentifier{URI: s.uris.doc},
+		})
+		s.uris.doc = ""
+	}
+	if uri == "" {
+		return
+	}
+
+	s.docVersion++
+	if s.uris.doc == "" {
+		s.notify("textDocument/didOpen", map[string]interface{}{
+			"textDocument": textDocumentItem{URI: uri, LanguageID: s.key.language, Version: s.docVersion, Text: doc.text},
+		})
+		s.uris.doc, s.docText = uri, doc.text
+		return
+	}
+	if doc.text == s.docText {
+		s.docVersion--
+		return
+	}
+	s.notify("textDocument/didChange", map[string]interface{}{
+		"textDocument":   textDocumentItem{URI: uri, Version: s.docVersion},
+		"contentChanges": []map[string]string{{"text": doc.text}},
+	})
+	s.docText = doc.text
+}
+
+// connect serves the client until it disconnects. It returns false when the
+// server is already closed.
+func (s *sharedServer) connect(conn *websocket.Conn, userID users_manager.UserID) bool {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return false
+	}
+	conn.SetReadLimit(maxMessageSize)
+	c := newSharedClient(conn, userID)
+	s.clients = append(s.clients, c)
+	s.mux.Unlock()
+
+	go func() {
+		defer s.disconnect(c)
+
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseAbnormalClosure) {
+					log.Printf("Unexpected websocket error: %v", err)
+				}
+				return
+			}
+
+			msg, err := parseMessage(b)
+			if err != nil {
+				log.Printf("Dropping LSP message of user %q: %v", userID, err)
+				continue
+			}
+			s.fromClient(c, msg)
+		}
+	}()
+	return true
+}
+
+// isSessionDocument tells whether the notification is about the document of
+// the client, which is replaced with the document of the session.
+func (s *sharedServer) isSessionDocument(c *sharedClient, msg *message) bool {
+	if !strings.HasPrefix(msg.Method, "textDocument/did") {
+		return false
+	}
+	params := struct {
+		TextDocument textDocumentItem `json:"textDocument"`
+	}{}
+	if err := json.Unmarshal(msg.Params, &params); err != nil {
+		return false
+	}
+
+	uri := params.TextDocument.URI
+	if c.uris.doc == "" && msg.Method == "textDocument/didOpen" && params.TextDocument.LanguageID == s.key.language {
+		c.uris.doc = uri
+		if c.uris.root == "" {
+			// The URI is not a path, path.Dir would drop the slashes of file://.
+			c.uris.root = uri[:strings.LastIndex(uri, "/")+1]
+		}
+	}
+	return uri != "" && uri == c.uris.doc
+}
+
+func (s *sharedServer) fromClient(c *sharedClient, msg *message) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	switch {
+	case msg.isResponse():
+		if s.serverRequests[string(msg.ID)] != c {
+			return
+		}
+		delete(s.serverRequests, string(msg.ID))
+		msg.Result = c.uris.rewriteRaw(msg.Result, s.uris)
+		s.sendToServer(msg)
+
+	case msg.Method == "initialize":
+		params := struct {
+			RootURI string `json:"rootUri"`
+		}{}
+		if err := json.Unmarshal(msg.Params, &params); err == nil && params.RootURI != "" {
+			c.uris.root = strings.TrimSuffix(params.RootURI, "/") + "/"
+		}
+		req := &pendingRequest{client: c, id: msg.ID}
+		if s.initResult != nil {
+			c.send(&message{JSONRPC: "2.0", ID: req.id, Result: s.initResult})
+			if config := configuration(msg); config != nil && s.server.initResult != nil {
+				// Initialized by the pool without the options of the client.
+				config.Params = c.uris.rewriteRaw(config.Params, s.uris)
+				s.sendToServer(config)
+			}
+			return
+		}
+		if s.initializing {
+			s.initWaiters = append(s.initWaiters, req)
+			return
+		}
+		s.initializing = true
+		s.initID = s.forwardRequest(c, msg)
+
+	case msg.Method == "initialized":
+		// Made while pooled, before any of the clients was there. The
+		// responses of the clients are dropped, as they aren't awaited.
+		for _, reg := range s.server.replayedRegistrations() {
+			s.toClient(c, reg)
+		}
+		if s.initialized {
+			return
+		}
+		s.initialized = true
+		s.sendToServer(msg)
+		// Opening the document once the server is ready.
+		select {
+		case s.updates <- struct{}{}:
+		default:
+		}
+
+	case msg.Method == "shutdown":
+		// The server stays up for the other participants.
+		c.send(&message{JSONRPC: "2.0", ID: msg.ID, Result: json.RawMessage("null")})
+
+	case msg.Method == "exit":
+
+	case msg.Method == "$/cancelRequest":
+		params := struct {
+			ID json.RawMessage `json:"id"`
+		}{}
+		if err := json.Unmarshal(msg.Params, &params); err != nil {
+			return
+		}
+		for id, p := range s.pending {
+			if p.client == c && bytes.Equal(p.id, params.ID) {
+				s.notify(msg.Method, map[string]int{"id": id})
+				return
+			}
+		}
+
+	case msg.isNotification():
+		if s.isSessionDocument(c, msg) {
+			return
+		}
+		msg.Params = c.uris.rewriteRaw(msg.Params, s.uris)
+		s.sendToServer(msg)
+
+	case msg.isRequest():
+		s.forwardRequest(c, msg)
+	}
+}
+
+// forwardRequest sends the request of the client with the new id, which is
+// returned.
+func (s *sharedServer) forwardRequest(c *sharedClient, msg *message) int {
+	s.nextID++
+	s.pending[s.nextID] = &pendingRequest{client: c, id: msg.ID}
+
+	msg.ID = json.RawMessage(strconv.Itoa(s.nextID))
+	msg.Params = c.uris.rewriteRaw(msg.Params, s.uris)
+	s.sendToServer(msg)
+	return s.nextID
+}
+
+func (s *sharedServer) readLoop() {
+	defer s.close()
+
+	for msg := range s.server.messages {
+		s.fromServer(msg)
+	}
+}
+
+func (s *sharedServer) fromServer(msg *message) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	switch {
+	case msg.isResponse():
+		id, err := strconv.Atoi(string(msg.ID))
+		if err != nil {
+			return
+		}
+		if s.initializing && s.initResult == nil && id == s.initID {
+			s.initialize(msg)
+		}
+		p, ok := s.pending[id]
+		if !ok {
+			return
+		}
+		delete(s.pending, id)
+		s.toClient(p.client, &message{JSONRPC: "2.0", ID: p.id, Result: msg.Result, Error: msg.Error})
+
+	case msg.isRequest():
+		// Any of the clients can answer the requests of the server.
+		if len(s.clients) == 0 {
+			s.sendToServer(&message{JSONRPC: "2.0", ID: msg.ID, Result: json.RawMessage("null")})
+			return
+		}
+		c := s.clients[0]
+		s.serverRequests[string(msg.ID)] = c
+		s.toClient(c, msg)
+
+	case msg.isNotification():
+		for _, c := range s.clients {
+			m := *msg
+			s.toClient(c, &m)
+		}
+	}
+}
+
+// initialize answers the clients waiting for the first initialize request.
+// When it has failed, the next initialize request is forwarded again.
+func (s *sharedServer) initialize(msg *message) {
+	if msg.Error == nil {
+		s.initResult = msg.Result
+	} else {
+		s.initializing = false
+	}
+	for _, w := range s.initWaiters {
+		w.client.send(&message{JSONRPC: "2.0", ID: w.id, Result: msg.Result, Error: msg.Error})
+	}
+	s.initWaiters = nil
+}
+
+func (s *sharedServer) toClient(c *sharedClient, msg *message) {
+	msg.Params = s.uris.rewriteRaw(msg.Params, c.uris)
+	msg.Result = s.uris.rewriteRaw(msg.Result, c.uris)
+	c.send(msg)
+}
+
+// disconnect forgets the client, closing the server once the last one has
+// left.
+func (s *sharedServer) disconnect(c *sharedClient) {
+	s.mux.Lock()
+
+	for i, o := range s.clients {
+		if o == c {
+			s.clients = append(s.clients[:i], s.clients[i+1:]...)
+			break
+		}
+	}
+	for id, p := range s.pending {
+		if p.client == c {
+			delete(s.pending, id)
+		}
+	}
+	for id, o := range s.serverRequests {
+		if o == c {
+			delete(s.serverRequests, id)
+			s.sendToServer(&message{JSONRPC: "2.0", ID: json.RawMessage(id), Result: json.RawMessage("null")})
+		}
+	}
+	empty := len(s.clients) == 0
+	s.mux.Unlock()
+
+	c.close()
+	log.Printf("Closed shared LSP connection for user: %q session: %q language: %q", c.userID, s.key.sessionID, s.key.language)
+
+	if empty {
+		s.close()
+	}
+}
+
+// close stops the server and disconnects all the clients.
+func (s *sharedServer) close() {
+	s.mux.Lock()
+	if s.closed {
+		s.mux.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	clients := s.clients
+	s.mux.Unlock()
+
+	s.m.forgetShared(s.key, s)
+
+	s.server.kill()
+	for _, c := range clients {
+		c.close()
+	}
+	log.Printf("Stopped shared LSP server for session: %q language: %q", s.key.sessionID, s.key.language)
+}
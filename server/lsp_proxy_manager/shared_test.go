@@ -0,0 +1,232 @@
+package lsp_proxy_manager
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/gorilla/websocket"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func TestSharedServer(t *testing.T) {
+	ctx := context.Background()
+	m, sm, srv := prepareManager(t, nil)
+
+	sessionID := sm.NewSession()
+	if _, err := sm.UpdateSession(ctx, sessionID, &common.UpdateSessionRequest{NewText: "print(1)", Language: "python"}); err != nil {
+		t.Fatalf("UpdateSession failed: %v", err)
+	}
+
+	clients := map[string]*websocket.Conn{}
+	for _, userID := range []string{"a", "b"} {
+		conn := dial(t, srv, sessionID, userID)
+		defer conn.Close()
+		clients[userID] = conn
+
+		uri := workspaceURI("python", userID) + "edit_code.py"
+		sendMessage(t, conn, `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"rootUri":"`+workspaceURI("python", userID)+`"}}`)
+		if got := waitForResponse(t, conn, "1"); string(got.Result) != `{"capabilities":{"textDocumentSync":1}}` {
+			t.Errorf("user %s got initialize result %s", userID, got.Result)
+		}
+		sendMessage(t, conn, `{"jsonrpc":"2.0","method":"initialized","params":{}}`)
+		sendMessage(t, conn, `{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"`+uri+`","languageId":"python","version":1,"text":"ignored"}}}`)
+		if userID == "a" {
+			waitForDiagnostic(t, conn, uri, "print(1)")
+		}
+	}
+
+	if _, err := sm.UpdateSession(ctx, sessionID, &common.UpdateSessionRequest{BaseText: "print(1)", NewText: "print(2)", Language: "python"}); err != nil {
+		t.Fatalf("UpdateSession failed: %v", err)
+	}
+	for userID, conn := range clients {
+		waitForDiagnostic(t, conn, workspaceURI("python", userID)+"edit_code.py", "print(2)")
+	}
+
+	for userID, conn := range clients {
+		sendMessage(t, conn, `{"jsonrpc":"2.0","id":7,"method":"fake/state","params":{}}`)
+		got := fakeState{}
+		if err := json.Unmarshal(waitForResponse(t, conn, "7").Result, &got); err != nil {
+			t.Fatalf("Invalid state: %v", err)
+		}
+		want := fakeState{
+			Root:            workspaceURI("python", userID),
+			Initializations: 1,
+			Initialized:     1,
+			Documents:       []fakeDocument{{URI: workspaceURI("python", userID) + "edit_code.py", Text: "print(2)"}},
+		}
+		if diff := cmp.Diff(want, got); diff != "" {
+			t.Errorf("user %s got wrong state, -want +got:\n%v", userID, diff)
+		}
+	}
+
+	a := clients["a"]
+	sendMessage(t, a, `{"jsonrpc":"2.0","id":8,"method":"fake/ask","params":{}}`)
+	question := waitForMessage(t, a, "question", func(msg *message) bool { return msg.Method == "fake/question" })
+	sendMessage(t, a, `{"jsonrpc":"2.0","id":`+string(question.ID)+`,"result":"yes"}`)
+	if got := waitForResponse(t, a, "8"); string(got.Result) != `"yes"` {
+		t.Errorf("fake/ask got result %s, want \"yes\"", got.Result)
+	}
+
+	for _, conn := range clients {
+		conn.Close()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.sharedMux.Lock()
+		n := len(m.shared)
+		m.sharedMux.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Shared server is still running after all the clients have left")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSharedServerInitializeError(t *testing.T) {
+	_, sm, srv := prepareManager(t, nil)
+	sessionID := sm.NewSession()
+
+	a := dial(t, srv, sessionID, "a")
+	defer a.Close()
+	b := dial(t, srv, sessionID, "b")
+	defer b.Close()
+
+	sendMessage(t, a, `{"jsonrpc":"2.0","id":1,"method":"initialize","params":{"initializationOptions":{"fail":true}}}`)
+	// The initialize request of b waits for the one of a, which is rejected.
+	time.Sleep(100 * time.Millisecond)
+	sendMessage(t, b, `{"jsonrpc":"2.0","id":2,"method":"initialize","params":{}}`)
+	for _, got := range []*message{waitForResponse(t, a, "1"), waitForResponse(t, b, "2")} {
+		if len(got.Error) == 0 {
+			t.Errorf("Initialize should've failed, got: %s", got)
+		}
+	}
+
+	sendMessage(t, b, `{"jsonrpc":"2.0","id":3,"method":"initialize","params":{}}`)
+	if got := waitForResponse(t, b, "3"); string(got.Result) != `{"capabilities":{"textDocumentSync":1}}` {
+		t.Errorf("Initialize after the failure got: %s", got)
+	}
+}
+
+func TestSharedServerFlood(t *testing.T) {
+	_, sm, srv := prepareManager(t, nil)
+	conn := dial(t, srv, sm.NewSession(), "a")
+	defer conn.Close()
+
+	// The messages of the client fill up the input of the server, while the
+	// server fills up its output.
+	sendMessage(t, conn, `{"jsonrpc":"2.0","id":1,"method":"fake/flood","params":{}}`)
+	params := `{"text":"` + strings.Repeat("y", 4096) + `"}`
+	for i := 0; i < 100; i++ {
+		sendMessage(t, conn, `{"jsonrpc":"2.0","method":"fake/noop","params":`+params+`}`)
+	}
+	if got := waitForResponse(t, conn, "1"); string(got.Result) != `"ok"` {
+		t.Errorf("fake/flood got: %s", got)
+	}
+}
+
+func TestIsSessionDocument(t *testing.T) {
+	s := &sharedServer{key: sharedKey{language: "go"}}
+	c := &sharedClient{}
+
+	open := &message{JSONRPC: "2.0", Method: "textDocument/didOpen", Params: json.RawMessage(`{"textDocument":{"uri":"file:///tmp/go/u/0_code.go","languageId":"go","version":1,"text":""}}`)}
+	if !s.isSessionDocument(c, open) {
+		t.Errorf("The document opened by the client should be replaced")
+	}
+	if want := (uriMapping{doc: "file:///tmp/go/u/0_code.go", root: "file:///tmp/go/u/"}); c.uris != want {
+		t.Errorf("Got URIs of the client: %+v, want: %+v", c.uris, want)
+	}
+
+	change := &message{JSONRPC: "2.0", Method: "textDocument/didChange", Params: json.RawMessage(`{"textDocument":{"uri":"file:///tmp/go/u/0_code.go","version":2}}`)}
+	if !s.isSessionDocument(c, change) {
+		t.Errorf("The change of the document of the client should be replaced")
+	}
+	other := &message{JSONRPC: "2.0", Method: "textDocument/didOpen", Params: json.RawMessage(`{"textDocument":{"uri":"file:///tmp/go/u/lib.go","languageId":"go","version":1,"text":""}}`)}
+	if s.isSessionDocument(c, other) {
+		t.Errorf("Other documents of the client should be passed")
+	}
+}
+
+func TestSharedClientQueueFull(t *testing.T) {
+	conns := make(chan *websocket.Conn, 1)
+	upgrader := websocket.Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := upgrader.Upgrade(w, r, nil); err == nil {
+			conns <- conn
+		}
+	}))
+	defer srv.Close()
+
+	peer, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer peer.Close()
+
+	// Without the write loop nothing is taken from the queue.
+	c := &sharedClient{conn: <-conns, userID: "slow", out: make(chan []byte, 1), done: make(chan struct{})}
+	sent := make(chan struct{})
+	go func() {
+		for i := 0; i < 3; i++ {
+			c.send(&message{JSONRPC: "2.0", Method: "fake/notification"})
+		}
+		close(sent)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Sending to the client blocked")
+	}
+	select {
+	case <-c.done:
+	default:
+		t.Errorf("The client falling behind should've been disconnected")
+	}
+	peer.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, _, err := peer.ReadMessage(); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Errorf("Connection should've been closed, got: %v", err)
+	}
+}
+
+func TestRewriteURIs(t *testing.T) {
+	client := uriMapping{doc: "file:///tmp/python/u/edit_code.py", root: "file:///tmp/python/u/"}
+	shared := uriMapping{doc: "file:///tmp/python/s/code.py", root: "file:///tmp/python/s/"}
+
+	for _, tc := range []struct {
+		name string
+		raw  string
+		want string
+	}{{
+		name: "document",
+		raw:  `{"textDocument":{"uri":"file:///tmp/python/u/edit_code.py"},"position":{"line":1,"character":12345678901234567}}`,
+		want: `{"position":{"character":12345678901234567,"line":1},"textDocument":{"uri":"file:///tmp/python/s/code.py"}}`,
+	}, {
+		name: "workspace",
+		raw:  `[{"uri":"file:///tmp/python/u/lib/x.py"},"file:///tmp/python/u/","file:///tmp/python/u"]`,
+		want: `[{"uri":"file:///tmp/python/s/lib/x.py"},"file:///tmp/python/s/","file:///tmp/python/s"]`,
+	}, {
+		name: "other",
+		raw:  `{"uri":"file:///usr/lib/python3/os.py"}`,
+		want: `{"uri":"file:///usr/lib/python3/os.py"}`,
+	}, {
+		name: "invalid",
+		raw:  `{"uri"`,
+		want: `{"uri"`,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(client.rewriteRaw(json.RawMessage(tc.raw), shared)); got != tc.want {
+				t.Errorf("rewriteRaw(%s) = %s, want %s", tc.raw, got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package replay_manager
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/pasiasty/cocoder/server/common"
+	"github.com/pasiasty/cocoder/server/session_manager"
+)
+
+var (
+	supportedSpeeds = map[int]bool{1: true, 2: true, 10: true}
+
+	// Long breaks in the recording are shortened, so that nobody has to wait
+	// minutes for the next keystroke.
+	maxReplayPause = 5 * time.Second
+
+	afterSource = time.After
+)
+
+type ReplayManager struct {
+	sm *session_manager.SessionManager
+}
+
+func New(sm *session_manager.SessionManager) *ReplayManager {
+	return &ReplayManager{
+		sm: sm,
+	}
+}
+
+func ValidateSpeed(speed int) error {
+	if !supportedSpeeds[speed] {
+		return fmt.Errorf("replay speed %dx is not supported", speed)
+	}
+	return nil
+}
+
+func pause(prev, next time.Time, speed int) time.Duration {
+	d := next.Sub(prev) / time.Duration(speed)
+	if d < 0 {
+		return 0
+	}
+	if d > maxReplayPause {
+		return maxReplayPause
+	}
+	return d
+}
+
+// discardIncoming reads (and ignores) everything the client sends, as replays
+// are read-only. The context is cancelled once the connection is closed.
+func discardIncoming(conn *websocket.Conn, cancel context.CancelFunc) {
+	defer cancel()
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+// Stream sends the recorded edits of the session over the websocket, keeping
+// the original pace sped up by the given factor.
+func (m *ReplayManager) Stream(ctx context.Context, conn *websocket.Conn, sessionID session_manager.SessionID, speed int) error {
+	defer conn.Close()
+
+	if err := ValidateSpeed(speed); err != nil {
+		return err
+	}
+
+	r, err := m.sm.Recording(sessionID)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go discardIncoming(conn, cancel)
+
+	var prev *common.ReplayFrame
+	for {
+		frame, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if prev != nil {
+			select {
+			case <-afterSource(pause(prev.Timestamp, frame.Timestamp, speed)):
+			case <-ctx.Done():
+				return nil
+			}
+		}
+
+		if err := conn.WriteJSON(frame); err != nil {
+			return fmt.Errorf("failed to send replay frame: %v", err)
+		}
+		prev = frame
+	}
+
+	if err := conn.WriteJSON(&common.ReplayFrame{Finished: true}); err != nil {
+		log.Printf("Failed to send the end of the replay: %v", err)
+	}
+	conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	return nil
+}
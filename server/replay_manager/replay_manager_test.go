@@ -0,0 +1,51 @@
+package replay_manager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPause(t *testing.T) {
+	start := time.Date(2015, 2, 13, 0, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name      string
+		next      time.Time
+		speed     int
+		wantPause time.Duration
+	}{{
+		name:      "normal_speed",
+		next:      start.Add(time.Second),
+		speed:     1,
+		wantPause: time.Second,
+	}, {
+		name:      "ten_times_faster",
+		next:      start.Add(time.Second),
+		speed:     10,
+		wantPause: 100 * time.Millisecond,
+	}, {
+		name:      "long_break",
+		next:      start.Add(time.Hour),
+		speed:     2,
+		wantPause: maxReplayPause,
+	}, {
+		name:      "clock_going_back",
+		next:      start.Add(-time.Second),
+		speed:     1,
+		wantPause: 0,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if res := pause(start, tc.next, tc.speed); res != tc.wantPause {
+				t.Errorf("pause() returned wrong result, want: %v got: %v", tc.wantPause, res)
+			}
+		})
+	}
+}
+
+func TestValidateSpeed(t *testing.T) {
+	for speed, wantOK := range map[int]bool{1: true, 2: true, 10: true, 0: false, 3: false, -1: false} {
+		if err := ValidateSpeed(speed); (err == nil) != wantOK {
+			t.Errorf("ValidateSpeed(%d) returned %v", speed, err)
+		}
+	}
+}
@@ -2,18 +2,23 @@ package route_manager
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/gin-contrib/pprof"
 	limits "github.com/gin-contrib/size"
 	"github.com/gin-gonic/gin"
-	"github.com/go-redis/redis"
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 
 	"github.com/pasiasty/cocoder/server/common"
 	"github.com/pasiasty/cocoder/server/executor"
+	"github.com/pasiasty/cocoder/server/language_registry"
 	lsp_proxy "github.com/pasiasty/cocoder/server/lsp_proxy_manager"
+	"github.com/pasiasty/cocoder/server/replay_manager"
 	"github.com/pasiasty/cocoder/server/session_manager"
 	"github.com/pasiasty/cocoder/server/users_manager"
 )
@@ -46,13 +51,13 @@ func CORSMiddleware() gin.HandlerFunc {
 	}
 }
 
-func NewRouterManager(ctx context.Context, c *redis.Client) *RouteManager {
+func NewRouterManager(ctx context.Context, store session_manager.Store, b users_manager.Broadcaster, languages *language_registry.Registry, e *executor.Executor) *RouteManager {
 	r := gin.Default()
 	pprof.Register(r)
-	sm := session_manager.NewSessionManager(c)
-	um := users_manager.NewUsersManager(ctx, sm)
-	lspm := lsp_proxy.New()
-	e := executor.New()
+	sm := session_manager.NewSessionManager(store)
+	um := users_manager.NewUsersManager(ctx, sm, b)
+	rpm := replay_manager.New(sm)
+	lspm := lsp_proxy.New(languages, sm)
 
 	r.Use(limits.RequestSizeLimiter(1024 * 1024))
 	r.Use(CORSMiddleware())
@@ -60,7 +65,16 @@ func NewRouterManager(ctx context.Context, c *redis.Client) *RouteManager {
 	g := r.Group("/api")
 
 	g.GET("/new_session", func(c *gin.Context) {
-		c.String(http.StatusOK, fmt.Sprintf("%q", string(sm.NewSession())))
+		sessionType, ok := session_manager.ParseSessionType(c.Query("type"))
+		if !ok {
+			c.String(http.StatusBadRequest, fmt.Sprintf("unknown session type: %q", c.Query("type")))
+			return
+		}
+		c.String(http.StatusOK, fmt.Sprintf("%q", string(sm.NewSessionOfType(sessionType))))
+	})
+
+	g.GET("/languages", func(c *gin.Context) {
+		c.JSON(http.StatusOK, languages.List())
 	})
 
 	g.GET("/:session_id", func(c *gin.Context) {
@@ -73,22 +87,122 @@ func NewRouterManager(ctx context.Context, c *redis.Client) *RouteManager {
 		}
 	})
 
+	g.GET("/:session_id/history", func(c *gin.Context) {
+		sessionID := session_manager.SessionID(c.Param("session_id"))
+
+		if h, err := sm.History(sessionID); err == nil {
+			c.JSON(http.StatusOK, h)
+		} else {
+			c.String(http.StatusNotFound, fmt.Sprintf("error while loading history: %v", err))
+		}
+	})
+
+	g.GET("/:session_id/test_cases", func(c *gin.Context) {
+		sessionID := session_manager.SessionID(c.Param("session_id"))
+
+		if tcs, err := sm.VisibleTestCases(sessionID); err == nil {
+			c.JSON(http.StatusOK, tcs)
+		} else {
+			c.String(http.StatusNotFound, fmt.Sprintf("error while loading test cases: %v", err))
+		}
+	})
+
+	g.PUT("/:session_id/test_cases", func(c *gin.Context) {
+		sessionID := session_manager.SessionID(c.Param("session_id"))
+
+		tcs := []common.TestCase{}
+		if err := c.BindJSON(&tcs); err != nil {
+			return
+		}
+		if err := session_manager.ValidateTestCases(tcs); err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("wrong test cases: %v", err))
+			return
+		}
+
+		if err := sm.SetTestCases(sessionID, tcs); err != nil {
+			c.String(http.StatusNotFound, fmt.Sprintf("error while storing test cases: %v", err))
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	g.GET("/:session_id/revision/:n", func(c *gin.Context) {
+		sessionID := session_manager.SessionID(c.Param("session_id"))
+
+		n, err := strconv.Atoi(c.Param("n"))
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("wrong revision number: %q", c.Param("n")))
+			return
+		}
+
+		if r, err := sm.Revision(sessionID, n); err == nil {
+			c.JSON(http.StatusOK, r)
+		} else {
+			c.String(http.StatusNotFound, fmt.Sprintf("error while loading revision: %v", err))
+		}
+	})
+
+	g.GET("/:session_id/replay", func(c *gin.Context) {
+		sessionID := session_manager.SessionID(c.Param("session_id"))
+
+		speed, err := strconv.Atoi(c.DefaultQuery("speed", "1"))
+		if err == nil {
+			err = replay_manager.ValidateSpeed(speed)
+		}
+		if err != nil {
+			c.String(http.StatusBadRequest, fmt.Sprintf("wrong replay speed: %q", c.Query("speed")))
+			return
+		}
+
+		conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		if err := rpm.Stream(c, conn, sessionID, speed); err != nil {
+			log.Printf("Failed to replay session %s: %v", sessionID, err)
+		}
+	})
+
 	g.GET("/:session_id/:user_id/session_ws", func(c *gin.Context) {
 		sessionID := session_manager.SessionID(c.Param("session_id"))
 		userID := users_manager.UserID(c.Param("user_id"))
 
+		var resume *users_manager.Resume
+		if token := c.Query("resume_token"); token != "" {
+			revision, err := strconv.Atoi(c.DefaultQuery("revision", "0"))
+			if err != nil {
+				c.String(http.StatusBadRequest, fmt.Sprintf("wrong revision: %q", c.Query("revision")))
+				return
+			}
+			resume = &users_manager.Resume{
+				Token:    token,
+				Revision: revision,
+			}
+		}
+
 		conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
 
-		um.RegisterUser(c, sessionID, userID, conn)
+		um.RegisterUser(c, sessionID, userID, conn, resume)
 	})
 
 	g.GET("/lsp/:user_id/:language", func(c *gin.Context) {
 		language := string(session_manager.SessionID(c.Param("language")))
 		userID := users_manager.UserID(c.Param("user_id"))
+		// The participants passing the session share its language server.
+		sessionID := session_manager.SessionID(c.Query("session_id"))
+
+		if sessionID != "" {
+			if _, err := sm.LoadSession(sessionID); err != nil {
+				c.String(http.StatusNotFound, fmt.Sprintf("error while loading session: %v", err))
+				return
+			}
+		}
 
 		conn, err := wsupgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
@@ -96,7 +210,12 @@ func NewRouterManager(ctx context.Context, c *redis.Client) *RouteManager {
 			return
 		}
 
-		if err := lspm.Connect(c, conn, language, userID); err != nil {
+		if sessionID != "" {
+			err = lspm.ConnectShared(conn, sessionID, language, userID)
+		} else {
+			err = lspm.Connect(c, conn, language, userID)
+		}
+		if err != nil {
 			c.AbortWithError(http.StatusInternalServerError, err)
 			conn.Close()
 		}
@@ -110,7 +229,55 @@ func NewRouterManager(ctx context.Context, c *redis.Client) *RouteManager {
 		code := c.PostForm("code")
 		stdin := c.PostForm("stdin")
 
-		resp, err := e.Execute(c, userID, language, code, stdin)
+		s, err := sm.LoadSession(sessionID)
+		if err != nil {
+			c.String(http.StatusNotFound, fmt.Sprintf("error while loading session: %v", err))
+			return
+		}
+
+		jobID := uuid.New().String()
+		req := &executor.ExecutionRequest{
+			JobID:     jobID,
+			SessionID: string(sessionID),
+			UserID:    userID,
+			Language:  language,
+			Code:      code,
+			Files:     s.FilesContent(),
+			Stdin:     stdin,
+			OnOutput: func(chunk common.OutputChunk) {
+				um.BroadcastOutput(sessionID, chunk)
+			},
+			OnQueued: func(position int) {
+				um.BroadcastQueuePosition(sessionID, userID, jobID, position)
+			},
+		}
+		if c.PostForm("interactive") == "true" {
+			inputCtx, cancel := context.WithCancel(ctx)
+			defer cancel()
+
+			if req.Input, err = um.AttachStdin(inputCtx, sessionID); err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+
+		execCtx, cancel := context.WithCancel(c)
+		defer cancel()
+
+		if err := um.WatchCancellation(execCtx, sessionID, jobID, cancel); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		resp, err := e.Execute(execCtx, req)
+		if errors.Is(err, executor.ErrQueueFull) {
+			sm.UpdateSession(ctx, sessionID, &common.UpdateSessionRequest{
+				UpdateRunningState: true,
+				Running:            false,
+			})
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
 		if err != nil {
 			fmt.Printf("Failed to execute: %v\n", err)
 			c.AbortWithError(http.StatusInternalServerError, err)
@@ -121,24 +288,184 @@ func NewRouterManager(ctx context.Context, c *redis.Client) *RouteManager {
 			UpdateOutputText:   true,
 			Stdout:             resp.Stdout,
 			Stderr:             resp.Stderr,
+			ExecutionResult:    resp.Result,
 			UpdateRunningState: true,
 			Running:            false,
 		})
 		c.JSON(http.StatusOK, resp)
 	})
 
+	g.POST("/execute/:session_id/cancel", func(c *gin.Context) {
+		sessionID := session_manager.SessionID(c.Param("session_id"))
+		userID := users_manager.UserID(c.PostForm("user_id"))
+		jobID := c.PostForm("job_id")
+
+		s, err := sm.LoadSession(sessionID)
+		if err != nil {
+			c.String(http.StatusNotFound, fmt.Sprintf("error while loading session: %v", err))
+			return
+		}
+		// Only the participants of the session can stop its programs.
+		if _, ok := s.Users[string(userID)]; !ok {
+			c.String(http.StatusForbidden, fmt.Sprintf("user %q is not a participant of the session", userID))
+			return
+		}
+
+		if err := um.CancelExecution(sessionID, userID, jobID); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		// The program stops running for everyone, even if it's already gone.
+		if _, err := sm.UpdateSession(ctx, sessionID, &common.UpdateSessionRequest{
+			UserID:             string(userID),
+			UpdateRunningState: true,
+			Running:            false,
+		}); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
+	g.POST("/judge/:session_id/:user_id/:language", func(c *gin.Context) {
+		sessionID := session_manager.SessionID(c.Param("session_id"))
+		userID := users_manager.UserID(c.Param("user_id"))
+		language := c.Param("language")
+
+		s, err := sm.LoadSession(sessionID)
+		if err != nil {
+			c.String(http.StatusNotFound, fmt.Sprintf("error while loading session: %v", err))
+			return
+		}
+		tcs, err := sm.TestCases(sessionID)
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		jobID := uuid.New().String()
+		execCtx, cancel := context.WithCancel(c)
+		defer cancel()
+
+		if err := um.WatchCancellation(execCtx, sessionID, jobID, cancel); err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		resp, err := e.Judge(execCtx, &executor.JudgeRequest{
+			JobID:     jobID,
+			SessionID: string(sessionID),
+			UserID:    userID,
+			Language:  language,
+			Code:      c.PostForm("code"),
+			Files:     s.FilesContent(),
+			TestCases: tcs,
+		})
+		if errors.Is(err, executor.ErrQueueFull) {
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
+	g.POST("/lint/:session_id/:language", func(c *gin.Context) {
+		sessionID := session_manager.SessionID(c.Param("session_id"))
+		language := c.Param("language")
+
+		s, err := sm.LoadSession(sessionID)
+		if err != nil {
+			c.String(http.StatusNotFound, fmt.Sprintf("error while loading session: %v", err))
+			return
+		}
+
+		resp, err := e.Lint(c, &executor.LintRequest{
+			SessionID: string(sessionID),
+			Language:  language,
+			Code:      s.Text,
+			Files:     s.FilesContent(),
+		})
+		if errors.Is(err, executor.ErrQueueFull) {
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		if err != nil {
+			c.AbortWithError(http.StatusInternalServerError, err)
+			return
+		}
+
+		// The result is shared with all the participants of the session.
+		if resp.Result != nil {
+			resp.Result.Revision = s.Revision
+			if _, err := sm.UpdateSession(ctx, sessionID, &common.UpdateSessionRequest{
+				UpdateLintResult: true,
+				LintResult:       resp.Result,
+			}); err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
+		c.JSON(http.StatusOK, resp)
+	})
+
 	g.POST("/format/:user_id/:language", func(c *gin.Context) {
 		language := string(session_manager.SessionID(c.Param("language")))
 		userID := users_manager.UserID(c.Param("user_id"))
 
-		code := c.PostForm("code")
+		req := &executor.FormatRequest{
+			UserID:   userID,
+			Language: language,
+			Code:     c.PostForm("code"),
+		}
+
+		// With the session given, its text is formatted within the selection
+		// of the user and the result is applied to the session.
+		sessionID := session_manager.SessionID(c.PostForm("session_id"))
+		var s *session_manager.Session
+		if sessionID != "" {
+			var err error
+			if s, err = sm.LoadSession(sessionID); err != nil {
+				c.String(http.StatusNotFound, fmt.Sprintf("error while loading session: %v", err))
+				return
+			}
+			req.SessionID = string(sessionID)
+			req.Code = s.Text
+			// The selection of the user counts the runes, as FormatRequest does.
+			if u, ok := s.Users[string(userID)]; ok && u.HasSelection {
+				req.HasSelection = true
+				req.SelectionStart = u.SelectionStart
+				req.SelectionEnd = u.SelectionEnd
+			}
+		}
 
-		resp, err := e.Format(c, userID, language, code)
+		resp, err := e.Format(c, req)
+		if errors.Is(err, executor.ErrQueueFull) {
+			c.String(http.StatusServiceUnavailable, err.Error())
+			return
+		}
 		if err != nil {
 			fmt.Printf("Failed to format: %v\n", err)
 			c.AbortWithError(http.StatusInternalServerError, err)
 			return
 		}
+
+		if s != nil && resp.ErrorMessage == "" && resp.Code != s.Text {
+			// Applied as the operation against the formatted revision, so that
+			// the concurrent edits are kept and the cursors of all the users
+			// are moved along with the text.
+			if _, err := sm.UpdateSession(ctx, sessionID, &common.UpdateSessionRequest{
+				UseOperations: true,
+				Revision:      s.Revision,
+				Operation:     session_manager.OperationFromTexts(s.Text, resp.Code),
+			}); err != nil {
+				c.AbortWithError(http.StatusInternalServerError, err)
+				return
+			}
+		}
 		c.JSON(http.StatusOK, resp)
 	})
 
@@ -153,6 +480,12 @@ func (m *RouteManager) Router() *gin.Engine {
 	return m.r
 }
 
+// StartLSPPool keeps the language servers started ahead of the connections,
+// as configured in the languages.
+func (m *RouteManager) StartLSPPool(ctx context.Context) {
+	m.lspm.StartPool(ctx)
+}
+
 func (m *RouteManager) Dispose() {
 	m.lspm.Dispose()
 }
@@ -18,7 +18,10 @@ import (
 	"github.com/google/go-cmp/cmp"
 	"github.com/gorilla/websocket"
 	"github.com/pasiasty/cocoder/server/common"
+	"github.com/pasiasty/cocoder/server/executor"
+	"github.com/pasiasty/cocoder/server/language_registry"
 	"github.com/pasiasty/cocoder/server/session_manager"
+	"github.com/pasiasty/cocoder/server/users_manager"
 )
 
 func prepareRouteManager(ctx context.Context) *RouteManager {
@@ -30,7 +33,12 @@ func prepareRouteManager(ctx context.Context) *RouteManager {
 		Addr: mr.Addr(),
 	})
 
-	return NewRouterManager(ctx, redisClient)
+	languages, err := language_registry.Load("../languages.json")
+	if err != nil {
+		log.Fatalf("Failed to load languages: %v", err)
+	}
+
+	return NewRouterManager(ctx, session_manager.NewRedisStore(redisClient), users_manager.NewLocalBroadcaster(), languages, executor.New(languages, executor.NewUnsafeLocalSandbox(), executor.NewQueue(4, 16), nil))
 }
 
 func createSession(t *testing.T, rm *RouteManager) string {
@@ -83,6 +91,7 @@ func TestLoadExistingSession(t *testing.T) {
 	s := loadSession(t, rm, sID)
 
 	if diff := compareSessions(&session_manager.Session{
+		Type:     session_manager.TextSession,
 		Users:    make(map[string]*common.User),
 		Language: "plaintext",
 	}, s); diff != "" {
@@ -102,6 +111,113 @@ func TestLoadNonExistingSession(t *testing.T) {
 	assert.Equal(t, http.StatusNotFound, w.Code)
 }
 
+func TestListLanguages(t *testing.T) {
+	ctx := context.Background()
+
+	rm := prepareRouteManager(ctx)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/languages", nil)
+	rm.Router().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	got := []language_registry.Info{}
+	assert.Equal(t, nil, json.Unmarshal(w.Body.Bytes(), &got))
+
+	want := []language_registry.Info{
+		{Name: "cpp", DisplayName: "C++", Extension: "cpp", Execute: true, Format: true, FormatRange: true, Lint: true, LSP: true},
+		{Name: "go", DisplayName: "Go", Extension: "go", Execute: true, Format: true, Lint: true, LSP: true},
+		{Name: "java", DisplayName: "Java", Extension: "java", Execute: true, Format: true, FormatRange: true, LSP: true},
+		{Name: "javascript", DisplayName: "JavaScript", Extension: "js", Execute: true, Format: true},
+		{Name: "kotlin", DisplayName: "Kotlin", Extension: "kt", Execute: true},
+		{Name: "python", DisplayName: "Python", Extension: "py", Execute: true, Format: true, FormatRange: true, Lint: true, LSP: true},
+		{Name: "rust", DisplayName: "Rust", Extension: "rs", Execute: true, Format: true},
+		{Name: "typescript", DisplayName: "TypeScript", Extension: "ts", Execute: true, Format: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Wrong languages, -want +got:\n%v", diff)
+	}
+}
+
+func TestCancelExecution(t *testing.T) {
+	ctx := context.Background()
+
+	rm := prepareRouteManager(ctx)
+	sID := createSession(t, rm)
+
+	if _, err := rm.sm.UpdateSession(ctx, session_manager.SessionID(sID), &common.UpdateSessionRequest{
+		UserID:             "user_1",
+		UpdateRunningState: true,
+		Running:            true,
+	}); err != nil {
+		t.Fatalf("Failed to update session: %v", err)
+	}
+
+	for _, tc := range []struct {
+		sessionID string
+		userID    string
+		wantCode  int
+	}{
+		{sessionID: "abc", userID: "user_1", wantCode: http.StatusNotFound},
+		{sessionID: sID, userID: "", wantCode: http.StatusForbidden},
+		{sessionID: sID, userID: "stranger", wantCode: http.StatusForbidden},
+		{sessionID: sID, userID: "user_1", wantCode: http.StatusOK},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/api/execute/%s/cancel", tc.sessionID), strings.NewReader(url.Values{"user_id": {tc.userID}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rm.Router().ServeHTTP(w, req)
+
+		assert.Equal(t, tc.wantCode, w.Code)
+		if tc.wantCode == http.StatusForbidden {
+			if s := loadSession(t, rm, sID); !s.Running {
+				t.Errorf("Session has stopped running after cancelling by %q", tc.userID)
+			}
+		}
+	}
+
+	if s := loadSession(t, rm, sID); s.Running {
+		t.Errorf("Session should stop running after cancelling")
+	}
+}
+
+func TestTestCases(t *testing.T) {
+	ctx := context.Background()
+
+	rm := prepareRouteManager(ctx)
+	sID := createSession(t, rm)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/api/%s/test_cases", sID), strings.NewReader(`[
+		{"Name": "visible", "Stdin": "1", "ExpectedStdout": "2"},
+		{"Name": "hidden", "Stdin": "3", "ExpectedStdout": "6", "Hidden": true}
+	]`))
+	rm.Router().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/api/%s/test_cases", sID), nil)
+	rm.Router().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	got := []common.TestCase{}
+	assert.Equal(t, nil, json.Unmarshal(w.Body.Bytes(), &got))
+
+	want := []common.TestCase{
+		{Name: "visible", Stdin: "1", ExpectedStdout: "2"},
+		{Name: "hidden", Hidden: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Wrong test cases, -want +got:\n%v", diff)
+	}
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("PUT", fmt.Sprintf("/api/%s/test_cases", sID), strings.NewReader(`[{"Name": "negative", "TimeLimitMs": -1}]`))
+	rm.Router().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
 func TestInteractWithTheWebsocket(t *testing.T) {
 	ctx := context.Background()
 
@@ -124,6 +240,15 @@ func TestInteractWithTheWebsocket(t *testing.T) {
 	}
 	defer conn.Close()
 
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	handshake := &common.UpdateSessionResponse{}
+	if err := conn.ReadJSON(handshake); err != nil {
+		t.Fatalf("Failed to read handshake from socket: %v", err)
+	}
+	if handshake.ResumeToken == "" {
+		t.Errorf("Handshake is missing the resume token")
+	}
+
 	conn.WriteJSON(&common.UpdateSessionRequest{
 		NewText: "abc",
 	})
@@ -141,9 +266,148 @@ func TestInteractWithTheWebsocket(t *testing.T) {
 	resp.Users = nil
 
 	if diff := cmp.Diff(&common.UpdateSessionResponse{
-		NewText:  "abc",
-		Language: "plaintext",
+		NewText:   "abc",
+		Language:  "plaintext",
+		Revision:  1,
+		Operation: common.Operation{{Insert: "abc"}},
 	}, resp); diff != "" {
 		t.Errorf("Obtained wrong response, -want +got:\n%v", diff)
 	}
 }
+
+func TestResumeWithWrongRevision(t *testing.T) {
+	ctx := context.Background()
+
+	rm := prepareRouteManager(ctx)
+
+	sID := createSession(t, rm)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/%s/u1/session_ws?resume_token=abc&revision=x", sID), nil)
+	rm.Router().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestSessionHistory(t *testing.T) {
+	ctx := context.Background()
+
+	rm := prepareRouteManager(ctx)
+
+	sID := createSession(t, rm)
+	if _, err := rm.sm.UpdateSession(ctx, session_manager.SessionID(sID), &common.UpdateSessionRequest{
+		UserID:  "u1",
+		NewText: "abc",
+	}); err != nil {
+		t.Fatalf("Failed to update session: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", fmt.Sprintf("/api/%s/history", sID), nil)
+	rm.Router().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	history := []*common.Revision{}
+	assert.Equal(t, nil, json.Unmarshal(w.Body.Bytes(), &history))
+	assert.Equal(t, 1, len(history))
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/api/%s/revision/1", sID), nil)
+	rm.Router().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	rev := &common.RevisionResponse{}
+	assert.Equal(t, nil, json.Unmarshal(w.Body.Bytes(), rev))
+	assert.Equal(t, "abc", rev.Text)
+	assert.Equal(t, "u1", rev.UserID)
+
+	w = httptest.NewRecorder()
+	req, _ = http.NewRequest("GET", fmt.Sprintf("/api/%s/revision/abc", sID), nil)
+	rm.Router().ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestReplaySession(t *testing.T) {
+	ctx := context.Background()
+
+	rm := prepareRouteManager(ctx)
+
+	sID := createSession(t, rm)
+	for _, text := range []string{"a", "ab"} {
+		if _, err := rm.sm.UpdateSession(ctx, session_manager.SessionID(sID), &common.UpdateSessionRequest{
+			UserID:   "u1",
+			BaseText: text[:len(text)-1],
+			NewText:  text,
+		}); err != nil {
+			t.Fatalf("Failed to update session: %v", err)
+		}
+	}
+
+	srv := httptest.NewServer(rm.Router())
+	defer srv.Close()
+
+	u := url.URL{
+		Scheme:   "ws",
+		Host:     strings.Replace(srv.URL, "http://", "", 1),
+		Path:     fmt.Sprintf("/api/%s/replay", sID),
+		RawQuery: "speed=10",
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(u.String(), nil)
+	if err != nil {
+		t.Fatalf("Failed to dial to the websocket: %v", err)
+	}
+	defer conn.Close()
+
+	texts := []string{}
+	for {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		frame := &common.ReplayFrame{}
+		if err := conn.ReadJSON(frame); err != nil {
+			t.Fatalf("Failed to read replay frame: %v", err)
+		}
+		if frame.Finished {
+			break
+		}
+		texts = append(texts, frame.NewText)
+	}
+
+	if diff := cmp.Diff([]string{"a", "ab"}, texts); diff != "" {
+		t.Errorf("Replay returned wrong frames, -want +got:\n%v", diff)
+	}
+}
+
+func TestLint(t *testing.T) {
+	ctx := context.Background()
+
+	rm := prepareRouteManager(ctx)
+	sID := createSession(t, rm)
+
+	for _, tc := range []struct {
+		sessionID string
+		language  string
+		wantCode  int
+	}{
+		{sessionID: "abc", language: "python", wantCode: http.StatusNotFound},
+		// Java has no linter.
+		{sessionID: sID, language: "java", wantCode: http.StatusInternalServerError},
+	} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest("POST", fmt.Sprintf("/api/lint/%s/%s", tc.sessionID, tc.language), nil)
+		rm.Router().ServeHTTP(w, req)
+
+		assert.Equal(t, tc.wantCode, w.Code)
+	}
+}
+
+func TestSharedLSPMissingSession(t *testing.T) {
+	ctx := context.Background()
+
+	rm := prepareRouteManager(ctx)
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest("GET", "/api/lsp/u1/python?session_id=abc", nil)
+	rm.Router().ServeHTTP(w, req)
+
+	assert.Equal(t, http.StatusNotFound, w.Code)
+}
@@ -0,0 +1,300 @@
+package session_manager
+
+import (
+	"encoding/binary"
+	"log"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	valuesBucket = []byte("values")
+	listsBucket  = []byte("lists")
+	expiryBucket = []byte("expiry")
+
+	boltExpiryCleanupInterval = time.Minute
+)
+
+// BoltStore keeps everything in a single file, which allows to run the server
+// without any external dependencies. Every list is a nested bucket keyed by
+// an increasing sequence number.
+type BoltStore struct {
+	db   *bolt.DB
+	done chan struct{}
+}
+
+// NewBoltStore opens (or creates) the database file. Expired keys are
+// removed in the background until the store is closed.
+func NewBoltStore(path string) (*BoltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{valuesBucket, listsBucket, expiryBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := &BoltStore{
+		db:   db,
+		done: make(chan struct{}),
+	}
+	go s.cleanupLoop()
+
+	return s, nil
+}
+
+func (s *BoltStore) Close() error {
+	close(s.done)
+	return s.db.Close()
+}
+
+func (s *BoltStore) cleanupLoop() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-time.After(boltExpiryCleanupInterval):
+			if err := s.removeExpired(); err != nil {
+				log.Printf("Failed to remove expired keys: %v", err)
+			}
+		}
+	}
+}
+
+func encodeTime(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano()))
+	return b
+}
+
+func decodeTime(b []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+}
+
+func expired(tx *bolt.Tx, key []byte) bool {
+	v := tx.Bucket(expiryBucket).Get(key)
+	return v != nil && !nowSource().Before(decodeTime(v))
+}
+
+func setExpiry(tx *bolt.Tx, key []byte, ttl time.Duration) error {
+	if ttl <= 0 {
+		return tx.Bucket(expiryBucket).Delete(key)
+	}
+	return tx.Bucket(expiryBucket).Put(key, encodeTime(nowSource().Add(ttl)))
+}
+
+func deleteKey(tx *bolt.Tx, key []byte) error {
+	if err := tx.Bucket(valuesBucket).Delete(key); err != nil {
+		return err
+	}
+	if tx.Bucket(listsBucket).Bucket(key) != nil {
+		if err := tx.Bucket(listsBucket).DeleteBucket(key); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(expiryBucket).Delete(key)
+}
+
+func (s *BoltStore) removeExpired() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		keys := [][]byte{}
+		if err := tx.Bucket(expiryBucket).ForEach(func(k, v []byte) error {
+			if !nowSource().Before(decodeTime(v)) {
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := deleteKey(tx, k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStore) Ping() error {
+	return s.db.View(func(tx *bolt.Tx) error { return nil })
+}
+
+func getValue(tx *bolt.Tx, key []byte) (string, error) {
+	v := tx.Bucket(valuesBucket).Get(key)
+	if v == nil || expired(tx, key) {
+		return "", ErrNotFound
+	}
+	return string(v), nil
+}
+
+func (s *BoltStore) Get(key string) (string, error) {
+	var res string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		var err error
+		res, err = getValue(tx, []byte(key))
+		return err
+	})
+	return res, err
+}
+
+func (s *BoltStore) Create(key, value string, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		k := []byte(key)
+		if err := deleteKey(tx, k); err != nil {
+			return err
+		}
+		if err := tx.Bucket(valuesBucket).Put(k, []byte(value)); err != nil {
+			return err
+		}
+		return setExpiry(tx, k, ttl)
+	})
+}
+
+func encodeSequence(seq uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, seq)
+	return b
+}
+
+func listBucket(tx *bolt.Tx, key []byte) (*bolt.Bucket, error) {
+	if expired(tx, key) {
+		if err := deleteKey(tx, key); err != nil {
+			return nil, err
+		}
+	}
+	return tx.Bucket(listsBucket).CreateBucketIfNotExists(key)
+}
+
+func trimFront(b *bolt.Bucket, n int) error {
+	keys := [][]byte{}
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil && len(keys) < n; k, _ = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+	}
+	for _, k := range keys {
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listLength relies on the values being removed only from the front of the
+// list, so that the sequence numbers are contiguous.
+func listLength(b *bolt.Bucket) int {
+	first, _ := b.Cursor().First()
+	if first == nil {
+		return 0
+	}
+	return int(b.Sequence() - binary.BigEndian.Uint64(first) + 1)
+}
+
+func applyBoltListUpdate(tx *bolt.Tx, lu ListUpdate) error {
+	k := []byte(lu.Key)
+	b, err := listBucket(tx, k)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range lu.Append {
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := b.Put(encodeSequence(seq), []byte(v)); err != nil {
+			return err
+		}
+	}
+	if lu.TrimFront > 0 {
+		if err := trimFront(b, lu.TrimFront); err != nil {
+			return err
+		}
+	}
+	if lu.MaxLength > 0 {
+		if l := listLength(b); l > lu.MaxLength {
+			if err := trimFront(b, l-lu.MaxLength); err != nil {
+				return err
+			}
+		}
+	}
+	if lu.TTL > 0 {
+		return setExpiry(tx, k, lu.TTL)
+	}
+	return nil
+}
+
+func (s *BoltStore) CompareAndSwap(key, oldValue, newValue string, ttl time.Duration, lists ...ListUpdate) (bool, error) {
+	swapped := false
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		k := []byte(key)
+		current, err := getValue(tx, k)
+		if err != nil && err != ErrNotFound {
+			return err
+		}
+		if current != oldValue {
+			return nil
+		}
+
+		if err := tx.Bucket(valuesBucket).Put(k, []byte(newValue)); err != nil {
+			return err
+		}
+		if err := setExpiry(tx, k, ttl); err != nil {
+			return err
+		}
+		for _, lu := range lists {
+			if err := applyBoltListUpdate(tx, lu); err != nil {
+				return err
+			}
+		}
+		swapped = true
+		return nil
+	})
+
+	return swapped, err
+}
+
+func (s *BoltStore) Delete(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return deleteKey(tx, []byte(key))
+	})
+}
+
+func (s *BoltStore) Expire(key string, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return setExpiry(tx, []byte(key), ttl)
+	})
+}
+
+func (s *BoltStore) AppendToList(key string, values []string, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return applyBoltListUpdate(tx, ListUpdate{Key: key, Append: values, TTL: ttl})
+	})
+}
+
+func (s *BoltStore) ListRange(key string) ([]string, error) {
+	res := []string{}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		k := []byte(key)
+		b := tx.Bucket(listsBucket).Bucket(k)
+		if b == nil || expired(tx, k) {
+			return nil
+		}
+		return b.ForEach(func(_, v []byte) error {
+			res = append(res, string(v))
+			return nil
+		})
+	})
+	return res, err
+}
@@ -0,0 +1,176 @@
+package session_manager
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func prepareBoltStore(t *testing.T) *BoltStore {
+	s, err := NewBoltStore(filepath.Join(t.TempDir(), "cocoder.db"))
+	if err != nil {
+		t.Fatalf("Failed to open BoltDB: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestBoltStoreValues(t *testing.T) {
+	s := prepareBoltStore(t)
+
+	if _, err := s.Get("key"); err != ErrNotFound {
+		t.Errorf("Get of non existing key returned %v, want ErrNotFound", err)
+	}
+
+	if err := s.Create("key", "a", time.Hour); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if v, err := s.Get("key"); err != nil || v != "a" {
+		t.Errorf("Get returned (%q, %v), want (\"a\", nil)", v, err)
+	}
+
+	if swapped, err := s.CompareAndSwap("key", "b", "c", time.Hour); err != nil || swapped {
+		t.Errorf("CompareAndSwap with stale value returned (%v, %v), want (false, nil)", swapped, err)
+	}
+	if swapped, err := s.CompareAndSwap("key", "a", "c", time.Hour); err != nil || !swapped {
+		t.Errorf("CompareAndSwap returned (%v, %v), want (true, nil)", swapped, err)
+	}
+	if v, err := s.Get("key"); err != nil || v != "c" {
+		t.Errorf("Get returned (%q, %v), want (\"c\", nil)", v, err)
+	}
+
+	if err := s.Delete("key"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := s.Get("key"); err != ErrNotFound {
+		t.Errorf("Get of deleted key returned %v, want ErrNotFound", err)
+	}
+}
+
+func TestBoltStoreLists(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		updates []ListUpdate
+		want    []string
+	}{
+		{
+			name: "append",
+			updates: []ListUpdate{
+				{Key: "list", Append: []string{"a", "b"}},
+				{Key: "list", Append: []string{"c"}},
+			},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "trim_front",
+			updates: []ListUpdate{
+				{Key: "list", Append: []string{"a", "b", "c"}},
+				{Key: "list", Append: []string{"d"}, TrimFront: 2},
+			},
+			want: []string{"c", "d"},
+		},
+		{
+			name: "max_length",
+			updates: []ListUpdate{
+				{Key: "list", Append: []string{"a", "b"}, MaxLength: 3},
+				{Key: "list", Append: []string{"c", "d"}, MaxLength: 3},
+				{Key: "list", Append: []string{"e"}, MaxLength: 3},
+			},
+			want: []string{"c", "d", "e"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := prepareBoltStore(t)
+			if err := s.Create("key", "value", time.Hour); err != nil {
+				t.Fatalf("Create failed: %v", err)
+			}
+
+			for _, lu := range tc.updates {
+				if swapped, err := s.CompareAndSwap("key", "value", "value", time.Hour, lu); err != nil || !swapped {
+					t.Fatalf("CompareAndSwap returned (%v, %v), want (true, nil)", swapped, err)
+				}
+			}
+
+			got, err := s.ListRange("list")
+			if err != nil {
+				t.Fatalf("ListRange failed: %v", err)
+			}
+			if diff := cmp.Diff(tc.want, got); diff != "" {
+				t.Errorf("ListRange returned wrong result, -want +got:\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestBoltStoreExpiry(t *testing.T) {
+	s := prepareBoltStore(t)
+
+	now := time.Date(2015, 2, 13, 0, 0, 0, 0, time.UTC)
+	nowSource = func() time.Time { return now }
+	defer func() { nowSource = time.Now }()
+
+	if err := s.Create("key", "value", time.Minute); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if err := s.AppendToList("list", []string{"a"}, time.Minute); err != nil {
+		t.Fatalf("AppendToList failed: %v", err)
+	}
+	if err := s.Expire("list", 2*time.Minute); err != nil {
+		t.Fatalf("Expire failed: %v", err)
+	}
+
+	now = now.Add(90 * time.Second)
+	if _, err := s.Get("key"); err != ErrNotFound {
+		t.Errorf("Get of expired key returned %v, want ErrNotFound", err)
+	}
+	if got, _ := s.ListRange("list"); len(got) != 1 {
+		t.Errorf("ListRange returned %v, the list shouldn't have expired yet", got)
+	}
+
+	now = now.Add(time.Minute)
+	if err := s.removeExpired(); err != nil {
+		t.Fatalf("removeExpired failed: %v", err)
+	}
+	if got, _ := s.ListRange("list"); len(got) != 0 {
+		t.Errorf("ListRange returned %v, the list should've expired", got)
+	}
+	if swapped, err := s.CompareAndSwap("key", "value", "new_value", time.Minute); err != nil || swapped {
+		t.Errorf("CompareAndSwap of expired key returned (%v, %v), want (false, nil)", swapped, err)
+	}
+}
+
+func TestSessionManagerWithBoltStore(t *testing.T) {
+	ctx := context.Background()
+	sm := NewSessionManager(prepareBoltStore(t))
+	s := sm.NewSession()
+
+	for _, req := range []*common.UpdateSessionRequest{
+		{UserID: "user_1", NewText: "abc"},
+		{UserID: "user_2", BaseText: "abc", NewText: "abcd"},
+	} {
+		if _, err := sm.UpdateSession(ctx, s, req); err != nil {
+			t.Fatalf("UpdateSession failed: %v", err)
+		}
+	}
+
+	session, err := sm.LoadSession(s)
+	if err != nil {
+		t.Fatalf("LoadSession failed: %v", err)
+	}
+	if session.Text != "abcd" {
+		t.Errorf("Session has text %q, want \"abcd\"", session.Text)
+	}
+
+	h, err := sm.History(s)
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if len(h) != 2 {
+		t.Errorf("History has %d revisions, want 2", len(h))
+	}
+}
@@ -0,0 +1,222 @@
+package session_manager
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/sergi/go-diff/diffmatchpatch"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+// SessionType selects how the text of the session is stored and merged.
+type SessionType string
+
+const (
+	// TextSession keeps a plain string merged by the server.
+	TextSession SessionType = "text"
+	// CRDTSession keeps a replicated sequence (RGA) whose operations commute,
+	// so that they can be merged in any order.
+	CRDTSession SessionType = "crdt"
+)
+
+func ParseSessionType(t string) (SessionType, bool) {
+	switch SessionType(t) {
+	case "", TextSession:
+		return TextSession, true
+	case CRDTSession:
+		return CRDTSession, true
+	}
+	return "", false
+}
+
+// CRDTElement is a single character of the document. Deleted characters are
+// kept as tombstones, as concurrent inserts may still refer to them.
+type CRDTElement struct {
+	ID      common.CharacterID `json:"ID" diff:"ID"`
+	Value   string             `json:"Value" diff:"Value"`
+	Deleted bool               `json:"Deleted" diff:"Deleted"`
+}
+
+// CRDTDocument is a Replicated Growable Array. Characters are ordered by the
+// position of their origin and, among siblings, by descending IDs.
+type CRDTDocument struct {
+	Elements []*CRDTElement `json:"Elements" diff:"Elements"`
+	Clock    int            `json:"Clock" diff:"Clock"`
+
+	// Pending holds operations referring to characters which were not
+	// integrated yet.
+	Pending []common.CRDTOperation `json:"Pending" diff:"Pending"`
+}
+
+func NewCRDTDocument() *CRDTDocument {
+	return &CRDTDocument{}
+}
+
+// idLess defines total order of the character IDs.
+func idLess(a, b common.CharacterID) bool {
+	if a.Clock != b.Clock {
+		return a.Clock < b.Clock
+	}
+	return a.Site < b.Site
+}
+
+func (d *CRDTDocument) indexOf(id common.CharacterID) int {
+	for i, e := range d.Elements {
+		if e.ID == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func (d *CRDTDocument) observeClock(clock int) {
+	if clock > d.Clock {
+		d.Clock = clock
+	}
+}
+
+// integrate applies a single operation. It returns false if the operation
+// refers to a character which is not known yet.
+func (d *CRDTDocument) integrate(op common.CRDTOperation) bool {
+	if op.Delete {
+		idx := d.indexOf(op.ID)
+		if idx < 0 {
+			return false
+		}
+		d.Elements[idx].Deleted = true
+		return true
+	}
+
+	if d.indexOf(op.ID) >= 0 {
+		// Already integrated, operations are idempotent.
+		return true
+	}
+
+	pos := 0
+	if op.Origin != (common.CharacterID{}) {
+		originIdx := d.indexOf(op.Origin)
+		if originIdx < 0 {
+			return false
+		}
+		pos = originIdx + 1
+	}
+
+	// Characters inserted concurrently after the same origin with greater IDs
+	// (and everything inserted after them) go first.
+	for pos < len(d.Elements) && idLess(op.ID, d.Elements[pos].ID) {
+		pos++
+	}
+
+	d.Elements = append(d.Elements, nil)
+	copy(d.Elements[pos+1:], d.Elements[pos:])
+	d.Elements[pos] = &CRDTElement{ID: op.ID, Value: op.Value}
+	d.observeClock(op.ID.Clock)
+	return true
+}
+
+// Integrate applies the operations in any order. Operations which can't be
+// applied yet are kept until the characters they depend on arrive.
+func (d *CRDTDocument) Integrate(ops []common.CRDTOperation) {
+	queue := append(d.Pending, ops...)
+	d.Pending = nil
+
+	for progress := true; progress; {
+		progress = false
+		var left []common.CRDTOperation
+		for _, op := range queue {
+			if d.integrate(op) {
+				progress = true
+			} else {
+				left = append(left, op)
+			}
+		}
+		queue = left
+	}
+	d.Pending = queue
+}
+
+func (d *CRDTDocument) Text() string {
+	b := strings.Builder{}
+	for _, e := range d.Elements {
+		if !e.Deleted {
+			b.WriteString(e.Value)
+		}
+	}
+	return b.String()
+}
+
+// visibleIndex returns the index in Elements of the n-th visible character,
+// or len(Elements) if there are not enough characters.
+func (d *CRDTDocument) visibleIndex(n int) int {
+	for i, e := range d.Elements {
+		if e.Deleted {
+			continue
+		}
+		if n == 0 {
+			return i
+		}
+		n--
+	}
+	return len(d.Elements)
+}
+
+// localInsert creates operations inserting the text before the pos-th
+// visible character.
+func (d *CRDTDocument) localInsert(site string, pos int, text string) []common.CRDTOperation {
+	origin := common.CharacterID{}
+	if pos > 0 {
+		origin = d.Elements[d.visibleIndex(pos-1)].ID
+	}
+
+	res := []common.CRDTOperation{}
+	for _, r := range text {
+		op := common.CRDTOperation{
+			ID:     common.CharacterID{Site: site, Clock: d.Clock + 1},
+			Origin: origin,
+			Value:  string(r),
+		}
+		d.integrate(op)
+		res = append(res, op)
+		origin = op.ID
+	}
+	return res
+}
+
+// localDelete creates operations removing n visible characters starting
+// from the pos-th one.
+func (d *CRDTDocument) localDelete(pos, n int) []common.CRDTOperation {
+	res := []common.CRDTOperation{}
+	for i := 0; i < n; i++ {
+		op := common.CRDTOperation{
+			ID:     d.Elements[d.visibleIndex(pos)].ID,
+			Delete: true,
+		}
+		d.integrate(op)
+		res = append(res, op)
+	}
+	return res
+}
+
+// replaceText creates operations turning the document into the newText.
+func (d *CRDTDocument) replaceText(newText string) []common.CRDTOperation {
+	site := "server/" + uuid.New().String()
+	dmp := diffmatchpatch.New()
+
+	res := []common.CRDTOperation{}
+	pos := 0
+	for _, diff := range dmp.DiffMain(d.Text(), newText, false) {
+		l := utf8.RuneCountInString(diff.Text)
+		switch diff.Type {
+		case diffmatchpatch.DiffEqual:
+			pos += l
+		case diffmatchpatch.DiffInsert:
+			res = append(res, d.localInsert(site, pos, diff.Text)...)
+			pos += l
+		case diffmatchpatch.DiffDelete:
+			res = append(res, d.localDelete(pos, l)...)
+		}
+	}
+	return res
+}
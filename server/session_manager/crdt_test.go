@@ -0,0 +1,64 @@
+package session_manager
+
+import (
+	"testing"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func TestCRDTConcurrentInserts(t *testing.T) {
+	base := NewCRDTDocument()
+	baseOps := base.localInsert("site_0", 0, "ac")
+
+	doc1 := NewCRDTDocument()
+	doc1.Integrate(baseOps)
+	doc2 := NewCRDTDocument()
+	doc2.Integrate(baseOps)
+
+	ops1 := doc1.localInsert("site_1", 1, "xx")
+	ops2 := doc2.localInsert("site_2", 1, "b")
+	ops2 = append(ops2, doc2.localDelete(2, 1)...)
+
+	doc1.Integrate(ops2)
+	doc2.Integrate(ops1)
+
+	if doc1.Text() != doc2.Text() {
+		t.Fatalf("Documents did not converge: %q vs %q", doc1.Text(), doc2.Text())
+	}
+	if want := "abxx"; doc1.Text() != want {
+		t.Errorf("Wrong text after merge, want: %q got: %q", want, doc1.Text())
+	}
+}
+
+func TestCRDTOutOfOrderDelivery(t *testing.T) {
+	src := NewCRDTDocument()
+	ops := src.localInsert("site_1", 0, "abc")
+	ops = append(ops, src.localDelete(1, 1)...)
+
+	dst := NewCRDTDocument()
+	for i := len(ops) - 1; i >= 0; i-- {
+		dst.Integrate([]common.CRDTOperation{ops[i]})
+	}
+	// Duplicates are ignored.
+	dst.Integrate(ops)
+
+	if dst.Text() != "ac" || len(dst.Pending) != 0 {
+		t.Errorf("Wrong document state, text: %q pending: %v", dst.Text(), dst.Pending)
+	}
+}
+
+func TestCRDTReplaceText(t *testing.T) {
+	doc := NewCRDTDocument()
+	ops := doc.localInsert("site_1", 0, "some text")
+	ops = append(ops, doc.replaceText("some other text")...)
+
+	if doc.Text() != "some other text" {
+		t.Errorf("replaceText() produced wrong text: %q", doc.Text())
+	}
+
+	replica := NewCRDTDocument()
+	replica.Integrate(ops)
+	if replica.Text() != doc.Text() {
+		t.Errorf("Replica did not converge: %q vs %q", replica.Text(), doc.Text())
+	}
+}
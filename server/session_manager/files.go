@@ -0,0 +1,194 @@
+package session_manager
+
+import (
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+const maxFilesInSession = 100
+
+// File is a single file of the session's file tree.
+type File struct {
+	Path     string `json:"Path" diff:"Path"`
+	Text     string `json:"Text" diff:"Text"`
+	Language string `json:"Language" diff:"Language"`
+
+	// Revision and Operations track the edits of the Text, as the ones of the
+	// session do for the main file.
+	Revision   int                `json:"Revision" diff:"Revision"`
+	Operations []common.Operation `json:"Operations" diff:"Operations"`
+}
+
+// setText replaces the Text keeping the operations history consistent.
+func (f *File) setText(newText string) common.Operation {
+	if newText == f.Text {
+		return nil
+	}
+	op := OperationFromTexts(f.Text, newText)
+	f.Text = newText
+	f.recordOperation(op)
+	return op
+}
+
+func (f *File) recordOperation(op common.Operation) {
+	f.Revision++
+	f.Operations = appendOperation(f.Operations, op)
+}
+
+// ValidateFilePath checks that the path is relative and stays inside of the
+// session's file tree.
+func ValidateFilePath(p string) error {
+	if p == "" || strings.HasPrefix(p, "/") || strings.Contains(p, "\\") {
+		return fmt.Errorf("file path %q has to be relative", p)
+	}
+	if path.Clean(p) != p {
+		return fmt.Errorf("file path %q is not canonical", p)
+	}
+	for _, part := range strings.Split(p, "/") {
+		if part == ".." || part == "." {
+			return fmt.Errorf("file path %q can't refer to parent directories", p)
+		}
+	}
+	return nil
+}
+
+func (s *Session) usersInFile(p string) map[string]*common.User {
+	res := make(map[string]*common.User)
+	for id, u := range s.Users {
+		if u.ActiveFile == p {
+			res[id] = u
+		}
+	}
+	return res
+}
+
+func (s *Session) filePaths() []string {
+	var res []string
+	for p := range s.Files {
+		res = append(res, p)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// FilesContent returns the text of all the files apart from the main one.
+func (s *Session) FilesContent() map[string]string {
+	res := make(map[string]string)
+	for p, f := range s.Files {
+		res[p] = f.Text
+	}
+	return res
+}
+
+func (s *Session) deleteFile(p string) {
+	delete(s.Files, p)
+	for _, u := range s.usersInFile(p) {
+		u.ActiveFile = ""
+		u.Position = 0
+		u.HasSelection = false
+		u.SelectionStart = 0
+		u.SelectionEnd = 0
+	}
+}
+
+func (s *Session) rejectFileEdit(req *common.UpdateSessionRequest) *common.UpdateSessionResponse {
+	// The response describes the main file, which must stay intact.
+	req.File = ""
+	req.Language = ""
+	return s.resyncResponse(req)
+}
+
+// documentState returns the text and the language of the file, the main one
+// for the empty path. Both are empty for a missing file.
+func (s *Session) documentState(p string) (string, string) {
+	if p == "" {
+		return s.Text, s.Language
+	}
+	if f, ok := s.Files[p]; ok {
+		return f.Text, f.Language
+	}
+	return "", ""
+}
+
+func fileResponse(resp *common.UpdateSessionResponse, f *File) *common.UpdateSessionResponse {
+	resp.File = f.Path
+	resp.NewText = f.Text
+	resp.Language = f.Language
+	resp.Revision = f.Revision
+	return resp
+}
+
+// applyFileOperation applies the operation of the client to the file, as
+// applyOperation does for the main file.
+func (s *Session) applyFileOperation(f *File, req *common.UpdateSessionRequest) *common.UpdateSessionResponse {
+	op, newText, ok := transformRequest(req, f.Text, f.Revision, f.Operations)
+	if !ok {
+		return s.rejectFileEdit(req)
+	}
+	if req.Language != "" {
+		f.Language = req.Language
+	}
+
+	if isNoop(op) {
+		s.updateRequestingUser(req)
+		return fileResponse(s.prepareResponse(req), f)
+	}
+
+	moveUsers(s.usersInFile(f.Path), req.UserID, op)
+	s.updateRequestingUser(req)
+
+	f.Text = newText
+	f.recordOperation(op)
+
+	return fileResponse(s.operationResponse(req, op), f)
+}
+
+// updateFile applies the edit of the file other than the main one, with the
+// operations or merged as plain text.
+func (s *Session) updateFile(req *common.UpdateSessionRequest) *common.UpdateSessionResponse {
+	if err := ValidateFilePath(req.File); err != nil {
+		log.Printf("Rejecting file edit: %v", err)
+		return s.rejectFileEdit(req)
+	}
+
+	if req.DeleteFile {
+		s.deleteFile(req.File)
+		req.File = ""
+		req.Language = ""
+		return s.prepareResponse(req)
+	}
+
+	f, ok := s.Files[req.File]
+	if !ok {
+		if len(s.Files) >= maxFilesInSession {
+			log.Printf("Rejecting file %q, session already has %d files", req.File, len(s.Files))
+			return s.rejectFileEdit(req)
+		}
+		if s.Files == nil {
+			s.Files = make(map[string]*File)
+		}
+		f = &File{Path: req.File, Language: "plaintext"}
+		s.Files[req.File] = f
+	}
+
+	if req.UseOperations {
+		return s.applyFileOperation(f, req)
+	}
+	if req.Language != "" {
+		f.Language = req.Language
+	}
+
+	validateRequest(req)
+	s.updateRequestingUser(req)
+
+	var op common.Operation
+	if !(f.Text == req.BaseText && req.BaseText == req.NewText) {
+		op = f.setText(mergeText(f.Text, s.usersInFile(req.File), req))
+	}
+	return fileResponse(s.operationResponse(req, op), f)
+}
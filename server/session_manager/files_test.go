@@ -0,0 +1,128 @@
+package session_manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func TestValidateFilePath(t *testing.T) {
+	for p, wantOK := range map[string]bool{
+		"main.go":         true,
+		"pkg/util/a.go":   true,
+		"":                false,
+		"/etc/passwd":     false,
+		"../outside.py":   false,
+		"a/../../b.py":    false,
+		"a//b.py":         false,
+		"./a.py":          false,
+		"dir\\file.py":    false,
+		"some dir/a b.py": true,
+	} {
+		if err := ValidateFilePath(p); (err == nil) != wantOK {
+			t.Errorf("ValidateFilePath(%q) returned: %v", p, err)
+		}
+	}
+}
+
+func TestUpdateFiles(t *testing.T) {
+	specialDate := time.Date(2015, 2, 13, 0, 0, 0, 0, time.UTC)
+	nowSource = func() time.Time { return specialDate }
+
+	s := DefaultSession()
+	s.Text = "main text"
+	s.Users["user_2"] = &common.User{ID: "user_2", Index: 0, Position: 4}
+
+	resp := s.Update(&common.UpdateSessionRequest{
+		UserID:    "user_1",
+		File:      "lib/util.py",
+		NewText:   "def f(): pass",
+		CursorPos: 13,
+		Language:  "python",
+	})
+
+	if resp.File != "lib/util.py" || resp.NewText != "def f(): pass" || resp.Language != "python" {
+		t.Errorf("Wrong response for the file edit: %+v", resp)
+	}
+	if diff := cmp.Diff([]string{"lib/util.py"}, resp.Files); diff != "" {
+		t.Errorf("Wrong list of files, -want +got:\n%v", diff)
+	}
+	if s.Text != "main text" || s.Language != "plaintext" {
+		t.Errorf("Main file should not change, got text: %q language: %q", s.Text, s.Language)
+	}
+	if s.Users["user_1"].ActiveFile != "lib/util.py" || s.Users["user_2"].Position != 4 {
+		t.Errorf("Wrong cursors: %+v %+v", s.Users["user_1"], s.Users["user_2"])
+	}
+
+	// Edits of the main file don't move cursors in other files.
+	s.Update(&common.UpdateSessionRequest{
+		UserID:    "user_2",
+		BaseText:  "main text",
+		NewText:   "new main text",
+		CursorPos: 4,
+	})
+	if s.Users["user_1"].Position != 13 {
+		t.Errorf("Cursor in the other file has moved to %v", s.Users["user_1"].Position)
+	}
+
+	if diff := cmp.Diff(map[string]string{"lib/util.py": "def f(): pass"}, s.FilesContent()); diff != "" {
+		t.Errorf("Wrong files content, -want +got:\n%v", diff)
+	}
+
+	resp = s.Update(&common.UpdateSessionRequest{
+		UserID:     "user_2",
+		File:       "lib/util.py",
+		DeleteFile: true,
+	})
+	if len(resp.Files) != 0 || s.Users["user_1"].ActiveFile != "" {
+		t.Errorf("File was not deleted properly: %+v", resp)
+	}
+
+	resp = s.Update(&common.UpdateSessionRequest{
+		UserID:   "user_2",
+		File:     "../escape.py",
+		NewText:  "abc",
+		Language: "python",
+	})
+	if !resp.Resync || len(resp.Files) != 0 || s.Language != "plaintext" {
+		t.Errorf("File outside of the tree should be rejected: %+v", resp)
+	}
+}
+
+func TestUpdateFileWithOperations(t *testing.T) {
+	s := DefaultSession()
+	s.Text = "main text"
+
+	resp := s.Update(&common.UpdateSessionRequest{UserID: "user_1", File: "a.py", NewText: "abc", CursorPos: 3})
+	if resp.Revision != 1 || s.Revision != 0 {
+		t.Fatalf("Only the file revision should be bumped, got file: %d session: %d", resp.Revision, s.Revision)
+	}
+
+	// Concurrent edits of the same revision are transformed against each other.
+	for _, req := range []*common.UpdateSessionRequest{
+		{UserID: "user_1", File: "a.py", UseOperations: true, Revision: 1, Operation: common.Operation{{Retain: 3}, {Insert: "d"}}, CursorPos: 4},
+		{UserID: "user_2", File: "a.py", UseOperations: true, Revision: 1, Operation: common.Operation{{Insert: "x"}, {Retain: 3}}, CursorPos: 1},
+	} {
+		if resp := s.Update(req); resp.Resync || resp.File != "a.py" {
+			t.Fatalf("Wrong response for the file operation: %+v", resp)
+		}
+	}
+
+	f := s.Files["a.py"]
+	if f.Text != "xabcd" || f.Revision != 3 || len(f.Operations) != 3 {
+		t.Errorf("Wrong file, text: %q revision: %d operations: %v", f.Text, f.Revision, f.Operations)
+	}
+	if s.Text != "main text" || s.Revision != 0 {
+		t.Errorf("Main file should not change, got text: %q revision: %d", s.Text, s.Revision)
+	}
+	if got := s.Users["user_1"].Position; got != 5 {
+		t.Errorf("Cursor of user_1 was not moved, got: %d", got)
+	}
+
+	if resp := s.Update(&common.UpdateSessionRequest{UserID: "user_2", File: "a.py", UseOperations: true, Revision: 7, Operation: common.Operation{{Retain: 5}, {Insert: "y"}}}); !resp.Resync {
+		t.Errorf("Operation of the unknown revision should be rejected: %+v", resp)
+	}
+}
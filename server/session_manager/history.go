@@ -0,0 +1,239 @@
+package session_manager
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+var (
+	maxHistoryRevisions = 1000
+	// Every historySnapshotInterval revisions the full text is stored, so that
+	// revisions can still be reconstructed once the oldest ones are dropped.
+	historySnapshotInterval = 50
+)
+
+type storedRevision struct {
+	common.Revision
+	HasSnapshot bool   `json:"HasSnapshot"`
+	Snapshot    string `json:"Snapshot"`
+	// FileSnapshots holds the text of the files apart from the main one.
+	FileSnapshots map[string]string `json:"FileSnapshots"`
+}
+
+func historyKey(sessionID SessionID) string {
+	return fmt.Sprintf("%s:history", sessionID)
+}
+
+func makePatch(oldText, newText string) string {
+	dmp := diffmatchpatch.New()
+	return dmp.PatchToText(dmp.PatchMake(oldText, newText))
+}
+
+func applyPatch(text, patch string) (string, error) {
+	dmp := diffmatchpatch.New()
+	patches, err := dmp.PatchFromText(patch)
+	if err != nil {
+		return "", err
+	}
+	res, applied := dmp.PatchApply(patches, text)
+	for _, ok := range applied {
+		if !ok {
+			return "", fmt.Errorf("patch could not be applied")
+		}
+	}
+	return res, nil
+}
+
+// recordRevision appends the revision to the history if the text or the
+// language of the file has changed. A deleted file is recorded as emptied.
+func recordRevision(sessionID SessionID, s *Session, userID, file, oldText, oldLanguage string) *ListUpdate {
+	text, language := s.documentState(file)
+	if text == oldText && language == oldLanguage {
+		return nil
+	}
+
+	s.RecordedRevisions++
+	rev := storedRevision{
+		Revision: common.Revision{
+			Number:    s.RecordedRevisions,
+			UserID:    userID,
+			Timestamp: nowSource(),
+			File:      file,
+			Language:  language,
+			Diff:      makePatch(oldText, text),
+		},
+	}
+	if (rev.Number-1)%historySnapshotInterval == 0 {
+		rev.HasSnapshot = true
+		rev.Snapshot = s.Text
+		rev.FileSnapshots = s.FilesContent()
+	}
+
+	b, err := json.Marshal(rev)
+	if err != nil {
+		log.Printf("Failed to encode revision: %v", err)
+		return nil
+	}
+
+	return &ListUpdate{
+		Key:       historyKey(sessionID),
+		Append:    []string{string(b)},
+		MaxLength: maxHistoryRevisions,
+		TTL:       sessionExpiry,
+	}
+}
+
+func (m *SessionManager) loadHistory(sessionID SessionID) ([]*storedRevision, error) {
+	raw, err := m.store.ListRange(historyKey(sessionID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load history of session '%s': %v", sessionID, err)
+	}
+
+	res := []*storedRevision{}
+	for _, r := range raw {
+		rev := &storedRevision{}
+		if err := json.Unmarshal([]byte(r), rev); err != nil {
+			return nil, fmt.Errorf("failed to decode revision of session '%s': %v", sessionID, err)
+		}
+		res = append(res, rev)
+	}
+	return res, nil
+}
+
+// History returns all the retained revisions of the session, oldest first.
+func (m *SessionManager) History(sessionID SessionID) ([]*common.Revision, error) {
+	if _, err := m.LoadSession(sessionID); err != nil {
+		return nil, err
+	}
+
+	stored, err := m.loadHistory(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []*common.Revision{}
+	for _, rev := range stored {
+		r := rev.Revision
+		res = append(res, &r)
+	}
+	return res, nil
+}
+
+var (
+	errRevisionMissing     = errors.New("does not exist")
+	errRevisionUnavailable = errors.New("is no longer available")
+)
+
+// historyReader reconstructs the texts of the revisions, moving forward it
+// reuses the texts already reconstructed.
+type historyReader struct {
+	revisions []*storedRevision
+	// idx is the index of the revision of the texts, -1 before the first one.
+	idx   int
+	text  string
+	files map[string]string
+}
+
+// documentText returns the text of the file, the main one for the empty path.
+func (h *historyReader) documentText(p string) string {
+	if p == "" {
+		return h.text
+	}
+	return h.files[p]
+}
+
+func (h *historyReader) restore(idx int) {
+	rev := h.revisions[idx]
+	h.idx, h.text = idx, rev.Snapshot
+	h.files = make(map[string]string)
+	for p, text := range rev.FileSnapshots {
+		h.files[p] = text
+	}
+}
+
+func (h *historyReader) apply(idx int) error {
+	rev := h.revisions[idx]
+	text, err := applyPatch(h.documentText(rev.File), rev.Diff)
+	if err != nil {
+		return err
+	}
+
+	h.idx = idx
+	switch {
+	case rev.File == "":
+		h.text = text
+	case text == "" && rev.Language == "":
+		delete(h.files, rev.File)
+	default:
+		h.files[rev.File] = text
+	}
+	return nil
+}
+
+func newHistoryReader(revisions []*storedRevision) *historyReader {
+	return &historyReader{revisions: revisions, idx: -1}
+}
+
+// seek reconstructs the text of the revision with the given number.
+func (h *historyReader) seek(number int) (*storedRevision, error) {
+	if len(h.revisions) == 0 || number < h.revisions[0].Number || number > h.revisions[len(h.revisions)-1].Number {
+		return nil, errRevisionMissing
+	}
+
+	end := number - h.revisions[0].Number
+	if end < h.idx {
+		h.idx = -1
+	}
+	start := end
+	for start > h.idx && !h.revisions[start].HasSnapshot {
+		start--
+	}
+	if start > h.idx {
+		h.restore(start)
+	} else if h.idx < 0 {
+		return nil, errRevisionUnavailable
+	}
+
+	for h.idx < end {
+		if err := h.apply(h.idx + 1); err != nil {
+			h.idx = -1
+			return nil, err
+		}
+	}
+	return h.revisions[end], nil
+}
+
+// Revision reconstructs the text of the session at the given revision.
+func (m *SessionManager) Revision(sessionID SessionID, number int) (*common.RevisionResponse, error) {
+	if _, err := m.LoadSession(sessionID); err != nil {
+		return nil, err
+	}
+
+	stored, err := m.loadHistory(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	h := newHistoryReader(stored)
+	rev, err := h.seek(number)
+	if err == errRevisionMissing || err == errRevisionUnavailable {
+		return nil, fmt.Errorf("revision %d of session '%s' %v", number, sessionID, err)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to reconstruct revision %d of session '%s': %v", number, sessionID, err)
+	}
+
+	return &common.RevisionResponse{
+		Number:    rev.Number,
+		UserID:    rev.UserID,
+		Timestamp: rev.Timestamp,
+		File:      rev.File,
+		Language:  rev.Language,
+		Text:      h.documentText(rev.File),
+	}, nil
+}
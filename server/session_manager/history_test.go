@@ -0,0 +1,167 @@
+package session_manager
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func TestHistory(t *testing.T) {
+	ctx := context.Background()
+	sm := prepareSessionManager(t)
+	s := sm.NewSession()
+
+	date := time.Date(2015, 2, 13, 0, 0, 0, 0, time.UTC)
+	nowSource = func() time.Time { return date }
+
+	for _, req := range []*common.UpdateSessionRequest{
+		{UserID: "user_1", NewText: "abc"},
+		{UserID: "user_1", BaseText: "abc", NewText: "abc"},
+		{UserID: "user_2", BaseText: "abc", NewText: "abcd", Language: "python"},
+		{UserID: "user_1", Language: "go"},
+	} {
+		if _, err := sm.UpdateSession(ctx, s, req); err != nil {
+			t.Fatalf("UpdateSession failed: %v", err)
+		}
+	}
+
+	h, err := sm.History(s)
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	for _, r := range h {
+		r.Diff = ""
+	}
+
+	if diff := cmp.Diff([]*common.Revision{
+		{Number: 1, UserID: "user_1", Timestamp: date, Language: "plaintext"},
+		{Number: 2, UserID: "user_2", Timestamp: date, Language: "python"},
+		{Number: 3, UserID: "user_1", Timestamp: date, Language: "go"},
+	}, h); diff != "" {
+		t.Errorf("History returned wrong result, -want +got:\n%v", diff)
+	}
+
+	r, err := sm.Revision(s, 2)
+	if err != nil {
+		t.Fatalf("Revision failed: %v", err)
+	}
+	if diff := cmp.Diff(&common.RevisionResponse{
+		Number:    2,
+		UserID:    "user_2",
+		Timestamp: date,
+		Language:  "python",
+		Text:      "abcd",
+	}, r); diff != "" {
+		t.Errorf("Revision returned wrong result, -want +got:\n%v", diff)
+	}
+
+	if _, err := sm.Revision(s, 4); err == nil {
+		t.Error("Revision should've failed for non existing revision, but didn't")
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	ctx := context.Background()
+	sm := prepareSessionManager(t)
+	s := sm.NewSession()
+
+	oldMax, oldInterval := maxHistoryRevisions, historySnapshotInterval
+	defer func() { maxHistoryRevisions, historySnapshotInterval = oldMax, oldInterval }()
+	maxHistoryRevisions, historySnapshotInterval = 5, 3
+
+	text := ""
+	for i := 0; i < 10; i++ {
+		newText := text + fmt.Sprint(i)
+		if _, err := sm.UpdateSession(ctx, s, &common.UpdateSessionRequest{BaseText: text, NewText: newText}); err != nil {
+			t.Fatalf("UpdateSession failed: %v", err)
+		}
+		text = newText
+	}
+
+	h, err := sm.History(s)
+	if err != nil {
+		t.Fatalf("History failed: %v", err)
+	}
+	if len(h) != 5 || h[0].Number != 6 {
+		t.Fatalf("History was not trimmed, got %d revisions starting at %d", len(h), h[0].Number)
+	}
+
+	// The closest snapshot before revision 6 was dropped.
+	if _, err := sm.Revision(s, 6); err == nil {
+		t.Error("Revision 6 should not be available")
+	}
+
+	r, err := sm.Revision(s, 9)
+	if err != nil {
+		t.Fatalf("Revision failed: %v", err)
+	}
+	if r.Text != "012345678" {
+		t.Errorf("Revision returned wrong text: %q", r.Text)
+	}
+}
+
+func TestHistoryOfFiles(t *testing.T) {
+	oldInterval := historySnapshotInterval
+	defer func() { historySnapshotInterval = oldInterval }()
+	historySnapshotInterval = 3
+
+	ctx := context.Background()
+	sm := prepareSessionManager(t)
+	s := sm.NewSession()
+
+	for _, req := range []*common.UpdateSessionRequest{
+		{UserID: "user_1", NewText: "main"},
+		{UserID: "user_1", File: "a.py", NewText: "abc", Language: "python"},
+		{UserID: "user_2", File: "b.py", NewText: "x"},
+		// The snapshot holds the files as well.
+		{UserID: "user_2", File: "a.py", UseOperations: true, Revision: 1, Operation: common.Operation{{Retain: 3}, {Insert: "d"}}},
+		{UserID: "user_2", File: "b.py", DeleteFile: true},
+		{UserID: "user_1", File: "a.py", BaseText: "abcd", NewText: "abcde"},
+	} {
+		if _, err := sm.UpdateSession(ctx, s, req); err != nil {
+			t.Fatalf("UpdateSession failed: %v", err)
+		}
+	}
+
+	for _, want := range []struct {
+		number   int
+		file     string
+		language string
+		text     string
+	}{
+		{1, "", "plaintext", "main"},
+		{2, "a.py", "python", "abc"},
+		{4, "a.py", "python", "abcd"},
+		{5, "b.py", "", ""},
+		{6, "a.py", "python", "abcde"},
+	} {
+		r, err := sm.Revision(s, want.number)
+		if err != nil {
+			t.Fatalf("Revision(%d) failed: %v", want.number, err)
+		}
+		if r.File != want.file || r.Language != want.language || r.Text != want.text {
+			t.Errorf("Revision(%d) returned file: %q language: %q text: %q, want: %+v", want.number, r.File, r.Language, r.Text, want)
+		}
+	}
+
+	rec, err := sm.Recording(s)
+	if err != nil {
+		t.Fatalf("Recording failed: %v", err)
+	}
+	var last *common.ReplayFrame
+	for {
+		f, err := rec.Next()
+		if err != nil {
+			break
+		}
+		last = f
+	}
+	if diff := cmp.Diff(map[string]string{"a.py": "abcde"}, last.Files); diff != "" || last.NewText != "main" {
+		t.Errorf("Wrong last frame, text: %q files -want +got:\n%v", last.NewText, diff)
+	}
+}
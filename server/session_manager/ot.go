@@ -0,0 +1,309 @@
+package session_manager
+
+import (
+	"fmt"
+	"unicode/utf8"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+// maxOperationsHistory bounds the amount of operations kept in the session.
+// Clients lagging behind more revisions than that have to resync.
+const maxOperationsHistory = 500
+
+type componentKind int
+
+const (
+	retainComponent componentKind = iota
+	insertComponent
+	deleteComponent
+)
+
+func kindOf(c common.OperationComponent) componentKind {
+	switch {
+	case c.Insert != "":
+		return insertComponent
+	case c.Delete > 0:
+		return deleteComponent
+	}
+	return retainComponent
+}
+
+// operationBuilder creates normalized operations: empty components are
+// skipped and neighbouring components of the same kind are merged.
+type operationBuilder struct {
+	op common.Operation
+}
+
+func (b *operationBuilder) retain(n int) {
+	if n <= 0 {
+		return
+	}
+	if l := len(b.op); l > 0 && kindOf(b.op[l-1]) == retainComponent {
+		b.op[l-1].Retain += n
+		return
+	}
+	b.op = append(b.op, common.OperationComponent{Retain: n})
+}
+
+func (b *operationBuilder) insert(s string) {
+	if s == "" {
+		return
+	}
+	if l := len(b.op); l > 0 && kindOf(b.op[l-1]) == insertComponent {
+		b.op[l-1].Insert += s
+		return
+	}
+	b.op = append(b.op, common.OperationComponent{Insert: s})
+}
+
+func (b *operationBuilder) delete(n int) {
+	if n <= 0 {
+		return
+	}
+	if l := len(b.op); l > 0 && kindOf(b.op[l-1]) == deleteComponent {
+		b.op[l-1].Delete += n
+		return
+	}
+	b.op = append(b.op, common.OperationComponent{Delete: n})
+}
+
+func (b *operationBuilder) add(c common.OperationComponent) {
+	switch kindOf(c) {
+	case insertComponent:
+		b.insert(c.Insert)
+	case deleteComponent:
+		b.delete(c.Delete)
+	default:
+		b.retain(c.Retain)
+	}
+}
+
+func (b *operationBuilder) operation() common.Operation {
+	return b.op
+}
+
+func validateOperation(op common.Operation) error {
+	for _, c := range op {
+		set := 0
+		if c.Retain != 0 {
+			set++
+		}
+		if c.Insert != "" {
+			set++
+		}
+		if c.Delete != 0 {
+			set++
+		}
+		if set != 1 || c.Retain < 0 || c.Delete < 0 {
+			return fmt.Errorf("malformed operation component: %+v", c)
+		}
+	}
+	return nil
+}
+
+// baseLength returns the length of the document the operation can be applied to.
+func baseLength(op common.Operation) int {
+	res := 0
+	for _, c := range op {
+		res += c.Retain + c.Delete
+	}
+	return res
+}
+
+// isNoop reports whether applying the operation leaves the document unchanged.
+func isNoop(op common.Operation) bool {
+	for _, c := range op {
+		if kindOf(c) != retainComponent {
+			return false
+		}
+	}
+	return true
+}
+
+// applyOperation applies the operation to the text.
+func applyOperation(text string, op common.Operation) (string, error) {
+	if err := validateOperation(op); err != nil {
+		return "", err
+	}
+
+	runes := []rune(text)
+	if l := baseLength(op); l != len(runes) {
+		return "", fmt.Errorf("operation spans %d characters, but the text has %d", l, len(runes))
+	}
+
+	res := make([]rune, 0, len(runes))
+	pos := 0
+	for _, c := range op {
+		switch kindOf(c) {
+		case retainComponent:
+			res = append(res, runes[pos:pos+c.Retain]...)
+			pos += c.Retain
+		case insertComponent:
+			res = append(res, []rune(c.Insert)...)
+		case deleteComponent:
+			pos += c.Delete
+		}
+	}
+	return string(res), nil
+}
+
+// componentIterator walks through an operation, allowing to consume its
+// components partially.
+type componentIterator struct {
+	op  common.Operation
+	idx int
+	// offset inside the current component (in runes)
+	offset int
+}
+
+func (it *componentIterator) done() bool {
+	return it.idx >= len(it.op)
+}
+
+func (it *componentIterator) peekKind() componentKind {
+	return kindOf(it.op[it.idx])
+}
+
+func (it *componentIterator) peekLength() int {
+	c := it.op[it.idx]
+	switch kindOf(c) {
+	case insertComponent:
+		return utf8.RuneCountInString(c.Insert) - it.offset
+	case deleteComponent:
+		return c.Delete - it.offset
+	}
+	return c.Retain - it.offset
+}
+
+// next consumes at most n runes of the current component.
+func (it *componentIterator) next(n int) common.OperationComponent {
+	c := it.op[it.idx]
+	l := it.peekLength()
+	if n > l {
+		n = l
+	}
+
+	var res common.OperationComponent
+	switch kindOf(c) {
+	case insertComponent:
+		res.Insert = string([]rune(c.Insert)[it.offset : it.offset+n])
+	case deleteComponent:
+		res.Delete = n
+	default:
+		res.Retain = n
+	}
+
+	if n == l {
+		it.idx++
+		it.offset = 0
+	} else {
+		it.offset += n
+	}
+	return res
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// transformOperations transforms two concurrent operations a and b, both
+// applicable to the same document, into a' and b' such that
+// apply(apply(doc, a), b') == apply(apply(doc, b), a'). When both operations
+// insert at the same position, the insertion of a is placed first.
+func transformOperations(a, b common.Operation) (common.Operation, common.Operation, error) {
+	if err := validateOperation(a); err != nil {
+		return nil, nil, err
+	}
+	if err := validateOperation(b); err != nil {
+		return nil, nil, err
+	}
+	if baseLength(a) != baseLength(b) {
+		return nil, nil, fmt.Errorf("concurrent operations span different lengths: %d and %d", baseLength(a), baseLength(b))
+	}
+
+	aPrime := &operationBuilder{}
+	bPrime := &operationBuilder{}
+	ia := &componentIterator{op: a}
+	ib := &componentIterator{op: b}
+
+	for !ia.done() || !ib.done() {
+		if !ia.done() && ia.peekKind() == insertComponent {
+			c := ia.next(ia.peekLength())
+			aPrime.add(c)
+			bPrime.retain(utf8.RuneCountInString(c.Insert))
+			continue
+		}
+		if !ib.done() && ib.peekKind() == insertComponent {
+			c := ib.next(ib.peekLength())
+			aPrime.retain(utf8.RuneCountInString(c.Insert))
+			bPrime.add(c)
+			continue
+		}
+		if ia.done() || ib.done() {
+			return nil, nil, fmt.Errorf("concurrent operations span different lengths")
+		}
+
+		n := minInt(ia.peekLength(), ib.peekLength())
+		ka, kb := ia.peekKind(), ib.peekKind()
+		ia.next(n)
+		ib.next(n)
+
+		switch {
+		case ka == retainComponent && kb == retainComponent:
+			aPrime.retain(n)
+			bPrime.retain(n)
+		case ka == deleteComponent && kb == retainComponent:
+			aPrime.delete(n)
+		case ka == retainComponent && kb == deleteComponent:
+			bPrime.delete(n)
+		}
+		// When both operations delete the same range, nothing is left to do.
+	}
+
+	return aPrime.operation(), bPrime.operation(), nil
+}
+
+// transformPosition moves the position in the text to reflect the operation.
+func transformPosition(pos int, op common.Operation) int {
+	res := pos
+	idx := 0
+	for _, c := range op {
+		if idx > pos {
+			break
+		}
+		switch kindOf(c) {
+		case retainComponent:
+			idx += c.Retain
+		case insertComponent:
+			res += utf8.RuneCountInString(c.Insert)
+		case deleteComponent:
+			res -= minInt(pos-idx, c.Delete)
+			idx += c.Delete
+		}
+	}
+	return res
+}
+
+// OperationFromTexts creates an operation transforming oldText into newText.
+func OperationFromTexts(oldText, newText string) common.Operation {
+	dmp := diffmatchpatch.New()
+	b := &operationBuilder{}
+
+	for _, d := range dmp.DiffMain(oldText, newText, false) {
+		switch d.Type {
+		case diffmatchpatch.DiffEqual:
+			b.retain(utf8.RuneCountInString(d.Text))
+		case diffmatchpatch.DiffInsert:
+			b.insert(d.Text)
+		case diffmatchpatch.DiffDelete:
+			b.delete(utf8.RuneCountInString(d.Text))
+		}
+	}
+	return b.operation()
+}
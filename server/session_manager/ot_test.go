@@ -0,0 +1,183 @@
+package session_manager
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func TestApplyOperation(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		text      string
+		op        common.Operation
+		wantText  string
+		wantError bool
+	}{{
+		name:     "insert_into_empty",
+		op:       common.Operation{{Insert: "abc"}},
+		wantText: "abc",
+	}, {
+		name:     "insert_delete_retain",
+		text:     "abcdef",
+		op:       common.Operation{{Retain: 1}, {Insert: "xy"}, {Delete: 2}, {Retain: 3}},
+		wantText: "axydef",
+	}, {
+		name:     "multibyte_characters",
+		text:     "zażółć",
+		op:       common.Operation{{Retain: 2}, {Delete: 3}, {Insert: "x"}, {Retain: 1}},
+		wantText: "zaxć",
+	}, {
+		name:      "too_short",
+		text:      "abc",
+		op:        common.Operation{{Retain: 2}},
+		wantError: true,
+	}, {
+		name:      "malformed_component",
+		text:      "abc",
+		op:        common.Operation{{Retain: 2, Delete: 1}},
+		wantError: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			res, err := applyOperation(tc.text, tc.op)
+			if err != nil && !tc.wantError {
+				t.Fatalf("applyOperation() shouldn't have failed but did: %v", err)
+			}
+			if err == nil && tc.wantError {
+				t.Fatal("applyOperation() should've failed, but didn't")
+			}
+			if res != tc.wantText {
+				t.Errorf("applyOperation() returned wrong result, want: %q got: %q", tc.wantText, res)
+			}
+		})
+	}
+}
+
+func TestTransformOperations(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		text     string
+		a        common.Operation
+		b        common.Operation
+		wantText string
+	}{{
+		name:     "inserts_at_different_positions",
+		text:     "abc",
+		a:        common.Operation{{Insert: "x"}, {Retain: 3}},
+		b:        common.Operation{{Retain: 3}, {Insert: "y"}},
+		wantText: "xabcy",
+	}, {
+		name:     "inserts_at_the_same_position",
+		text:     "abc",
+		a:        common.Operation{{Retain: 1}, {Insert: "x"}, {Retain: 2}},
+		b:        common.Operation{{Retain: 1}, {Insert: "y"}, {Retain: 2}},
+		wantText: "axybc",
+	}, {
+		name:     "overlapping_deletes",
+		text:     "abcdef",
+		a:        common.Operation{{Retain: 1}, {Delete: 3}, {Retain: 2}},
+		b:        common.Operation{{Retain: 2}, {Delete: 3}, {Retain: 1}},
+		wantText: "af",
+	}, {
+		name:     "insert_inside_deleted_range",
+		text:     "abcdef",
+		a:        common.Operation{{Retain: 3}, {Insert: "x"}, {Retain: 3}},
+		b:        common.Operation{{Retain: 1}, {Delete: 4}, {Retain: 1}},
+		wantText: "axf",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			aPrime, bPrime, err := transformOperations(tc.a, tc.b)
+			if err != nil {
+				t.Fatalf("transformOperations() failed: %v", err)
+			}
+
+			afterA, err := applyOperation(tc.text, tc.a)
+			if err != nil {
+				t.Fatalf("applyOperation() failed: %v", err)
+			}
+			afterB, err := applyOperation(tc.text, tc.b)
+			if err != nil {
+				t.Fatalf("applyOperation() failed: %v", err)
+			}
+
+			res1, err := applyOperation(afterA, bPrime)
+			if err != nil {
+				t.Fatalf("applyOperation() failed: %v", err)
+			}
+			res2, err := applyOperation(afterB, aPrime)
+			if err != nil {
+				t.Fatalf("applyOperation() failed: %v", err)
+			}
+
+			if res1 != tc.wantText || res2 != tc.wantText {
+				t.Errorf("operations did not converge, want: %q got: %q and %q", tc.wantText, res1, res2)
+			}
+		})
+	}
+}
+
+func TestTransformPosition(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		pos     int
+		op      common.Operation
+		wantPos int
+	}{{
+		name:    "insert_before",
+		pos:     2,
+		op:      common.Operation{{Insert: "xyz"}, {Retain: 4}},
+		wantPos: 5,
+	}, {
+		name:    "insert_after",
+		pos:     2,
+		op:      common.Operation{{Retain: 3}, {Insert: "xyz"}, {Retain: 1}},
+		wantPos: 2,
+	}, {
+		name:    "delete_before",
+		pos:     3,
+		op:      common.Operation{{Delete: 2}, {Retain: 2}},
+		wantPos: 1,
+	}, {
+		name:    "delete_around",
+		pos:     3,
+		op:      common.Operation{{Retain: 1}, {Delete: 3}},
+		wantPos: 1,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if res := transformPosition(tc.pos, tc.op); res != tc.wantPos {
+				t.Errorf("transformPosition() returned wrong result, want: %v got: %v", tc.wantPos, res)
+			}
+		})
+	}
+}
+
+func TestOperationFromTexts(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		oldText string
+		newText string
+		wantOp  common.Operation
+	}{{
+		name:    "append",
+		oldText: "abc",
+		newText: "abcd",
+		wantOp:  common.Operation{{Retain: 3}, {Insert: "d"}},
+	}, {
+		name:    "replace_multibyte",
+		oldText: "zażółć",
+		newText: "zażółw",
+		wantOp:  common.Operation{{Retain: 5}, {Delete: 1}, {Insert: "w"}},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			op := OperationFromTexts(tc.oldText, tc.newText)
+			if diff := cmp.Diff(tc.wantOp, op); diff != "" {
+				t.Errorf("OperationFromTexts() returned wrong result, -want +got:\n%v", diff)
+			}
+			if res, err := applyOperation(tc.oldText, op); err != nil || res != tc.newText {
+				t.Errorf("applying the operation gave %q (%v), want %q", res, err, tc.newText)
+			}
+		})
+	}
+}
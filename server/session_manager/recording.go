@@ -0,0 +1,160 @@
+package session_manager
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+var maxRecordedEvents = 10000
+
+// recordedEvent holds the cursors of the users after the edit, the text is
+// the one of the revision in the history.
+type recordedEvent struct {
+	Number    int            `json:"Number"`
+	Timestamp time.Time      `json:"Timestamp"`
+	UserID    string         `json:"UserID"`
+	Language  string         `json:"Language"`
+	Users     []*common.User `json:"Users"`
+	// Revision is the number of the recorded revision, 0 before the first one.
+	Revision int `json:"Revision"`
+}
+
+func recordingKey(sessionID SessionID) string {
+	return fmt.Sprintf("%s:recording", sessionID)
+}
+
+func copyUsers(users map[string]*common.User) map[string]common.User {
+	res := make(map[string]common.User)
+	for id, u := range users {
+		res[id] = *u
+	}
+	return res
+}
+
+func usersMoved(old map[string]common.User, users map[string]*common.User) bool {
+	if len(old) != len(users) {
+		return true
+	}
+	for id, u := range users {
+		o, ok := old[id]
+		if !ok || o.Position != u.Position || o.HasSelection != u.HasSelection ||
+			o.SelectionStart != u.SelectionStart || o.SelectionEnd != u.SelectionEnd {
+			return true
+		}
+	}
+	return false
+}
+
+// recordEvent appends the edit to the session recording if a revision was
+// recorded for it or any of the cursors has changed. It must follow
+// recordRevision, whose revision it refers to.
+func recordEvent(sessionID SessionID, s *Session, userID string, revised bool, oldUsers map[string]common.User) *ListUpdate {
+	if !revised && !usersMoved(oldUsers, s.Users) {
+		return nil
+	}
+
+	users := []*common.User{}
+	for _, u := range s.Users {
+		uc := *u
+		users = append(users, &uc)
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Index < users[j].Index
+	})
+
+	s.RecordedEvents++
+	ev := recordedEvent{
+		Number:    s.RecordedEvents,
+		Timestamp: nowSource(),
+		UserID:    userID,
+		Language:  s.Language,
+		Users:     users,
+		Revision:  s.RecordedRevisions,
+	}
+
+	b, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("Failed to encode recorded event: %v", err)
+		return nil
+	}
+
+	return &ListUpdate{
+		Key:       recordingKey(sessionID),
+		Append:    []string{string(b)},
+		MaxLength: maxRecordedEvents,
+		TTL:       sessionExpiry,
+	}
+}
+
+// Recording replays the recorded events of the session one by one.
+type Recording struct {
+	events  []*recordedEvent
+	idx     int
+	history *historyReader
+}
+
+// Recording loads the recording of the session. It does not modify the
+// session in any way.
+func (m *SessionManager) Recording(sessionID SessionID) (*Recording, error) {
+	if _, err := m.LoadSession(sessionID); err != nil {
+		return nil, err
+	}
+
+	raw, err := m.store.ListRange(recordingKey(sessionID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to load recording of session '%s': %v", sessionID, err)
+	}
+	history, err := m.loadHistory(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &Recording{history: newHistoryReader(history)}
+	for _, e := range raw {
+		ev := &recordedEvent{}
+		if err := json.Unmarshal([]byte(e), ev); err != nil {
+			return nil, fmt.Errorf("failed to decode recorded event of session '%s': %v", sessionID, err)
+		}
+		r.events = append(r.events, ev)
+	}
+	return r, nil
+}
+
+// Next returns the state of the session after the next event, or io.EOF when
+// there are no more events. Events whose revision was dropped from the
+// history are skipped.
+func (r *Recording) Next() (*common.ReplayFrame, error) {
+	for r.idx < len(r.events) {
+		ev := r.events[r.idx]
+		r.idx++
+
+		frame := &common.ReplayFrame{
+			Timestamp: ev.Timestamp,
+			UserID:    ev.UserID,
+			Language:  ev.Language,
+			Files:     map[string]string{},
+			Users:     ev.Users,
+		}
+		if ev.Revision == 0 {
+			return frame, nil
+		}
+
+		if _, err := r.history.seek(ev.Revision); err == errRevisionMissing || err == errRevisionUnavailable {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to reconstruct event %d: %v", ev.Number, err)
+		}
+		frame.NewText = r.history.text
+		for p, text := range r.history.files {
+			frame.Files[p] = text
+		}
+		return frame, nil
+	}
+	return nil, io.EOF
+}
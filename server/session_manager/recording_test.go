@@ -0,0 +1,108 @@
+package session_manager
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func TestRecording(t *testing.T) {
+	ctx := context.Background()
+	sm := prepareSessionManager(t)
+	s := sm.NewSession()
+
+	start := time.Date(2015, 2, 13, 0, 0, 0, 0, time.UTC)
+
+	for i, req := range []*common.UpdateSessionRequest{
+		{UserID: "user_1", NewText: "abc", CursorPos: 3},
+		{UserID: "user_1", BaseText: "abc", NewText: "abc", CursorPos: 1},
+		// Nothing changes, so nothing is recorded.
+		{UserID: "user_1", BaseText: "abc", NewText: "abc", CursorPos: 1},
+		{UserID: "user_1", BaseText: "abc", NewText: "axbc", CursorPos: 2},
+	} {
+		nowSource = func() time.Time { return start.Add(time.Duration(i) * time.Second) }
+		if _, err := sm.UpdateSession(ctx, s, req); err != nil {
+			t.Fatalf("UpdateSession failed: %v", err)
+		}
+	}
+
+	session, err := sm.LoadSession(s)
+	if err != nil {
+		t.Fatalf("LoadSession failed: %v", err)
+	}
+
+	r, err := sm.Recording(s)
+	if err != nil {
+		t.Fatalf("Recording failed: %v", err)
+	}
+
+	for _, want := range []struct {
+		text     string
+		position int
+		offset   time.Duration
+	}{
+		{"abc", 3, 0},
+		{"abc", 1, time.Second},
+		{"axbc", 2, 3 * time.Second},
+	} {
+		f, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if f.NewText != want.text || f.Users[0].Position != want.position || !f.Timestamp.Equal(start.Add(want.offset)) {
+			t.Errorf("Wrong frame, want: %+v got text: %q position: %v timestamp: %v", want, f.NewText, f.Users[0].Position, f.Timestamp)
+		}
+	}
+
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Recording should have ended, got: %v", err)
+	}
+
+	after, err := sm.LoadSession(s)
+	if err != nil {
+		t.Fatalf("LoadSession failed: %v", err)
+	}
+	if !after.LastEdit.Equal(session.LastEdit) {
+		t.Errorf("Reading the recording modified the session: %v vs %v", after.LastEdit, session.LastEdit)
+	}
+}
+
+func TestRecordingTrimmedHistory(t *testing.T) {
+	oldMax, oldInterval := maxHistoryRevisions, historySnapshotInterval
+	defer func() { maxHistoryRevisions, historySnapshotInterval = oldMax, oldInterval }()
+	maxHistoryRevisions, historySnapshotInterval = 3, 3
+
+	ctx := context.Background()
+	sm := prepareSessionManager(t)
+	s := sm.NewSession()
+
+	text := ""
+	for _, next := range []string{"a", "ab", "abc", "abcd", "abcde"} {
+		if _, err := sm.UpdateSession(ctx, s, &common.UpdateSessionRequest{UserID: "user_1", BaseText: text, NewText: next, Language: "go"}); err != nil {
+			t.Fatalf("UpdateSession failed: %v", err)
+		}
+		text = next
+	}
+
+	r, err := sm.Recording(s)
+	if err != nil {
+		t.Fatalf("Recording failed: %v", err)
+	}
+
+	// Revisions 3-5 are retained, the 3rd one precedes the oldest snapshot.
+	for _, want := range []string{"abcd", "abcde"} {
+		f, err := r.Next()
+		if err != nil {
+			t.Fatalf("Next failed: %v", err)
+		}
+		if f.NewText != want || f.Language != "go" {
+			t.Errorf("Wrong frame, want text: %q got text: %q language: %q", want, f.NewText, f.Language)
+		}
+	}
+	if _, err := r.Next(); err != io.EOF {
+		t.Errorf("Recording should have ended, got: %v", err)
+	}
+}
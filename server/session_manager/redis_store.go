@@ -0,0 +1,107 @@
+package session_manager
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+type redisStore struct {
+	c *redis.Client
+}
+
+func NewRedisStore(c *redis.Client) Store {
+	return &redisStore{
+		c: c,
+	}
+}
+
+func (s *redisStore) Ping() error {
+	return s.c.Ping().Err()
+}
+
+func (s *redisStore) Get(key string) (string, error) {
+	val, err := s.c.Get(key).Result()
+	if err == redis.Nil {
+		return "", ErrNotFound
+	}
+	return val, err
+}
+
+func (s *redisStore) Create(key, value string, ttl time.Duration) error {
+	return s.c.Set(key, value, ttl).Err()
+}
+
+func applyListUpdate(pipe redis.Pipeliner, lu ListUpdate) {
+	if len(lu.Append) > 0 {
+		values := []interface{}{}
+		for _, v := range lu.Append {
+			values = append(values, v)
+		}
+		pipe.RPush(lu.Key, values...)
+	}
+	if lu.TrimFront > 0 {
+		pipe.LTrim(lu.Key, int64(lu.TrimFront), -1)
+	}
+	if lu.MaxLength > 0 {
+		pipe.LTrim(lu.Key, int64(-lu.MaxLength), -1)
+	}
+	if lu.TTL > 0 {
+		pipe.Expire(lu.Key, lu.TTL)
+	}
+}
+
+func (s *redisStore) CompareAndSwap(key, oldValue, newValue string, ttl time.Duration, lists ...ListUpdate) (bool, error) {
+	swapped := false
+
+	err := s.c.Watch(func(tx *redis.Tx) error {
+		current, err := tx.Get(key).Result()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		if current != oldValue {
+			return nil
+		}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, newValue, ttl)
+			for _, lu := range lists {
+				applyListUpdate(pipe, lu)
+			}
+			return nil
+		})
+		if err == nil {
+			swapped = true
+		}
+		return err
+	}, key)
+
+	if err == redis.TxFailedErr {
+		return false, nil
+	}
+	return swapped, err
+}
+
+func (s *redisStore) Delete(key string) error {
+	return s.c.Del(key).Err()
+}
+
+func (s *redisStore) Expire(key string, ttl time.Duration) error {
+	return s.c.Expire(key, ttl).Err()
+}
+
+func (s *redisStore) AppendToList(key string, values []string, ttl time.Duration) error {
+	_, err := s.c.Pipelined(func(pipe redis.Pipeliner) error {
+		applyListUpdate(pipe, ListUpdate{Key: key, Append: values, TTL: ttl})
+		return nil
+	})
+	return err
+}
+
+func (s *redisStore) ListRange(key string) ([]string, error) {
+	res, err := s.c.LRange(key, 0, -1).Result()
+	if err == redis.Nil {
+		return []string{}, nil
+	}
+	return res, err
+}
@@ -0,0 +1,31 @@
+package session_manager
+
+import (
+	"fmt"
+
+	"github.com/google/uuid"
+)
+
+func resumeTokenKey(sessionID SessionID, userID string) string {
+	return fmt.Sprintf("%s:resume_token:%s", sessionID, userID)
+}
+
+// NewResumeToken issues the token allowing the user to resume the connection
+// to the session. It replaces the previously issued one.
+func (m *SessionManager) NewResumeToken(sessionID SessionID, userID string) (string, error) {
+	token := uuid.New().String()
+	if err := m.store.Create(resumeTokenKey(sessionID, userID), token, sessionExpiry); err != nil {
+		return "", fmt.Errorf("failed to store resume token of user '%s' in session '%s': %v", userID, sessionID, err)
+	}
+	return token, nil
+}
+
+// ValidResumeToken checks whether the token was the last one issued to the
+// user in the session.
+func (m *SessionManager) ValidResumeToken(sessionID SessionID, userID, token string) bool {
+	if token == "" {
+		return false
+	}
+	stored, err := m.store.Get(resumeTokenKey(sessionID, userID))
+	return err == nil && stored == token
+}
@@ -0,0 +1,96 @@
+package session_manager
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+// sessionSchemaVersion is the version of the format written by
+// serializeSession. Whenever the format changes incompatibly, bump it and
+// register the migration from the previous version in sessionMigrations.
+const sessionSchemaVersion = 1
+
+// legacySessionVersion denotes gob encoded sessions, stored before the
+// envelope was introduced.
+const legacySessionVersion = 0
+
+type sessionEnvelope struct {
+	Version int             `json:"Version"`
+	Session json.RawMessage `json:"Session"`
+}
+
+type sessionMigration = func(payload []byte) ([]byte, error)
+
+// sessionMigrations converts the payload of the given version to the next one.
+var sessionMigrations = map[int]sessionMigration{
+	legacySessionVersion: migrateGobSession,
+}
+
+func init() {
+	gob.Register(&Session{})
+	gob.Register(&common.User{})
+}
+
+func migrateGobSession(payload []byte) ([]byte, error) {
+	s := &Session{}
+	if err := gob.NewDecoder(bytes.NewBuffer(payload)).Decode(s); err != nil {
+		return nil, fmt.Errorf("failed to decode legacy session: %v", err)
+	}
+	return json.Marshal(s)
+}
+
+func serializeSession(s *Session) (string, error) {
+	payload, err := json.Marshal(s)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode session: %v", err)
+	}
+
+	b, err := json.Marshal(sessionEnvelope{
+		Version: sessionSchemaVersion,
+		Session: payload,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode session: %v", err)
+	}
+	return string(b), nil
+}
+
+// deserializeSession decodes the session stored in any of the known versions.
+// Unknown fields are ignored, so that the sessions written by newer servers
+// with the same schema version can still be read.
+func deserializeSession(s string) (*Session, error) {
+	env := sessionEnvelope{}
+	if err := json.Unmarshal([]byte(s), &env); err != nil || env.Version == legacySessionVersion {
+		env = sessionEnvelope{
+			Version: legacySessionVersion,
+			Session: []byte(s),
+		}
+	}
+
+	if env.Version > sessionSchemaVersion {
+		return nil, fmt.Errorf("session schema version %d is not supported (newest known: %d)", env.Version, sessionSchemaVersion)
+	}
+
+	payload := []byte(env.Session)
+	for v := env.Version; v < sessionSchemaVersion; v++ {
+		migrate, ok := sessionMigrations[v]
+		if !ok {
+			return nil, fmt.Errorf("no migration from session schema version %d", v)
+		}
+
+		var err error
+		if payload, err = migrate(payload); err != nil {
+			return nil, err
+		}
+	}
+
+	res := &Session{}
+	if err := json.Unmarshal(payload, res); err != nil {
+		return nil, fmt.Errorf("failed to decode session: %v", err)
+	}
+	return res, nil
+}
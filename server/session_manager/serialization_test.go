@@ -0,0 +1,123 @@
+package session_manager
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func gobEncodeSession(t *testing.T, s *Session) string {
+	b := new(bytes.Buffer)
+	if err := gob.NewEncoder(b).Encode(s); err != nil {
+		t.Fatalf("Failed to encode session: %v", err)
+	}
+	return b.String()
+}
+
+func TestDeserializeSession(t *testing.T) {
+	legacy := &Session{
+		Text:     "abc",
+		Language: "go",
+		Users: map[string]*common.User{
+			"user_1": {ID: "user_1", Index: 1, Position: 2},
+		},
+	}
+
+	for _, tc := range []struct {
+		name    string
+		data    string
+		want    *Session
+		wantErr bool
+	}{{
+		name: "legacy_gob",
+		data: gobEncodeSession(t, legacy),
+		want: legacy,
+	}, {
+		name: "unknown_fields",
+		data: `{"Version":1,"Session":{"Text":"abc","NewField":123}}`,
+		want: &Session{Text: "abc"},
+	}, {
+		name:    "newer_version",
+		data:    `{"Version":2,"Session":{"Text":"abc"}}`,
+		wantErr: true,
+	}, {
+		name:    "corrupted",
+		data:    "corrupted",
+		wantErr: true,
+	}, {
+		name:    "corrupted_payload",
+		data:    `{"Version":1,"Session":{"Text":1}}`,
+		wantErr: true,
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := deserializeSession(tc.data)
+			if tc.wantErr {
+				if err == nil {
+					t.Errorf("deserializeSession should've failed, but didn't")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("deserializeSession failed: %v", err)
+			}
+
+			if diff := cmp.Diff(tc.want, got, cmpopts.IgnoreUnexported(Session{})); diff != "" {
+				t.Errorf("deserializeSession returned wrong result, -want +got:\n%v", diff)
+			}
+		})
+	}
+}
+
+func TestLegacySessionIsMigrated(t *testing.T) {
+	ctx := context.Background()
+	sm := prepareSessionManager(t)
+
+	legacy := DefaultSession()
+	legacy.Text = "abc"
+	if err := sm.store.Create("legacy", gobEncodeSession(t, legacy), sessionExpiry); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	if _, err := sm.UpdateSession(ctx, "legacy", &common.UpdateSessionRequest{UserID: "user_1", BaseText: "abc", NewText: "abcd"}); err != nil {
+		t.Fatalf("UpdateSession failed: %v", err)
+	}
+
+	stored, err := sm.store.Get("legacy")
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !strings.HasPrefix(stored, `{"Version":1,`) {
+		t.Errorf("Session should've been stored in the current format, got: %q", stored)
+	}
+
+	s, err := sm.LoadSession("legacy")
+	if err != nil {
+		t.Fatalf("LoadSession failed: %v", err)
+	}
+	if s.Text != "abcd" {
+		t.Errorf("Session has text %q, want \"abcd\"", s.Text)
+	}
+}
+
+func TestCorruptedSession(t *testing.T) {
+	ctx := context.Background()
+	sm := prepareSessionManager(t)
+
+	if err := sm.store.Create("corrupted", "corrupted", sessionExpiry); err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	if _, err := sm.LoadSession("corrupted"); err == nil {
+		t.Error("LoadSession should've failed, but didn't")
+	}
+	if _, err := sm.UpdateSession(ctx, "corrupted", &common.UpdateSessionRequest{NewText: "abc"}); err == nil {
+		t.Error("UpdateSession should've failed, but didn't")
+	}
+}
@@ -1,14 +1,14 @@
 package session_manager
 
 import (
-	"bytes"
-	"encoding/gob"
 	"fmt"
+	"log"
 	"regexp"
 	"sort"
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 
 	"github.com/sergi/go-diff/diffmatchpatch"
 
@@ -66,6 +66,10 @@ func sequencesToInsertByPosition(m map[string]*common.User) []SpecialSequence {
 type Session struct {
 	mux sync.Mutex
 
+	Type SessionType `json:"Type" diff:"Type"`
+	// Document is the source of the Text in CRDTSession sessions.
+	Document *CRDTDocument `json:"Document" diff:"Document"`
+
 	Text      string    `json:"Text" diff:"Text"`
 	Language  string    `json:"Language" diff:"Language"`
 	InputText string    `json:"InputText" diff:"InputText"`
@@ -74,22 +78,55 @@ type Session struct {
 	Running   bool      `json:"Running" diff:"Running"`
 	LastEdit  time.Time `json:"LastEdit" diff:"LastEdit"`
 
+	ExecutionResult *common.ExecutionResult `json:"ExecutionResult" diff:"ExecutionResult"`
+	LintResult      *common.LintResult      `json:"LintResult" diff:"LintResult"`
+
+	// Revision is incremented with every change of the Text. Operations holds
+	// the most recent operations, the last one producing the current Revision.
+	Revision   int                `json:"Revision" diff:"Revision"`
+	Operations []common.Operation `json:"Operations" diff:"Operations"`
+
+	// RecordedRevisions is the number of the last revision stored in the history.
+	RecordedRevisions int `json:"RecordedRevisions" diff:"RecordedRevisions"`
+	// RecordedEvents is the number of the last event stored in the recording.
+	RecordedEvents int `json:"RecordedEvents" diff:"RecordedEvents"`
+
+	// Files holds the file tree of the session apart from the main file,
+	// which is kept in the Text and the Language.
+	Files map[string]*File `json:"Files" diff:"Files"`
+
 	Users map[string]*common.User `json:"Users" diff:"Users"`
+
+	// AppliedSequences holds the Sequence of the last edit applied on behalf
+	// of every user.
+	AppliedSequences map[string]int `json:"AppliedSequences" diff:"AppliedSequences"`
 }
 
 func DefaultSession() *Session {
 	return &Session{
+		Type:     TextSession,
 		Language: "plaintext",
 		Users:    make(map[string]*common.User),
 	}
 }
 
+func defaultSessionOfType(t SessionType) *Session {
+	s := DefaultSession()
+	s.Type = t
+	if t == CRDTSession {
+		s.Document = NewCRDTDocument()
+	}
+	return s
+}
+
 func cursorSpecialSequenceRe() *regexp.Regexp {
 	return regexp.MustCompile(fmt.Sprintf(`([%s-%s])`, string(specialRuneStart), string(specialRuneEnd)))
 }
 
+// validateRequest resets the cursor outside of the text. Like in the
+// operations, the positions count the runes.
 func validateRequest(req *common.UpdateSessionRequest) {
-	if req.CursorPos < 0 || req.CursorPos > len(req.NewText) {
+	if req.CursorPos < 0 || req.CursorPos > utf8.RuneCountInString(req.NewText) {
 		req.CursorPos = 0
 	}
 }
@@ -104,6 +141,7 @@ func (s *Session) updateRequestingUser(req *common.UpdateSessionRequest) {
 		user.HasSelection = req.HasSelection
 		user.SelectionStart = req.SelectionStart
 		user.SelectionEnd = req.SelectionEnd
+		user.ActiveFile = req.File
 		user.LastEdit = nowSource()
 	} else {
 		s.Users[req.UserID] = &common.User{
@@ -113,6 +151,7 @@ func (s *Session) updateRequestingUser(req *common.UpdateSessionRequest) {
 			HasSelection:   req.HasSelection,
 			SelectionStart: req.SelectionStart,
 			SelectionEnd:   req.SelectionEnd,
+			ActiveFile:     req.File,
 			LastEdit:       nowSource(),
 		}
 	}
@@ -127,7 +166,7 @@ func (s *Session) prepareResponse(req *common.UpdateSessionRequest) *common.Upda
 		users = append(users, u)
 	}
 
-	if req.Language != "" {
+	if req.Language != "" && req.File == "" {
 		s.Language = req.Language
 	}
 
@@ -138,23 +177,34 @@ func (s *Session) prepareResponse(req *common.UpdateSessionRequest) *common.Upda
 	if req.UpdateOutputText {
 		s.Stdout = req.Stdout
 		s.Stderr = req.Stderr
+		s.ExecutionResult = req.ExecutionResult
 	}
 
 	if req.UpdateRunningState {
 		s.Running = req.Running
 	}
 
+	// The result of the older text, which took longer to lint, is dropped.
+	if req.UpdateLintResult && (s.LintResult == nil || req.LintResult == nil || req.LintResult.Revision >= s.LintResult.Revision) {
+		s.LintResult = req.LintResult
+	}
+
 	return &common.UpdateSessionResponse{
 		NewText:            s.Text,
 		Language:           s.Language,
 		Users:              users,
+		Files:              s.filePaths(),
+		Revision:           s.Revision,
 		UpdateInputText:    req.UpdateInputText,
 		InputText:          req.InputText,
 		UpdateOutputText:   req.UpdateOutputText,
 		Stdout:             req.Stdout,
 		Stderr:             req.Stderr,
+		ExecutionResult:    req.ExecutionResult,
 		UpdateRunningState: req.UpdateRunningState,
 		Running:            req.Running,
+		UpdateLintResult:   req.UpdateLintResult,
+		LintResult:         req.LintResult,
 	}
 }
 
@@ -175,7 +225,19 @@ func findTokenPosition(userIdx int, ro RuneOffset, textWithCursors string) int {
 	if rawNewPosition < 0 {
 		rawNewPosition = 0
 	}
-	return len(cursorSpecialSequenceRe().ReplaceAllString(textWithCursors[:rawNewPosition], ""))
+	return utf8.RuneCountInString(cursorSpecialSequenceRe().ReplaceAllString(textWithCursors[:rawNewPosition], ""))
+}
+
+// insertAt inserts the sequence at the rune offset, clamped to the text.
+func insertAt(text string, offset int, seq string) string {
+	runes := []rune(text)
+	if offset < 0 {
+		offset = 0
+	}
+	if offset > len(runes) {
+		offset = len(runes)
+	}
+	return string(runes[:offset]) + seq + string(runes[offset:])
 }
 
 func updateUserPosition(old *common.User, new *common.User) {
@@ -185,10 +247,213 @@ func updateUserPosition(old *common.User, new *common.User) {
 	old.SelectionEnd = new.SelectionEnd
 }
 
+// appendOperation adds the operation to the bounded operations history.
+func appendOperation(ops []common.Operation, op common.Operation) []common.Operation {
+	ops = append(ops, op)
+	if len(ops) > maxOperationsHistory {
+		ops = ops[len(ops)-maxOperationsHistory:]
+	}
+	return ops
+}
+
+// recordOperation stores the operation which has just been applied to the
+// Text and bumps the revision.
+func (s *Session) recordOperation(op common.Operation) {
+	s.Revision++
+	s.Operations = appendOperation(s.Operations, op)
+}
+
+// setText replaces the Text keeping the operations history consistent, so
+// that clients using operations can follow edits of the full-text clients.
+func (s *Session) setText(newText string) common.Operation {
+	if newText == s.Text {
+		return nil
+	}
+	op := OperationFromTexts(s.Text, newText)
+	s.Text = newText
+	s.recordOperation(op)
+	return op
+}
+
+// operationResponse prepares the response carrying the operation applied on
+// behalf of the requesting user, if any.
+func (s *Session) operationResponse(req *common.UpdateSessionRequest, op common.Operation) *common.UpdateSessionResponse {
+	resp := s.prepareResponse(req)
+	if op != nil {
+		resp.Operation = op
+		resp.OperationAuthor = req.UserID
+	}
+	return resp
+}
+
+func (s *Session) resyncResponse(req *common.UpdateSessionRequest) *common.UpdateSessionResponse {
+	resp := s.prepareResponse(req)
+	resp.Resync = true
+	return resp
+}
+
+// transformRequest transforms the operation sent by the client against all the
+// operations applied to the text since the client's revision, together with
+// the cursor of the request. It returns false if the client has to resync.
+func transformRequest(req *common.UpdateSessionRequest, text string, revision int, operations []common.Operation) (common.Operation, string, bool) {
+	firstKnownRevision := revision - len(operations)
+	if req.Revision < firstKnownRevision || req.Revision > revision {
+		log.Printf("Revision %d is out of the known range [%d, %d], requesting resync", req.Revision, firstKnownRevision, revision)
+		return nil, "", false
+	}
+
+	op := req.Operation
+	cursor := []int{req.CursorPos, req.SelectionStart, req.SelectionEnd}
+
+	for _, concurrent := range operations[req.Revision-firstKnownRevision:] {
+		var concurrentPrime common.Operation
+		var err error
+		op, concurrentPrime, err = transformOperations(op, concurrent)
+		if err != nil {
+			log.Printf("Failed to transform operation: %v", err)
+			return nil, "", false
+		}
+		for i := range cursor {
+			cursor[i] = transformPosition(cursor[i], concurrentPrime)
+		}
+	}
+
+	newText, err := applyOperation(text, op)
+	if err != nil {
+		log.Printf("Failed to apply operation: %v", err)
+		return nil, "", false
+	}
+
+	textLen := utf8.RuneCountInString(newText)
+	for i := range cursor {
+		if cursor[i] < 0 || cursor[i] > textLen {
+			cursor[i] = 0
+		}
+	}
+	req.CursorPos, req.SelectionStart, req.SelectionEnd = cursor[0], cursor[1], cursor[2]
+	return op, newText, true
+}
+
+// moveUsers moves the cursors of the users other than the author of the
+// operation.
+func moveUsers(users map[string]*common.User, authorID string, op common.Operation) {
+	for _, u := range users {
+		if u.ID == authorID {
+			continue
+		}
+		u.Position = transformPosition(u.Position, op)
+		u.SelectionStart = transformPosition(u.SelectionStart, op)
+		u.SelectionEnd = transformPosition(u.SelectionEnd, op)
+	}
+}
+
+// applyOperation transforms the operation sent by the client against all the
+// operations applied since the client's revision and applies it to the Text.
+func (s *Session) applyOperation(req *common.UpdateSessionRequest) *common.UpdateSessionResponse {
+	op, newText, ok := transformRequest(req, s.Text, s.Revision, s.Operations)
+	if !ok {
+		return s.resyncResponse(req)
+	}
+
+	if isNoop(op) {
+		s.updateRequestingUser(req)
+		return s.prepareResponse(req)
+	}
+
+	moveUsers(s.usersInFile(""), req.UserID, op)
+	s.updateRequestingUser(req)
+
+	s.Text = newText
+	s.recordOperation(op)
+
+	return s.operationResponse(req, op)
+}
+
+// isDuplicate checks whether the edit has been already applied, which
+// happens when the user resends the edits after reconnecting.
+func (s *Session) isDuplicate(req *common.UpdateSessionRequest) bool {
+	return req.Sequence > 0 && req.UserID != "" && req.Sequence <= s.AppliedSequences[req.UserID]
+}
+
+func (s *Session) markApplied(req *common.UpdateSessionRequest) {
+	if req.Sequence <= 0 || req.UserID == "" {
+		return
+	}
+	if s.AppliedSequences == nil {
+		s.AppliedSequences = make(map[string]int)
+	}
+	s.AppliedSequences[req.UserID] = req.Sequence
+}
+
 func (s *Session) Update(req *common.UpdateSessionRequest) *common.UpdateSessionResponse {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
+	if s.isDuplicate(req) {
+		log.Printf("Skipping edit %d of user %s, it's already applied", req.Sequence, req.UserID)
+		return s.prepareResponse(&common.UpdateSessionRequest{UserID: req.UserID})
+	}
+
+	resp := s.dispatch(req)
+	// Rejected edits are resent by the user after resyncing.
+	if !resp.Resync {
+		s.markApplied(req)
+	}
+	return resp
+}
+
+func (s *Session) dispatch(req *common.UpdateSessionRequest) *common.UpdateSessionResponse {
+	if req.File != "" {
+		return s.updateFile(req)
+	}
+	if s.Type == CRDTSession {
+		return s.updateDocument(req)
+	}
+	return s.update(req)
+}
+
+// integrateOperations merges CRDT operations into the Document and reflects
+// the result in the Text.
+func (s *Session) integrateOperations(ops []common.CRDTOperation) common.Operation {
+	s.Document.Integrate(ops)
+	op := s.setText(s.Document.Text())
+
+	if op != nil {
+		for _, u := range s.usersInFile("") {
+			u.Position = transformPosition(u.Position, op)
+			u.SelectionStart = transformPosition(u.SelectionStart, op)
+			u.SelectionEnd = transformPosition(u.SelectionEnd, op)
+		}
+	}
+	return op
+}
+
+func (s *Session) updateDocument(req *common.UpdateSessionRequest) *common.UpdateSessionResponse {
+	if len(req.CRDTOperations) == 0 {
+		// Clients not aware of the CRDT are merged as in the text sessions,
+		// the result is then turned into the CRDT operations.
+		s.integrateOperations(nil)
+		resp := s.update(req)
+		resp.CRDTOperations = s.Document.replaceText(s.Text)
+		return resp
+	}
+
+	op := s.integrateOperations(req.CRDTOperations)
+	if req.CursorPos < 0 || req.CursorPos > utf8.RuneCountInString(s.Text) {
+		req.CursorPos = 0
+	}
+	s.updateRequestingUser(req)
+
+	resp := s.operationResponse(req, op)
+	resp.CRDTOperations = req.CRDTOperations
+	return resp
+}
+
+func (s *Session) update(req *common.UpdateSessionRequest) *common.UpdateSessionResponse {
+	if req.UseOperations {
+		return s.applyOperation(req)
+	}
+
 	validateRequest(req)
 	s.updateRequestingUser(req)
 
@@ -196,28 +461,37 @@ func (s *Session) Update(req *common.UpdateSessionRequest) *common.UpdateSession
 		return s.prepareResponse(req)
 	}
 
-	if s.Text == req.BaseText {
+	return s.operationResponse(req, s.setText(mergeText(s.Text, s.usersInFile(""), req)))
+}
+
+// mergeText merges the edit of the requesting user into the text, moving
+// cursors of the users accordingly.
+func mergeText(text string, users map[string]*common.User, req *common.UpdateSessionRequest) string {
+	if text == req.BaseText {
 		for _, u := range req.Users {
-			updateUserPosition(s.Users[u.ID], u)
+			if su, ok := users[u.ID]; ok {
+				updateUserPosition(su, u)
+			}
 		}
-		s.Text = req.NewText
-		return s.prepareResponse(req)
+		return req.NewText
 	}
 
-	for _, seq := range sequencesToInsertByPosition(s.Users) {
+	textWithCursors := text
+
+	for _, seq := range sequencesToInsertByPosition(users) {
 		if seq.userID == req.UserID {
-			req.NewText = req.NewText[:seq.position] + seq.text + req.NewText[seq.position:]
+			req.NewText = insertAt(req.NewText, seq.position, seq.text)
 		} else {
-			s.Text = s.Text[:seq.position] + seq.text + s.Text[seq.position:]
+			textWithCursors = insertAt(textWithCursors, seq.position, seq.text)
 		}
 
 	}
 
 	dmp := diffmatchpatch.New()
 	userPatches := dmp.PatchMake(dmp.DiffMain(req.BaseText, req.NewText, false))
-	textWithCursors, _ := dmp.PatchApply(userPatches, s.Text)
+	textWithCursors, _ = dmp.PatchApply(userPatches, textWithCursors)
 
-	for _, u := range s.Users {
+	for _, u := range users {
 		u.Position = findTokenPosition(u.Index, Cursor, textWithCursors)
 
 		if u.HasSelection {
@@ -226,26 +500,5 @@ func (s *Session) Update(req *common.UpdateSessionRequest) *common.UpdateSession
 		}
 	}
 
-	s.Text = cursorSpecialSequenceRe().ReplaceAllString(textWithCursors, "")
-
-	return s.prepareResponse(req)
-}
-
-func serializeSession(s *Session) string {
-	b := new(bytes.Buffer)
-	e := gob.NewEncoder(b)
-	if err := e.Encode(s); err != nil {
-		panic(fmt.Sprintf("Failed to encode session (%v): %v", s, err))
-	}
-	return b.String()
-}
-
-func deserializeSession(s string) *Session {
-	res := &Session{}
-	b := bytes.NewBuffer([]byte(s))
-	d := gob.NewDecoder(b)
-	if err := d.Decode(res); err != nil {
-		panic(fmt.Sprintf("Failed to decode session (%v): %v", s, err))
-	}
-	return res
+	return cursorSpecialSequenceRe().ReplaceAllString(textWithCursors, "")
 }
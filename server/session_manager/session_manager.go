@@ -2,13 +2,14 @@ package session_manager
 
 import (
 	"context"
-	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"log"
+	"math/rand"
 	"runtime/trace"
+	"sync"
 	"time"
 
-	"github.com/go-redis/redis"
 	"github.com/google/uuid"
 
 	"github.com/pasiasty/cocoder/server/common"
@@ -20,28 +21,118 @@ var (
 	nowSource = time.Now
 )
 
-func init() {
-	gob.Register(&Session{})
-	gob.Register(&common.User{})
-}
+// maxModifyAttempts bounds retries of the session modification when the
+// session is concurrently modified by someone else.
+const maxModifyAttempts = 5
+
+// modifyBackoff bounds the wait before the first retry of the modification,
+// the bound doubles with every attempt. The wait is random, so that the
+// concurrent writers don't collide again.
+var modifyBackoff = 10 * time.Millisecond
+
+// UpdateListener is notified about the sessions updated by this instance,
+// once the update is stored. It must neither block nor modify the session.
+type UpdateListener func(sessionID SessionID, s *Session)
 
 type SessionManager struct {
-	c *redis.Client
+	store Store
+
+	listenersMux sync.RWMutex
+	listeners    []UpdateListener
+
+	// locks serialize the modifications of the session made by this
+	// instance, only the other instances contend for it.
+	locksMux sync.Mutex
+	locks    map[SessionID]*sessionLock
 }
 
-func NewSessionManager(c *redis.Client) *SessionManager {
-	if _, err := c.Ping().Result(); err != nil {
-		log.Fatalf(fmt.Sprintf("Could not connect to redis: %v", err))
+type sessionLock struct {
+	mux sync.Mutex
+	// refs counts the holders and the waiters of the lock.
+	refs int
+}
+
+func NewSessionManager(store Store) *SessionManager {
+	if err := store.Ping(); err != nil {
+		log.Fatalf(fmt.Sprintf("Could not connect to the store: %v", err))
 	}
 
 	return &SessionManager{
-		c: c,
+		store: store,
+		locks: make(map[SessionID]*sessionLock),
+	}
+}
+
+// AddUpdateListener registers the listener of the session updates.
+func (m *SessionManager) AddUpdateListener(l UpdateListener) {
+	m.listenersMux.Lock()
+	defer m.listenersMux.Unlock()
+
+	m.listeners = append(m.listeners, l)
+}
+
+// lockSession waits for the other modifications of the session, it returns
+// the function releasing the lock.
+func (m *SessionManager) lockSession(sessionID SessionID) func() {
+	m.locksMux.Lock()
+	l, ok := m.locks[sessionID]
+	if !ok {
+		l = &sessionLock{}
+		m.locks[sessionID] = l
+	}
+	l.refs++
+	m.locksMux.Unlock()
+
+	l.mux.Lock()
+	return func() {
+		l.mux.Unlock()
+
+		m.locksMux.Lock()
+		defer m.locksMux.Unlock()
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, sessionID)
+		}
 	}
 }
 
+func (m *SessionManager) notifyListeners(sessionID SessionID, s *Session) {
+	m.listenersMux.RLock()
+	defer m.listenersMux.RUnlock()
+
+	for _, l := range m.listeners {
+		l(sessionID, s)
+	}
+}
+
+func crdtOperationsKey(sessionID SessionID) string {
+	return fmt.Sprintf("%s:crdt_operations", sessionID)
+}
+
+func decodeCRDTOperations(raw []string) []common.CRDTOperation {
+	res := []common.CRDTOperation{}
+	for _, r := range raw {
+		op := common.CRDTOperation{}
+		if err := json.Unmarshal([]byte(r), &op); err != nil {
+			log.Printf("Failed to decode CRDT operation (%q): %v", r, err)
+			continue
+		}
+		res = append(res, op)
+	}
+	return res
+}
+
 func (m *SessionManager) NewSession() SessionID {
+	return m.NewSessionOfType(TextSession)
+}
+
+func (m *SessionManager) NewSessionOfType(t SessionType) SessionID {
 	newSessionID := SessionID(uuid.New().String())
-	if err := m.c.Set(string(newSessionID), serializeSession(DefaultSession()), sessionExpiry).Err(); err != nil {
+	ss, err := serializeSession(defaultSessionOfType(t))
+	if err != nil {
+		log.Printf("Could not create the session: %v", err)
+		return ""
+	}
+	if err := m.store.Create(string(newSessionID), ss, sessionExpiry); err != nil {
 		log.Printf("Could not create the session: %v", err)
 		return ""
 	}
@@ -49,59 +140,163 @@ func (m *SessionManager) NewSession() SessionID {
 }
 
 func (m *SessionManager) LoadSession(session SessionID) (*Session, error) {
-	if exists, err := m.c.Exists(string(session)).Result(); err != nil && err != redis.Nil {
-		return nil, fmt.Errorf("failed to check if session '%s' exists", session)
-	} else if exists == 0 {
+	val, err := m.store.Get(string(session))
+	if err == ErrNotFound {
 		return nil, fmt.Errorf("session '%s' does not exist", session)
-	}
-	if val, err := m.c.Get(string(session)).Result(); err != nil && err != redis.Nil {
+	} else if err != nil {
 		return nil, fmt.Errorf("failed to load session '%s'", session)
-	} else {
-		return deserializeSession(val), nil
 	}
+
+	s, err := deserializeSession(val)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session '%s': %v", session, err)
+	}
+	if s.Type == CRDTSession {
+		storedOps, err := m.store.ListRange(crdtOperationsKey(session))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load operations of session '%s'", session)
+		}
+		s.Document.Integrate(decodeCRDTOperations(storedOps))
+		s.Text = s.Document.Text()
+	}
+	return s, nil
+}
+
+// appendCRDTOperations returns the update storing the operations along with
+// the session, which has integrated them.
+func appendCRDTOperations(sessionID SessionID, ops []common.CRDTOperation) (*ListUpdate, error) {
+	values := []string{}
+	for _, op := range ops {
+		b, err := json.Marshal(op)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(b))
+	}
+
+	return &ListUpdate{Key: crdtOperationsKey(sessionID), Append: values, TTL: sessionExpiry}, nil
 }
 
-type requestProcessor = func(req interface{}, s *Session) interface{}
+// requestProcessor modifies the session and returns the response together
+// with the updates of the lists to be stored along with the session. The
+// session is not stored if the request is rejected with the error.
+type requestProcessor = func(req interface{}, s *Session) (interface{}, []ListUpdate, error)
 
 func (m *SessionManager) modifySession(ctx context.Context, sessionID SessionID, req interface{}, processor requestProcessor) (interface{}, error) {
 	resp := *new(interface{})
-	var watchErr error
+	var modifyErr error
+
+	unlock := m.lockSession(sessionID)
+	defer unlock()
 
 	trace.WithRegion(ctx, "modify_session", func() {
-		watchErr = m.c.Watch(func(tx *redis.Tx) error {
-			trace.Log(ctx, "start", "")
-			ss, err := tx.Get(string(sessionID)).Result()
-			if err != nil && err != redis.Nil {
-				return err
+		for attempt := 0; attempt < maxModifyAttempts; attempt++ {
+			var swapped bool
+			resp, swapped, modifyErr = m.tryModifySession(ctx, sessionID, req, processor)
+			if modifyErr != nil || swapped {
+				return
 			}
+			modifyErr = fmt.Errorf("session was concurrently modified")
+			time.Sleep(time.Duration(rand.Int63n(int64(modifyBackoff) << attempt)))
+		}
+	})
+
+	if modifyErr != nil {
+		return nil, fmt.Errorf("failed to modify session '%s': %v", sessionID, modifyErr)
+	}
 
-			trace.Log(ctx, "deserializing", "")
-			session := deserializeSession(ss)
+	return resp, nil
+}
 
-			trace.Log(ctx, "storing", "")
+// tryModifySession makes a single attempt of the session modification, it
+// reports whether the modified session was stored.
+func (m *SessionManager) tryModifySession(ctx context.Context, sessionID SessionID, req interface{}, processor requestProcessor) (interface{}, bool, error) {
+	trace.Log(ctx, "start", "")
+	ss, err := m.store.Get(string(sessionID))
+	if err != nil {
+		return nil, false, err
+	}
 
-			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
-				resp = processor(req, session)
-				pipe.Set(string(sessionID), serializeSession(session), sessionExpiry)
-				return nil
-			})
-			return err
-		}, string(sessionID))
-	})
+	trace.Log(ctx, "deserializing", "")
+	session, err := deserializeSession(ss)
+	if err != nil {
+		return nil, false, err
+	}
 
-	if watchErr != nil {
-		return nil, fmt.Errorf("failed to modify session '%s': %v", sessionID, watchErr)
+	lists := []ListUpdate{}
+	if session.Type == CRDTSession {
+		storedOps, err := m.store.ListRange(crdtOperationsKey(sessionID))
+		if err != nil {
+			return nil, false, err
+		}
+		session.Document.Integrate(decodeCRDTOperations(storedOps))
+		// Operations appended in the meantime are kept.
+		lists = append(lists, ListUpdate{Key: crdtOperationsKey(sessionID), TrimFront: len(storedOps)})
 	}
 
-	return resp, nil
+	trace.Log(ctx, "storing", "")
+
+	resp, processorLists, err := processor(req, session)
+	if err != nil {
+		return nil, false, err
+	}
+	lists = append(lists, processorLists...)
+
+	newSS, err := serializeSession(session)
+	if err != nil {
+		return nil, false, err
+	}
+
+	swapped, err := m.store.CompareAndSwap(string(sessionID), ss, newSS, sessionExpiry, lists...)
+	if err != nil {
+		return nil, false, err
+	}
+	return resp, swapped, nil
 }
 
 func (m *SessionManager) UpdateSession(ctx context.Context, sessionID SessionID, req *common.UpdateSessionRequest) (*common.UpdateSessionResponse, error) {
-	resp, err := m.modifySession(ctx, sessionID, req, func(req interface{}, s *Session) interface{} {
-		return s.Update(req.(*common.UpdateSessionRequest))
-	})
+	var updated *Session
+	resp, err := m.modifySession(ctx, sessionID, req, m.updateProcessor(sessionID, &updated))
 	if err != nil {
 		return nil, err
 	}
+	m.notifyListeners(sessionID, updated)
 	return resp.(*common.UpdateSessionResponse), nil
 }
+
+// updateProcessor applies the update request to the session, which is then
+// reported through updated.
+func (m *SessionManager) updateProcessor(sessionID SessionID, updated **Session) requestProcessor {
+	return func(req interface{}, s *Session) (interface{}, []ListUpdate, error) {
+		*updated = s
+		// The request is modified while merging, so every attempt works on a copy.
+		r := *req.(*common.UpdateSessionRequest)
+
+		lists := []ListUpdate{}
+		if len(r.CRDTOperations) > 0 {
+			if s.Type != CRDTSession {
+				return nil, nil, fmt.Errorf("CRDT operations are only accepted in CRDT sessions")
+			}
+			ops, err := appendCRDTOperations(sessionID, r.CRDTOperations)
+			if err != nil {
+				return nil, nil, err
+			}
+			lists = append(lists, *ops)
+		}
+		// The file is cleared from the request once it's deleted.
+		file := r.File
+		oldText, oldLanguage := s.documentState(file)
+		oldUsers := copyUsers(s.Users)
+
+		resp := s.Update(&r)
+
+		revision := recordRevision(sessionID, s, r.UserID, file, oldText, oldLanguage)
+		if revision != nil {
+			lists = append(lists, *revision)
+		}
+		if lu := recordEvent(sessionID, s, r.UserID, revision != nil, oldUsers); lu != nil {
+			lists = append(lists, *lu)
+		}
+		return resp, lists, nil
+	}
+}
@@ -3,7 +3,9 @@ package session_manager
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -20,9 +22,9 @@ func prepareSessionManager(t *testing.T) *SessionManager {
 	if err != nil {
 		t.Fatalf("Failed to setup miniredis: %v", err)
 	}
-	return NewSessionManager(redis.NewClient(&redis.Options{
+	return NewSessionManager(NewRedisStore(redis.NewClient(&redis.Options{
 		Addr: mr.Addr(),
-	}))
+	})))
 }
 
 func TestNewSession(t *testing.T) {
@@ -49,9 +51,33 @@ func TestSerializeDeserialize(t *testing.T) {
 		s: &Session{
 			Text: "abc",
 		},
+	}, {
+		name: "execution_result",
+		s: &Session{
+			Stdout:          "out",
+			ExecutionResult: &common.ExecutionResult{Step: "run", ExitCode: 1, WallTimeMs: 12, PeakMemoryKB: 2048},
+		},
+	}, {
+		name: "lint_result",
+		s: &Session{
+			LintResult: &common.LintResult{
+				Revision: 3,
+				Language: "go",
+				Diagnostics: []common.Diagnostic{
+					{File: "code.go", Line: 4, Column: 2, Severity: "warning", Message: "unreachable code", Rule: "unreachable"},
+				},
+			},
+		},
 	}} {
 		t.Run(tc.name, func(t *testing.T) {
-			s := deserializeSession(serializeSession(tc.s))
+			ss, err := serializeSession(tc.s)
+			if err != nil {
+				t.Fatalf("Serializing failed, but shouldn't: %v", err)
+			}
+			s, err := deserializeSession(ss)
+			if err != nil {
+				t.Fatalf("Deserializing failed, but shouldn't: %v", err)
+			}
 
 			changelog, err := diff.Diff(s, tc.s)
 			if err != nil {
@@ -118,9 +144,15 @@ func TestLoadSession(t *testing.T) {
 		name:      "proper_session",
 		sessionID: existingSessionID1,
 		wantSession: &Session{
-			Text:     sampleText,
-			Language: sampleLanguage,
-			LastEdit: date1,
+			Type:       TextSession,
+			Text:       sampleText,
+			Language:   sampleLanguage,
+			LastEdit:   date1,
+			Revision:   1,
+			Operations: []common.Operation{{{Insert: sampleText}}},
+
+			RecordedRevisions: 1,
+			RecordedEvents:    1,
 			Users: map[string]*common.User{
 				userID1: {
 					ID:       userID1,
@@ -134,9 +166,15 @@ func TestLoadSession(t *testing.T) {
 		name:      "proper_session_default_language",
 		sessionID: existingSessionID2,
 		wantSession: &Session{
-			Text:     anotherSampleText,
-			Language: defaultLanguage,
-			LastEdit: date2,
+			Type:       TextSession,
+			Text:       anotherSampleText,
+			Language:   defaultLanguage,
+			LastEdit:   date2,
+			Revision:   1,
+			Operations: []common.Operation{{{Insert: anotherSampleText}}},
+
+			RecordedRevisions: 1,
+			RecordedEvents:    2,
 			Users: map[string]*common.User{
 				userID1: {
 					ID:       userID1,
@@ -204,10 +242,14 @@ func TestUpdateSessionText(t *testing.T) {
 		clientBase      string
 		clientEditState string
 		wantEditState   string
+		wantRevision    int
+		wantOperation   common.Operation
 	}{{
 		name:            "append_to_empty",
 		clientEditState: "abc|",
 		wantEditState:   "abc|",
+		wantRevision:    1,
+		wantOperation:   common.Operation{{Insert: "abc"}},
 	}, {
 		name: "simultaneous_edit",
 		initialState: `Here's something original
@@ -230,6 +272,8 @@ func TestUpdateSessionText(t *testing.T) {
 		animal of the year is: gorilla|
 		fruit of the year is: banana
 		`,
+		wantRevision:  2,
+		wantOperation: common.Operation{{Retain: 52}, {Insert: " gorilla"}, {Retain: 34}},
 	}, {
 		name: "cursor_at_whitespaces",
 		clientEditState: `abc
@@ -240,6 +284,8 @@ func TestUpdateSessionText(t *testing.T) {
 		
 		
 		|`,
+		wantRevision:  1,
+		wantOperation: common.Operation{{Insert: "abc\n\t\t\n\t\t\n\t\t"}},
 	}} {
 		ctx := context.Background()
 
@@ -260,6 +306,8 @@ func TestUpdateSessionText(t *testing.T) {
 			}
 			resEs.Users = nil
 			wantEs := editResponseForTesting(tc.wantEditState)
+			wantEs.Revision = tc.wantRevision
+			wantEs.Operation = tc.wantOperation
 
 			if diff := cmp.Diff(wantEs, resEs); diff != "" {
 				t.Errorf("UpdateSession has returned wrong result, -want +got:\n%v", diff)
@@ -267,3 +315,208 @@ func TestUpdateSessionText(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateCRDTSession(t *testing.T) {
+	ctx := context.Background()
+	sm := prepareSessionManager(t)
+	s := sm.NewSessionOfType(CRDTSession)
+
+	client := NewCRDTDocument()
+	ops := client.localInsert("user_1", 0, "abc")
+
+	resp, err := sm.UpdateSession(ctx, s, &common.UpdateSessionRequest{
+		UserID:         "user_1",
+		CRDTOperations: ops,
+		CursorPos:      3,
+	})
+	if err != nil {
+		t.Fatalf("UpdateSession failed: %v", err)
+	}
+	if resp.NewText != "abc" || len(resp.CRDTOperations) != len(ops) {
+		t.Errorf("Wrong response: %+v", resp)
+	}
+
+	// Client not aware of the CRDT edits the text as in the text session.
+	resp, err = sm.UpdateSession(ctx, s, &common.UpdateSessionRequest{
+		UserID:   "user_2",
+		BaseText: "abc",
+		NewText:  "abcd",
+	})
+	if err != nil {
+		t.Fatalf("UpdateSession failed: %v", err)
+	}
+	client.Integrate(resp.CRDTOperations)
+	if client.Text() != "abcd" {
+		t.Errorf("Client did not converge, got: %q", client.Text())
+	}
+
+	ops = client.localInsert("user_1", 0, "x")
+	if _, err := sm.UpdateSession(ctx, s, &common.UpdateSessionRequest{UserID: "user_1", CRDTOperations: ops}); err != nil {
+		t.Fatalf("UpdateSession failed: %v", err)
+	}
+	session, err := sm.LoadSession(s)
+	if err != nil {
+		t.Fatalf("LoadSession failed: %v", err)
+	}
+	if session.Type != CRDTSession || session.Text != "xabcd" || session.Revision != 3 {
+		t.Errorf("Wrong session loaded, type: %v text: %q revision: %v", session.Type, session.Text, session.Revision)
+	}
+	// The operations integrated by the session are trimmed on the next write.
+	if stored, err := sm.store.ListRange(crdtOperationsKey(s)); err != nil || len(stored) != len(ops) {
+		t.Errorf("Stored %d operations (%v), want %d", len(stored), err, len(ops))
+	}
+}
+
+// racingStore modifies the session right before the first swap, as if done by
+// another server instance.
+type racingStore struct {
+	Store
+	race func()
+}
+
+func (s *racingStore) CompareAndSwap(key, oldValue, newValue string, ttl time.Duration, lists ...ListUpdate) (bool, error) {
+	if race := s.race; race != nil {
+		s.race = nil
+		race()
+	}
+	return s.Store.CompareAndSwap(key, oldValue, newValue, ttl, lists...)
+}
+
+func TestUpdateCRDTSessionLostSwap(t *testing.T) {
+	ctx := context.Background()
+	store := prepareBoltStore(t)
+	other := NewSessionManager(store)
+	s := other.NewSessionOfType(CRDTSession)
+
+	racing := &racingStore{Store: store}
+	sm := NewSessionManager(racing)
+	racing.race = func() {
+		client := NewCRDTDocument()
+		if _, err := other.UpdateSession(ctx, s, &common.UpdateSessionRequest{
+			UserID:         "user_2",
+			CRDTOperations: client.localInsert("user_2", 0, "b"),
+		}); err != nil {
+			t.Errorf("UpdateSession of the other instance failed: %v", err)
+		}
+	}
+
+	client := NewCRDTDocument()
+	ops := client.localInsert("user_1", 0, "a")
+	resp, err := sm.UpdateSession(ctx, s, &common.UpdateSessionRequest{UserID: "user_1", CRDTOperations: ops})
+	if err != nil {
+		t.Fatalf("UpdateSession failed: %v", err)
+	}
+	if resp.Revision != 2 || len(resp.NewText) != 2 {
+		t.Errorf("Wrong response, text: %q revision: %v", resp.NewText, resp.Revision)
+	}
+
+	// The operations of the lost attempt weren't stored, every revision
+	// recorded its own operations.
+	if stored, err := store.ListRange(crdtOperationsKey(s)); err != nil || len(stored) != len(ops) {
+		t.Errorf("Stored %d operations (%v), want %d", len(stored), err, len(ops))
+	}
+	session, err := sm.LoadSession(s)
+	if err != nil {
+		t.Fatalf("LoadSession failed: %v", err)
+	}
+	if session.Text != resp.NewText || session.Revision != 2 {
+		t.Errorf("Wrong session loaded, text: %q revision: %v", session.Text, session.Revision)
+	}
+	for revision, want := range map[int]string{1: "b", 2: session.Text} {
+		if got, err := sm.Revision(s, revision); err != nil || got.Text != want {
+			t.Errorf("Revision(%d) = %+v (%v), want text %q", revision, got, err, want)
+		}
+	}
+}
+
+func TestUpdateTextSessionWithCRDTOperations(t *testing.T) {
+	ctx := context.Background()
+	sm := prepareSessionManager(t)
+	s := sm.NewSession()
+
+	client := NewCRDTDocument()
+	if _, err := sm.UpdateSession(ctx, s, &common.UpdateSessionRequest{
+		UserID:         "user_1",
+		CRDTOperations: client.localInsert("user_1", 0, "abc"),
+	}); err == nil {
+		t.Errorf("UpdateSession with CRDT operations of the text session should fail")
+	}
+	if stored, err := sm.store.ListRange(crdtOperationsKey(s)); err != nil || len(stored) != 0 {
+		t.Errorf("Stored operations of the text session: %v (%v)", stored, err)
+	}
+	if session, err := sm.LoadSession(s); err != nil || session.Revision != 0 || len(session.Users) != 0 {
+		t.Errorf("Session was modified: %+v (%v)", session, err)
+	}
+}
+
+func TestConcurrentCRDTUpdates(t *testing.T) {
+	ctx := context.Background()
+	// The transactions of miniredis don't cope with the concurrent clients.
+	sm := NewSessionManager(prepareBoltStore(t))
+	s := sm.NewSessionOfType(CRDTSession)
+
+	const users, edits = 8, 20
+	wg := sync.WaitGroup{}
+	errs := make(chan error, users*edits)
+	for u := 0; u < users; u++ {
+		wg.Add(1)
+		go func(userID string) {
+			defer wg.Done()
+			client := NewCRDTDocument()
+			for i := 0; i < edits; i++ {
+				_, err := sm.UpdateSession(ctx, s, &common.UpdateSessionRequest{
+					UserID:         userID,
+					CRDTOperations: client.localInsert(userID, 0, "a"),
+					CursorPos:      1,
+				})
+				if err != nil {
+					errs <- err
+				}
+			}
+		}(fmt.Sprintf("user_%d", u))
+	}
+	wg.Wait()
+	close(errs)
+
+	// The edits of the users connected to the same instance take turns.
+	for err := range errs {
+		t.Errorf("UpdateSession failed: %v", err)
+	}
+	session, err := sm.LoadSession(s)
+	if err != nil {
+		t.Fatalf("LoadSession failed: %v", err)
+	}
+	if want := strings.Repeat("a", users*edits); session.Text != want {
+		t.Errorf("Wrong text, got %q, want %q", session.Text, want)
+	}
+}
+
+func TestUpdateListener(t *testing.T) {
+	ctx := context.Background()
+	sm := prepareSessionManager(t)
+	s := sm.NewSession()
+
+	got := []string{}
+	sm.AddUpdateListener(func(sessionID SessionID, sess *Session) {
+		if sessionID != s {
+			t.Errorf("listener got session %q, want %q", sessionID, s)
+		}
+		got = append(got, sess.Text)
+	})
+
+	for _, req := range []*common.UpdateSessionRequest{
+		{NewText: "abc"},
+		{BaseText: "abc", NewText: "abcd"},
+	} {
+		if _, err := sm.UpdateSession(ctx, s, req); err != nil {
+			t.Fatalf("UpdateSession failed: %v", err)
+		}
+	}
+	if _, err := sm.UpdateSession(ctx, "missing", &common.UpdateSessionRequest{NewText: "x"}); err == nil {
+		t.Errorf("UpdateSession of a missing session should fail")
+	}
+
+	if diff := cmp.Diff([]string{"abc", "abcd"}, got); diff != "" {
+		t.Errorf("listener got wrong updates, -want +got:\n%v", diff)
+	}
+}
@@ -155,6 +155,26 @@ func TestValidateRequest(t *testing.T) {
 			NewText:   "abc",
 			CursorPos: 0,
 		},
+	}, {
+		name: "multi_byte_text",
+		req: &common.UpdateSessionRequest{
+			NewText:   "żółw",
+			CursorPos: 4,
+		},
+		wantRes: &common.UpdateSessionRequest{
+			NewText:   "żółw",
+			CursorPos: 4,
+		},
+	}, {
+		name: "too_big_cursor_pos_in_multi_byte_text",
+		req: &common.UpdateSessionRequest{
+			NewText:   "żółw",
+			CursorPos: 5,
+		},
+		wantRes: &common.UpdateSessionRequest{
+			NewText:   "żółw",
+			CursorPos: 0,
+		},
 	}} {
 		t.Run(tc.name, func(t *testing.T) {
 			validateRequest(tc.req)
@@ -184,6 +204,12 @@ func TestFindTokenPosition(t *testing.T) {
 		ro:      SelectionStart,
 		text:    fmt.Sprintf("a %s abc %s", string(specialRune(0, Cursor)), string(specialRune(1, SelectionStart))),
 		wantRes: 7,
+	}, {
+		name:    "multi_byte_text",
+		uIdx:    1,
+		ro:      SelectionStart,
+		text:    fmt.Sprintf("ż %s łódź %s", string(specialRune(0, Cursor)), string(specialRune(1, SelectionStart))),
+		wantRes: 8,
 	}, {
 		name:    "non_existing_token",
 		uIdx:    1,
@@ -234,7 +260,10 @@ func TestUpdateText(t *testing.T) {
 			CursorPos: 10,
 		},
 		wantResp: common.UpdateSessionResponse{
-			NewText: "some texta",
+			NewText:         "some texta",
+			Revision:        1,
+			Operation:       common.Operation{{Retain: 9}, {Insert: "a"}},
+			OperationAuthor: "user_1",
 			Users: []*common.User{
 				{
 					ID:       "user_1",
@@ -282,7 +311,10 @@ func TestUpdateText(t *testing.T) {
 			},
 		},
 		wantResp: common.UpdateSessionResponse{
-			NewText: "asome text",
+			NewText:         "asome text",
+			Revision:        1,
+			Operation:       common.Operation{{Insert: "a"}, {Retain: 9}},
+			OperationAuthor: "user_1",
 			Users: []*common.User{
 				{
 					ID:       "user_1",
@@ -351,6 +383,9 @@ func TestUpdateText(t *testing.T) {
 			edited by user 1 added
 			edited by user 2 added
 			`,
+			Revision:        1,
+			Operation:       common.Operation{{Retain: 20}, {Insert: " added"}, {Retain: 30}},
+			OperationAuthor: "user_1",
 			Users: []*common.User{
 				{
 					ID:       "user_1",
@@ -388,3 +423,222 @@ func TestUpdateText(t *testing.T) {
 		})
 	}
 }
+
+func TestUpdateWithOperations(t *testing.T) {
+	specialDate := time.Date(2015, 2, 13, 0, 0, 0, 0, time.UTC)
+	nowSource = func() time.Time { return specialDate }
+
+	s := &Session{
+		Text:     "abc",
+		Revision: 1,
+		Users: map[string]*common.User{
+			"user_2": {
+				ID:       "user_2",
+				Index:    0,
+				Position: 3,
+				LastEdit: specialDate,
+			},
+		},
+	}
+
+	resp := s.Update(&common.UpdateSessionRequest{
+		UserID:        "user_1",
+		UseOperations: true,
+		Revision:      1,
+		Operation:     common.Operation{{Insert: "x"}, {Retain: 3}},
+		CursorPos:     1,
+	})
+	if diff := cmp.Diff(common.Operation{{Insert: "x"}, {Retain: 3}}, resp.Operation); diff != "" {
+		t.Errorf("Update returned wrong operation, -want +got:\n%v", diff)
+	}
+
+	// user_2 has not seen the edit of user_1 yet.
+	resp = s.Update(&common.UpdateSessionRequest{
+		UserID:        "user_2",
+		UseOperations: true,
+		Revision:      1,
+		Operation:     common.Operation{{Retain: 3}, {Insert: "y"}},
+		CursorPos:     4,
+	})
+
+	if diff := cmp.Diff(common.Operation{{Retain: 4}, {Insert: "y"}}, resp.Operation); diff != "" {
+		t.Errorf("Update returned wrong operation, -want +got:\n%v", diff)
+	}
+	if resp.NewText != "xabcy" || resp.Revision != 3 || resp.OperationAuthor != "user_2" {
+		t.Errorf("Update returned wrong state: text: %q revision: %v author: %q", resp.NewText, resp.Revision, resp.OperationAuthor)
+	}
+	if s.Users["user_1"].Position != 1 || s.Users["user_2"].Position != 5 {
+		t.Errorf("Cursors were not transformed: user_1: %v user_2: %v", s.Users["user_1"].Position, s.Users["user_2"].Position)
+	}
+
+	resp = s.Update(&common.UpdateSessionRequest{
+		UserID:        "user_1",
+		UseOperations: true,
+		Revision:      7,
+		Operation:     common.Operation{{Retain: 5}, {Insert: "z"}},
+	})
+	if !resp.Resync || resp.NewText != "xabcy" {
+		t.Errorf("Update with unknown revision should request resync, got: %+v", resp)
+	}
+}
+
+func TestUpdateMixedClientsMultiByteText(t *testing.T) {
+	specialDate := time.Date(2015, 2, 13, 0, 0, 0, 0, time.UTC)
+	nowSource = func() time.Time { return specialDate }
+
+	s := &Session{
+		Text:     "zażółć",
+		Revision: 1,
+		Users:    map[string]*common.User{},
+	}
+
+	resp := s.Update(&common.UpdateSessionRequest{
+		UserID:         "ot",
+		UseOperations:  true,
+		Revision:       1,
+		Operation:      common.Operation{{Retain: 6}, {Insert: "!"}},
+		CursorPos:      7,
+		HasSelection:   true,
+		SelectionStart: 2,
+		SelectionEnd:   6,
+	})
+	if resp.NewText != "zażółć!" {
+		t.Fatalf("Update returned wrong text: %q", resp.NewText)
+	}
+
+	// The plain-text client hasn't seen the edit of the operations client.
+	resp = s.Update(&common.UpdateSessionRequest{
+		UserID:    "plain",
+		BaseText:  "zażółć",
+		NewText:   "Xzażółć",
+		CursorPos: 1,
+	})
+	if resp.NewText != "Xzażółć!" {
+		t.Fatalf("Update returned wrong text: %q", resp.NewText)
+	}
+	want := map[string]*common.User{
+		"ot":    {ID: "ot", Index: 0, Position: 8, HasSelection: true, SelectionStart: 3, SelectionEnd: 7, LastEdit: specialDate},
+		"plain": {ID: "plain", Index: 1, Position: 1, LastEdit: specialDate},
+	}
+	if diff := cmp.Diff(want, s.Users); diff != "" {
+		t.Errorf("Cursors were moved by bytes, -want +got:\n%v", diff)
+	}
+
+	resp = s.Update(&common.UpdateSessionRequest{
+		UserID:        "ot",
+		UseOperations: true,
+		Revision:      resp.Revision,
+		Operation:     common.Operation{{Retain: 8}, {Insert: "ę"}},
+		CursorPos:     9,
+	})
+	if resp.NewText != "Xzażółć!ę" {
+		t.Fatalf("Update returned wrong text: %q", resp.NewText)
+	}
+	if s.Users["plain"].Position != 1 || s.Users["ot"].Position != 9 {
+		t.Errorf("Wrong cursors: plain: %v ot: %v", s.Users["plain"].Position, s.Users["ot"].Position)
+	}
+}
+
+func TestUpdateWithFormattedText(t *testing.T) {
+	s := &Session{
+		Text:     "f( x )\ng( y )",
+		Revision: 1,
+		Users: map[string]*common.User{
+			"user_1": {ID: "user_1", Index: 0, Position: 4},
+			"user_2": {ID: "user_2", Index: 1, Position: 11, HasSelection: true, SelectionStart: 9, SelectionEnd: 11},
+		},
+	}
+	formatted, formattedRevision := s.Text, s.Revision
+
+	// user_1 edits the text while it's being formatted.
+	s.Update(&common.UpdateSessionRequest{
+		UserID:        "user_1",
+		UseOperations: true,
+		Revision:      1,
+		Operation:     common.Operation{{Retain: 4}, {Insert: "1"}, {Retain: 9}},
+		CursorPos:     5,
+	})
+
+	resp := s.Update(&common.UpdateSessionRequest{
+		UseOperations: true,
+		Revision:      formattedRevision,
+		Operation:     OperationFromTexts(formatted, "f(x)\ng(y)"),
+	})
+
+	if resp.NewText != "f(x1)\ng(y)" || resp.OperationAuthor != "" {
+		t.Errorf("Update returned wrong state: text: %q author: %q", resp.NewText, resp.OperationAuthor)
+	}
+	u1, u2 := s.Users["user_1"], s.Users["user_2"]
+	if u1.Position != 4 || u2.Position != 9 || u2.SelectionStart != 8 || u2.SelectionEnd != 9 {
+		t.Errorf("Cursors were not preserved: user_1: %+v user_2: %+v", u1, u2)
+	}
+}
+
+func TestUpdateLintResult(t *testing.T) {
+	s := DefaultSession()
+
+	for _, tc := range []struct {
+		name         string
+		revision     int
+		wantRevision int
+	}{
+		{name: "first", revision: 2, wantRevision: 2},
+		{name: "newer", revision: 5, wantRevision: 5},
+		// The result of the older text finishing later is dropped.
+		{name: "older", revision: 3, wantRevision: 5},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s.Update(&common.UpdateSessionRequest{
+				UpdateLintResult: true,
+				LintResult:       &common.LintResult{Revision: tc.revision, Language: "go"},
+			})
+			if s.LintResult.Revision != tc.wantRevision {
+				t.Errorf("Lint result of revision %d, want: %d", s.LintResult.Revision, tc.wantRevision)
+			}
+		})
+	}
+}
+
+func TestUpdateResentEdits(t *testing.T) {
+	s := DefaultSession()
+
+	for _, tc := range []struct {
+		name     string
+		req      *common.UpdateSessionRequest
+		wantText string
+	}{{
+		name:     "first_edit",
+		req:      &common.UpdateSessionRequest{UserID: "user_1", NewText: "abc", Sequence: 1},
+		wantText: "abc",
+	}, {
+		name:     "resent_edit",
+		req:      &common.UpdateSessionRequest{UserID: "user_1", NewText: "abc", Sequence: 1},
+		wantText: "abc",
+	}, {
+		name:     "resent_operation",
+		req:      &common.UpdateSessionRequest{UserID: "user_1", UseOperations: true, Operation: common.Operation{{Insert: "abc"}}, Sequence: 1},
+		wantText: "abc",
+	}, {
+		name:     "other_user",
+		req:      &common.UpdateSessionRequest{UserID: "user_2", UseOperations: true, Revision: 1, Operation: common.Operation{{Retain: 3}, {Insert: "d"}}, Sequence: 1},
+		wantText: "abcd",
+	}, {
+		name:     "rejected_operation",
+		req:      &common.UpdateSessionRequest{UserID: "user_1", UseOperations: true, Revision: 10, Operation: common.Operation{{Retain: 4}, {Insert: "e"}}, Sequence: 2},
+		wantText: "abcd",
+	}, {
+		name:     "operation_after_resync",
+		req:      &common.UpdateSessionRequest{UserID: "user_1", UseOperations: true, Revision: 2, Operation: common.Operation{{Retain: 4}, {Insert: "e"}}, Sequence: 2},
+		wantText: "abcde",
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if resp := s.Update(tc.req); resp.NewText != tc.wantText {
+				t.Errorf("Update returned text %q, want %q", resp.NewText, tc.wantText)
+			}
+		})
+	}
+
+	if diff := cmp.Diff(map[string]int{"user_1": 2, "user_2": 1}, s.AppliedSequences); diff != "" {
+		t.Errorf("Wrong applied sequences, -want +got:\n%v", diff)
+	}
+}
@@ -0,0 +1,44 @@
+package session_manager
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by the Store when the key does not exist.
+var ErrNotFound = errors.New("key not found")
+
+// ListUpdate describes changes of a list committed together with the value
+// in Store.CompareAndSwap.
+type ListUpdate struct {
+	Key string
+	// Append adds the values at the end of the list.
+	Append []string
+	// TrimFront removes that many values from the beginning of the list.
+	TrimFront int
+	// MaxLength, if positive, bounds the list keeping the newest values.
+	MaxLength int
+	TTL       time.Duration
+}
+
+// Store persists sessions as well as their auxiliary lists (stored CRDT
+// operations, history, recordings).
+type Store interface {
+	Ping() error
+
+	// Get returns the value stored under the key or ErrNotFound.
+	Get(key string) (string, error)
+	// Create stores the value under the key, which expires after the ttl.
+	Create(key, value string, ttl time.Duration) error
+	// CompareAndSwap stores the new value under the key, as long as the
+	// current value is still the old one, and applies the list updates. It
+	// returns false if the value has been modified in the meantime.
+	CompareAndSwap(key, oldValue, newValue string, ttl time.Duration, lists ...ListUpdate) (bool, error)
+	Delete(key string) error
+	Expire(key string, ttl time.Duration) error
+
+	// AppendToList adds the values at the end of the list.
+	AppendToList(key string, values []string, ttl time.Duration) error
+	// ListRange returns all the values of the list, empty for non-existing one.
+	ListRange(key string) ([]string, error)
+}
@@ -0,0 +1,107 @@
+package session_manager
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+// The test cases are stored apart from the session, as the session is
+// visible to all the users, while the hidden test cases must not be.
+func testCasesKey(sessionID SessionID) string {
+	return fmt.Sprintf("%s:test_cases", sessionID)
+}
+
+const (
+	maxTestCases = 100
+	// maxTestCaseSize bounds the input and the expected output of a single
+	// test case.
+	maxTestCaseSize     = 64 * 1024
+	maxTestCaseNameSize = 256
+	// maxTestCaseTimeLimitMs is the upper bound of the time limit, the judge
+	// also never exceeds the timeout of the language.
+	maxTestCaseTimeLimitMs = 60 * 1000
+)
+
+// ValidateTestCases checks that the test cases fit in the limits.
+func ValidateTestCases(testCases []common.TestCase) error {
+	if len(testCases) > maxTestCases {
+		return fmt.Errorf("got %d test cases, at most %d are allowed", len(testCases), maxTestCases)
+	}
+	for i, tc := range testCases {
+		if len(tc.Name) > maxTestCaseNameSize {
+			return fmt.Errorf("name of test case %d is longer than %d bytes", i, maxTestCaseNameSize)
+		}
+		if len(tc.Stdin) > maxTestCaseSize || len(tc.ExpectedStdout) > maxTestCaseSize {
+			return fmt.Errorf("input or expected output of test case %d is longer than %d bytes", i, maxTestCaseSize)
+		}
+		if tc.TimeLimitMs < 0 || tc.TimeLimitMs > maxTestCaseTimeLimitMs {
+			return fmt.Errorf("time limit of test case %d has to be between 0 and %d ms", i, maxTestCaseTimeLimitMs)
+		}
+	}
+	return nil
+}
+
+// SetTestCases replaces the test cases of the session, which have to pass
+// ValidateTestCases.
+func (m *SessionManager) SetTestCases(sessionID SessionID, testCases []common.TestCase) error {
+	if err := ValidateTestCases(testCases); err != nil {
+		return err
+	}
+	if _, err := m.LoadSession(sessionID); err != nil {
+		return err
+	}
+
+	b, err := json.Marshal(testCases)
+	if err != nil {
+		return err
+	}
+	if err := m.store.Create(testCasesKey(sessionID), string(b), sessionExpiry); err != nil {
+		return fmt.Errorf("failed to store test cases of session '%s': %v", sessionID, err)
+	}
+	return nil
+}
+
+// TestCases returns all the test cases of the session, including the hidden
+// ones.
+func (m *SessionManager) TestCases(sessionID SessionID) ([]common.TestCase, error) {
+	if _, err := m.LoadSession(sessionID); err != nil {
+		return nil, err
+	}
+
+	v, err := m.store.Get(testCasesKey(sessionID))
+	if err == ErrNotFound {
+		return []common.TestCase{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load test cases of session '%s': %v", sessionID, err)
+	}
+
+	// Reading the test cases keeps them alive as long as the session.
+	if err := m.store.Expire(testCasesKey(sessionID), sessionExpiry); err != nil {
+		return nil, err
+	}
+
+	res := []common.TestCase{}
+	if err := json.Unmarshal([]byte(v), &res); err != nil {
+		return nil, fmt.Errorf("failed to parse test cases of session '%s': %v", sessionID, err)
+	}
+	return res, nil
+}
+
+// VisibleTestCases returns the test cases of the session with the input and
+// the expected output of the hidden ones removed.
+func (m *SessionManager) VisibleTestCases(sessionID SessionID) ([]common.TestCase, error) {
+	testCases, err := m.TestCases(sessionID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range testCases {
+		if testCases[i].Hidden {
+			testCases[i].Stdin = ""
+			testCases[i].ExpectedStdout = ""
+		}
+	}
+	return testCases, nil
+}
@@ -0,0 +1,78 @@
+package session_manager
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func TestTestCases(t *testing.T) {
+	sm := prepareSessionManager(t)
+	sessionID := sm.NewSession()
+
+	if tcs, err := sm.TestCases(sessionID); err != nil || len(tcs) != 0 {
+		t.Errorf("New session should have no test cases, got: %v, %v", tcs, err)
+	}
+
+	tcs := []common.TestCase{
+		{Name: "visible", Stdin: "1", ExpectedStdout: "2"},
+		{Name: "hidden", Stdin: "3", ExpectedStdout: "6", TimeLimitMs: 100, Hidden: true},
+	}
+	if err := sm.SetTestCases(sessionID, tcs); err != nil {
+		t.Fatalf("SetTestCases failed: %v", err)
+	}
+
+	got, err := sm.TestCases(sessionID)
+	if err != nil {
+		t.Fatalf("TestCases failed: %v", err)
+	}
+	if diff := cmp.Diff(tcs, got); diff != "" {
+		t.Errorf("Wrong test cases, -want +got:\n%v", diff)
+	}
+
+	got, err = sm.VisibleTestCases(sessionID)
+	if err != nil {
+		t.Fatalf("VisibleTestCases failed: %v", err)
+	}
+	want := []common.TestCase{
+		{Name: "visible", Stdin: "1", ExpectedStdout: "2"},
+		{Name: "hidden", TimeLimitMs: 100, Hidden: true},
+	}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("Wrong visible test cases, -want +got:\n%v", diff)
+	}
+
+	if err := sm.SetTestCases("missing", tcs); err == nil {
+		t.Errorf("Setting test cases of missing session should fail")
+	}
+	if _, err := sm.TestCases("missing"); err == nil {
+		t.Errorf("Loading test cases of missing session should fail")
+	}
+}
+
+func TestValidateTestCases(t *testing.T) {
+	large := strings.Repeat("a", maxTestCaseSize+1)
+	for _, tc := range []struct {
+		name      string
+		testCases []common.TestCase
+		wantOK    bool
+	}{
+		{"valid", []common.TestCase{{Name: "a", Stdin: "1", ExpectedStdout: "2", TimeLimitMs: 100}}, true},
+		{"empty", nil, true},
+		{"too many", make([]common.TestCase, maxTestCases+1), false},
+		{"long name", []common.TestCase{{Name: large}}, false},
+		{"large input", []common.TestCase{{Stdin: large}}, false},
+		{"large expected output", []common.TestCase{{ExpectedStdout: large}}, false},
+		{"negative time limit", []common.TestCase{{TimeLimitMs: -1}}, false},
+		{"long time limit", []common.TestCase{{TimeLimitMs: maxTestCaseTimeLimitMs + 1}}, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := ValidateTestCases(tc.testCases); (err == nil) != tc.wantOK {
+				t.Errorf("ValidateTestCases returned: %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,210 @@
+package users_manager
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis"
+
+	"github.com/pasiasty/cocoder/server/common"
+	"github.com/pasiasty/cocoder/server/session_manager"
+)
+
+const subscriptionBufferSize = 32
+
+// deliveryTimeout is how long the response which can't be dropped waits for
+// the subscriber falling behind, which is disconnected afterwards.
+var deliveryTimeout = 5 * time.Second
+
+// Broadcaster propagates the responses to all the server instances serving
+// the same session.
+type Broadcaster interface {
+	Publish(sessionID session_manager.SessionID, resp *common.UpdateSessionResponse) error
+	// Subscribe returns the channel receiving the responses published for the
+	// session. The channel is closed once the context is done, or once the
+	// subscriber falls behind with the responses which can't be dropped.
+	Subscribe(ctx context.Context, sessionID session_manager.SessionID) (<-chan *common.UpdateSessionResponse, error)
+}
+
+// coalescible tells whether the response only refreshes the state of the
+// session, which the following responses refresh again.
+func coalescible(resp *common.UpdateSessionResponse) bool {
+	return len(resp.Operation) == 0 && len(resp.CRDTOperations) == 0 && resp.OutputChunk == nil && resp.StdinLine == nil && resp.ExecutionCancel == nil
+}
+
+// deliver hands the response to the subscriber. The state refreshes are
+// dropped if the subscriber falls behind, its users catch up with the
+// following ones. The other responses wait for the subscriber for up to
+// deliveryTimeout, false is returned if it didn't keep up.
+func deliver(sessionID session_manager.SessionID, ch chan<- *common.UpdateSessionResponse, resp *common.UpdateSessionResponse) bool {
+	select {
+	case ch <- resp:
+		return true
+	default:
+	}
+	if coalescible(resp) {
+		log.Printf("Dropping update of session %v, the subscriber is not keeping up", sessionID)
+		return true
+	}
+
+	t := time.NewTimer(deliveryTimeout)
+	defer t.Stop()
+	select {
+	case ch <- resp:
+		return true
+	case <-t.C:
+		log.Printf("Disconnecting the subscriber of session %v, which is not keeping up", sessionID)
+		return false
+	}
+}
+
+type localSubscriber struct {
+	mux    sync.Mutex
+	ch     chan *common.UpdateSessionResponse
+	closed bool
+}
+
+// send reports false if the subscriber didn't keep up with the response.
+func (s *localSubscriber) send(sessionID session_manager.SessionID, resp *common.UpdateSessionResponse) bool {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.closed {
+		return true
+	}
+	return deliver(sessionID, s.ch, resp)
+}
+
+func (s *localSubscriber) close() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if !s.closed {
+		s.closed = true
+		close(s.ch)
+	}
+}
+
+type localBroadcaster struct {
+	mux         sync.Mutex
+	subscribers map[session_manager.SessionID]map[*localSubscriber]interface{}
+}
+
+// NewLocalBroadcaster returns the Broadcaster for a single server instance.
+func NewLocalBroadcaster() Broadcaster {
+	return &localBroadcaster{
+		subscribers: make(map[session_manager.SessionID]map[*localSubscriber]interface{}),
+	}
+}
+
+func (b *localBroadcaster) Publish(sessionID session_manager.SessionID, resp *common.UpdateSessionResponse) error {
+	b.mux.Lock()
+	subscribers := []*localSubscriber{}
+	for sub := range b.subscribers[sessionID] {
+		subscribers = append(subscribers, sub)
+	}
+	b.mux.Unlock()
+
+	for _, sub := range subscribers {
+		if !sub.send(sessionID, resp) {
+			b.unsubscribe(sessionID, sub)
+		}
+	}
+	return nil
+}
+
+// unsubscribe forgets the subscriber and closes its channel.
+func (b *localBroadcaster) unsubscribe(sessionID session_manager.SessionID, sub *localSubscriber) {
+	b.mux.Lock()
+	delete(b.subscribers[sessionID], sub)
+	if len(b.subscribers[sessionID]) == 0 {
+		delete(b.subscribers, sessionID)
+	}
+	b.mux.Unlock()
+
+	sub.close()
+}
+
+func (b *localBroadcaster) Subscribe(ctx context.Context, sessionID session_manager.SessionID) (<-chan *common.UpdateSessionResponse, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	sub := &localSubscriber{ch: make(chan *common.UpdateSessionResponse, subscriptionBufferSize)}
+	if _, ok := b.subscribers[sessionID]; !ok {
+		b.subscribers[sessionID] = make(map[*localSubscriber]interface{})
+	}
+	b.subscribers[sessionID][sub] = new(interface{})
+
+	go func() {
+		<-ctx.Done()
+		b.unsubscribe(sessionID, sub)
+	}()
+
+	return sub.ch, nil
+}
+
+type redisBroadcaster struct {
+	c *redis.Client
+}
+
+// NewRedisBroadcaster returns the Broadcaster publishing the responses on
+// a per-session Redis channel.
+func NewRedisBroadcaster(c *redis.Client) Broadcaster {
+	return &redisBroadcaster{
+		c: c,
+	}
+}
+
+func updatesChannel(sessionID session_manager.SessionID) string {
+	return fmt.Sprintf("%s:updates", sessionID)
+}
+
+func (b *redisBroadcaster) Publish(sessionID session_manager.SessionID, resp *common.UpdateSessionResponse) error {
+	msg, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	return b.c.Publish(updatesChannel(sessionID), string(msg)).Err()
+}
+
+func (b *redisBroadcaster) Subscribe(ctx context.Context, sessionID session_manager.SessionID) (<-chan *common.UpdateSessionResponse, error) {
+	ps := b.c.Subscribe(updatesChannel(sessionID))
+	// Waits for the subscription to be confirmed, so that no response
+	// published afterwards is missed.
+	if _, err := ps.Receive(); err != nil {
+		ps.Close()
+		return nil, err
+	}
+
+	ch := make(chan *common.UpdateSessionResponse, subscriptionBufferSize)
+	go func() {
+		defer close(ch)
+		defer ps.Close()
+
+		msgs := ps.Channel()
+		for {
+			select {
+			case msg, ok := <-msgs:
+				if !ok {
+					return
+				}
+				resp := &common.UpdateSessionResponse{}
+				if err := json.Unmarshal([]byte(msg.Payload), resp); err != nil {
+					log.Printf("Failed to unmarshal published UpdateSessionResponse: %v", err)
+					continue
+				}
+				if !deliver(sessionID, ch, resp) {
+					return
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return ch, nil
+}
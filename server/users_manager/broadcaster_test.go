@@ -0,0 +1,176 @@
+package users_manager
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func TestLocalBroadcaster(t *testing.T) {
+	ctx := context.Background()
+	b := NewLocalBroadcaster()
+
+	ctx1, cancel1 := context.WithCancel(ctx)
+	defer cancel1()
+	sub1, err := b.Subscribe(ctx1, "s1")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	ctx2, cancel2 := context.WithCancel(ctx)
+	sub2, err := b.Subscribe(ctx2, "s1")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	otherCtx, otherCancel := context.WithCancel(ctx)
+	defer otherCancel()
+	other, err := b.Subscribe(otherCtx, "s2")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	resp := &common.UpdateSessionResponse{NewText: "abc"}
+	if err := b.Publish("s1", resp); err != nil {
+		t.Fatalf("Publish failed: %v", err)
+	}
+
+	for _, sub := range []<-chan *common.UpdateSessionResponse{sub1, sub2} {
+		select {
+		case got := <-sub:
+			if diff := cmp.Diff(resp, got); diff != "" {
+				t.Errorf("Received wrong response, -want +got:\n%v", diff)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Response did not come within the given deadline.")
+		}
+	}
+
+	select {
+	case got := <-other:
+		t.Errorf("Subscriber of other session received response: %v", got)
+	default:
+	}
+
+	cancel2()
+	select {
+	case _, ok := <-sub2:
+		if ok {
+			t.Errorf("Subscription should've been closed")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Subscription was not closed within the given deadline.")
+	}
+}
+
+func TestLocalBroadcasterSlowSubscriber(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := NewLocalBroadcaster()
+
+	slow, err := b.Subscribe(ctx, "s1")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	fast, err := b.Subscribe(ctx, "s1")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range fast {
+			n++
+			if n == 2*subscriptionBufferSize {
+				received <- n
+			}
+		}
+	}()
+
+	// Nobody reads the slow subscription, which must not block the publisher.
+	published := make(chan struct{})
+	go func() {
+		defer close(published)
+		for i := 0; i < 2*subscriptionBufferSize; i++ {
+			if err := b.Publish("s1", &common.UpdateSessionResponse{NewText: "abc"}); err != nil {
+				t.Errorf("Publish failed: %v", err)
+			}
+			// Gives the fast subscriber the time to keep up.
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-published:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Publish blocked on the slow subscriber")
+	}
+	select {
+	case <-received:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Fast subscriber did not receive all the responses")
+	}
+	if got := len(slow); got != subscriptionBufferSize {
+		t.Errorf("Slow subscriber has %d buffered responses, want %d", got, subscriptionBufferSize)
+	}
+}
+
+func TestLocalBroadcasterReliableResponses(t *testing.T) {
+	defer func(d time.Duration) { deliveryTimeout = d }(deliveryTimeout)
+	deliveryTimeout = 200 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	b := NewLocalBroadcaster()
+
+	stalled, err := b.Subscribe(ctx, "s1")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+	slow, err := b.Subscribe(ctx, "s1")
+	if err != nil {
+		t.Fatalf("Subscribe failed: %v", err)
+	}
+
+	// The slow subscriber keeps up within the delivery timeout.
+	received := make(chan int)
+	go func() {
+		n := 0
+		for range slow {
+			n++
+			time.Sleep(time.Millisecond)
+		}
+		received <- n
+	}()
+
+	n := 2 * subscriptionBufferSize
+	for i := 0; i < n; i++ {
+		if err := b.Publish("s1", &common.UpdateSessionResponse{OutputChunk: &common.OutputChunk{Sequence: i + 1}}); err != nil {
+			t.Fatalf("Publish failed: %v", err)
+		}
+	}
+
+	// The stalled subscriber is disconnected instead of losing the chunks.
+	got := 0
+	for range stalled {
+		got++
+	}
+	if got != subscriptionBufferSize {
+		t.Errorf("Stalled subscriber received %d chunks before being disconnected, want %d", got, subscriptionBufferSize)
+	}
+
+	cancel()
+	select {
+	case got := <-received:
+		if got != n {
+			t.Errorf("Slow subscriber received %d chunks, want %d", got, n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Slow subscription was not closed")
+	}
+}
@@ -0,0 +1,169 @@
+package users_manager
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/gob"
+	"io"
+	"log"
+	"sort"
+
+	"github.com/pasiasty/cocoder/server/common"
+	"github.com/pasiasty/cocoder/server/session_manager"
+)
+
+// maxCachedRevisions bounds the amount of texts the deltas can be computed
+// against. Users acknowledging older revisions receive the full text.
+const maxCachedRevisions = 64
+
+func responseHash(v interface{}) []byte {
+	b := new(bytes.Buffer)
+	e := gob.NewEncoder(b)
+	if err := e.Encode(v); err != nil {
+		log.Printf("Failed to encode %T: %v", v, err)
+	}
+
+	h := md5.New()
+	io.WriteString(h, b.String())
+	return h.Sum(nil)
+}
+
+// revisionCache keeps the texts of the newest revisions of the main file.
+type revisionCache struct {
+	texts map[int]string
+	order []int
+}
+
+func newRevisionCache() *revisionCache {
+	return &revisionCache{
+		texts: make(map[int]string),
+	}
+}
+
+func (c *revisionCache) add(revision int, text string) {
+	if _, ok := c.texts[revision]; ok {
+		return
+	}
+
+	c.texts[revision] = text
+	c.order = append(c.order, revision)
+	sort.Ints(c.order)
+
+	if len(c.order) > maxCachedRevisions {
+		delete(c.texts, c.order[0])
+		c.order = c.order[1:]
+	}
+}
+
+func (c *revisionCache) get(revision int) (string, bool) {
+	text, ok := c.texts[revision]
+	return text, ok
+}
+
+// deltaState tracks what was already delivered to the user.
+type deltaState struct {
+	enabled     bool
+	ackRevision int
+	// synced is set once the user received the complete state apart from the
+	// text. Until then nothing is stripped from the responses.
+	synced bool
+
+	inputText string
+	stdout    string
+	stderr    string
+	result    *common.ExecutionResult
+	running   bool
+	usersHash []byte
+	lintHash  []byte
+}
+
+func (d *deltaState) acknowledge(req *common.UpdateSessionRequest) {
+	if !req.UseDeltas {
+		return
+	}
+
+	d.enabled = true
+	if req.AckRevision > d.ackRevision {
+		d.ackRevision = req.AckRevision
+	}
+}
+
+func sameResult(a, b *common.ExecutionResult) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+func usersHash(users []*common.User) []byte {
+	sorted := append([]*common.User{}, users...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].ID < sorted[j].ID
+	})
+	return responseHash(sorted)
+}
+
+// prepare strips the response of everything the user already knows. The text
+// is replaced with the delta, unless the acknowledged revision is unknown, in
+// which case the full text is sent and the user resyncs.
+func (d *deltaState) prepare(resp *common.UpdateSessionResponse, revisions *revisionCache) *common.UpdateSessionResponse {
+	res := *resp
+	known := d.synced
+	d.synced = true
+
+	if resp.UpdateInputText {
+		if known && resp.InputText == d.inputText {
+			res.UpdateInputText = false
+			res.InputText = ""
+		}
+		d.inputText = resp.InputText
+	}
+	if resp.UpdateOutputText {
+		if known && resp.Stdout == d.stdout && resp.Stderr == d.stderr && sameResult(resp.ExecutionResult, d.result) {
+			res.UpdateOutputText = false
+			res.Stdout = ""
+			res.Stderr = ""
+			res.ExecutionResult = nil
+		}
+		d.stdout, d.stderr, d.result = resp.Stdout, resp.Stderr, resp.ExecutionResult
+	}
+	if resp.UpdateRunningState {
+		if known && resp.Running == d.running {
+			res.UpdateRunningState = false
+			res.Running = false
+		}
+		d.running = resp.Running
+	}
+
+	if resp.UpdateLintResult {
+		var h []byte
+		if resp.LintResult != nil {
+			h = responseHash(resp.LintResult)
+		}
+		if known && bytes.Equal(h, d.lintHash) {
+			res.UpdateLintResult = false
+			res.LintResult = nil
+		}
+		d.lintHash = h
+	}
+
+	h := usersHash(resp.Users)
+	if known && bytes.Equal(h, d.usersHash) {
+		res.Users = nil
+	}
+	d.usersHash = h
+
+	if resp.File != "" || resp.Resync || d.ackRevision > resp.Revision {
+		return &res
+	}
+	base, ok := revisions.get(d.ackRevision)
+	if !ok {
+		return &res
+	}
+
+	res.IsDelta = true
+	res.BaseRevision = d.ackRevision
+	res.TextDelta = session_manager.OperationFromTexts(base, resp.NewText)
+	res.NewText = ""
+	return &res
+}
@@ -0,0 +1,146 @@
+package users_manager
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+
+	"github.com/pasiasty/cocoder/server/common"
+)
+
+func TestRevisionCache(t *testing.T) {
+	c := newRevisionCache()
+	for i := 0; i < maxCachedRevisions+10; i++ {
+		c.add(i, string(rune('a'+i%26)))
+	}
+
+	if _, ok := c.get(9); ok {
+		t.Errorf("Revision 9 should've been evicted")
+	}
+	if text, ok := c.get(10); !ok || text != "k" {
+		t.Errorf("get(10) returned (%q, %v), want (\"k\", true)", text, ok)
+	}
+	if len(c.texts) != maxCachedRevisions {
+		t.Errorf("Cache holds %d revisions, want %d", len(c.texts), maxCachedRevisions)
+	}
+}
+
+func TestDeltaStatePrepare(t *testing.T) {
+	users := []*common.User{{ID: "u1", Position: 1}}
+
+	lintResult := &common.LintResult{
+		Revision:    2,
+		Language:    "go",
+		Diagnostics: []common.Diagnostic{{File: "code.go", Line: 1, Message: "unused variable"}},
+	}
+
+	revisions := newRevisionCache()
+	revisions.add(1, "abc")
+	revisions.add(2, "abcd")
+
+	for _, tc := range []struct {
+		name  string
+		state deltaState
+		resp  *common.UpdateSessionResponse
+		want  *common.UpdateSessionResponse
+	}{{
+		name:  "delta",
+		state: deltaState{ackRevision: 1, synced: true, usersHash: usersHash(users)},
+		resp:  &common.UpdateSessionResponse{NewText: "abcd", Revision: 2, Users: users, Language: "go"},
+		want: &common.UpdateSessionResponse{
+			IsDelta:      true,
+			BaseRevision: 1,
+			TextDelta:    common.Operation{{Retain: 3}, {Insert: "d"}},
+			Revision:     2,
+			Language:     "go",
+		},
+	}, {
+		name:  "unknown_revision",
+		state: deltaState{ackRevision: 5},
+		resp:  &common.UpdateSessionResponse{NewText: "abcd", Revision: 2, Users: users},
+		want:  &common.UpdateSessionResponse{NewText: "abcd", Revision: 2, Users: users},
+	}, {
+		name:  "other_file",
+		state: deltaState{ackRevision: 1},
+		resp:  &common.UpdateSessionResponse{NewText: "xyz", File: "a.go", Revision: 2},
+		want:  &common.UpdateSessionResponse{NewText: "xyz", File: "a.go", Revision: 2},
+	}, {
+		name:  "unchanged_output",
+		state: deltaState{ackRevision: 2, synced: true, stdout: "out", running: true},
+		resp: &common.UpdateSessionResponse{
+			NewText:            "abcd",
+			Revision:           2,
+			UpdateOutputText:   true,
+			Stdout:             "out",
+			UpdateRunningState: true,
+			Running:            true,
+			UpdateInputText:    true,
+			InputText:          "in",
+		},
+		want: &common.UpdateSessionResponse{
+			IsDelta:         true,
+			BaseRevision:    2,
+			TextDelta:       common.Operation{{Retain: 4}},
+			Revision:        2,
+			UpdateInputText: true,
+			InputText:       "in",
+		},
+	}, {
+		name:  "changed_result",
+		state: deltaState{ackRevision: 2, synced: true, stdout: "out"},
+		resp: &common.UpdateSessionResponse{
+			NewText:          "abcd",
+			Revision:         2,
+			UpdateOutputText: true,
+			Stdout:           "out",
+			ExecutionResult:  &common.ExecutionResult{Step: "run", ExitCode: 1},
+		},
+		want: &common.UpdateSessionResponse{
+			IsDelta:          true,
+			BaseRevision:     2,
+			TextDelta:        common.Operation{{Retain: 4}},
+			Revision:         2,
+			UpdateOutputText: true,
+			Stdout:           "out",
+			ExecutionResult:  &common.ExecutionResult{Step: "run", ExitCode: 1},
+		},
+	}, {
+		name:  "unchanged_lint_result",
+		state: deltaState{ackRevision: 2, synced: true, lintHash: responseHash(lintResult)},
+		resp: &common.UpdateSessionResponse{
+			NewText:          "abcd",
+			Revision:         2,
+			UpdateLintResult: true,
+			LintResult:       lintResult,
+		},
+		want: &common.UpdateSessionResponse{
+			IsDelta:      true,
+			BaseRevision: 2,
+			TextDelta:    common.Operation{{Retain: 4}},
+			Revision:     2,
+		},
+	}, {
+		name:  "changed_lint_result",
+		state: deltaState{ackRevision: 2, synced: true},
+		resp: &common.UpdateSessionResponse{
+			NewText:          "abcd",
+			Revision:         2,
+			UpdateLintResult: true,
+			LintResult:       lintResult,
+		},
+		want: &common.UpdateSessionResponse{
+			IsDelta:          true,
+			BaseRevision:     2,
+			TextDelta:        common.Operation{{Retain: 4}},
+			Revision:         2,
+			UpdateLintResult: true,
+			LintResult:       lintResult,
+		},
+	}} {
+		t.Run(tc.name, func(t *testing.T) {
+			if diff := cmp.Diff(tc.want, tc.state.prepare(tc.resp, revisions)); diff != "" {
+				t.Errorf("prepare() returned wrong result, -want +got:\n%v", diff)
+			}
+		})
+	}
+}
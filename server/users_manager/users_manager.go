@@ -3,12 +3,11 @@ package users_manager
 import (
 	"bytes"
 	"context"
-	"crypto/md5"
-	"encoding/gob"
 	"encoding/json"
 	"io"
 	"log"
 	"runtime/trace"
+	"sort"
 	"sync"
 	"time"
 
@@ -36,6 +35,15 @@ type ConnectedUser struct {
 	fromUsersHandler func(context.Context, *common.UpdateSessionRequest)
 	toUser           chan *common.UpdateSessionResponse
 	cancelled        bool
+
+	// stream gathers the streamed responses until the writeLoop, signalled
+	// through streamReady, takes them.
+	stream      pendingStream
+	streamReady chan struct{}
+
+	deltas           deltaState
+	streamOutput     bool
+	lastResponseHash []byte
 }
 
 func (u *ConnectedUser) send(resp *common.UpdateSessionResponse) {
@@ -47,6 +55,100 @@ func (u *ConnectedUser) send(resp *common.UpdateSessionResponse) {
 	}
 }
 
+// sendUpdate sends the response (or its delta, if the user asked for them)
+// unless it's identical to the previously sent one.
+func (u *ConnectedUser) sendUpdate(resp *common.UpdateSessionResponse, hash []byte, revisions *revisionCache) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	if u.cancelled {
+		return
+	}
+
+	if u.deltas.enabled {
+		resp = u.deltas.prepare(resp, revisions)
+		hash = responseHash(resp)
+	}
+
+	if bytes.Equal(hash, u.lastResponseHash) {
+		return
+	}
+	u.lastResponseHash = hash
+	u.toUser <- resp
+}
+
+// sendStream queues the output chunk or the queue position, if the user asked
+// for them. It never blocks, a slow connection gets them merged instead.
+func (u *ConnectedUser) sendStream(resp *common.UpdateSessionResponse) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	if u.cancelled || !u.streamOutput {
+		return
+	}
+	u.stream.add(resp)
+	select {
+	case u.streamReady <- struct{}{}:
+	default:
+	}
+}
+
+// takeStream returns the queued streamed responses.
+func (u *ConnectedUser) takeStream() []*common.UpdateSessionResponse {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	return u.stream.take()
+}
+
+// pendingStream holds the streamed responses not yet written to the
+// connection. Adjacent output chunks are merged and only the last position
+// of a job in the queue is kept.
+type pendingStream struct {
+	responses []*common.UpdateSessionResponse
+}
+
+func (p *pendingStream) add(resp *common.UpdateSessionResponse) {
+	if c := resp.OutputChunk; c != nil {
+		if n := len(p.responses); n > 0 {
+			if last := p.responses[n-1].OutputChunk; last != nil && last.Stderr == c.Stderr {
+				// The responses are shared by the users, so the merged chunk
+				// is a copy.
+				merged := &common.OutputChunk{Sequence: c.Sequence, Stderr: c.Stderr, Text: last.Text + c.Text}
+				p.responses[n-1] = &common.UpdateSessionResponse{OutputChunk: merged}
+				return
+			}
+		}
+	}
+	if q := resp.QueuePosition; q != nil {
+		for i, r := range p.responses {
+			if r.QueuePosition != nil && r.QueuePosition.JobID == q.JobID {
+				p.responses[i] = resp
+				return
+			}
+		}
+	}
+	p.responses = append(p.responses, resp)
+}
+
+func (p *pendingStream) take() []*common.UpdateSessionResponse {
+	res := p.responses
+	p.responses = nil
+	return res
+}
+
+// configure applies the options of the connection sent along with the
+// requests.
+func (u *ConnectedUser) configure(req *common.UpdateSessionRequest) {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	u.deltas.acknowledge(req)
+	if req.StreamOutput {
+		u.streamOutput = true
+	}
+}
+
 func NewConnectedUser(ctx context.Context, userID UserID, conn *websocket.Conn, fromUsersHandler func(context.Context, *common.UpdateSessionRequest)) *ConnectedUser {
 	log.Printf("connected user: %v", userID)
 	u := &ConnectedUser{
@@ -54,6 +156,7 @@ func NewConnectedUser(ctx context.Context, userID UserID, conn *websocket.Conn,
 		conn:             conn,
 		fromUsersHandler: fromUsersHandler,
 		toUser:           make(chan *common.UpdateSessionResponse, 32),
+		streamReady:      make(chan struct{}, 1),
 	}
 
 	go u.readLoop(ctx)
@@ -80,6 +183,7 @@ func (u *ConnectedUser) readLoop(ctx context.Context) {
 				log.Printf("Failed to unmarshal UpdateSessionRequest: %v", err)
 				continue
 			}
+			u.configure(req)
 			if req.Ping {
 				u.send(&common.UpdateSessionResponse{Ping: true})
 				continue
@@ -101,17 +205,32 @@ func (u *ConnectedUser) writeLoop(ctx context.Context) {
 			if !ok {
 				return
 			}
-			u.mux.Lock()
-			if err := u.conn.WriteJSON(resp); err != nil {
-				log.Printf("Failed to send response to user: %v", err)
+			u.write(resp)
+		case <-u.streamReady:
+			for _, resp := range u.takeStream() {
+				u.write(resp)
 			}
-			u.mux.Unlock()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+func (u *ConnectedUser) isCancelled() bool {
+	u.mux.Lock()
+	defer u.mux.Unlock()
+
+	return u.cancelled
+}
+
+// write is only called by the writeLoop, the websocket allows a single
+// writer at a time.
+func (u *ConnectedUser) write(resp *common.UpdateSessionResponse) {
+	if err := u.conn.WriteJSON(resp); err != nil {
+		log.Printf("Failed to send response to user: %v", err)
+	}
+}
+
 func (u *ConnectedUser) Cancel() {
 	u.mux.Lock()
 	defer u.mux.Unlock()
@@ -120,7 +239,8 @@ func (u *ConnectedUser) Cancel() {
 		close(u.toUser)
 	}
 
-	u.conn.WriteMessage(websocket.CloseMessage, []byte{})
+	// Control messages may be written concurrently with the writeLoop.
+	u.conn.WriteControl(websocket.CloseMessage, []byte{}, time.Time{})
 	u.conn.Close()
 	u.cancelled = true
 }
@@ -139,15 +259,17 @@ type ManagedSession struct {
 	mux sync.Mutex
 
 	cancelled bool
+	cancelCtx context.CancelFunc
 
 	SessionID session_manager.SessionID
 	Users     map[UserID]*ConnectedUser
 	sm        *session_manager.SessionManager
+	b         Broadcaster
 
 	fromUsers chan FromUsersItem
 	toUsers   chan *common.UpdateSessionResponse
 
-	lastResponseHash []byte
+	revisions *revisionCache
 
 	runningTasks map[int64]*trace.Task
 }
@@ -178,7 +300,7 @@ func (s *ManagedSession) toUsersHandler(ctx context.Context, tui *ToUsersItem) {
 	}
 }
 
-func (s *ManagedSession) AddUser(ctx context.Context, userID UserID, conn *websocket.Conn) {
+func (s *ManagedSession) AddUser(ctx context.Context, userID UserID, conn *websocket.Conn) *ConnectedUser {
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
@@ -186,7 +308,26 @@ func (s *ManagedSession) AddUser(ctx context.Context, userID UserID, conn *webso
 		u.Cancel()
 		s.cleanupInactiveUsers()
 	}
-	s.Users[userID] = NewConnectedUser(ctx, userID, conn, s.fromUsersHandler)
+	u := NewConnectedUser(ctx, userID, conn, s.fromUsersHandler)
+	s.Users[userID] = u
+	return u
+}
+
+// greetUser sends the current state of the session to the newly connected
+// user. Resumed users only receive the delta against the given revision.
+func (s *ManagedSession) greetUser(u *ConnectedUser, resp *common.UpdateSessionResponse, resumedRevision int) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	s.revisions.add(resp.Revision, resp.NewText)
+
+	if resp.Resumed {
+		u.mux.Lock()
+		u.deltas.enabled = true
+		u.deltas.ackRevision = resumedRevision
+		u.mux.Unlock()
+	}
+	u.sendUpdate(resp, responseHash(resp), s.revisions)
 }
 
 func (s *ManagedSession) Cancel() {
@@ -194,31 +335,50 @@ func (s *ManagedSession) Cancel() {
 	defer s.mux.Unlock()
 
 	s.cancelled = true
+	s.cancelCtx()
 	close(s.fromUsers)
 	close(s.toUsers)
 }
 
 func (s *ManagedSession) sendResponseToUsers(resp *common.UpdateSessionResponse) {
+	if resp.OutputChunk != nil || resp.QueuePosition != nil {
+		// Streamed outside of the lock, a slow user only delays itself.
+		for _, u := range s.activeUsers() {
+			u.sendStream(resp)
+		}
+		return
+	}
+
 	s.mux.Lock()
 	defer s.mux.Unlock()
 
-	b := new(bytes.Buffer)
-	e := gob.NewEncoder(b)
-	if err := e.Encode(resp); err != nil {
-		log.Printf("Failed to encodeUpdateSessionResponse: %v", err)
+	if s.cancelled || resp.StdinLine != nil || resp.ExecutionCancel != nil {
+		return
 	}
 
-	h := md5.New()
-	io.WriteString(h, b.String())
-	newHash := h.Sum(nil)
+	if resp.File == "" && !resp.Ping {
+		s.revisions.add(resp.Revision, resp.NewText)
+	}
 
+	newHash := responseHash(resp)
 	for _, u := range s.Users {
-		if !bytes.Equal(newHash, s.lastResponseHash) {
-			u.send(resp)
-		}
+		u.sendUpdate(resp, newHash, s.revisions)
 	}
+}
 
-	s.lastResponseHash = newHash
+// activeUsers returns the users of the session, none once it's cancelled.
+func (s *ManagedSession) activeUsers() []*ConnectedUser {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if s.cancelled {
+		return nil
+	}
+	res := make([]*ConnectedUser, 0, len(s.Users))
+	for _, u := range s.Users {
+		res = append(res, u)
+	}
+	return res
 }
 
 func (s *ManagedSession) loop(ctx context.Context) {
@@ -228,14 +388,7 @@ func (s *ManagedSession) loop(ctx context.Context) {
 			if !ok {
 				return
 			}
-			resp, err := s.sm.UpdateSession(ctx, s.SessionID, fromUsersItem.req)
-			if err != nil {
-				log.Printf("Failed to update session: %v", err)
-			}
-			s.toUsersHandler(ctx, &ToUsersItem{
-				task: fromUsersItem.task,
-				resp: resp,
-			})
+			s.processRequest(ctx, fromUsersItem)
 		case resp, ok := <-s.toUsers:
 			if !ok {
 				return
@@ -249,11 +402,78 @@ func (s *ManagedSession) loop(ctx context.Context) {
 	}
 }
 
+// processRequest publishes the response instead of sending it directly, so
+// that it also reaches the users connected to other server instances.
+func (s *ManagedSession) processRequest(ctx context.Context, item FromUsersItem) {
+	defer item.task.End()
+
+	if item.req.SendStdin {
+		// The program may run on any of the instances.
+		if err := s.b.Publish(s.SessionID, &common.UpdateSessionResponse{
+			StdinLine: &common.StdinLine{
+				UserID: item.req.UserID,
+				Text:   item.req.Stdin,
+			},
+		}); err != nil {
+			log.Printf("Failed to publish stdin: %v", err)
+		}
+		return
+	}
+
+	req := item.req
+	if req.CancelExecution {
+		if err := s.b.Publish(s.SessionID, &common.UpdateSessionResponse{
+			ExecutionCancel: &common.ExecutionCancel{
+				UserID: req.UserID,
+				JobID:  req.JobID,
+			},
+		}); err != nil {
+			log.Printf("Failed to publish cancellation: %v", err)
+		}
+		// The program stops running for everyone, even if it's already gone.
+		req = &common.UpdateSessionRequest{
+			UserID:             req.UserID,
+			UpdateRunningState: true,
+			Running:            false,
+		}
+	}
+
+	resp, err := s.sm.UpdateSession(ctx, s.SessionID, req)
+	if err != nil {
+		log.Printf("Failed to update session: %v", err)
+		return
+	}
+	if err := s.b.Publish(s.SessionID, resp); err != nil {
+		log.Printf("Failed to publish response: %v", err)
+		// Users of this instance don't have to wait for the periodic update.
+		s.sendResponseToUsers(resp)
+	}
+}
+
+func (s *ManagedSession) subscriptionLoop(ctx context.Context, updates <-chan *common.UpdateSessionResponse) {
+	for {
+		for resp := range updates {
+			s.sendResponseToUsers(resp)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Disconnected for falling behind, the users catch up with the next
+		// state of the session.
+		var err error
+		if updates, err = s.b.Subscribe(ctx, s.SessionID); err != nil {
+			log.Printf("Failed to resubscribe to updates of session %v: %v", s.SessionID, err)
+			return
+		}
+	}
+}
+
 func (s *ManagedSession) cleanupInactiveUsers() {
 	usersToCleanup := make(map[UserID]interface{})
 
 	for _, u := range s.Users {
-		if u.cancelled {
+		if u.isCancelled() {
 			usersToCleanup[u.UserID] = new(interface{})
 		}
 	}
@@ -263,16 +483,27 @@ func (s *ManagedSession) cleanupInactiveUsers() {
 	}
 }
 
-func NewManagedSession(ctx context.Context, sessionID session_manager.SessionID, sm *session_manager.SessionManager) *ManagedSession {
+func NewManagedSession(ctx context.Context, sessionID session_manager.SessionID, sm *session_manager.SessionManager, b Broadcaster) *ManagedSession {
+	ctx, cancel := context.WithCancel(ctx)
 	s := &ManagedSession{
+		cancelCtx:    cancel,
 		SessionID:    sessionID,
 		sm:           sm,
+		b:            b,
 		fromUsers:    make(chan FromUsersItem, 32),
 		toUsers:      make(chan *common.UpdateSessionResponse, 32),
 		Users:        make(map[UserID]*ConnectedUser),
+		revisions:    newRevisionCache(),
 		runningTasks: make(map[int64]*trace.Task),
 	}
 
+	updates, err := b.Subscribe(ctx, sessionID)
+	if err != nil {
+		log.Printf("Failed to subscribe to updates of session %v: %v", sessionID, err)
+	} else {
+		go s.subscriptionLoop(ctx, updates)
+	}
+
 	go s.loop(ctx)
 
 	return s
@@ -283,11 +514,13 @@ type UsersManager struct {
 	managedSessions    map[session_manager.SessionID]*ManagedSession
 	sessionsInactivity map[session_manager.SessionID]int32
 	sm                 *session_manager.SessionManager
+	b                  Broadcaster
 }
 
-func NewUsersManager(ctx context.Context, sm *session_manager.SessionManager) *UsersManager {
+func NewUsersManager(ctx context.Context, sm *session_manager.SessionManager, b Broadcaster) *UsersManager {
 	um := &UsersManager{
 		sm:                 sm,
+		b:                  b,
 		managedSessions:    make(map[session_manager.SessionID]*ManagedSession),
 		sessionsInactivity: make(map[session_manager.SessionID]int32),
 	}
@@ -297,6 +530,34 @@ func NewUsersManager(ctx context.Context, sm *session_manager.SessionManager) *U
 	return um
 }
 
+func sessionStateResponse(s *session_manager.Session) *common.UpdateSessionResponse {
+	users := []*common.User{}
+	for _, u := range s.Users {
+		users = append(users, u)
+	}
+	// Stable order keeps the unchanged responses deduplicated.
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Index < users[j].Index
+	})
+
+	return &common.UpdateSessionResponse{
+		NewText:            s.Text,
+		Language:           s.Language,
+		Revision:           s.Revision,
+		UpdateInputText:    true,
+		InputText:          s.InputText,
+		UpdateOutputText:   true,
+		Stdout:             s.Stdout,
+		Stderr:             s.Stderr,
+		ExecutionResult:    s.ExecutionResult,
+		UpdateRunningState: true,
+		Running:            s.Running,
+		UpdateLintResult:   true,
+		LintResult:         s.LintResult,
+		Users:              users,
+	}
+}
+
 func (m *UsersManager) triggerResponsesAndSessionCleanup(ctx context.Context) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
@@ -313,24 +574,8 @@ func (m *UsersManager) triggerResponsesAndSessionCleanup(ctx context.Context) {
 				continue
 			}
 
-			users := []*common.User{}
-			for _, u := range s.Users {
-				users = append(users, u)
-			}
-
 			ms.toUsersHandler(ctx, &ToUsersItem{
-				resp: &common.UpdateSessionResponse{
-					NewText:            s.Text,
-					Language:           s.Language,
-					UpdateInputText:    true,
-					InputText:          s.InputText,
-					UpdateOutputText:   true,
-					Stdout:             s.Stdout,
-					Stderr:             s.Stderr,
-					UpdateRunningState: true,
-					Running:            s.Running,
-					Users:              users,
-				},
+				resp: sessionStateResponse(s),
 			})
 		}
 	}
@@ -354,12 +599,175 @@ func (m *UsersManager) loop(ctx context.Context) {
 	}
 }
 
-func (m *UsersManager) RegisterUser(ctx context.Context, sessionID session_manager.SessionID, userID UserID, conn *websocket.Conn) {
+// BroadcastOutput sends the chunk of the program's output to all the users
+// of the session which asked for it.
+func (m *UsersManager) BroadcastOutput(sessionID session_manager.SessionID, chunk common.OutputChunk) {
+	if err := m.b.Publish(sessionID, &common.UpdateSessionResponse{OutputChunk: &chunk}); err != nil {
+		log.Printf("Failed to publish output of session %v: %v", sessionID, err)
+	}
+}
+
+// BroadcastQueuePosition tells all the users of the session which asked for
+// the output, where the program run by the user is in the execution queue.
+func (m *UsersManager) BroadcastQueuePosition(sessionID session_manager.SessionID, userID UserID, jobID string, position int) {
+	if err := m.b.Publish(sessionID, &common.UpdateSessionResponse{QueuePosition: &common.QueuePosition{
+		JobID:    jobID,
+		UserID:   string(userID),
+		Position: position,
+	}}); err != nil {
+		log.Printf("Failed to publish queue position of session %v: %v", sessionID, err)
+	}
+}
+
+// CancelExecution stops the program with the jobID, or all the programs of
+// the session if it's empty, on whichever instance they run.
+func (m *UsersManager) CancelExecution(sessionID session_manager.SessionID, userID UserID, jobID string) error {
+	return m.b.Publish(sessionID, &common.UpdateSessionResponse{ExecutionCancel: &common.ExecutionCancel{
+		UserID: string(userID),
+		JobID:  jobID,
+	}})
+}
+
+// WatchCancellation calls cancel once the program with the jobID gets
+// cancelled by any user of the session. It stops watching once the context
+// is done.
+func (m *UsersManager) WatchCancellation(ctx context.Context, sessionID session_manager.SessionID, jobID string, cancel func()) error {
+	updates, err := m.b.Subscribe(ctx, sessionID)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		for resp := range updates {
+			if c := resp.ExecutionCancel; c != nil && (c.JobID == "" || c.JobID == jobID) {
+				log.Printf("User %v has cancelled execution %v in session %v", c.UserID, jobID, sessionID)
+				cancel()
+			}
+		}
+	}()
+	return nil
+}
+
+// AttachStdin returns the standard input for the interactively running
+// program, made of the lines sent by the users of the session. The input is
+// closed once the context is done.
+func (m *UsersManager) AttachStdin(ctx context.Context, sessionID session_manager.SessionID) (io.Reader, error) {
+	updates, err := m.b.Subscribe(ctx, sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	in := newStdinBuffer()
+	go func() {
+		<-ctx.Done()
+		in.close()
+	}()
+	go func() {
+		// The subscription is drained even if the program doesn't read its
+		// input, so that the lines aren't lost with the subscription.
+		for resp := range updates {
+			if resp.StdinLine != nil {
+				in.write(resp.StdinLine.Text + "\n")
+			}
+		}
+	}()
+
+	return in, nil
+}
+
+// stdinBuffer is the input of the program, which is written without waiting
+// for the program to read it.
+type stdinBuffer struct {
+	mux    sync.Mutex
+	ready  *sync.Cond
+	buf    bytes.Buffer
+	closed bool
+}
+
+func newStdinBuffer() *stdinBuffer {
+	b := &stdinBuffer{}
+	b.ready = sync.NewCond(&b.mux)
+	return b
+}
+
+func (b *stdinBuffer) write(text string) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	if !b.closed {
+		b.buf.WriteString(text)
+		b.ready.Signal()
+	}
+}
+
+// Read waits for the input, the EOF is returned once the buffer is closed.
+func (b *stdinBuffer) Read(p []byte) (int, error) {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	for b.buf.Len() == 0 && !b.closed {
+		b.ready.Wait()
+	}
+	if b.closed {
+		return 0, io.EOF
+	}
+	return b.buf.Read(p)
+}
+
+func (b *stdinBuffer) close() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+
+	b.closed = true
+	b.ready.Broadcast()
+}
+
+// Resume identifies the connection the user is reconnecting to, and the
+// newest revision the user has seen.
+type Resume struct {
+	Token    string
+	Revision int
+}
+
+// handshake prepares the first response on the user's connection.
+func (m *UsersManager) handshake(sessionID session_manager.SessionID, userID UserID, resume *Resume) (*common.UpdateSessionResponse, error) {
+	s, err := m.sm.LoadSession(sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := sessionStateResponse(s)
+	resp.AppliedSequence = s.AppliedSequences[string(userID)]
+
+	if resume != nil && m.sm.ValidResumeToken(sessionID, string(userID), resume.Token) {
+		resp.ResumeToken = resume.Token
+		resp.Resumed = true
+		return resp, nil
+	}
+
+	if resp.ResumeToken, err = m.sm.NewResumeToken(sessionID, string(userID)); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (m *UsersManager) RegisterUser(ctx context.Context, sessionID session_manager.SessionID, userID UserID, conn *websocket.Conn, resume *Resume) {
 	m.mux.Lock()
 	defer m.mux.Unlock()
 	if _, ok := m.managedSessions[sessionID]; !ok {
-		m.managedSessions[sessionID] = NewManagedSession(ctx, sessionID, m.sm)
+		m.managedSessions[sessionID] = NewManagedSession(ctx, sessionID, m.sm, m.b)
 	}
 	ms := m.managedSessions[sessionID]
-	ms.AddUser(ctx, userID, conn)
+	u := ms.AddUser(ctx, userID, conn)
+
+	resp, err := m.handshake(sessionID, userID, resume)
+	if err != nil {
+		log.Printf("Failed to prepare handshake for user %v: %v", userID, err)
+		return
+	}
+	resumedRevision := 0
+	if resume != nil {
+		resumedRevision = resume.Revision
+	}
+	ms.greetUser(u, resp, resumedRevision)
 }
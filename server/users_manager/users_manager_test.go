@@ -3,6 +3,7 @@ package users_manager
 import (
 	"context"
 	"encoding/json"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
@@ -105,7 +106,7 @@ func prepareSessionmanager() *session_manager.SessionManager {
 		Addr: mr.Addr(),
 	})
 
-	return session_manager.NewSessionManager(redisClient)
+	return session_manager.NewSessionManager(session_manager.NewRedisStore(redisClient))
 }
 
 func assertChannelGotMessage(t *testing.T, ch <-chan testMessage, wantResp *common.UpdateSessionResponse) {
@@ -119,6 +120,27 @@ func assertChannelGotMessage(t *testing.T, ch <-chan testMessage, wantResp *comm
 	}
 }
 
+// receiveHandshake checks the first response on the connection and returns
+// its resume token.
+func receiveHandshake(t *testing.T, ch <-chan testMessage, wantResp *common.UpdateSessionResponse) string {
+	select {
+	case tm := <-ch:
+		resp := tm.toUpdateSessionResponse()
+		token := resp.ResumeToken
+		if token == "" {
+			t.Errorf("Handshake is missing the resume token")
+		}
+		resp.ResumeToken = ""
+		if diff := cmp.Diff(wantResp, resp); diff != "" {
+			t.Errorf("Received wrong handshake, -want +got:\n%v", diff)
+		}
+		return token
+	case <-time.After(time.Second):
+		t.Fatalf("Handshake did not come within the given deadline.")
+	}
+	return ""
+}
+
 func TestUserSend(t *testing.T) {
 	ctx := context.Background()
 	ts := prepareTestServer()
@@ -138,6 +160,47 @@ func TestUserSend(t *testing.T) {
 	assertChannelGotMessage(t, ts.gotMessage, resp)
 }
 
+func TestUserStreamIsMerged(t *testing.T) {
+	// The user isn't connected, nothing takes the stream but the test.
+	u := &ConnectedUser{
+		UserID:       "abc",
+		toUser:       make(chan *common.UpdateSessionResponse),
+		streamReady:  make(chan struct{}, 1),
+		streamOutput: true,
+	}
+	s := &ManagedSession{Users: map[UserID]*ConnectedUser{u.UserID: u}, revisions: newRevisionCache()}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 1; i <= 1000; i++ {
+			s.sendResponseToUsers(&common.UpdateSessionResponse{OutputChunk: &common.OutputChunk{Sequence: i, Text: "a"}})
+			if i%100 == 0 {
+				s.sendResponseToUsers(&common.UpdateSessionResponse{QueuePosition: &common.QueuePosition{JobID: "job_1", Position: i}})
+			}
+		}
+		s.sendResponseToUsers(&common.UpdateSessionResponse{OutputChunk: &common.OutputChunk{Sequence: 1001, Stderr: true, Text: "b"}})
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Streaming to the user has blocked")
+	}
+
+	want := []*common.UpdateSessionResponse{
+		{OutputChunk: &common.OutputChunk{Sequence: 100, Text: strings.Repeat("a", 100)}},
+		{QueuePosition: &common.QueuePosition{JobID: "job_1", Position: 1000}},
+		{OutputChunk: &common.OutputChunk{Sequence: 1000, Text: strings.Repeat("a", 900)}},
+		{OutputChunk: &common.OutputChunk{Sequence: 1001, Stderr: true, Text: "b"}},
+	}
+	if diff := cmp.Diff(want, u.takeStream()); diff != "" {
+		t.Errorf("Wrong stream, -want +got:\n%v", diff)
+	}
+	if got := u.takeStream(); len(got) != 0 {
+		t.Errorf("Stream was taken twice: %v", got)
+	}
+}
+
 func TestUserRead(t *testing.T) {
 	ctx := context.Background()
 	ts := prepareTestServer()
@@ -209,7 +272,7 @@ func TestSessionBroadcast(t *testing.T) {
 	sm := prepareSessionmanager()
 	sID := sm.NewSession()
 
-	ms := NewManagedSession(ctx, sID, sm)
+	ms := NewManagedSession(ctx, sID, sm, NewLocalBroadcaster())
 	defer ms.Cancel()
 	ms.AddUser(ctx, "u1", ws1)
 	ms.AddUser(ctx, "u2", ws2)
@@ -224,15 +287,108 @@ func TestSessionBroadcast(t *testing.T) {
 	}
 
 	assertChannelGotMessage(t, ts.gotMessage, &common.UpdateSessionResponse{
-		NewText:  "abc",
-		Language: "plaintext",
+		NewText:   "abc",
+		Language:  "plaintext",
+		Revision:  1,
+		Operation: common.Operation{{Insert: "abc"}},
 	})
 	assertChannelGotMessage(t, ts.gotMessage, &common.UpdateSessionResponse{
-		NewText:  "abc",
-		Language: "plaintext",
+		NewText:   "abc",
+		Language:  "plaintext",
+		Revision:  1,
+		Operation: common.Operation{{Insert: "abc"}},
 	})
 }
 
+func TestSessionBroadcastAcrossInstances(t *testing.T) {
+	ctx := context.Background()
+	ts := prepareTestServer()
+	defer ts.Close()
+
+	ws1 := ts.connect()
+	defer ws1.Close()
+
+	ws2 := ts.connect()
+	defer ws2.Close()
+
+	sm := prepareSessionmanager()
+	sID := sm.NewSession()
+
+	// Both managed sessions act as if they were run by different server
+	// instances, sharing only the storage and the broadcaster.
+	b := NewLocalBroadcaster()
+	ms1 := NewManagedSession(ctx, sID, sm, b)
+	defer ms1.Cancel()
+	ms1.AddUser(ctx, "u1", ws1)
+
+	ms2 := NewManagedSession(ctx, sID, sm, b)
+	defer ms2.Cancel()
+	ms2.AddUser(ctx, "u2", ws2)
+
+	<-ts.connected
+	<-ts.connected
+	if err := ts.connections[0].WriteJSON(&common.UpdateSessionRequest{
+		NewText: "abc",
+	}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	wantResp := &common.UpdateSessionResponse{
+		NewText:   "abc",
+		Language:  "plaintext",
+		Revision:  1,
+		Operation: common.Operation{{Insert: "abc"}},
+	}
+	assertChannelGotMessage(t, ts.gotMessage, wantResp)
+	assertChannelGotMessage(t, ts.gotMessage, wantResp)
+}
+
+func TestSessionDeltas(t *testing.T) {
+	ctx := context.Background()
+	ts := prepareTestServer()
+	defer ts.Close()
+
+	ws := ts.connect()
+	defer ws.Close()
+
+	sm := prepareSessionmanager()
+	sID := sm.NewSession()
+
+	ms := NewManagedSession(ctx, sID, sm, NewLocalBroadcaster())
+	defer ms.Cancel()
+	ms.AddUser(ctx, "u1", ws)
+
+	<-ts.connected
+	for _, tc := range []struct {
+		req  *common.UpdateSessionRequest
+		want *common.UpdateSessionResponse
+	}{{
+		// The revision the user started with is not known, full text is sent.
+		req: &common.UpdateSessionRequest{UseDeltas: true, NewText: "abc"},
+		want: &common.UpdateSessionResponse{
+			NewText:   "abc",
+			Language:  "plaintext",
+			Revision:  1,
+			Operation: common.Operation{{Insert: "abc"}},
+		},
+	}, {
+		req: &common.UpdateSessionRequest{UseDeltas: true, AckRevision: 1, BaseText: "abc", NewText: "abcd"},
+		want: &common.UpdateSessionResponse{
+			Language:     "plaintext",
+			Revision:     2,
+			Operation:    common.Operation{{Retain: 3}, {Insert: "d"}},
+			IsDelta:      true,
+			BaseRevision: 1,
+			TextDelta:    common.Operation{{Retain: 3}, {Insert: "d"}},
+		},
+	}} {
+		if err := ts.connections[0].WriteJSON(tc.req); err != nil {
+			t.Fatalf("Failed to write: %v", err)
+		}
+		assertChannelGotMessage(t, ts.gotMessage, tc.want)
+	}
+}
+
 func TestSessionCleanupInactiveUsers(t *testing.T) {
 	ctx := context.Background()
 	ts := prepareTestServer()
@@ -247,7 +403,7 @@ func TestSessionCleanupInactiveUsers(t *testing.T) {
 	cleanupTrigger := make(chan time.Time)
 	inactiveUserCleanupIntervalChannelSource = func() <-chan time.Time { return cleanupTrigger }
 
-	ms := NewManagedSession(ctx, sID, sm)
+	ms := NewManagedSession(ctx, sID, sm, NewLocalBroadcaster())
 	defer ms.Cancel()
 	ms.AddUser(ctx, "u1", ws1)
 	ms.Users["u1"].Cancel()
@@ -279,18 +435,112 @@ func TestUsersManagerPeriodicResponse(t *testing.T) {
 
 	inactiveSessionCleanupIntervalChannelSource = func() <-chan time.Time { return umTrigger }
 
-	um := NewUsersManager(ctx, sm)
-	um.RegisterUser(ctx, sID, "u1", ws1)
+	um := NewUsersManager(ctx, sm, NewLocalBroadcaster())
+	um.RegisterUser(ctx, sID, "u1", ws1, nil)
+
+	wantResp := &common.UpdateSessionResponse{
+		NewText:            "some text",
+		Language:           "plaintext",
+		Revision:           1,
+		UpdateInputText:    true,
+		UpdateOutputText:   true,
+		UpdateRunningState: true,
+		UpdateLintResult:   true,
+	}
+	receiveHandshake(t, ts.gotMessage, wantResp)
 
 	umTrigger <- time.Now()
 
-	assertChannelGotMessage(t, ts.gotMessage, &common.UpdateSessionResponse{
-		NewText:            "some text",
+	assertChannelGotMessage(t, ts.gotMessage, wantResp)
+
+	// The lint result stored on the session reaches all the participants.
+	lintResult := &common.LintResult{
+		Revision:    1,
+		Language:    "python",
+		Diagnostics: []common.Diagnostic{{File: "code.py", Line: 1, Severity: "warning", Message: "unused import", Rule: "F401"}},
+	}
+	if _, err := sm.UpdateSession(ctx, sID, &common.UpdateSessionRequest{UpdateLintResult: true, LintResult: lintResult}); err != nil {
+		t.Fatalf("Failed to update session: %v", err)
+	}
+	wantResp.LintResult = lintResult
+
+	umTrigger <- time.Now()
+
+	assertChannelGotMessage(t, ts.gotMessage, wantResp)
+}
+
+func TestUsersManagerResume(t *testing.T) {
+	ctx := context.Background()
+	ts := prepareTestServer()
+	defer ts.Close()
+
+	sm := prepareSessionmanager()
+	sID := sm.NewSession()
+	sm.UpdateSession(ctx, sID, &common.UpdateSessionRequest{
+		UserID:   "u1",
+		NewText:  "abc",
+		Sequence: 1,
+	})
+
+	inactiveSessionCleanupIntervalChannelSource = func() <-chan time.Time { return make(chan time.Time) }
+
+	um := NewUsersManager(ctx, sm, NewLocalBroadcaster())
+
+	ws1 := ts.connect()
+	defer ws1.Close()
+	um.RegisterUser(ctx, sID, "u1", ws1, nil)
+	token := receiveHandshake(t, ts.gotMessage, &common.UpdateSessionResponse{
+		NewText:            "abc",
 		Language:           "plaintext",
+		Revision:           1,
+		AppliedSequence:    1,
 		UpdateInputText:    true,
 		UpdateOutputText:   true,
 		UpdateRunningState: true,
+		UpdateLintResult:   true,
+	})
+
+	// Edit made while the user was disconnected.
+	sm.UpdateSession(ctx, sID, &common.UpdateSessionRequest{
+		UserID:   "u2",
+		BaseText: "abc",
+		NewText:  "abcd",
 	})
+
+	ws2 := ts.connect()
+	defer ws2.Close()
+	um.RegisterUser(ctx, sID, "u1", ws2, &Resume{Token: token, Revision: 1})
+	if got := receiveHandshake(t, ts.gotMessage, &common.UpdateSessionResponse{
+		Language:           "plaintext",
+		Revision:           2,
+		IsDelta:            true,
+		BaseRevision:       1,
+		TextDelta:          common.Operation{{Retain: 3}, {Insert: "d"}},
+		Resumed:            true,
+		AppliedSequence:    1,
+		UpdateInputText:    true,
+		UpdateOutputText:   true,
+		UpdateRunningState: true,
+		UpdateLintResult:   true,
+	}); got != token {
+		t.Errorf("Resumed connection got token %q, want %q", got, token)
+	}
+
+	ws3 := ts.connect()
+	defer ws3.Close()
+	um.RegisterUser(ctx, sID, "u1", ws3, &Resume{Token: "wrong", Revision: 1})
+	if got := receiveHandshake(t, ts.gotMessage, &common.UpdateSessionResponse{
+		NewText:            "abcd",
+		Language:           "plaintext",
+		Revision:           2,
+		AppliedSequence:    1,
+		UpdateInputText:    true,
+		UpdateOutputText:   true,
+		UpdateRunningState: true,
+		UpdateLintResult:   true,
+	}); got == token {
+		t.Errorf("Connection with wrong token should've got a new one")
+	}
 }
 
 func TestUsersManagerInactiveSessionCleanup(t *testing.T) {
@@ -312,8 +562,8 @@ func TestUsersManagerInactiveSessionCleanup(t *testing.T) {
 	amountOfTriggersForSessionToBeInactive = 1
 	inactiveSessionCleanupIntervalChannelSource = func() <-chan time.Time { return umTrigger }
 
-	um := NewUsersManager(ctx, sm)
-	um.RegisterUser(ctx, sID, "u1", ws1)
+	um := NewUsersManager(ctx, sm, NewLocalBroadcaster())
+	um.RegisterUser(ctx, sID, "u1", ws1, nil)
 	um.managedSessions[sID].Users["u1"].Cancel()
 
 	sessionCleanupTrigger <- time.Now()
@@ -328,3 +578,196 @@ func TestUsersManagerInactiveSessionCleanup(t *testing.T) {
 		t.Errorf("Session %v not cleaned up as expected", sID)
 	}
 }
+
+func TestUsersManagerBroadcastOutput(t *testing.T) {
+	ctx := context.Background()
+	ts := prepareTestServer()
+	defer ts.Close()
+
+	ws1 := ts.connect()
+	defer ws1.Close()
+
+	sm := prepareSessionmanager()
+	sID := sm.NewSession()
+
+	inactiveSessionCleanupIntervalChannelSource = func() <-chan time.Time { return make(chan time.Time) }
+
+	um := NewUsersManager(ctx, sm, NewLocalBroadcaster())
+	um.RegisterUser(ctx, sID, "u1", ws1, nil)
+	receiveHandshake(t, ts.gotMessage, &common.UpdateSessionResponse{
+		Language:           "plaintext",
+		UpdateInputText:    true,
+		UpdateOutputText:   true,
+		UpdateRunningState: true,
+		UpdateLintResult:   true,
+	})
+
+	// Users which didn't ask for the output don't receive it.
+	um.BroadcastOutput(sID, common.OutputChunk{Sequence: 1, Text: "ignored"})
+
+	<-ts.connected
+	if err := ts.connections[0].WriteJSON(&common.UpdateSessionRequest{Ping: true, StreamOutput: true}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	assertChannelGotMessage(t, ts.gotMessage, &common.UpdateSessionResponse{Ping: true})
+
+	// Repeated lines are delivered as well.
+	for _, chunk := range []common.OutputChunk{
+		{Sequence: 1, Text: "line\n"},
+		{Sequence: 2, Text: "line\n"},
+		{Sequence: 3, Stderr: true, Text: "error\n"},
+	} {
+		c := chunk
+		um.BroadcastOutput(sID, c)
+		assertChannelGotMessage(t, ts.gotMessage, &common.UpdateSessionResponse{OutputChunk: &c})
+	}
+
+	// So are the positions in the queue.
+	for _, position := range []int{2, 1, 0} {
+		um.BroadcastQueuePosition(sID, "u1", "job_1", position)
+		assertChannelGotMessage(t, ts.gotMessage, &common.UpdateSessionResponse{
+			QueuePosition: &common.QueuePosition{JobID: "job_1", UserID: "u1", Position: position},
+		})
+	}
+}
+
+func TestUsersManagerAttachStdin(t *testing.T) {
+	ctx := context.Background()
+	ts := prepareTestServer()
+	defer ts.Close()
+
+	ws1 := ts.connect()
+	defer ws1.Close()
+
+	sm := prepareSessionmanager()
+	sID := sm.NewSession()
+
+	inactiveSessionCleanupIntervalChannelSource = func() <-chan time.Time { return make(chan time.Time) }
+
+	um := NewUsersManager(ctx, sm, NewLocalBroadcaster())
+	um.RegisterUser(ctx, sID, "u1", ws1, nil)
+	receiveHandshake(t, ts.gotMessage, &common.UpdateSessionResponse{
+		Language:           "plaintext",
+		UpdateInputText:    true,
+		UpdateOutputText:   true,
+		UpdateRunningState: true,
+		UpdateLintResult:   true,
+	})
+
+	inputCtx, cancel := context.WithCancel(ctx)
+	input, err := um.AttachStdin(inputCtx, sID)
+	if err != nil {
+		t.Fatalf("AttachStdin failed: %v", err)
+	}
+
+	<-ts.connected
+	if err := ts.connections[0].WriteJSON(&common.UpdateSessionRequest{UserID: "u1", SendStdin: true, Stdin: "Bob"}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(input, got); err != nil {
+		t.Fatalf("Failed to read the input: %v", err)
+	}
+	if string(got) != "Bob\n" {
+		t.Errorf("Got input %q, want \"Bob\\n\"", got)
+	}
+
+	// The output flooding the session while the program doesn't read its
+	// input doesn't lose the following lines.
+	for i := 0; i < 2*subscriptionBufferSize; i++ {
+		um.BroadcastOutput(sID, common.OutputChunk{Sequence: i + 1, Text: "x"})
+	}
+	if err := ts.connections[0].WriteJSON(&common.UpdateSessionRequest{UserID: "u1", SendStdin: true, Stdin: "Eve"}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	if _, err := io.ReadFull(input, got); err != nil {
+		t.Fatalf("Failed to read the input: %v", err)
+	}
+	if string(got) != "Eve\n" {
+		t.Errorf("Got input %q, want \"Eve\\n\"", got)
+	}
+
+	cancel()
+	if _, err := input.Read(got); err == nil {
+		t.Errorf("Input should've been closed")
+	}
+
+	if s, err := sm.LoadSession(sID); err != nil || s.Revision != 0 {
+		t.Errorf("Stdin should not modify the session, got: %+v, %v", s, err)
+	}
+}
+
+func TestUsersManagerCancelExecution(t *testing.T) {
+	ctx := context.Background()
+	ts := prepareTestServer()
+	defer ts.Close()
+
+	ws1 := ts.connect()
+	defer ws1.Close()
+
+	sm := prepareSessionmanager()
+	sID := sm.NewSession()
+	if _, err := sm.UpdateSession(ctx, sID, &common.UpdateSessionRequest{UpdateRunningState: true, Running: true}); err != nil {
+		t.Fatalf("Failed to update session: %v", err)
+	}
+
+	inactiveSessionCleanupIntervalChannelSource = func() <-chan time.Time { return make(chan time.Time) }
+
+	um := NewUsersManager(ctx, sm, NewLocalBroadcaster())
+	um.RegisterUser(ctx, sID, "u1", ws1, nil)
+	receiveHandshake(t, ts.gotMessage, &common.UpdateSessionResponse{
+		Language:           "plaintext",
+		UpdateInputText:    true,
+		UpdateOutputText:   true,
+		UpdateRunningState: true,
+		UpdateLintResult:   true,
+		Running:            true,
+	})
+
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	defer stopWatching()
+
+	cancelled := make(chan string, 3)
+	for _, jobID := range []string{"job_1", "job_2"} {
+		jobID := jobID
+		if err := um.WatchCancellation(watchCtx, sID, jobID, func() { cancelled <- jobID }); err != nil {
+			t.Fatalf("WatchCancellation failed: %v", err)
+		}
+	}
+
+	<-ts.connected
+	if err := ts.connections[0].WriteJSON(&common.UpdateSessionRequest{UserID: "u1", CancelExecution: true, JobID: "job_1"}); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+
+	select {
+	case jobID := <-cancelled:
+		if jobID != "job_1" {
+			t.Errorf("Cancelled %v, want job_1", jobID)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Execution was not cancelled")
+	}
+
+	select {
+	case tm := <-ts.gotMessage:
+		if resp := tm.toUpdateSessionResponse(); !resp.UpdateRunningState || resp.Running {
+			t.Errorf("Session should stop running, got: %+v", resp)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Response did not come within the given deadline.")
+	}
+
+	// Empty job ID cancels all the jobs, cancelling the job_1 again is no-op.
+	if err := um.CancelExecution(sID, "u1", ""); err != nil {
+		t.Fatalf("CancelExecution failed: %v", err)
+	}
+	for jobID := ""; jobID != "job_2"; {
+		select {
+		case jobID = <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatalf("Execution was not cancelled")
+		}
+	}
+}